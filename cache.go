@@ -0,0 +1,325 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package doh
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/gokit/xcache"
+)
+
+// Cache is the query cache interface, for example a shared cache backed by redis
+type Cache interface {
+	// Get returns the value of key, false if not found or expired
+	Get(key string) ([]byte, bool)
+	// Set sets the value of key, expires after ttl
+	Set(key string, value []byte, ttl time.Duration) error
+	// Delete deletes the value of key
+	Delete(key string) error
+}
+
+// memoryCache is the in-memory cache
+type memoryCache struct {
+	cache xcache.Cachex
+}
+
+// NewMemoryCache returns a new in-memory cache, it is the default cache
+func NewMemoryCache() Cache {
+	return &memoryCache{
+		cache: xcache.New(xcache.MemoryCache),
+	}
+}
+
+// Get returns the value of key, false if not found or expired
+func (c *memoryCache) Get(key string) ([]byte, bool) {
+	v := c.cache.Get(key)
+	if v == nil {
+		return nil, false
+	}
+
+	return v.([]byte), true
+}
+
+// Set sets the value of key, expires after ttl, the ttl is rounded up to seconds
+func (c *memoryCache) Set(key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return c.cache.Del(key)
+	}
+
+	return c.cache.Set(key, value, int64((ttl+time.Second-1)/time.Second))
+}
+
+// Delete deletes the value of key
+func (c *memoryCache) Delete(key string) error {
+	return c.cache.Del(key)
+}
+
+// Close stops the memory cache
+func (c *memoryCache) Close() error {
+	return c.cache.Close()
+}
+
+// cacheEntry is the cached response with the time it is cached
+type cacheEntry struct {
+	Time     time.Time     `json:"time"`
+	TTL      int           `json:"ttl"`
+	Response *dns.Response `json:"response"`
+	stale    bool
+}
+
+const (
+	// defaultMaxCacheTTL is the default max cache ttl
+	defaultMaxCacheTTL = 24 * time.Hour
+	// maxNegativeTTL is the max cache ttl of negative response, see RFC 2308
+	maxNegativeTTL = 3 * time.Hour
+	// staleTTL is the ttl of stale answer, see RFC 8767
+	staleTTL = 30
+	// refreshTimeout is the timeout of background cache refresh
+	refreshTimeout = 10 * time.Second
+	// staleAnswerTimeout is the client response timeout of serve stale, see RFC 8767
+	staleAnswerTimeout = 1800 * time.Millisecond
+	// staleRetryTimeout is the failure recheck timeout of serve stale, see RFC 8767
+	staleRetryTimeout = 30 * time.Second
+)
+
+// SetCacheTTL set the min and max cache ttl, the ttl of records are clamped, zero to use the default
+func (c *DoH) SetCacheTTL(min, max time.Duration) *DoH {
+	if max <= 0 {
+		max = defaultMaxCacheTTL
+	}
+
+	if min > max {
+		min = max
+	}
+
+	c.Lock()
+	c.minTTL = min
+	c.maxTTL = max
+	c.Unlock()
+
+	return c
+}
+
+// SetServeStale set the stale window of expired cache, the stale answer is returned
+// if all providers failed, and it is refreshed in background, zero to disable, see RFC 8767
+func (c *DoH) SetServeStale(window time.Duration) *DoH {
+	if window < 0 {
+		window = 0
+	}
+
+	c.Lock()
+	c.staleWindow = window
+	c.Unlock()
+
+	return c
+}
+
+// SetStaleTimeout set the client response timeout and failure recheck timeout of serve stale,
+// the stale answer is returned if providers not answered in the client response timeout,
+// and providers are not queried again in the failure recheck timeout if failed,
+// zero to use the default 1.8 seconds and 30 seconds, see RFC 8767
+func (c *DoH) SetStaleTimeout(answer, retry time.Duration) *DoH {
+	if answer <= 0 {
+		answer = staleAnswerTimeout
+	}
+
+	if retry <= 0 {
+		retry = staleRetryTimeout
+	}
+
+	c.Lock()
+	c.staleAnswer = answer
+	c.staleRetry = retry
+	c.Unlock()
+
+	return c
+}
+
+// getCache returns the cached entry of key, the ttl of records are reduced by the age,
+// the entry is stale if it is expired but within the stale window
+func (c *DoH) getCache(key string) (*cacheEntry, bool) {
+	b, ok := c.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+
+	e := &cacheEntry{}
+	err := json.Unmarshal(b, e)
+	if err != nil || e.Response == nil {
+		_ = c.cache.Delete(key)
+		return nil, false
+	}
+
+	age := time.Since(e.Time)
+	if age < 0 {
+		return nil, false
+	}
+
+	c.RLock()
+	window := c.staleWindow
+	c.RUnlock()
+
+	ttl := time.Duration(e.TTL) * time.Second
+	if age >= ttl {
+		if age >= ttl+window {
+			return nil, false
+		}
+		e.Response = staleResponse(e.Response)
+		e.stale = true
+		return e, true
+	}
+
+	rsp := e.Response
+	for _, rrs := range [][]dns.Answer{rsp.Answer, rsp.Authority, rsp.Additional} {
+		for i := range rrs {
+			rrs[i].TTL -= int(age / time.Second)
+			if rrs[i].TTL < 0 {
+				rrs[i].TTL = 0
+			}
+		}
+	}
+
+	return e, true
+}
+
+// staleResponse returns the stale answer of response, it has a small ttl and the stale extended error
+func staleResponse(rsp *dns.Response) *dns.Response {
+	for _, rrs := range [][]dns.Answer{rsp.Answer, rsp.Authority, rsp.Additional} {
+		for i := range rrs {
+			rrs[i].TTL = staleTTL
+		}
+	}
+
+	code := dns.EDEStaleAnswer
+	if rsp.Status == int(dns.RCodeNXDomain) {
+		code = dns.EDEStaleNXDomainAnswer
+	}
+	rsp.EDE = append(rsp.EDE, dns.ExtendedError{InfoCode: code})
+
+	return rsp
+}
+
+// setCache caches the response of key, the response is not cached if the ttl is zero
+func (c *DoH) setCache(key string, rsp *dns.Response) error {
+	ttl := c.cacheTTL(rsp)
+	if ttl <= 0 {
+		return nil
+	}
+
+	r := *rsp
+	r.Answer = c.clampTTL(rsp.Answer)
+	r.Authority = c.clampTTL(rsp.Authority)
+	r.Additional = c.clampTTL(rsp.Additional)
+
+	b, err := json.Marshal(&cacheEntry{
+		Time:     time.Now(),
+		TTL:      int(ttl / time.Second),
+		Response: &r,
+	})
+	if err != nil {
+		return fmt.Errorf("doh: encode cache failed: %w", err)
+	}
+
+	c.RLock()
+	window := c.staleWindow
+	c.RUnlock()
+
+	return c.cache.Set(key, b, ttl+window)
+}
+
+// cacheTTL returns the cache ttl of response, it is the min ttl of records,
+// or the SOA minimum of negative response, see RFC 2308
+func (c *DoH) cacheTTL(rsp *dns.Response) time.Duration {
+	var ttl time.Duration
+	switch {
+	case rsp.Status == int(dns.RCodeNXDomain) || rsp.Status == int(dns.RCodeNoError) && len(rsp.Answer) == 0:
+		ttl = -1
+		for _, v := range rsp.Authority {
+			soa, err := v.SOA()
+			if err != nil {
+				continue
+			}
+			ttl = time.Duration(v.TTL) * time.Second
+			if minimum := time.Duration(soa.MinTTL) * time.Second; minimum < ttl {
+				ttl = minimum
+			}
+			if ttl > maxNegativeTTL {
+				ttl = maxNegativeTTL
+			}
+			break
+		}
+		// the negative response without SOA is not cached
+		if ttl < 0 {
+			return 0
+		}
+	case rsp.Status == int(dns.RCodeNoError):
+		ttl = -1
+		for _, rrs := range [][]dns.Answer{rsp.Answer, rsp.Authority, rsp.Additional} {
+			for _, v := range rrs {
+				if t := time.Duration(v.TTL) * time.Second; ttl < 0 || t < ttl {
+					ttl = t
+				}
+			}
+		}
+	default:
+		return 0
+	}
+
+	return c.clamp(ttl)
+}
+
+// clampTTL returns the records with ttl clamped
+func (c *DoH) clampTTL(rrs []dns.Answer) []dns.Answer {
+	if len(rrs) == 0 {
+		return rrs
+	}
+
+	r := make([]dns.Answer, len(rrs))
+	for i, v := range rrs {
+		v.TTL = int(c.clamp(time.Duration(v.TTL)*time.Second) / time.Second)
+		r[i] = v
+	}
+
+	return r
+}
+
+// clamp returns the ttl between min and max cache ttl
+func (c *DoH) clamp(ttl time.Duration) time.Duration {
+	c.RLock()
+	min, max := c.minTTL, c.maxTTL
+	c.RUnlock()
+
+	if max <= 0 {
+		max = defaultMaxCacheTTL
+	}
+
+	if ttl < min {
+		ttl = min
+	}
+
+	if ttl > max {
+		ttl = max
+	}
+
+	return ttl.Truncate(time.Second)
+}
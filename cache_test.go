@@ -0,0 +1,418 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package doh
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/doh/provider/custom"
+	"github.com/likexian/gokit/assert"
+	"github.com/likexian/gokit/xhash"
+)
+
+// fakeRedis is a redis like shared store
+type fakeRedis struct {
+	values map[string]fakeItem
+	sync.Mutex
+}
+
+type fakeItem struct {
+	value  []byte
+	expire time.Time
+}
+
+// countProvider counts the queries sent to provider, the next fail queries are failed,
+// and queries are delayed by delay
+type countProvider struct {
+	Provider
+	n     atomic.Int32
+	fail  atomic.Int32
+	delay atomic.Int64
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{values: map[string]fakeItem{}}
+}
+
+func (r *fakeRedis) Get(key string) ([]byte, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	v, ok := r.values[key]
+	if !ok || time.Now().After(v.expire) {
+		return nil, false
+	}
+
+	return append([]byte{}, v.value...), true
+}
+
+func (r *fakeRedis) Set(key string, value []byte, ttl time.Duration) error {
+	r.Lock()
+	defer r.Unlock()
+
+	r.values[key] = fakeItem{append([]byte{}, value...), time.Now().Add(ttl)}
+
+	return nil
+}
+
+func (r *fakeRedis) Delete(key string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.values, key)
+
+	return nil
+}
+
+// expireCache returns the cached entry of name, which is aged by age
+func expireCache(t *testing.T, store *fakeRedis, name string, age time.Duration) *cacheEntry {
+	key := xhash.Sha1(name, string(dns.TypeA), "", false, false).Hex()
+	b, ok := store.Get(key)
+	assert.True(t, ok)
+
+	e := &cacheEntry{}
+	assert.Nil(t, json.Unmarshal(b, e))
+	e.Time = e.Time.Add(-age)
+	b, _ = json.Marshal(e)
+	_ = store.Set(key, b, time.Hour)
+
+	return e
+}
+
+func (p *countProvider) QueryWithOptions(ctx context.Context, q dns.Question, o dns.Options) (*dns.Response, error) {
+	p.n.Add(1)
+	if d := time.Duration(p.delay.Load()); d > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(d):
+		}
+	}
+
+	if p.fail.Add(-1) >= 0 {
+		return nil, errors.New("test: query failed")
+	}
+	p.fail.Store(0)
+
+	return p.Provider.QueryWithOptions(ctx, q, o)
+}
+
+func TestMemoryCache(t *testing.T) {
+	c := NewMemoryCache()
+	defer c.(*memoryCache).Close()
+
+	_, ok := c.Get("likexian")
+	assert.False(t, ok)
+
+	err := c.Set("likexian", []byte("doh"), 500*time.Millisecond)
+	assert.Nil(t, err)
+
+	v, ok := c.Get("likexian")
+	assert.True(t, ok)
+	assert.Equal(t, v, []byte("doh"))
+
+	err = c.Delete("likexian")
+	assert.Nil(t, err)
+
+	_, ok = c.Get("likexian")
+	assert.False(t, ok)
+
+	err = c.Set("likexian", []byte("doh"), 0)
+	assert.Nil(t, err)
+
+	_, ok = c.Get("likexian")
+	assert.False(t, ok)
+}
+
+func TestSetCache(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	p, err := custom.NewClient(ts.URL+"/dns-query", dns.FormatWire)
+	assert.Nil(t, err)
+
+	// the cache is shared by clients
+	store := newFakeRedis()
+	ps := []*countProvider{{Provider: p}, {Provider: p}}
+	for _, v := range ps {
+		c := UseProvider(v).SetCache(store)
+		defer c.Close()
+
+		rsp, err := c.Query(ctx, "likexian.com", dns.TypeA)
+		assert.Nil(t, err)
+		assert.Equal(t, rsp.Answer[0].Data, "1.2.3.4")
+		assert.Equal(t, rsp.Provider, p.String())
+
+		rsp, err = c.Query(ctx, "nx.likexian.com", dns.TypeA)
+		assert.True(t, errors.Is(err, dns.ErrNXDomain))
+		assert.Equal(t, rsp.Status, 3)
+	}
+
+	assert.Equal(t, ps[0].n.Load(), int32(2))
+	assert.Equal(t, ps[1].n.Load(), int32(0))
+	assert.Equal(t, len(store.values), 2)
+
+	// the options are part of cache key
+	c := UseProvider(ps[1]).SetCache(store)
+	defer c.Close()
+
+	// the name of cache key is normalized
+	for _, v := range []dns.Domain{"LikeXian.com", "likexian.com.", "LIKEXIAN.COM."} {
+		rsp, err := c.Query(ctx, v, dns.TypeA)
+		assert.Nil(t, err)
+		assert.Equal(t, rsp.Answer[0].Data, "1.2.3.4")
+	}
+	assert.Equal(t, ps[1].n.Load(), int32(0))
+
+	_, err = c.QueryWithOptions(ctx, dns.Question{Name: "likexian.com", Type: 1}, dns.Options{DO: true})
+	assert.Nil(t, err)
+	assert.Equal(t, ps[1].n.Load(), int32(1))
+
+	// the broken cache value is deleted
+	for k := range store.values {
+		_ = store.Set(k, []byte("xx"), time.Minute)
+	}
+
+	rsp, err := c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Answer[0].Data, "1.2.3.4")
+	assert.Equal(t, ps[1].n.Load(), int32(2))
+
+	// the memory cache is replaced
+	c.EnableCache(true)
+	_, ok := c.cache.(*memoryCache)
+	assert.True(t, ok)
+
+	c.SetCache(nil)
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, ps[1].n.Load(), int32(3))
+}
+
+func TestCacheTTL(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	p, err := custom.NewClient(ts.URL+"/dns-query", dns.FormatWire)
+	assert.Nil(t, err)
+
+	store := newFakeRedis()
+	cp := &countProvider{Provider: p}
+	c := UseProvider(cp).SetCache(store)
+	defer c.Close()
+
+	entry := func(name string) (string, *cacheEntry) {
+		key := xhash.Sha1(name, string(dns.TypeA), "", false, false).Hex()
+		b, ok := store.Get(key)
+		if !ok {
+			return key, nil
+		}
+		e := &cacheEntry{}
+		assert.Nil(t, json.Unmarshal(b, e))
+		return key, e
+	}
+
+	// the ttl is the min ttl of records
+	_, err = c.Query(ctx, "ttl.likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	key, e := entry("ttl.likexian.com")
+	assert.NotNil(t, e)
+	assert.Equal(t, e.TTL, 30)
+
+	// the ttl of records are reduced by the age
+	e.Time = e.Time.Add(-10 * time.Second)
+	b, _ := json.Marshal(e)
+	_ = store.Set(key, b, time.Minute)
+
+	rsp, err := c.Query(ctx, "ttl.likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Answer[0].TTL, 590)
+	assert.Equal(t, rsp.Answer[1].TTL, 20)
+	assert.Equal(t, cp.n.Load(), int32(1))
+
+	// the expired entry is not used
+	e.Time = e.Time.Add(-30 * time.Second)
+	b, _ = json.Marshal(e)
+	_ = store.Set(key, b, time.Minute)
+
+	rsp, err = c.Query(ctx, "ttl.likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Answer[1].TTL, 30)
+	assert.Equal(t, cp.n.Load(), int32(2))
+
+	// the negative response is cached by the SOA minimum
+	_, err = c.Query(ctx, "nx.likexian.com", dns.TypeA)
+	assert.True(t, errors.Is(err, dns.ErrNXDomain))
+	_, e = entry("nx.likexian.com")
+	assert.NotNil(t, e)
+	assert.Equal(t, e.TTL, 60)
+
+	// the negative response without SOA is not cached
+	_, err = c.Query(ctx, "nosoa.likexian.com", dns.TypeA)
+	assert.True(t, errors.Is(err, dns.ErrNXDomain))
+	_, e = entry("nosoa.likexian.com")
+	assert.True(t, e == nil)
+
+	// the failed response is not cached
+	_, err = c.Query(ctx, "servfail.likexian.com", dns.TypeA)
+	assert.True(t, errors.Is(err, dns.ErrServFail))
+	_, e = entry("servfail.likexian.com")
+	assert.True(t, e == nil)
+
+	// the ttl is clamped
+	store = newFakeRedis()
+	c.SetCache(store).SetCacheTTL(time.Minute, 5*time.Minute)
+	rsp, err = c.Query(ctx, "ttl.likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Answer[0].TTL, 600)
+
+	_, e = entry("ttl.likexian.com")
+	assert.NotNil(t, e)
+	assert.Equal(t, e.TTL, 60)
+	assert.Equal(t, e.Response.Answer[0].TTL, 300)
+	assert.Equal(t, e.Response.Answer[1].TTL, 60)
+
+	rsp, err = c.Query(ctx, "ttl.likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Answer[0].TTL, 300)
+	assert.Equal(t, rsp.Answer[1].TTL, 60)
+
+	// the ttl and stale window are changed while caching
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.SetCacheTTL(0, 0)
+		c.SetServeStale(time.Minute)
+	}()
+	assert.Nil(t, c.setCache(key, rsp))
+	_, ok := c.getCache(key)
+	assert.True(t, ok)
+	wg.Wait()
+}
+
+func TestServeStale(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	p, err := custom.NewClient(ts.URL+"/dns-query", dns.FormatWire)
+	assert.Nil(t, err)
+
+	store := newFakeRedis()
+	cp := &countProvider{Provider: p}
+	c := UseProvider(cp).SetCache(store)
+	defer c.Close()
+
+	expire := func(name string, age time.Duration) *cacheEntry {
+		return expireCache(t, store, name, age)
+	}
+
+	// the expired entry is not used without serve stale
+	_, err = c.Query(ctx, "ttl.likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	expire("ttl.likexian.com", time.Minute)
+
+	cp.fail.Store(1)
+	_, err = c.Query(ctx, "ttl.likexian.com", dns.TypeA)
+	assert.NotNil(t, err)
+
+	// the stale answer is returned if all providers failed
+	c.SetServeStale(time.Hour).SetStaleTimeout(time.Second, 200*time.Millisecond)
+	_, err = c.Query(ctx, "ttl.likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	expire("ttl.likexian.com", time.Minute)
+
+	cp.fail.Store(1)
+	rsp, err := c.Query(ctx, "ttl.likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.True(t, rsp.Stale())
+	assert.Equal(t, rsp.EDE, []dns.ExtendedError{{InfoCode: dns.EDEStaleAnswer}})
+	assert.Equal(t, rsp.Answer[0].TTL, staleTTL)
+	assert.Equal(t, rsp.Answer[1].TTL, staleTTL)
+
+	// the failed refresh is not retried in the failure recheck timeout
+	n := cp.n.Load()
+	rsp, err = c.Query(ctx, "ttl.likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.True(t, rsp.Stale())
+	assert.Equal(t, cp.n.Load(), n)
+
+	time.Sleep(300 * time.Millisecond)
+	rsp, err = c.Query(ctx, "ttl.likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.False(t, rsp.Stale())
+	assert.Equal(t, rsp.Answer[1].TTL, 30)
+	assert.Equal(t, cp.n.Load(), n+1)
+
+	// the stale answer is returned if providers not answered in the client response timeout
+	c.SetStaleTimeout(50*time.Millisecond, 0)
+	e := expire("ttl.likexian.com", time.Minute)
+
+	cp.delay.Store(int64(300 * time.Millisecond))
+	start := time.Now()
+	rsp, err = c.Query(ctx, "ttl.likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.True(t, rsp.Stale())
+	assert.Lt(t, time.Since(start), 250*time.Millisecond)
+	cp.delay.Store(0)
+
+	// the stale entry is refreshed in background
+	for i := 0; i < 100; i++ {
+		if f := expire("ttl.likexian.com", 0); f.Time.After(e.Time) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rsp, err = c.Query(ctx, "ttl.likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.False(t, rsp.Stale())
+	assert.Equal(t, rsp.Answer[1].TTL, 30)
+
+	// the stale NXDOMAIN answer is returned with error
+	_, err = c.Query(ctx, "nx.likexian.com", dns.TypeA)
+	assert.True(t, errors.Is(err, dns.ErrNXDomain))
+	expire("nx.likexian.com", 2*time.Minute)
+
+	cp.fail.Store(1)
+	rsp, err = c.Query(ctx, "nx.likexian.com", dns.TypeA)
+	assert.True(t, errors.Is(err, dns.ErrNXDomain))
+	assert.True(t, rsp.Stale())
+	assert.Equal(t, rsp.EDE, []dns.ExtendedError{{InfoCode: dns.EDEStaleNXDomainAnswer}})
+
+	// the entry out of stale window is not used
+	expire("ttl.likexian.com", 2*time.Hour)
+	cp.fail.Store(100)
+	_, err = c.Query(ctx, "ttl.likexian.com", dns.TypeA)
+	assert.NotNil(t, err)
+}
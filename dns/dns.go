@@ -20,6 +20,8 @@
 package dns
 
 import (
+	"encoding/json"
+	"fmt"
 	"strings"
 
 	"golang.org/x/net/idna"
@@ -34,12 +36,29 @@ type Type string
 // ECS is the edns0-client-subnet option, for example: 1.2.3.4/24
 type ECS string
 
+// Format is DoH message format
+type Format uint
+
 // Question is dns query question
 type Question struct {
 	Name string `json:"name"`
 	Type int    `json:"type"`
 }
 
+// Options is dns query options
+type Options struct {
+	// DO sets the DNSSEC OK bit, requests DNSSEC records
+	DO bool
+	// CD sets the checking disabled bit, disables upstream DNSSEC validation
+	CD bool
+	// ECS is the edns0-client-subnet option
+	ECS ECS
+	// Method is the http method of DoH wire format query, GET or POST, empty to use the client setting
+	Method string
+	// Padding pads the query to hide its size, see RFC 7830 and RFC 8467
+	Padding bool
+}
+
 // Answer is dns query answer
 type Answer struct {
 	Name string `json:"name"`
@@ -48,31 +67,138 @@ type Answer struct {
 	Data string `json:"data"`
 }
 
-// Response is dns query response
+// Response is dns query response, the ECS is the edns0-client-subnet with scope prefix length,
+// the EDE is the extended dns errors, see RFC 8914
 type Response struct {
-	Status   int        `json:"Status"`
-	TC       bool       `json:"TC"`
-	RD       bool       `json:"RD"`
-	RA       bool       `json:"RA"`
-	AD       bool       `json:"AD"`
-	CD       bool       `json:"CD"`
-	Question []Question `json:"Question"`
-	Answer   []Answer   `json:"Answer"`
-	Provider string     `json:"provider"`
+	Status     int             `json:"Status"`
+	TC         bool            `json:"TC"`
+	RD         bool            `json:"RD"`
+	RA         bool            `json:"RA"`
+	AD         bool            `json:"AD"`
+	CD         bool            `json:"CD"`
+	Question   []Question      `json:"Question"`
+	Answer     []Answer        `json:"Answer"`
+	Authority  []Answer        `json:"Authority,omitempty"`
+	Additional []Answer        `json:"Additional,omitempty"`
+	Comment    string          `json:"Comment,omitempty"`
+	ECS        ECS             `json:"edns_client_subnet,omitempty"`
+	EDE        []ExtendedError `json:"extended_dns_errors,omitempty"`
+	Provider   string          `json:"provider"`
 }
 
-// Supported dns query type
+// Padding block size recommended by RFC 8467
+const (
+	// QueryPadding is the block size of query padding
+	QueryPadding = 128
+	// ResponsePadding is the block size of response padding
+	ResponsePadding = 468
+)
+
+// Supported DoH message format
+const (
+	// FormatJSON is the JSON API format, application/dns-json
+	FormatJSON Format = iota
+	// FormatWire is the RFC 8484 wire format, application/dns-message
+	FormatWire
+)
+
+// Supported dns query type, see https://www.iana.org/assignments/dns-parameters
 var (
-	TypeA     = Type("A")
-	TypeAAAA  = Type("AAAA")
-	TypeCNAME = Type("CNAME")
-	TypeMX    = Type("MX")
-	TypeTXT   = Type("TXT")
-	TypeSPF   = Type("SPF")
-	TypeNS    = Type("NS")
-	TypeSOA   = Type("SOA")
-	TypePTR   = Type("PTR")
-	TypeANY   = Type("ANY")
+	TypeA          = Type("A")
+	TypeNS         = Type("NS")
+	TypeMD         = Type("MD")
+	TypeMF         = Type("MF")
+	TypeCNAME      = Type("CNAME")
+	TypeSOA        = Type("SOA")
+	TypeMB         = Type("MB")
+	TypeMG         = Type("MG")
+	TypeMR         = Type("MR")
+	TypeNULL       = Type("NULL")
+	TypeWKS        = Type("WKS")
+	TypePTR        = Type("PTR")
+	TypeHINFO      = Type("HINFO")
+	TypeMINFO      = Type("MINFO")
+	TypeMX         = Type("MX")
+	TypeTXT        = Type("TXT")
+	TypeRP         = Type("RP")
+	TypeAFSDB      = Type("AFSDB")
+	TypeX25        = Type("X25")
+	TypeISDN       = Type("ISDN")
+	TypeRT         = Type("RT")
+	TypeNSAP       = Type("NSAP")
+	TypeNSAPPTR    = Type("NSAP-PTR")
+	TypeSIG        = Type("SIG")
+	TypeKEY        = Type("KEY")
+	TypePX         = Type("PX")
+	TypeGPOS       = Type("GPOS")
+	TypeAAAA       = Type("AAAA")
+	TypeLOC        = Type("LOC")
+	TypeNXT        = Type("NXT")
+	TypeEID        = Type("EID")
+	TypeNIMLOC     = Type("NIMLOC")
+	TypeSRV        = Type("SRV")
+	TypeATMA       = Type("ATMA")
+	TypeNAPTR      = Type("NAPTR")
+	TypeKX         = Type("KX")
+	TypeCERT       = Type("CERT")
+	TypeA6         = Type("A6")
+	TypeDNAME      = Type("DNAME")
+	TypeSINK       = Type("SINK")
+	TypeOPT        = Type("OPT")
+	TypeAPL        = Type("APL")
+	TypeDS         = Type("DS")
+	TypeSSHFP      = Type("SSHFP")
+	TypeIPSECKEY   = Type("IPSECKEY")
+	TypeRRSIG      = Type("RRSIG")
+	TypeNSEC       = Type("NSEC")
+	TypeDNSKEY     = Type("DNSKEY")
+	TypeDHCID      = Type("DHCID")
+	TypeNSEC3      = Type("NSEC3")
+	TypeNSEC3PARAM = Type("NSEC3PARAM")
+	TypeTLSA       = Type("TLSA")
+	TypeSMIMEA     = Type("SMIMEA")
+	TypeHIP        = Type("HIP")
+	TypeNINFO      = Type("NINFO")
+	TypeRKEY       = Type("RKEY")
+	TypeTALINK     = Type("TALINK")
+	TypeCDS        = Type("CDS")
+	TypeCDNSKEY    = Type("CDNSKEY")
+	TypeOPENPGPKEY = Type("OPENPGPKEY")
+	TypeCSYNC      = Type("CSYNC")
+	TypeZONEMD     = Type("ZONEMD")
+	TypeSVCB       = Type("SVCB")
+	TypeHTTPS      = Type("HTTPS")
+	TypeDSYNC      = Type("DSYNC")
+	TypeSPF        = Type("SPF")
+	TypeUINFO      = Type("UINFO")
+	TypeUID        = Type("UID")
+	TypeGID        = Type("GID")
+	TypeUNSPEC     = Type("UNSPEC")
+	TypeNID        = Type("NID")
+	TypeL32        = Type("L32")
+	TypeL64        = Type("L64")
+	TypeLP         = Type("LP")
+	TypeEUI48      = Type("EUI48")
+	TypeEUI64      = Type("EUI64")
+	TypeNXNAME     = Type("NXNAME")
+	TypeTKEY       = Type("TKEY")
+	TypeTSIG       = Type("TSIG")
+	TypeIXFR       = Type("IXFR")
+	TypeAXFR       = Type("AXFR")
+	TypeMAILB      = Type("MAILB")
+	TypeMAILA      = Type("MAILA")
+	TypeANY        = Type("ANY")
+	TypeURI        = Type("URI")
+	TypeCAA        = Type("CAA")
+	TypeAVC        = Type("AVC")
+	TypeDOA        = Type("DOA")
+	TypeAMTRELAY   = Type("AMTRELAY")
+	TypeRESINFO    = Type("RESINFO")
+	TypeWALLET     = Type("WALLET")
+	TypeCLA        = Type("CLA")
+	TypeIPN        = Type("IPN")
+	TypeTA         = Type("TA")
+	TypeDLV        = Type("DLV")
 )
 
 // Version returns package version
@@ -90,6 +216,40 @@ func License() string {
 	return "Licensed under the Apache License 2.0"
 }
 
+// UnmarshalJSON parses the json response, the comment is either string or strings,
+// and the extended dns errors are parsed from comments if missing
+func (r *Response) UnmarshalJSON(b []byte) error {
+	type response Response
+	v := struct {
+		*response
+		Comment json.RawMessage `json:"Comment"`
+	}{
+		response: (*response)(r),
+	}
+
+	err := json.Unmarshal(b, &v)
+	if err != nil {
+		return err
+	}
+
+	comments := []string{}
+	if len(v.Comment) > 0 && string(v.Comment) != "null" {
+		var comment string
+		if json.Unmarshal(v.Comment, &comment) == nil {
+			comments = append(comments, comment)
+		} else if err := json.Unmarshal(v.Comment, &comments); err != nil {
+			return fmt.Errorf("dns: invalid json comment: %w", err)
+		}
+	}
+
+	r.Comment = strings.Join(comments, "; ")
+	if len(r.EDE) == 0 {
+		r.EDE = parseExtendedErrors(comments)
+	}
+
+	return nil
+}
+
 // Punycode returns punycode of domain
 func (d Domain) Punycode() (string, error) {
 	name := strings.TrimSpace(string(d))
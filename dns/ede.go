@@ -0,0 +1,191 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ExtendedError is the extended dns error, see RFC 8914
+type ExtendedError struct {
+	InfoCode  int    `json:"info_code"`
+	ExtraText string `json:"extra_text,omitempty"`
+}
+
+// Supported extended dns error info code, see https://www.iana.org/assignments/dns-parameters
+const (
+	EDEOther                       = 0
+	EDEUnsupportedDNSKEYAlgorithm  = 1
+	EDEUnsupportedDSDigestType     = 2
+	EDEStaleAnswer                 = 3
+	EDEForgedAnswer                = 4
+	EDEDNSSECIndeterminate         = 5
+	EDEDNSSECBogus                 = 6
+	EDESignatureExpired            = 7
+	EDESignatureNotYetValid        = 8
+	EDEDNSKEYMissing               = 9
+	EDERRSIGsMissing               = 10
+	EDENoZoneKeyBitSet             = 11
+	EDENSECMissing                 = 12
+	EDECachedError                 = 13
+	EDENotReady                    = 14
+	EDEBlocked                     = 15
+	EDECensored                    = 16
+	EDEFiltered                    = 17
+	EDEProhibited                  = 18
+	EDEStaleNXDomainAnswer         = 19
+	EDENotAuthoritative            = 20
+	EDENotSupported                = 21
+	EDENoReachableAuthority        = 22
+	EDENetworkError                = 23
+	EDEInvalidData                 = 24
+	EDESignatureExpiredBeforeValid = 25
+	EDETooEarly                    = 26
+	EDEUnsupportedNSEC3Iterations  = 27
+	EDEUnableToConformToPolicy     = 28
+	EDESynthesized                 = 29
+	EDEInvalidQueryType            = 30
+)
+
+// optionEDE is the extended dns error option code
+const optionEDE = 15
+
+// edeNames is extended dns error info code to name map
+var edeNames = map[int]string{
+	EDEOther:                       "Other Error",
+	EDEUnsupportedDNSKEYAlgorithm:  "Unsupported DNSKEY Algorithm",
+	EDEUnsupportedDSDigestType:     "Unsupported DS Digest Type",
+	EDEStaleAnswer:                 "Stale Answer",
+	EDEForgedAnswer:                "Forged Answer",
+	EDEDNSSECIndeterminate:         "DNSSEC Indeterminate",
+	EDEDNSSECBogus:                 "DNSSEC Bogus",
+	EDESignatureExpired:            "Signature Expired",
+	EDESignatureNotYetValid:        "Signature Not Yet Valid",
+	EDEDNSKEYMissing:               "DNSKEY Missing",
+	EDERRSIGsMissing:               "RRSIGs Missing",
+	EDENoZoneKeyBitSet:             "No Zone Key Bit Set",
+	EDENSECMissing:                 "NSEC Missing",
+	EDECachedError:                 "Cached Error",
+	EDENotReady:                    "Not Ready",
+	EDEBlocked:                     "Blocked",
+	EDECensored:                    "Censored",
+	EDEFiltered:                    "Filtered",
+	EDEProhibited:                  "Prohibited",
+	EDEStaleNXDomainAnswer:         "Stale NXDomain Answer",
+	EDENotAuthoritative:            "Not Authoritative",
+	EDENotSupported:                "Not Supported",
+	EDENoReachableAuthority:        "No Reachable Authority",
+	EDENetworkError:                "Network Error",
+	EDEInvalidData:                 "Invalid Data",
+	EDESignatureExpiredBeforeValid: "Signature Expired before Valid",
+	EDETooEarly:                    "Too Early",
+	EDEUnsupportedNSEC3Iterations:  "Unsupported NSEC3 Iterations Value",
+	EDEUnableToConformToPolicy:     "Unable to conform to policy",
+	EDESynthesized:                 "Synthesized",
+	EDEInvalidQueryType:            "Invalid Query Type",
+}
+
+// edeComment is the extended dns error in json comment, for example: EDE(18): Prohibited
+var edeComment = regexp.MustCompile(`^EDE\((\d+)\):?\s*(.*)$`)
+
+// String returns the extended dns error in text, for example: EDE(15): Blocked (ads domain)
+func (e ExtendedError) String() string {
+	name, ok := edeNames[e.InfoCode]
+	if !ok {
+		name = "Unknown Error"
+	}
+
+	if e.ExtraText == "" {
+		return fmt.Sprintf("EDE(%d): %s", e.InfoCode, name)
+	}
+
+	return fmt.Sprintf("EDE(%d): %s (%s)", e.InfoCode, name, e.ExtraText)
+}
+
+// option returns the extended dns error option
+func (e ExtendedError) option() EDNSOption {
+	return EDNSOption{
+		Code: optionEDE,
+		Data: append(binary.BigEndian.AppendUint16(nil, uint16(e.InfoCode)), e.ExtraText...),
+	}
+}
+
+// ExtendedErrors returns the extended dns errors of message
+func (m *Msg) ExtendedErrors() []ExtendedError {
+	if m.EDNS == nil {
+		return nil
+	}
+
+	var es []ExtendedError
+	for _, o := range m.EDNS.Options {
+		if o.Code != optionEDE || len(o.Data) < 2 {
+			continue
+		}
+		es = append(es, ExtendedError{
+			InfoCode:  int(binary.BigEndian.Uint16(o.Data)),
+			ExtraText: strings.TrimRight(string(o.Data[2:]), "\x00"),
+		})
+	}
+
+	return es
+}
+
+// Stale returns whether the response is a stale answer served from cache, see RFC 8767
+func (r *Response) Stale() bool {
+	for _, v := range r.EDE {
+		if v.InfoCode == EDEStaleAnswer || v.InfoCode == EDEStaleNXDomainAnswer {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseExtendedErrors returns the extended dns errors in json comments
+func parseExtendedErrors(comments []string) []ExtendedError {
+	var es []ExtendedError
+	for _, v := range comments {
+		ms := edeComment.FindStringSubmatch(strings.TrimSpace(v))
+		if ms == nil {
+			continue
+		}
+		code, err := strconv.Atoi(ms[1])
+		if err != nil || code > 0xffff {
+			continue
+		}
+		text := ms[2]
+		if name, ok := edeNames[code]; ok && strings.HasPrefix(text, name) {
+			text = strings.TrimLeft(strings.TrimPrefix(text, name), ": ")
+			if strings.HasPrefix(text, "(") && strings.HasSuffix(text, ")") {
+				text = text[1 : len(text)-1]
+			}
+		}
+		es = append(es, ExtendedError{
+			InfoCode:  code,
+			ExtraText: text,
+		})
+	}
+
+	return es
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package dns
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/likexian/gokit/assert"
+)
+
+func TestExtendedError(t *testing.T) {
+	assert.Equal(t, ExtendedError{InfoCode: EDEBlocked}.String(), "EDE(15): Blocked")
+	assert.Equal(t, ExtendedError{InfoCode: EDEProhibited, ExtraText: "acl"}.String(), "EDE(18): Prohibited (acl)")
+	assert.Equal(t, ExtendedError{InfoCode: 1000}.String(), "EDE(1000): Unknown Error")
+
+	es := parseExtendedErrors([]string{
+		"EDE(18): Prohibited",
+		"EDE(22): No Reachable Authority: at delegation likexian.com.",
+		"EDE(15): Blocked (ads)",
+		"EDE(1000) something",
+		"EDE(99999): invalid",
+		"Response from 1.2.3.4",
+	})
+	assert.Equal(t, es, []ExtendedError{
+		{InfoCode: EDEProhibited},
+		{InfoCode: EDENoReachableAuthority, ExtraText: "at delegation likexian.com."},
+		{InfoCode: EDEBlocked, ExtraText: "ads"},
+		{InfoCode: 1000, ExtraText: "something"},
+	})
+
+	rsp := &Response{EDE: []ExtendedError{{InfoCode: EDEBlocked}}}
+	assert.False(t, rsp.Stale())
+	rsp.EDE = append(rsp.EDE, ExtendedError{InfoCode: EDEStaleAnswer})
+	assert.True(t, rsp.Stale())
+	rsp.EDE = []ExtendedError{{InfoCode: EDEStaleNXDomainAnswer}}
+	assert.True(t, rsp.Stale())
+}
+
+func TestResponseJSON(t *testing.T) {
+	rsp := &Response{}
+	err := json.Unmarshal([]byte(`{"Status":2,"Comment":"EDE(9): DNSKEY Missing","edns_client_subnet":"1.2.3.0/16"}`), rsp)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Status, 2)
+	assert.Equal(t, rsp.Comment, "EDE(9): DNSKEY Missing")
+	assert.Equal(t, rsp.ECS, ECS("1.2.3.0/16"))
+	assert.Equal(t, rsp.EDE, []ExtendedError{{InfoCode: EDEDNSKEYMissing}})
+
+	rsp = &Response{}
+	err = json.Unmarshal([]byte(`{"Status":0,"Comment":["Response from 1.2.3.4","EDE(3): Stale Answer"],
+		"Authority":[{"name":"likexian.com.","type":6,"TTL":300,"data":"ns1.likexian.com. admin.likexian.com. 1 2 3 4 5"}],
+		"Additional":[{"name":"ns1.likexian.com.","type":1,"TTL":300,"data":"1.2.3.4"}]}`), rsp)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Comment, "Response from 1.2.3.4; EDE(3): Stale Answer")
+	assert.Equal(t, rsp.EDE, []ExtendedError{{InfoCode: EDEStaleAnswer}})
+	assert.Equal(t, rsp.Authority[0].Type, 6)
+	assert.Equal(t, rsp.Additional[0].Data, "1.2.3.4")
+
+	// the extended_dns_errors is preferred
+	rsp = &Response{}
+	err = json.Unmarshal([]byte(`{"Comment":"EDE(9): DNSKEY Missing","extended_dns_errors":[{"info_code":15}]}`), rsp)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.EDE, []ExtendedError{{InfoCode: EDEBlocked}})
+
+	rsp = &Response{}
+	err = json.Unmarshal([]byte(`{"Comment":null}`), rsp)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Comment, "")
+
+	err = json.Unmarshal([]byte(`{"Comment":1}`), rsp)
+	assert.NotNil(t, err)
+
+	err = json.Unmarshal([]byte(`{"Status":"0"}`), rsp)
+	assert.NotNil(t, err)
+
+	b, err := json.Marshal(&Response{Comment: "test", EDE: []ExtendedError{{InfoCode: EDEBlocked}}})
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), `"Comment":"test"`)
+	assert.Contains(t, string(b), `"extended_dns_errors":[{"info_code":15}]`)
+}
+
+func TestResponseWire(t *testing.T) {
+	rsp := &Response{
+		Status: 2,
+		EDE:    []ExtendedError{{InfoCode: EDEBlocked, ExtraText: "ads"}, {InfoCode: EDECensored}},
+	}
+
+	b, err := rsp.Msg().Pack()
+	assert.Nil(t, err)
+
+	m := &Msg{}
+	err = m.Unpack(b)
+	assert.Nil(t, err)
+	assert.Equal(t, m.Response().EDE, rsp.EDE)
+	assert.Equal(t, m.Response().Err().Error(), "dns: bad response code: SERVFAIL, EDE(15): Blocked (ads), EDE(16): Censored")
+
+	// the ECS of response is the scope prefix length
+	m = &Msg{EDNS: &EDNS{Options: []EDNSOption{{Code: optionECS, Data: []byte{0, 1, 24, 16, 1, 2, 3}}}}}
+	assert.Equal(t, m.ECS(), ECS("1.2.3.0/24"))
+	assert.Equal(t, m.Response().ECS, ECS("1.2.3.0/16"))
+
+	assert.Equal(t, len((&Response{}).Msg().ExtendedErrors()), 0)
+	assert.True(t, (&Response{}).Msg().EDNS == nil)
+}
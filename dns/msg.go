@@ -0,0 +1,529 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/likexian/gokit/xip"
+)
+
+// Msg is dns wire format message, see RFC 1035
+type Msg struct {
+	ID         uint16
+	QR         bool
+	Opcode     int
+	AA         bool
+	TC         bool
+	RD         bool
+	RA         bool
+	AD         bool
+	CD         bool
+	RCode      int
+	Question   []Question
+	Answer     []Answer
+	Authority  []Answer
+	Additional []Answer
+	EDNS       *EDNS
+}
+
+// EDNS is the edns0 OPT pseudo record, see RFC 6891,
+// the message is padded to a multiple of Padding octets if it is not zero, see RFC 7830
+type EDNS struct {
+	UDPSize int
+	DO      bool
+	Options []EDNSOption
+	Padding int
+}
+
+// EDNSOption is the edns0 option
+type EDNSOption struct {
+	Code int
+	Data []byte
+}
+
+const (
+	// headerLen is dns message header length
+	headerLen = 12
+	// classINET is the internet class
+	classINET = 1
+	// typeOPT is the edns0 OPT pseudo record type
+	typeOPT = 41
+	// optionECS is the edns0-client-subnet option code
+	optionECS = 8
+	// optionPadding is the edns0 padding option code
+	optionPadding = 12
+	// defaultUDPSize is the default edns0 udp payload size
+	defaultUDPSize = 4096
+)
+
+// NewQuery returns a new query message with the edns0-client-subnet option
+func NewQuery(d Domain, t Type, s ...ECS) (*Msg, error) {
+	name, err := d.Punycode()
+	if err != nil {
+		return nil, err
+	}
+
+	code, err := typeCode(t)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Msg{
+		RD: true,
+		Question: []Question{
+			{
+				Name: name,
+				Type: int(code),
+			},
+		},
+		EDNS: &EDNS{
+			UDPSize: defaultUDPSize,
+		},
+	}
+
+	if len(s) > 0 {
+		opt, err := s[0].option()
+		if err != nil {
+			return nil, err
+		}
+		if opt != nil {
+			m.EDNS.Options = append(m.EDNS.Options, *opt)
+		}
+	}
+
+	return m, nil
+}
+
+// NewQueryWithOptions returns a new query message of question with options
+func NewQueryWithOptions(q Question, o Options) (*Msg, error) {
+	m, err := NewQuery(Domain(q.Name), TypeFromCode(q.Type), o.ECS)
+	if err != nil {
+		return nil, err
+	}
+
+	m.CD = o.CD
+	m.EDNS.DO = o.DO
+	if o.Padding {
+		m.EDNS.Padding = QueryPadding
+	}
+
+	return m, nil
+}
+
+// Padded returns whether the message has edns0 padding option
+func (m *Msg) Padded() bool {
+	if m.EDNS == nil {
+		return false
+	}
+
+	if m.EDNS.Padding > 0 {
+		return true
+	}
+
+	for _, o := range m.EDNS.Options {
+		if o.Code == optionPadding {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ECS returns the edns0-client-subnet option of message, empty if not present
+func (m *Msg) ECS() ECS {
+	return m.subnet(false)
+}
+
+// subnet returns the edns0-client-subnet with source or scope prefix length
+func (m *Msg) subnet(scope bool) ECS {
+	if m.EDNS == nil {
+		return ""
+	}
+
+	for _, o := range m.EDNS.Options {
+		if o.Code != optionECS || len(o.Data) < 4 {
+			continue
+		}
+		size := 4
+		if binary.BigEndian.Uint16(o.Data) == 2 {
+			size = 16
+		}
+		addr := make([]byte, size)
+		copy(addr, o.Data[4:])
+		ip, ok := netip.AddrFromSlice(addr)
+		if !ok {
+			return ""
+		}
+		if scope {
+			return ECS(fmt.Sprintf("%s/%d", ip, o.Data[3]))
+		}
+		return ECS(fmt.Sprintf("%s/%d", ip, o.Data[2]))
+	}
+
+	return ""
+}
+
+// Response returns message as response
+func (m *Msg) Response() *Response {
+	return &Response{
+		Status:     m.RCode,
+		TC:         m.TC,
+		RD:         m.RD,
+		RA:         m.RA,
+		AD:         m.AD,
+		CD:         m.CD,
+		Question:   m.Question,
+		Answer:     m.Answer,
+		Authority:  m.Authority,
+		Additional: m.Additional,
+		ECS:        m.subnet(true),
+		EDE:        m.ExtendedErrors(),
+	}
+}
+
+// Msg returns response as message, the extended dns errors are kept
+func (r *Response) Msg() *Msg {
+	m := &Msg{
+		QR:         true,
+		TC:         r.TC,
+		RD:         r.RD,
+		RA:         r.RA,
+		AD:         r.AD,
+		CD:         r.CD,
+		RCode:      r.Status,
+		Question:   r.Question,
+		Answer:     r.Answer,
+		Authority:  r.Authority,
+		Additional: r.Additional,
+	}
+
+	if len(r.EDE) > 0 {
+		m.EDNS = &EDNS{
+			UDPSize: defaultUDPSize,
+		}
+		for _, v := range r.EDE {
+			m.EDNS.Options = append(m.EDNS.Options, v.option())
+		}
+	}
+
+	return m
+}
+
+// Pack returns wire format of message
+func (m *Msg) Pack() ([]byte, error) {
+	b := make([]byte, headerLen, 512)
+
+	flags := uint16(m.Opcode&0xf)<<11 | uint16(m.RCode&0xf)
+	for _, v := range []struct {
+		set bool
+		bit uint16
+	}{
+		{m.QR, 1 << 15}, {m.AA, 1 << 10}, {m.TC, 1 << 9}, {m.RD, 1 << 8},
+		{m.RA, 1 << 7}, {m.AD, 1 << 5}, {m.CD, 1 << 4},
+	} {
+		if v.set {
+			flags |= v.bit
+		}
+	}
+
+	edns := m.EDNS
+	if edns == nil && m.RCode > 0xf {
+		edns = &EDNS{UDPSize: defaultUDPSize}
+	}
+
+	arCount := len(m.Additional)
+	if edns != nil {
+		arCount++
+	}
+
+	binary.BigEndian.PutUint16(b[0:], m.ID)
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.Question)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.Answer)))
+	binary.BigEndian.PutUint16(b[8:], uint16(len(m.Authority)))
+	binary.BigEndian.PutUint16(b[10:], uint16(arCount))
+
+	var err error
+	comp := map[string]int{}
+
+	for _, q := range m.Question {
+		b, err = packName(b, q.Name, comp)
+		if err != nil {
+			return nil, err
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(q.Type))
+		b = binary.BigEndian.AppendUint16(b, classINET)
+	}
+
+	for _, rrs := range [][]Answer{m.Answer, m.Authority, m.Additional} {
+		for _, rr := range rrs {
+			b, err = packRR(b, rr, comp)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if edns != nil {
+		b = edns.pack(b, m.RCode)
+	}
+
+	return b, nil
+}
+
+// Unpack parses wire format message
+func (m *Msg) Unpack(b []byte) error {
+	if len(b) < headerLen {
+		return fmt.Errorf("dns: message too short")
+	}
+
+	flags := binary.BigEndian.Uint16(b[2:])
+	*m = Msg{
+		ID:     binary.BigEndian.Uint16(b[0:]),
+		QR:     flags&(1<<15) != 0,
+		Opcode: int(flags>>11) & 0xf,
+		AA:     flags&(1<<10) != 0,
+		TC:     flags&(1<<9) != 0,
+		RD:     flags&(1<<8) != 0,
+		RA:     flags&(1<<7) != 0,
+		AD:     flags&(1<<5) != 0,
+		CD:     flags&(1<<4) != 0,
+		RCode:  int(flags & 0xf),
+	}
+
+	qdCount := int(binary.BigEndian.Uint16(b[4:]))
+	counts := []int{
+		int(binary.BigEndian.Uint16(b[6:])),
+		int(binary.BigEndian.Uint16(b[8:])),
+		int(binary.BigEndian.Uint16(b[10:])),
+	}
+
+	off := headerLen
+	for i := 0; i < qdCount; i++ {
+		name, n, err := unpackName(b, off)
+		if err != nil {
+			return err
+		}
+		if n+4 > len(b) {
+			return fmt.Errorf("dns: question too short")
+		}
+		m.Question = append(m.Question, Question{
+			Name: name,
+			Type: int(binary.BigEndian.Uint16(b[n:])),
+		})
+		off = n + 4
+	}
+
+	sections := []*[]Answer{&m.Answer, &m.Authority, &m.Additional}
+	for i, count := range counts {
+		for j := 0; j < count; j++ {
+			rr, n, err := unpackRR(b, off)
+			if err != nil {
+				return err
+			}
+			off = n
+			if rr.Type == typeOPT {
+				m.EDNS, err = unpackEDNS(b, rr)
+				if err != nil {
+					return err
+				}
+				m.RCode |= int(rr.ttl>>24) << 4
+				continue
+			}
+			*sections[i] = append(*sections[i], rr.Answer)
+		}
+	}
+
+	return nil
+}
+
+// rawRR is the unpacked resource record with raw fields
+type rawRR struct {
+	Answer
+	class uint16
+	ttl   uint32
+	start int
+	end   int
+}
+
+// packRR appends wire format of resource record to b
+func packRR(b []byte, rr Answer, comp map[string]int) ([]byte, error) {
+	b, err := packName(b, rr.Name, comp)
+	if err != nil {
+		return nil, err
+	}
+
+	b = binary.BigEndian.AppendUint16(b, uint16(rr.Type))
+	b = binary.BigEndian.AppendUint16(b, classINET)
+	b = binary.BigEndian.AppendUint32(b, uint32(rr.TTL))
+
+	n := len(b)
+	b = append(b, 0, 0)
+	b, err = packRData(b, uint16(rr.Type), rr.Data, comp, false)
+	if err != nil {
+		return nil, fmt.Errorf("dns: invalid %s record data: %w", rr.Name, err)
+	}
+
+	if len(b)-n-2 > 0xffff {
+		return nil, fmt.Errorf("dns: %s record data too long", rr.Name)
+	}
+	binary.BigEndian.PutUint16(b[n:], uint16(len(b)-n-2))
+
+	return b, nil
+}
+
+// unpackRR parses resource record at off, returns the record and next offset
+func unpackRR(b []byte, off int) (rr rawRR, n int, err error) {
+	rr.Name, n, err = unpackName(b, off)
+	if err != nil {
+		return
+	}
+
+	if n+10 > len(b) {
+		return rr, 0, fmt.Errorf("dns: resource record too short")
+	}
+
+	rr.Type = int(binary.BigEndian.Uint16(b[n:]))
+	rr.class = binary.BigEndian.Uint16(b[n+2:])
+	rr.ttl = binary.BigEndian.Uint32(b[n+4:])
+	rr.start = n + 10
+	rr.end = rr.start + int(binary.BigEndian.Uint16(b[n+8:]))
+	if rr.end > len(b) {
+		return rr, 0, fmt.Errorf("dns: resource record data too short")
+	}
+
+	if rr.ttl <= 1<<31-1 {
+		rr.TTL = int(rr.ttl)
+	}
+
+	if rr.Type != typeOPT {
+		rr.Data, err = unpackRData(b, rr.start, rr.end, uint16(rr.Type))
+		if err != nil {
+			return
+		}
+	}
+
+	return rr, rr.end, nil
+}
+
+// pack appends the OPT pseudo record to b
+func (e *EDNS) pack(b []byte, rcode int) []byte {
+	size := e.UDPSize
+	if size < 512 {
+		size = 512
+	}
+
+	ttl := uint32(rcode>>4&0xff) << 24
+	if e.DO {
+		ttl |= 1 << 15
+	}
+
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint16(b, typeOPT)
+	b = binary.BigEndian.AppendUint16(b, uint16(size))
+	b = binary.BigEndian.AppendUint32(b, ttl)
+
+	n := len(b)
+	b = append(b, 0, 0)
+	for _, o := range e.Options {
+		if e.Padding > 0 && o.Code == optionPadding {
+			continue
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(o.Code))
+		b = binary.BigEndian.AppendUint16(b, uint16(len(o.Data)))
+		b = append(b, o.Data...)
+	}
+
+	if e.Padding > 0 {
+		size := (e.Padding - (len(b)+4)%e.Padding) % e.Padding
+		b = binary.BigEndian.AppendUint16(b, optionPadding)
+		b = binary.BigEndian.AppendUint16(b, uint16(size))
+		b = append(b, make([]byte, size)...)
+	}
+
+	binary.BigEndian.PutUint16(b[n:], uint16(len(b)-n-2))
+
+	return b
+}
+
+// unpackEDNS parses the OPT pseudo record
+func unpackEDNS(b []byte, rr rawRR) (*EDNS, error) {
+	e := &EDNS{
+		UDPSize: int(rr.class),
+		DO:      rr.ttl&(1<<15) != 0,
+	}
+
+	for off := rr.start; off < rr.end; {
+		if off+4 > rr.end {
+			return nil, fmt.Errorf("dns: edns0 option too short")
+		}
+		code := binary.BigEndian.Uint16(b[off:])
+		size := int(binary.BigEndian.Uint16(b[off+2:]))
+		off += 4
+		if off+size > rr.end {
+			return nil, fmt.Errorf("dns: edns0 option data too short")
+		}
+		e.Options = append(e.Options, EDNSOption{
+			Code: int(code),
+			Data: append([]byte{}, b[off:off+size]...),
+		})
+		off += size
+	}
+
+	return e, nil
+}
+
+// option returns the edns0-client-subnet option, see RFC 7871
+func (s ECS) option() (*EDNSOption, error) {
+	ss := strings.TrimSpace(string(s))
+	if ss == "" {
+		return nil, nil
+	}
+
+	ss, err := xip.FixSubnet(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix, err := netip.ParsePrefix(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix = prefix.Masked()
+	family := uint16(1)
+	if prefix.Addr().Is6() {
+		family = 2
+	}
+
+	bits := prefix.Bits()
+	data := binary.BigEndian.AppendUint16(nil, family)
+	data = append(data, byte(bits), 0)
+	data = append(data, prefix.Addr().AsSlice()[:(bits+7)/8]...)
+
+	return &EDNSOption{
+		Code: optionECS,
+		Data: data,
+	}, nil
+}
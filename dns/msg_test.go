@@ -0,0 +1,212 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package dns
+
+import (
+	"testing"
+
+	"github.com/likexian/gokit/assert"
+)
+
+func TestNewQuery(t *testing.T) {
+	m, err := NewQuery("likexian.com", TypeA)
+	assert.Nil(t, err)
+	assert.True(t, m.RD)
+	assert.Equal(t, m.Question, []Question{{Name: "likexian.com", Type: 1}})
+	assert.Len(t, m.EDNS.Options, 0)
+
+	m, err = NewQuery("likexian.com", TypeMX, "1.2.3.4")
+	assert.Nil(t, err)
+	assert.Equal(t, m.Question[0].Type, 15)
+	assert.Equal(t, m.EDNS.Options, []EDNSOption{{Code: 8, Data: []byte{0, 1, 24, 0, 1, 2, 3}}})
+
+	m, err = NewQuery("likexian.com", "TYPE65", "2001:db8::1/48")
+	assert.Nil(t, err)
+	assert.Equal(t, m.Question[0].Type, 65)
+	assert.Equal(t, m.EDNS.Options[0].Data, []byte{0, 2, 48, 0, 0x20, 0x01, 0x0d, 0xb8, 0, 0})
+
+	assert.Equal(t, m.ECS(), ECS("2001:db8::/48"))
+
+	m, err = NewQuery("likexian.com", TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, m.ECS(), ECS(""))
+
+	m.EDNS = nil
+	assert.Equal(t, m.ECS(), ECS(""))
+
+	_, err = NewQuery("likexian.com", "XX")
+	assert.NotNil(t, err)
+
+	_, err = NewQuery("likexian.com", TypeA, "xx")
+	assert.NotNil(t, err)
+}
+
+func TestNewQueryWithOptions(t *testing.T) {
+	m, err := NewQueryWithOptions(Question{Name: "likexian.com", Type: 48}, Options{DO: true, CD: true, ECS: "1.1.1.1"})
+	assert.Nil(t, err)
+	assert.Equal(t, m.Question, []Question{{Name: "likexian.com", Type: 48}})
+	assert.True(t, m.CD)
+	assert.True(t, m.EDNS.DO)
+	assert.Equal(t, m.ECS(), ECS("1.1.1.0/24"))
+
+	_, err = NewQueryWithOptions(Question{Name: "likexian.com", Type: 1}, Options{ECS: "abc"})
+	assert.NotNil(t, err)
+}
+
+func TestMsgPadding(t *testing.T) {
+	for _, name := range []string{"a.com", "likexian.com", "a-very-long-subdomain-name.of.likexian.com"} {
+		m, err := NewQueryWithOptions(Question{Name: name, Type: 1}, Options{ECS: "1.2.3.4", Padding: true})
+		assert.Nil(t, err)
+		assert.True(t, m.Padded())
+
+		b, err := m.Pack()
+		assert.Nil(t, err)
+		assert.Equal(t, len(b), QueryPadding, name)
+
+		q := &Msg{}
+		err = q.Unpack(b)
+		assert.Nil(t, err)
+		assert.True(t, q.Padded())
+		assert.Equal(t, q.ECS(), ECS("1.2.3.0/24"))
+
+		// the padding option is replaced
+		q.EDNS.Padding = ResponsePadding
+		b, err = q.Pack()
+		assert.Nil(t, err)
+		assert.Equal(t, len(b), ResponsePadding, name)
+		assert.Equal(t, len(q.EDNS.Options), 2)
+	}
+
+	m, err := NewQuery("likexian.com", TypeA)
+	assert.Nil(t, err)
+	assert.False(t, m.Padded())
+	assert.False(t, (&Msg{}).Padded())
+}
+
+func TestMsgPackUnpack(t *testing.T) {
+	m := &Msg{
+		ID:    0xbeef,
+		QR:    true,
+		RD:    true,
+		RA:    true,
+		AD:    true,
+		RCode: 3,
+		Question: []Question{
+			{Name: "likexian.com.", Type: 255},
+		},
+		Answer: []Answer{
+			{Name: "likexian.com.", Type: 1, TTL: 600, Data: "1.2.3.4"},
+			{Name: "likexian.com.", Type: 28, TTL: 600, Data: "2001:db8::1"},
+			{Name: "www.likexian.com.", Type: 5, TTL: 60, Data: "likexian.com."},
+			{Name: "likexian.com.", Type: 15, TTL: 60, Data: "10 mx.likexian.com."},
+			{Name: "likexian.com.", Type: 16, TTL: 60, Data: `"v=spf1 -all" "a \"quoted\" \\ string"`},
+			{Name: "likexian.com.", Type: 33, TTL: 60, Data: "1 2 443 sip.likexian.com."},
+			{Name: "likexian.com.", Type: 257, TTL: 60, Data: `0 issue "letsencrypt.org"`},
+			{Name: "likexian.com.", Type: 65534, TTL: 60, Data: `\# 3 ABCDEF`},
+			{Name: "likexian.com.", Type: 65533, TTL: 60, Data: `\# 0`},
+			{Name: "a\\.b.likexian.com.", Type: 12, TTL: 60, Data: "likexian.com."},
+			{Name: "likexian.com.", Type: 43, TTL: 60, Data: "12345 13 2 ABCDEF0123"},
+			{Name: "likexian.com.", Type: 48, TTL: 60, Data: "257 3 13 AQIDBA=="},
+			{Name: "likexian.com.", Type: 46, TTL: 60, Data: "A 13 2 600 20240101000000 20231201000000 12345 likexian.com. AQIDBA=="},
+			{Name: "likexian.com.", Type: 47, TTL: 60, Data: "www.likexian.com. A NS SOA RRSIG NSEC DNSKEY TYPE1234"},
+			{Name: "likexian.com.", Type: 50, TTL: 60, Data: "1 1 12 AABBCCDD 2T7B4G4VSA5SMI47K61MV5BV1A22BOJR A RRSIG"},
+			{Name: "likexian.com.", Type: 51, TTL: 60, Data: "1 0 0 -"},
+			{Name: "likexian.com.", Type: 35, TTL: 60, Data: `100 10 "S" "SIP+D2U" "" _sip._udp.likexian.com.`},
+			{Name: "likexian.com.", Type: 44, TTL: 60, Data: "1 2 ABCDEF0123"},
+			{Name: "likexian.com.", Type: 52, TTL: 60, Data: "3 1 1 ABCDEF0123"},
+			{Name: "likexian.com.", Type: 256, TTL: 60, Data: `10 1 "https://www.likexian.com/"`},
+			{Name: "likexian.com.", Type: 64, TTL: 60, Data: `1 svc.likexian.com. alpn="h2,h3" port=8443 ipv4hint=1.2.3.4,5.6.7.8 key65000="a b"`},
+			{Name: "likexian.com.", Type: 65, TTL: 60, Data: `1 . alpn="h2" no-default-alpn ech=AQID ipv6hint=2001:db8::1`},
+			{Name: "likexian.com.", Type: 65, TTL: 60, Data: "0 svc.likexian.com."},
+		},
+		Authority: []Answer{
+			{Name: "likexian.com.", Type: 6, TTL: 60, Data: "ns.likexian.com. admin.likexian.com. 1 7200 3600 86400 300"},
+		},
+		Additional: []Answer{
+			{Name: "ns.likexian.com.", Type: 1, TTL: 60, Data: "5.6.7.8"},
+		},
+		EDNS: &EDNS{
+			UDPSize: 1232,
+			DO:      true,
+			Options: []EDNSOption{{Code: 8, Data: []byte{0, 1, 24, 0, 1, 2, 3}}},
+		},
+	}
+
+	b, err := m.Pack()
+	assert.Nil(t, err)
+
+	n := &Msg{}
+	err = n.Unpack(b)
+	assert.Nil(t, err)
+	assert.Equal(t, n, m)
+
+	m.RCode = 16
+	b, err = m.Pack()
+	assert.Nil(t, err)
+	err = n.Unpack(b)
+	assert.Nil(t, err)
+	assert.Equal(t, n.RCode, 16)
+
+	err = n.Unpack(b[:len(b)-1])
+	assert.NotNil(t, err)
+
+	err = n.Unpack(b[:10])
+	assert.NotNil(t, err)
+}
+
+func TestMsgPackError(t *testing.T) {
+	tests := []Answer{
+		{Name: "likexian.com.", Type: 1, Data: "2001:db8::1"},
+		{Name: "likexian.com.", Type: 28, Data: "1.2.3.4"},
+		{Name: "likexian.com.", Type: 15, Data: "x mx.likexian.com."},
+		{Name: "likexian.com.", Type: 15, Data: "10"},
+		{Name: "likexian.com.", Type: 16, Data: `"unterminated`},
+		{Name: "likexian.com.", Type: 65534, Data: "abc"},
+		{Name: "likexian.com.", Type: 65534, Data: `\# 2 ABCDEF`},
+		{Name: "likexian..com.", Type: 1, Data: "1.2.3.4"},
+	}
+
+	for _, v := range tests {
+		_, err := (&Msg{Answer: []Answer{v}}).Pack()
+		assert.NotNil(t, err, v)
+	}
+}
+
+func TestMsgResponse(t *testing.T) {
+	r := &Response{
+		Status:   0,
+		RD:       true,
+		RA:       true,
+		Question: []Question{{Name: "likexian.com.", Type: 16}},
+		Answer:   []Answer{{Name: "likexian.com.", Type: 16, TTL: 60, Data: "v=spf1 -all"}},
+	}
+
+	b, err := r.Msg().Pack()
+	assert.Nil(t, err)
+
+	m := &Msg{}
+	err = m.Unpack(b)
+	assert.Nil(t, err)
+	assert.True(t, m.QR)
+
+	rr := m.Response()
+	assert.Equal(t, rr.Question, r.Question)
+	assert.Equal(t, rr.Answer[0].Data, `"v=spf1 -all"`)
+}
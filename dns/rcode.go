@@ -0,0 +1,137 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package dns
+
+import (
+	"fmt"
+)
+
+// RCode is dns response code
+type RCode int
+
+// RCodeError is the error of non-zero response code
+type RCodeError struct {
+	// RCode is the response code
+	RCode RCode
+	// Provider is the provider returns the response
+	Provider string
+	// EDE is the extended dns errors of response
+	EDE []ExtendedError
+}
+
+// Supported dns response code, see https://www.iana.org/assignments/dns-parameters
+const (
+	RCodeNoError   RCode = 0
+	RCodeFormErr   RCode = 1
+	RCodeServFail  RCode = 2
+	RCodeNXDomain  RCode = 3
+	RCodeNotImp    RCode = 4
+	RCodeRefused   RCode = 5
+	RCodeYXDomain  RCode = 6
+	RCodeYXRRSet   RCode = 7
+	RCodeNXRRSet   RCode = 8
+	RCodeNotAuth   RCode = 9
+	RCodeNotZone   RCode = 10
+	RCodeDSOTypeNI RCode = 11
+	RCodeBadVers   RCode = 16
+	RCodeBadKey    RCode = 17
+	RCodeBadTime   RCode = 18
+	RCodeBadMode   RCode = 19
+	RCodeBadName   RCode = 20
+	RCodeBadAlg    RCode = 21
+	RCodeBadTrunc  RCode = 22
+	RCodeBadCookie RCode = 23
+)
+
+// Response code errors, use with errors.Is
+var (
+	ErrFormErr  = &RCodeError{RCode: RCodeFormErr}
+	ErrServFail = &RCodeError{RCode: RCodeServFail}
+	ErrNXDomain = &RCodeError{RCode: RCodeNXDomain}
+	ErrNotImp   = &RCodeError{RCode: RCodeNotImp}
+	ErrRefused  = &RCodeError{RCode: RCodeRefused}
+)
+
+// rcodeNames is dns response code to name map
+var rcodeNames = map[RCode]string{
+	RCodeNoError:   "NOERROR",
+	RCodeFormErr:   "FORMERR",
+	RCodeServFail:  "SERVFAIL",
+	RCodeNXDomain:  "NXDOMAIN",
+	RCodeNotImp:    "NOTIMP",
+	RCodeRefused:   "REFUSED",
+	RCodeYXDomain:  "YXDOMAIN",
+	RCodeYXRRSet:   "YXRRSET",
+	RCodeNXRRSet:   "NXRRSET",
+	RCodeNotAuth:   "NOTAUTH",
+	RCodeNotZone:   "NOTZONE",
+	RCodeDSOTypeNI: "DSOTYPENI",
+	RCodeBadVers:   "BADVERS",
+	RCodeBadKey:    "BADKEY",
+	RCodeBadTime:   "BADTIME",
+	RCodeBadMode:   "BADMODE",
+	RCodeBadName:   "BADNAME",
+	RCodeBadAlg:    "BADALG",
+	RCodeBadTrunc:  "BADTRUNC",
+	RCodeBadCookie: "BADCOOKIE",
+}
+
+// String returns the name of response code, RCODEnnn if unknown
+func (r RCode) String() string {
+	if name, ok := rcodeNames[r]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("RCODE%d", int(r))
+}
+
+// Error returns the error message, with the extended dns errors if present
+func (e *RCodeError) Error() string {
+	name := e.Provider
+	if name == "" {
+		name = "dns"
+	}
+
+	s := fmt.Sprintf("%s: bad response code: %s", name, e.RCode)
+	for _, v := range e.EDE {
+		s += ", " + v.String()
+	}
+
+	return s
+}
+
+// Is reports whether the target is the error of same response code
+func (e *RCodeError) Is(target error) bool {
+	t, ok := target.(*RCodeError)
+	return ok && t.RCode == e.RCode
+}
+
+// Err returns the RCodeError of response, nil if the response code is NOERROR
+func (r *Response) Err() error {
+	if r.Status == int(RCodeNoError) {
+		return nil
+	}
+
+	return &RCodeError{
+		RCode:    RCode(r.Status),
+		Provider: r.Provider,
+		EDE:      r.EDE,
+	}
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/likexian/gokit/assert"
+)
+
+func TestRCode(t *testing.T) {
+	assert.Equal(t, RCodeNoError.String(), "NOERROR")
+	assert.Equal(t, RCodeNXDomain.String(), "NXDOMAIN")
+	assert.Equal(t, RCodeBadCookie.String(), "BADCOOKIE")
+	assert.Equal(t, RCode(4000).String(), "RCODE4000")
+
+	rsp := &Response{Status: 0, Provider: "test"}
+	assert.Nil(t, rsp.Err())
+
+	rsp.Status = 3
+	err := rsp.Err()
+	assert.Equal(t, err.Error(), "test: bad response code: NXDOMAIN")
+	assert.True(t, errors.Is(err, ErrNXDomain))
+	assert.False(t, errors.Is(err, ErrServFail))
+	assert.True(t, errors.Is(fmt.Errorf("wrapped: %w", err), ErrNXDomain))
+
+	var rerr *RCodeError
+	assert.True(t, errors.As(err, &rerr))
+	assert.Equal(t, rerr.RCode, RCodeNXDomain)
+	assert.Equal(t, rerr.Provider, "test")
+
+	rsp = &Response{Status: 2}
+	assert.Equal(t, rsp.Err().Error(), "dns: bad response code: SERVFAIL")
+	assert.True(t, errors.Is(rsp.Err(), ErrServFail))
+	assert.False(t, errors.Is(rsp.Err(), errors.New("dns: bad response code: SERVFAIL")))
+}
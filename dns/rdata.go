@@ -0,0 +1,946 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package dns
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rdField is the field kind of record data
+type rdField int
+
+// Record data field kinds
+const (
+	// rdCName is a domain name which may be compressed
+	rdCName rdField = iota
+	// rdName is a domain name which must not be compressed
+	rdName
+	// rdUint8 is an 8 bit integer
+	rdUint8
+	// rdUint16 is a 16 bit integer
+	rdUint16
+	// rdUint32 is a 32 bit integer
+	rdUint32
+	// rdIPv4 is an ipv4 address
+	rdIPv4
+	// rdIPv6 is an ipv6 address
+	rdIPv6
+	// rdString is a quoted character string
+	rdString
+	// rdTag is an unquoted character string
+	rdTag
+	// rdStrings is all the remaining character strings
+	rdStrings
+	// rdText is all the remaining data as quoted text without length
+	rdText
+	// rdBase64 is all the remaining data in base64
+	rdBase64
+	// rdHex is all the remaining data in hex
+	rdHex
+	// rdType is a 16 bit record type
+	rdType
+	// rdTime is a 32 bit timestamp in YYYYMMDDHHmmSS
+	rdTime
+	// rdSalt is a hex string with 8 bit length, - if empty
+	rdSalt
+	// rdHash is a base32hex string with 8 bit length
+	rdHash
+	// rdTypeBitmap is all the remaining data as type bitmap
+	rdTypeBitmap
+	// rdSvcParams is all the remaining data as service parameters, see RFC 9460
+	rdSvcParams
+)
+
+// timeLayout is the presentation format of rdTime
+const timeLayout = "20060102150405"
+
+// base32Hex is the base32 extended hex encoding without padding
+var base32Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// svcParamKeys is the service parameter key names, see RFC 9460 section 14.3.2
+var svcParamKeys = []string{"mandatory", "alpn", "no-default-alpn", "port", "ipv4hint", "ech", "ipv6hint"}
+
+// rdataFields is the record data fields of known types
+var rdataFields = map[uint16][]rdField{
+	1:   {rdIPv4},
+	2:   {rdCName},
+	5:   {rdCName},
+	6:   {rdCName, rdCName, rdUint32, rdUint32, rdUint32, rdUint32, rdUint32},
+	12:  {rdCName},
+	15:  {rdUint16, rdCName},
+	16:  {rdStrings},
+	28:  {rdIPv6},
+	33:  {rdUint16, rdUint16, rdUint16, rdName},
+	35:  {rdUint16, rdUint16, rdString, rdString, rdString, rdName},
+	39:  {rdName},
+	43:  {rdUint16, rdUint8, rdUint8, rdHex},
+	44:  {rdUint8, rdUint8, rdHex},
+	46:  {rdType, rdUint8, rdUint8, rdUint32, rdTime, rdTime, rdUint16, rdName, rdBase64},
+	47:  {rdName, rdTypeBitmap},
+	48:  {rdUint16, rdUint8, rdUint8, rdBase64},
+	50:  {rdUint8, rdUint8, rdUint16, rdSalt, rdHash, rdTypeBitmap},
+	51:  {rdUint8, rdUint8, rdUint16, rdSalt},
+	52:  {rdUint8, rdUint8, rdUint8, rdHex},
+	59:  {rdUint16, rdUint8, rdUint8, rdHex},
+	60:  {rdUint16, rdUint8, rdUint8, rdBase64},
+	64:  {rdUint16, rdName, rdSvcParams},
+	65:  {rdUint16, rdName, rdSvcParams},
+	99:  {rdStrings},
+	256: {rdUint16, rdUint16, rdText},
+	257: {rdUint8, rdTag, rdText},
+}
+
+// canonicalTypes is the types whose names in record data are lowercased in canonical form,
+// see RFC 4034 section 6.2 and RFC 6840 section 5.1
+var canonicalTypes = map[uint16]bool{
+	2: true, 3: true, 4: true, 5: true, 6: true, 7: true, 8: true, 9: true, 12: true, 13: true,
+	14: true, 15: true, 17: true, 18: true, 21: true, 24: true, 26: true, 30: true, 35: true,
+	36: true, 33: true, 39: true, 38: true, 46: true,
+}
+
+// RData returns wire format of record data
+func (a Answer) RData() ([]byte, error) {
+	return packRData(nil, uint16(a.Type), a.Data, nil, false)
+}
+
+// CanonicalRData returns canonical wire format of record data, see RFC 4034 section 6.2
+func (a Answer) CanonicalRData() ([]byte, error) {
+	return packRData(nil, uint16(a.Type), a.Data, nil, canonicalTypes[uint16(a.Type)])
+}
+
+// CanonicalName returns canonical wire format of domain name, see RFC 4034 section 6.2
+func CanonicalName(name string) ([]byte, error) {
+	return packCanonicalName(nil, name)
+}
+
+// isRemaining returns if the field kind consumes all the remaining data
+func isRemaining(f rdField) bool {
+	return f == rdStrings || f == rdText || f == rdBase64 || f == rdHex || f == rdTypeBitmap || f == rdSvcParams
+}
+
+// packRData appends wire format of record data to b, lowercase names if lower is true
+func packRData(b []byte, t uint16, data string, comp map[string]int, lower bool) ([]byte, error) {
+	data = strings.TrimSpace(data)
+	if strings.HasPrefix(data, `\#`) {
+		return packUnknownRData(b, data)
+	}
+
+	fields, ok := rdataFields[t]
+	if !ok {
+		return nil, fmt.Errorf("unknown record type %d requires \\# format", t)
+	}
+
+	// the JSON API of some providers returns TXT data without quotes
+	if len(fields) == 1 && fields[0] == rdStrings && !strings.HasPrefix(data, `"`) {
+		return packStrings(b, []string{data}), nil
+	}
+
+	tokens, err := tokenize(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, f := range fields {
+		if i >= len(tokens) {
+			if isRemaining(f) {
+				break
+			}
+			return nil, fmt.Errorf("missing record data field")
+		}
+		b, err = packField(b, f, tokens[i:], comp, lower)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// packField appends wire format of the first token, or all tokens for remaining kinds
+func packField(b []byte, f rdField, tokens []string, comp map[string]int, lower bool) ([]byte, error) {
+	token := tokens[0]
+	switch f {
+	case rdCName, rdName:
+		if lower {
+			return packCanonicalName(b, token)
+		}
+		if f == rdName {
+			comp = nil
+		}
+		return packName(b, token, comp)
+	case rdType:
+		t, err := typeCode(Type(token))
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint16(b, t), nil
+	case rdTime:
+		v, err := parseTime(token)
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint32(b, v), nil
+	case rdSalt:
+		if token == "-" {
+			return append(b, 0), nil
+		}
+		v, err := hex.DecodeString(token)
+		if err != nil || len(v) > 255 {
+			return nil, fmt.Errorf("invalid salt: %s", token)
+		}
+		return append(append(b, byte(len(v))), v...), nil
+	case rdHash:
+		v, err := base32Hex.DecodeString(strings.ToUpper(token))
+		if err != nil || len(v) > 255 {
+			return nil, fmt.Errorf("invalid hash: %s", token)
+		}
+		return append(append(b, byte(len(v))), v...), nil
+	case rdTypeBitmap:
+		return packTypeBitmap(b, tokens)
+	case rdSvcParams:
+		return packSvcParams(b, tokens)
+	case rdUint8, rdUint16, rdUint32:
+		size := map[rdField]int{rdUint8: 8, rdUint16: 16, rdUint32: 32}[f]
+		v, err := strconv.ParseUint(token, 10, size)
+		if err != nil {
+			return nil, err
+		}
+		switch f {
+		case rdUint8:
+			return append(b, byte(v)), nil
+		case rdUint16:
+			return binary.BigEndian.AppendUint16(b, uint16(v)), nil
+		default:
+			return binary.BigEndian.AppendUint32(b, uint32(v)), nil
+		}
+	case rdIPv4, rdIPv6:
+		ip, err := netip.ParseAddr(token)
+		if err != nil {
+			return nil, err
+		}
+		if f == rdIPv4 && !ip.Is4() || f == rdIPv6 && !ip.Is6() {
+			return nil, fmt.Errorf("invalid ip address: %s", token)
+		}
+		return append(b, ip.AsSlice()...), nil
+	case rdString, rdTag:
+		s := unquote(token)
+		if len(s) > 255 {
+			return nil, fmt.Errorf("character string too long")
+		}
+		return append(append(b, byte(len(s))), s...), nil
+	case rdStrings:
+		ss := make([]string, len(tokens))
+		for i, v := range tokens {
+			ss[i] = unquote(v)
+		}
+		return packStrings(b, ss), nil
+	case rdText:
+		return append(b, unquote(strings.Join(tokens, " "))...), nil
+	case rdBase64:
+		v, err := base64.StdEncoding.DecodeString(strings.Join(tokens, ""))
+		if err != nil {
+			return nil, err
+		}
+		return append(b, v...), nil
+	default:
+		v, err := hex.DecodeString(strings.Join(tokens, ""))
+		if err != nil {
+			return nil, err
+		}
+		return append(b, v...), nil
+	}
+}
+
+// packTypeBitmap appends type bitmap of type mnemonics, see RFC 4034 section 4.1.2
+func packTypeBitmap(b []byte, tokens []string) ([]byte, error) {
+	windows := [256][]byte{}
+	for _, v := range tokens {
+		t, err := typeCode(Type(v))
+		if err != nil {
+			return nil, err
+		}
+		w, n := t>>8, int(t&0xff)/8
+		if len(windows[w]) <= n {
+			windows[w] = append(windows[w], make([]byte, n+1-len(windows[w]))...)
+		}
+		windows[w][n] |= 0x80 >> (t & 0x7)
+	}
+
+	for i, v := range windows {
+		if len(v) > 0 {
+			b = append(append(b, byte(i), byte(len(v))), v...)
+		}
+	}
+
+	return b, nil
+}
+
+// unpackTypeBitmap returns type mnemonics of type bitmap
+func unpackTypeBitmap(b []byte) (string, error) {
+	ss := []string{}
+	for len(b) > 0 {
+		if len(b) < 2 || b[1] == 0 || b[1] > 32 || len(b) < 2+int(b[1]) {
+			return "", fmt.Errorf("dns: invalid type bitmap")
+		}
+		for i, v := range b[2 : 2+int(b[1])] {
+			for j := 0; j < 8; j++ {
+				if v&(0x80>>j) != 0 {
+					ss = append(ss, string(TypeFromCode(int(b[0])<<8|(i*8+j))))
+				}
+			}
+		}
+		b = b[2+int(b[1]):]
+	}
+
+	return strings.Join(ss, " "), nil
+}
+
+// packSvcParams appends service parameters of key=value tokens in key order, see RFC 9460 section 2.2
+func packSvcParams(b []byte, tokens []string) ([]byte, error) {
+	params := map[uint16][]byte{}
+	keys := []uint16{}
+	for _, v := range tokens {
+		name, value, _ := strings.Cut(v, "=")
+		key, err := svcParamKey(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := params[key]; ok {
+			return nil, fmt.Errorf("duplicate service parameter: %s", name)
+		}
+		data, err := packSvcParam(key, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid service parameter %s: %w", name, err)
+		}
+		params[key] = data
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	for _, k := range keys {
+		b = binary.BigEndian.AppendUint16(b, k)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(params[k])))
+		b = append(b, params[k]...)
+	}
+
+	return b, nil
+}
+
+// packSvcParam returns wire format of service parameter value
+func packSvcParam(key uint16, value string) ([]byte, error) {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+
+	b := []byte{}
+	switch key {
+	case 0:
+		for _, v := range strings.Split(value, ",") {
+			k, err := svcParamKey(v)
+			if err != nil {
+				return nil, err
+			}
+			b = binary.BigEndian.AppendUint16(b, k)
+		}
+	case 1:
+		for _, v := range splitList(value) {
+			s := unquote(v)
+			if s == "" || len(s) > 255 {
+				return nil, fmt.Errorf("invalid alpn: %s", v)
+			}
+			b = append(append(b, byte(len(s))), s...)
+		}
+	case 2:
+		if value != "" {
+			return nil, fmt.Errorf("unexpected value")
+		}
+	case 3:
+		v, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(v))
+	case 4, 6:
+		for _, v := range strings.Split(value, ",") {
+			ip, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, err
+			}
+			if key == 4 && !ip.Is4() || key == 6 && !ip.Is6() {
+				return nil, fmt.Errorf("invalid ip address: %s", v)
+			}
+			b = append(b, ip.AsSlice()...)
+		}
+	case 5:
+		v, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, v...)
+	default:
+		b = append(b, unquote(value)...)
+	}
+
+	return b, nil
+}
+
+// unpackSvcParams returns presentation format of service parameters
+func unpackSvcParams(b []byte) (string, error) {
+	ss := []string{}
+	for len(b) > 0 {
+		if len(b) < 4 || len(b) < 4+int(binary.BigEndian.Uint16(b[2:])) {
+			return "", fmt.Errorf("dns: invalid service parameters")
+		}
+		key := binary.BigEndian.Uint16(b)
+		n := 4 + int(binary.BigEndian.Uint16(b[2:]))
+		s, err := unpackSvcParam(key, b[4:n])
+		if err != nil {
+			return "", err
+		}
+		ss = append(ss, s)
+		b = b[n:]
+	}
+
+	return strings.Join(ss, " "), nil
+}
+
+// unpackSvcParam returns presentation format of service parameter
+func unpackSvcParam(key uint16, b []byte) (string, error) {
+	name := svcParamName(key)
+	vs := []string{}
+	switch key {
+	case 0:
+		if len(b)%2 != 0 {
+			return "", fmt.Errorf("dns: invalid service parameter %s", name)
+		}
+		for i := 0; i < len(b); i += 2 {
+			vs = append(vs, svcParamName(binary.BigEndian.Uint16(b[i:])))
+		}
+		return name + "=" + strings.Join(vs, ","), nil
+	case 1:
+		for i := 0; i < len(b); {
+			n := i + 1 + int(b[i])
+			if n > len(b) {
+				return "", fmt.Errorf("dns: invalid service parameter %s", name)
+			}
+			vs = append(vs, strings.ReplaceAll(escape(string(b[i+1:n]), false), ",", `\,`))
+			i = n
+		}
+		return name + `="` + strings.Join(vs, ",") + `"`, nil
+	case 2:
+		return name, nil
+	case 3:
+		if len(b) != 2 {
+			return "", fmt.Errorf("dns: invalid service parameter %s", name)
+		}
+		return name + "=" + strconv.Itoa(int(binary.BigEndian.Uint16(b))), nil
+	case 4, 6:
+		size := 4
+		if key == 6 {
+			size = 16
+		}
+		if len(b) == 0 || len(b)%size != 0 {
+			return "", fmt.Errorf("dns: invalid service parameter %s", name)
+		}
+		for i := 0; i < len(b); i += size {
+			ip, _ := netip.AddrFromSlice(b[i : i+size])
+			vs = append(vs, ip.String())
+		}
+		return name + "=" + strings.Join(vs, ","), nil
+	case 5:
+		return name + "=" + base64.StdEncoding.EncodeToString(b), nil
+	default:
+		if len(b) == 0 {
+			return name, nil
+		}
+		return name + "=" + quote(string(b)), nil
+	}
+}
+
+// svcParamKey returns the service parameter key of name, keyNNNNN is supported
+func svcParamKey(name string) (uint16, error) {
+	for i, v := range svcParamKeys {
+		if v == name {
+			return uint16(i), nil
+		}
+	}
+
+	if strings.HasPrefix(name, "key") {
+		v, err := strconv.ParseUint(name[3:], 10, 16)
+		if err == nil {
+			return uint16(v), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown service parameter: %s", name)
+}
+
+// svcParamName returns the service parameter name of key
+func svcParamName(key uint16) string {
+	if int(key) < len(svcParamKeys) {
+		return svcParamKeys[key]
+	}
+
+	return "key" + strconv.Itoa(int(key))
+}
+
+// splitList splits comma separated list, the escaped comma is not a separator
+func splitList(s string) []string {
+	r := []string{}
+	i := 0
+	for j := 0; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case ',':
+			r = append(r, s[i:j])
+			i = j + 1
+		}
+	}
+
+	return append(r, s[i:])
+}
+
+// parseTime parses timestamp in YYYYMMDDHHmmSS or seconds since epoch
+func parseTime(s string) (uint32, error) {
+	if len(s) == len(timeLayout) {
+		v, err := time.Parse(timeLayout, s)
+		if err != nil {
+			return 0, err
+		}
+		return uint32(v.Unix()), nil
+	}
+
+	v, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint32(v), nil
+}
+
+// packStrings appends character strings, long string is split into 255 bytes chunks
+func packStrings(b []byte, ss []string) []byte {
+	for _, s := range ss {
+		for {
+			n := len(s)
+			if n > 255 {
+				n = 255
+			}
+			b = append(append(b, byte(n)), s[:n]...)
+			s = s[n:]
+			if s == "" {
+				break
+			}
+		}
+	}
+
+	return b
+}
+
+// packUnknownRData appends record data in RFC 3597 \# format
+func packUnknownRData(b []byte, data string) ([]byte, error) {
+	fields := strings.Fields(data)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("invalid \\# record data")
+	}
+
+	size, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := hex.DecodeString(strings.Join(fields[2:], ""))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(v) != size {
+		return nil, fmt.Errorf("invalid \\# record data length")
+	}
+
+	return append(b, v...), nil
+}
+
+// unpackRData returns presentation format of record data in b[off:end]
+func unpackRData(b []byte, off, end int, t uint16) (string, error) {
+	fields, ok := rdataFields[t]
+	if !ok {
+		return unpackUnknownRData(b[off:end]), nil
+	}
+
+	ss := []string{}
+	for _, f := range fields {
+		if off >= end && isRemaining(f) {
+			break
+		}
+		s, n, err := unpackField(b, off, end, f)
+		if err != nil {
+			return "", err
+		}
+		ss = append(ss, s)
+		off = n
+	}
+
+	if off != end {
+		return "", fmt.Errorf("dns: invalid record data length of type %d", t)
+	}
+
+	return strings.Join(ss, " "), nil
+}
+
+// unpackField returns presentation format of field at off and next offset
+func unpackField(b []byte, off, end int, f rdField) (string, int, error) {
+	size := map[rdField]int{
+		rdUint8: 1, rdUint16: 2, rdUint32: 4, rdIPv4: 4, rdIPv6: 16,
+		rdType: 2, rdTime: 4, rdSalt: 1, rdHash: 1,
+	}[f]
+	if off+size > end {
+		return "", 0, fmt.Errorf("dns: record data too short")
+	}
+
+	switch f {
+	case rdType:
+		return string(TypeFromCode(int(binary.BigEndian.Uint16(b[off:])))), off + 2, nil
+	case rdTime:
+		v := time.Unix(int64(binary.BigEndian.Uint32(b[off:])), 0).UTC()
+		return v.Format(timeLayout), off + 4, nil
+	case rdSalt, rdHash:
+		n := off + 1 + int(b[off])
+		if n > end {
+			return "", 0, fmt.Errorf("dns: record data too short")
+		}
+		if f == rdHash {
+			return base32Hex.EncodeToString(b[off+1 : n]), n, nil
+		}
+		if n == off+1 {
+			return "-", n, nil
+		}
+		return strings.ToUpper(hex.EncodeToString(b[off+1 : n])), n, nil
+	case rdTypeBitmap:
+		s, err := unpackTypeBitmap(b[off:end])
+		return s, end, err
+	case rdSvcParams:
+		s, err := unpackSvcParams(b[off:end])
+		return s, end, err
+	case rdCName, rdName:
+		name, n, err := unpackName(b[:end], off)
+		return name, n, err
+	case rdUint8:
+		return strconv.Itoa(int(b[off])), off + 1, nil
+	case rdUint16:
+		return strconv.Itoa(int(binary.BigEndian.Uint16(b[off:]))), off + 2, nil
+	case rdUint32:
+		return strconv.FormatUint(uint64(binary.BigEndian.Uint32(b[off:])), 10), off + 4, nil
+	case rdIPv4, rdIPv6:
+		ip, _ := netip.AddrFromSlice(b[off : off+size])
+		return ip.String(), off + size, nil
+	case rdString, rdTag:
+		if off >= end || off+1+int(b[off]) > end {
+			return "", 0, fmt.Errorf("dns: character string too short")
+		}
+		s := string(b[off+1 : off+1+int(b[off])])
+		if f == rdTag {
+			return escape(s, false), off + 1 + len(s), nil
+		}
+		return quote(s), off + 1 + len(s), nil
+	case rdStrings:
+		ss := []string{}
+		for off < end {
+			s, n, err := unpackField(b, off, end, rdString)
+			if err != nil {
+				return "", 0, err
+			}
+			ss = append(ss, s)
+			off = n
+		}
+		return strings.Join(ss, " "), off, nil
+	case rdText:
+		return quote(string(b[off:end])), end, nil
+	case rdBase64:
+		return base64.StdEncoding.EncodeToString(b[off:end]), end, nil
+	default:
+		return strings.ToUpper(hex.EncodeToString(b[off:end])), end, nil
+	}
+}
+
+// unpackUnknownRData returns record data in RFC 3597 \# format
+func unpackUnknownRData(b []byte) string {
+	if len(b) == 0 {
+		return `\# 0`
+	}
+
+	return fmt.Sprintf(`\# %d %s`, len(b), strings.ToUpper(hex.EncodeToString(b)))
+}
+
+// packName appends wire format of domain name, compress it if comp is not nil
+func packName(b []byte, name string, comp map[string]int) ([]byte, error) {
+	labels, err := splitName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range labels {
+		suffix := strings.ToLower(strings.Join(labels[i:], "."))
+		if comp != nil {
+			if ptr, ok := comp[suffix]; ok {
+				return binary.BigEndian.AppendUint16(b, uint16(0xc000|ptr)), nil
+			}
+			if len(b) < 0x3fff {
+				comp[suffix] = len(b)
+			}
+		}
+		b = append(append(b, byte(len(labels[i]))), labels[i]...)
+	}
+
+	return append(b, 0), nil
+}
+
+// packCanonicalName appends lowercase and uncompressed wire format of domain name
+func packCanonicalName(b []byte, name string) ([]byte, error) {
+	labels, err := splitName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range labels {
+		b = append(b, byte(len(v)))
+		for i := 0; i < len(v); i++ {
+			c := v[i]
+			if c >= 'A' && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			b = append(b, c)
+		}
+	}
+
+	return append(b, 0), nil
+}
+
+// splitName returns unescaped labels of presentation format domain name
+func splitName(name string) ([]string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." {
+		return nil, nil
+	}
+
+	labels := []string{}
+	label := []byte{}
+	size := 1
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '\\':
+			v, n, err := unescapeAt(name, i)
+			if err != nil {
+				return nil, err
+			}
+			label = append(label, v)
+			i = n - 1
+		case c == '.':
+			if len(label) == 0 {
+				return nil, fmt.Errorf("dns: empty label in name: %s", name)
+			}
+			labels = append(labels, string(label))
+			size += len(label) + 1
+			label = []byte{}
+		default:
+			label = append(label, c)
+		}
+		if len(label) > 63 {
+			return nil, fmt.Errorf("dns: label too long in name: %s", name)
+		}
+	}
+
+	if len(label) > 0 {
+		labels = append(labels, string(label))
+		size += len(label) + 1
+	}
+
+	if size > 255 {
+		return nil, fmt.Errorf("dns: name too long: %s", name)
+	}
+
+	return labels, nil
+}
+
+// unpackName returns presentation format of domain name at off and next offset
+func unpackName(b []byte, off int) (string, int, error) {
+	labels := []string{}
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(b) {
+			return "", 0, fmt.Errorf("dns: name too short")
+		}
+		c := int(b[off])
+		switch c & 0xc0 {
+		case 0x00:
+			if c == 0 {
+				if next < 0 {
+					next = off + 1
+				}
+				return strings.Join(labels, ".") + ".", next, nil
+			}
+			if off+1+c > len(b) {
+				return "", 0, fmt.Errorf("dns: label too short")
+			}
+			labels = append(labels, escape(string(b[off+1:off+1+c]), true))
+			off += 1 + c
+		case 0xc0:
+			if off+2 > len(b) {
+				return "", 0, fmt.Errorf("dns: name pointer too short")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			jumps++
+			if jumps > 126 {
+				return "", 0, fmt.Errorf("dns: too many name pointers")
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+		default:
+			return "", 0, fmt.Errorf("dns: invalid label type")
+		}
+	}
+}
+
+// tokenize splits presentation format record data into raw tokens
+func tokenize(s string) ([]string, error) {
+	tokens := []string{}
+	for i := 0; i < len(s); {
+		switch s[i] {
+		case ' ', '\t', '\n', '\r':
+			i++
+			continue
+		}
+		j := i
+		quoted := s[i] == '"'
+		if quoted {
+			j++
+		}
+		// the quoted value of unquoted token, such as alpn="h2,h3" of service parameters
+		inner := false
+		for ; j < len(s); j++ {
+			if s[j] == '\\' {
+				j++
+				continue
+			}
+			if quoted && s[j] == '"' {
+				j++
+				break
+			}
+			if !quoted && s[j] == '"' {
+				inner = !inner
+			}
+			if !quoted && !inner && (s[j] == ' ' || s[j] == '\t' || s[j] == '\n' || s[j] == '\r') {
+				break
+			}
+		}
+		if j > len(s) || quoted && (j-i < 2 || s[j-1] != '"') {
+			return nil, fmt.Errorf("dns: unterminated quoted string")
+		}
+		tokens = append(tokens, s[i:j])
+		i = j
+	}
+
+	return tokens, nil
+}
+
+// unquote returns the unescaped character string of a raw token
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+
+	r := []byte{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			r = append(r, s[i])
+			continue
+		}
+		v, n, err := unescapeAt(s, i)
+		if err != nil {
+			r = append(r, s[i])
+			continue
+		}
+		r = append(r, v)
+		i = n - 1
+	}
+
+	return string(r)
+}
+
+// unescapeAt returns the escaped byte at s[i] and next index, both \X and \DDD are supported
+func unescapeAt(s string, i int) (byte, int, error) {
+	if i+1 >= len(s) {
+		return 0, 0, fmt.Errorf("dns: invalid escape sequence")
+	}
+
+	if s[i+1] < '0' || s[i+1] > '9' {
+		return s[i+1], i + 2, nil
+	}
+
+	if i+4 > len(s) {
+		return 0, 0, fmt.Errorf("dns: invalid escape sequence")
+	}
+
+	v, err := strconv.ParseUint(s[i+1:i+4], 10, 8)
+	if err != nil {
+		return 0, 0, fmt.Errorf("dns: invalid escape sequence")
+	}
+
+	return byte(v), i + 4, nil
+}
+
+// quote returns the quoted presentation format of character string
+func quote(s string) string {
+	return `"` + escape(s, false) + `"`
+}
+
+// escape returns the escaped string, escape all special chars of label if label is true
+func escape(s string, label bool) string {
+	r := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			r.WriteByte('\\')
+			r.WriteByte(c)
+		case label && strings.IndexByte(".()@$; ", c) >= 0:
+			r.WriteByte('\\')
+			r.WriteByte(c)
+		case c < ' ' || c > '~':
+			r.WriteString(fmt.Sprintf("\\%03d", c))
+		default:
+			r.WriteByte(c)
+		}
+	}
+
+	return r.String()
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package dns
+
+import (
+	"testing"
+
+	"github.com/likexian/gokit/assert"
+)
+
+func TestRData(t *testing.T) {
+	b, err := Answer{Type: 15, Data: "10 MX.Likexian.com."}.RData()
+	assert.Nil(t, err)
+	assert.Equal(t, b, append([]byte{0, 10, 2, 'M', 'X', 8}, []byte("Likexian\x03com\x00")...))
+
+	b, err = Answer{Type: 15, Data: "10 MX.Likexian.com."}.CanonicalRData()
+	assert.Nil(t, err)
+	assert.Equal(t, b, append([]byte{0, 10, 2, 'm', 'x', 8}, []byte("likexian\x03com\x00")...))
+
+	// the next domain name of NSEC is not lowercased, see RFC 6840 section 5.1
+	b, err = Answer{Type: 47, Data: "A.likexian.com. A"}.CanonicalRData()
+	assert.Nil(t, err)
+	assert.Equal(t, b, append([]byte("\x01A\x08likexian\x03com\x00"), 0, 1, 0x40))
+
+	b, err = Answer{Type: 46, Data: "A 13 2 600 1704067200 20231201000000 12345 Likexian.COM. AQID"}.CanonicalRData()
+	assert.Nil(t, err)
+	assert.Equal(t, b[8:12], []byte{0x65, 0x92, 0x00, 0x80})
+	assert.Equal(t, b[12:16], []byte{0x65, 0x69, 0x22, 0x00})
+	assert.Equal(t, b[18:], []byte("\x08likexian\x03com\x00\x01\x02\x03"))
+
+	_, err = Answer{Type: 46, Data: "A 13 2 600 2024 20231201000000 12345 likexian.com. AQID"}.RData()
+	assert.Nil(t, err)
+
+	_, err = Answer{Type: 46, Data: "NONE 13 2 600 20240101000000 20231201000000 12345 likexian.com. AQID"}.RData()
+	assert.NotNil(t, err)
+
+	_, err = Answer{Type: 50, Data: "1 0 0 XYZ 2T7B4G4VSA5SMI47K61MV5BV1A22BOJR"}.RData()
+	assert.NotNil(t, err)
+
+	_, err = Answer{Type: 50, Data: "1 0 0 - 2T7B4G4VSA5SMI47K61MV5BV1A22BOJ!"}.RData()
+	assert.NotNil(t, err)
+
+	// the service parameters are sorted by key, see RFC 9460 section 2.2
+	b, err = Answer{Type: 65, Data: `1 . port=443 mandatory=port alpn=h2,h3`}.RData()
+	assert.Nil(t, err)
+	assert.Equal(t, b, []byte{0, 1, 0, 0, 0, 0, 2, 0, 3, 0, 1, 0, 6, 2, 'h', '2', 2, 'h', '3', 0, 3, 0, 2, 1, 187})
+
+	rsp := &Msg{Answer: []Answer{{Name: "likexian.com.", Type: 65, TTL: 60, Data: "1 . port=443 mandatory=port alpn=h2,h3"}}}
+	data, err := rsp.Pack()
+	assert.Nil(t, err)
+	m := &Msg{}
+	assert.Nil(t, m.Unpack(data))
+	assert.Equal(t, m.Answer[0].Data, `1 . mandatory=port alpn="h2,h3" port=443`)
+
+	for _, v := range []string{
+		"1 . port=443 port=8443",
+		"1 . unknown=1",
+		"1 . port=abc",
+		"1 . ipv4hint=2001:db8::1",
+		"1 . no-default-alpn=1",
+		"1 . ech=!!!",
+	} {
+		_, err = Answer{Type: 65, Data: v}.RData()
+		assert.NotNil(t, err, v)
+	}
+
+	b, err = CanonicalName("WWW.Likexian.com")
+	assert.Nil(t, err)
+	assert.Equal(t, b, []byte("\x03www\x08likexian\x03com\x00"))
+
+	b, err = CanonicalName(".")
+	assert.Nil(t, err)
+	assert.Equal(t, b, []byte{0})
+}
@@ -0,0 +1,234 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// MX is the MX record data
+type MX struct {
+	Preference uint16
+	Host       string
+}
+
+// SOA is the SOA record data
+type SOA struct {
+	NS      string
+	Mbox    string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	MinTTL  uint32
+}
+
+// SRV is the SRV record data
+type SRV struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+// CAA is the CAA record data
+type CAA struct {
+	Flag  uint8
+	Tag   string
+	Value string
+}
+
+// ErrTypeMismatch is the error of accessing record data of another type
+var ErrTypeMismatch = errors.New("dns: record type mismatch")
+
+// A returns the address of A record
+func (a Answer) A() (netip.Addr, error) {
+	b, err := a.rdata(1)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	if len(b) != 4 {
+		return netip.Addr{}, fmt.Errorf("dns: invalid A record: %s", a.Data)
+	}
+
+	return netip.AddrFrom4([4]byte(b)), nil
+}
+
+// AAAA returns the address of AAAA record
+func (a Answer) AAAA() (netip.Addr, error) {
+	b, err := a.rdata(28)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	if len(b) != 16 {
+		return netip.Addr{}, fmt.Errorf("dns: invalid AAAA record: %s", a.Data)
+	}
+
+	return netip.AddrFrom16([16]byte(b)), nil
+}
+
+// MX returns the data of MX record
+func (a Answer) MX() (*MX, error) {
+	b, err := a.rdata(15)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < 3 {
+		return nil, fmt.Errorf("dns: invalid MX record: %s", a.Data)
+	}
+
+	host, _, err := unpackName(b, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MX{
+		Preference: binary.BigEndian.Uint16(b),
+		Host:       host,
+	}, nil
+}
+
+// SOA returns the data of SOA record
+func (a Answer) SOA() (*SOA, error) {
+	b, err := a.rdata(6)
+	if err != nil {
+		return nil, err
+	}
+
+	ns, off, err := unpackName(b, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	mbox, off, err := unpackName(b, off)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) != off+20 {
+		return nil, fmt.Errorf("dns: invalid SOA record: %s", a.Data)
+	}
+
+	return &SOA{
+		NS:      ns,
+		Mbox:    mbox,
+		Serial:  binary.BigEndian.Uint32(b[off:]),
+		Refresh: binary.BigEndian.Uint32(b[off+4:]),
+		Retry:   binary.BigEndian.Uint32(b[off+8:]),
+		Expire:  binary.BigEndian.Uint32(b[off+12:]),
+		MinTTL:  binary.BigEndian.Uint32(b[off+16:]),
+	}, nil
+}
+
+// SRV returns the data of SRV record
+func (a Answer) SRV() (*SRV, error) {
+	b, err := a.rdata(33)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < 7 {
+		return nil, fmt.Errorf("dns: invalid SRV record: %s", a.Data)
+	}
+
+	target, _, err := unpackName(b, 6)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SRV{
+		Priority: binary.BigEndian.Uint16(b),
+		Weight:   binary.BigEndian.Uint16(b[2:]),
+		Port:     binary.BigEndian.Uint16(b[4:]),
+		Target:   target,
+	}, nil
+}
+
+// CAA returns the data of CAA record, the value is unquoted
+func (a Answer) CAA() (*CAA, error) {
+	b, err := a.rdata(257)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < 2 || len(b) < 2+int(b[1]) {
+		return nil, fmt.Errorf("dns: invalid CAA record: %s", a.Data)
+	}
+
+	return &CAA{
+		Flag:  b[0],
+		Tag:   string(b[2 : 2+b[1]]),
+		Value: string(b[2+b[1]:]),
+	}, nil
+}
+
+// TXT returns the strings of TXT or SPF record, the quotes and escapes are resolved
+func (a Answer) TXT() ([]string, error) {
+	t := 16
+	if a.Type == 99 {
+		t = 99
+	}
+
+	b, err := a.rdata(t)
+	if err != nil {
+		return nil, err
+	}
+
+	ss := []string{}
+	for len(b) > 0 {
+		if len(b) < 1+int(b[0]) {
+			return nil, fmt.Errorf("dns: invalid TXT record: %s", a.Data)
+		}
+		ss = append(ss, string(b[1:1+b[0]]))
+		b = b[1+b[0]:]
+	}
+
+	return ss, nil
+}
+
+// rdata returns wire format of record data if the record is type t
+func (a Answer) rdata(t int) ([]byte, error) {
+	if a.Type != t {
+		return nil, fmt.Errorf("%w: %s is not %s", ErrTypeMismatch, TypeFromCode(a.Type), TypeFromCode(t))
+	}
+
+	b, err := a.RData()
+	if err != nil {
+		return nil, fmt.Errorf("dns: invalid %s record: %w", TypeFromCode(t), err)
+	}
+
+	return b, nil
+}
+
+// String returns the question in presentation format, for example: likexian.com. IN A
+func (q Question) String() string {
+	return fmt.Sprintf("%s IN %s", q.Name, TypeFromCode(q.Type))
+}
+
+// String returns the answer in presentation format, for example: likexian.com. 300 IN A 1.2.3.4
+func (a Answer) String() string {
+	return fmt.Sprintf("%s %d IN %s %s", a.Name, a.TTL, TypeFromCode(a.Type), a.Data)
+}
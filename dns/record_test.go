@@ -0,0 +1,99 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package dns
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/likexian/gokit/assert"
+)
+
+func TestRecord(t *testing.T) {
+	ip, err := Answer{Type: 1, Data: "1.2.3.4"}.A()
+	assert.Nil(t, err)
+	assert.Equal(t, ip, netip.MustParseAddr("1.2.3.4"))
+
+	ip, err = Answer{Type: 28, Data: "2001:db8::1"}.AAAA()
+	assert.Nil(t, err)
+	assert.Equal(t, ip, netip.MustParseAddr("2001:db8::1"))
+
+	mx, err := Answer{Type: 15, Data: "10 mx.likexian.com."}.MX()
+	assert.Nil(t, err)
+	assert.Equal(t, *mx, MX{Preference: 10, Host: "mx.likexian.com."})
+
+	soa, err := Answer{Type: 6, Data: "ns1.likexian.com. admin.likexian.com. 2024010101 7200 3600 1209600 300"}.SOA()
+	assert.Nil(t, err)
+	assert.Equal(t, *soa, SOA{
+		NS:      "ns1.likexian.com.",
+		Mbox:    "admin.likexian.com.",
+		Serial:  2024010101,
+		Refresh: 7200,
+		Retry:   3600,
+		Expire:  1209600,
+		MinTTL:  300,
+	})
+
+	srv, err := Answer{Type: 33, Data: "10 60 5060 sip.likexian.com."}.SRV()
+	assert.Nil(t, err)
+	assert.Equal(t, *srv, SRV{Priority: 10, Weight: 60, Port: 5060, Target: "sip.likexian.com."})
+
+	caa, err := Answer{Type: 257, Data: `0 issue "letsencrypt.org"`}.CAA()
+	assert.Nil(t, err)
+	assert.Equal(t, *caa, CAA{Flag: 0, Tag: "issue", Value: "letsencrypt.org"})
+
+	txt, err := Answer{Type: 16, Data: `"v=spf1 -all" "say \"hi\"\059\255"`}.TXT()
+	assert.Nil(t, err)
+	assert.Equal(t, txt, []string{"v=spf1 -all", "say \"hi\";\xff"})
+
+	txt, err = Answer{Type: 99, Data: `"v=spf1 -all"`}.TXT()
+	assert.Nil(t, err)
+	assert.Equal(t, txt, []string{"v=spf1 -all"})
+
+	_, err = Answer{Type: 28, Data: "2001:db8::1"}.A()
+	assert.True(t, errors.Is(err, ErrTypeMismatch))
+	assert.Equal(t, err.Error(), "dns: record type mismatch: AAAA is not A")
+
+	_, err = Answer{Type: 1, Data: "1.2.3.4"}.AAAA()
+	assert.True(t, errors.Is(err, ErrTypeMismatch))
+
+	_, err = Answer{Type: 1, Data: "1.2.3.4"}.MX()
+	assert.True(t, errors.Is(err, ErrTypeMismatch))
+
+	_, err = Answer{Type: 15, Data: "10 mx.likexian.com."}.SOA()
+	assert.True(t, errors.Is(err, ErrTypeMismatch))
+
+	_, err = Answer{Type: 1, Data: "1.2.3.4"}.SRV()
+	assert.True(t, errors.Is(err, ErrTypeMismatch))
+
+	_, err = Answer{Type: 16, Data: `"issue"`}.CAA()
+	assert.True(t, errors.Is(err, ErrTypeMismatch))
+
+	_, err = Answer{Type: 257, Data: `0 issue "letsencrypt.org"`}.TXT()
+	assert.True(t, errors.Is(err, ErrTypeMismatch))
+
+	_, err = Answer{Type: 1, Data: "1.2.3"}.A()
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, ErrTypeMismatch))
+
+	_, err = Answer{Type: 15, Data: "mx.likexian.com."}.MX()
+	assert.NotNil(t, err)
+}
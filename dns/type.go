@@ -0,0 +1,183 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package dns
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// typeCodes is dns query type to code map
+var typeCodes = map[Type]uint16{
+	TypeA:          1,
+	TypeNS:         2,
+	TypeMD:         3,
+	TypeMF:         4,
+	TypeCNAME:      5,
+	TypeSOA:        6,
+	TypeMB:         7,
+	TypeMG:         8,
+	TypeMR:         9,
+	TypeNULL:       10,
+	TypeWKS:        11,
+	TypePTR:        12,
+	TypeHINFO:      13,
+	TypeMINFO:      14,
+	TypeMX:         15,
+	TypeTXT:        16,
+	TypeRP:         17,
+	TypeAFSDB:      18,
+	TypeX25:        19,
+	TypeISDN:       20,
+	TypeRT:         21,
+	TypeNSAP:       22,
+	TypeNSAPPTR:    23,
+	TypeSIG:        24,
+	TypeKEY:        25,
+	TypePX:         26,
+	TypeGPOS:       27,
+	TypeAAAA:       28,
+	TypeLOC:        29,
+	TypeNXT:        30,
+	TypeEID:        31,
+	TypeNIMLOC:     32,
+	TypeSRV:        33,
+	TypeATMA:       34,
+	TypeNAPTR:      35,
+	TypeKX:         36,
+	TypeCERT:       37,
+	TypeA6:         38,
+	TypeDNAME:      39,
+	TypeSINK:       40,
+	TypeOPT:        41,
+	TypeAPL:        42,
+	TypeDS:         43,
+	TypeSSHFP:      44,
+	TypeIPSECKEY:   45,
+	TypeRRSIG:      46,
+	TypeNSEC:       47,
+	TypeDNSKEY:     48,
+	TypeDHCID:      49,
+	TypeNSEC3:      50,
+	TypeNSEC3PARAM: 51,
+	TypeTLSA:       52,
+	TypeSMIMEA:     53,
+	TypeHIP:        55,
+	TypeNINFO:      56,
+	TypeRKEY:       57,
+	TypeTALINK:     58,
+	TypeCDS:        59,
+	TypeCDNSKEY:    60,
+	TypeOPENPGPKEY: 61,
+	TypeCSYNC:      62,
+	TypeZONEMD:     63,
+	TypeSVCB:       64,
+	TypeHTTPS:      65,
+	TypeDSYNC:      66,
+	TypeSPF:        99,
+	TypeUINFO:      100,
+	TypeUID:        101,
+	TypeGID:        102,
+	TypeUNSPEC:     103,
+	TypeNID:        104,
+	TypeL32:        105,
+	TypeL64:        106,
+	TypeLP:         107,
+	TypeEUI48:      108,
+	TypeEUI64:      109,
+	TypeNXNAME:     128,
+	TypeTKEY:       249,
+	TypeTSIG:       250,
+	TypeIXFR:       251,
+	TypeAXFR:       252,
+	TypeMAILB:      253,
+	TypeMAILA:      254,
+	TypeANY:        255,
+	TypeURI:        256,
+	TypeCAA:        257,
+	TypeAVC:        258,
+	TypeDOA:        259,
+	TypeAMTRELAY:   260,
+	TypeRESINFO:    261,
+	TypeWALLET:     262,
+	TypeCLA:        263,
+	TypeIPN:        264,
+	TypeTA:         32768,
+	TypeDLV:        32769,
+}
+
+// typeNames is dns query code to type map
+var typeNames = func() map[uint16]Type {
+	names := map[uint16]Type{}
+	for k, v := range typeCodes {
+		names[v] = k
+	}
+	return names
+}()
+
+// TypeFromCode returns the dns query type of code, TYPEnnn if unknown, see RFC 3597
+func TypeFromCode(code int) Type {
+	if name, ok := typeNames[uint16(code)]; code >= 0 && code <= 0xffff && ok {
+		return name
+	}
+
+	return Type(fmt.Sprintf("TYPE%d", code))
+}
+
+// Code returns the code of dns query type, the name is case insensitive,
+// the RFC 3597 TYPEnnn and the plain number are also supported
+func (t Type) Code() (int, error) {
+	code, err := typeCode(t)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(code), nil
+}
+
+// String returns the mnemonic of dns query type, for example: 28 to AAAA
+func (t Type) String() string {
+	code, err := typeCode(t)
+	if err != nil {
+		return string(t)
+	}
+
+	return string(TypeFromCode(int(code)))
+}
+
+// typeCode returns the code of dns query type
+func typeCode(t Type) (uint16, error) {
+	name := Type(strings.ToUpper(strings.TrimSpace(string(t))))
+	if code, ok := typeCodes[name]; ok {
+		return code, nil
+	}
+
+	if name == "*" {
+		return typeCodes[TypeANY], nil
+	}
+
+	code, err := strconv.ParseUint(strings.TrimPrefix(string(name), "TYPE"), 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("dns: unknown query type: %s", string(t))
+	}
+
+	return uint16(code), nil
+}
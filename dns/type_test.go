@@ -0,0 +1,85 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package dns
+
+import (
+	"testing"
+
+	"github.com/likexian/gokit/assert"
+)
+
+func TestType(t *testing.T) {
+	tests := map[Type]int{
+		TypeA:         1,
+		TypeNSAPPTR:   23,
+		TypeSRV:       33,
+		TypeNAPTR:     35,
+		TypeDS:        43,
+		TypeSSHFP:     44,
+		TypeRRSIG:     46,
+		TypeDNSKEY:    48,
+		TypeTLSA:      52,
+		TypeSVCB:      64,
+		TypeHTTPS:     65,
+		TypeANY:       255,
+		TypeURI:       256,
+		TypeCAA:       257,
+		TypeDLV:       32769,
+		"aaaa":        28,
+		" mx ":        15,
+		"nsap-ptr":    23,
+		"*":           255,
+		"TYPE65534":   65534,
+		"type1":       1,
+		"99":          99,
+		Type("TYPE0"): 0,
+		Type("65535"): 65535,
+	}
+
+	for k, v := range tests {
+		code, err := k.Code()
+		assert.Nil(t, err, k)
+		assert.Equal(t, code, v, k)
+	}
+
+	for _, v := range []Type{"", "NONE", "TYPE", "TYPE65536", "-1"} {
+		_, err := v.Code()
+		assert.NotNil(t, err, v)
+	}
+
+	assert.Equal(t, TypeFromCode(1), TypeA)
+	assert.Equal(t, TypeFromCode(23), TypeNSAPPTR)
+	assert.Equal(t, TypeFromCode(65), TypeHTTPS)
+	assert.Equal(t, TypeFromCode(65534), Type("TYPE65534"))
+	assert.Equal(t, TypeFromCode(65536), Type("TYPE65536"))
+	assert.Equal(t, TypeFromCode(-1), Type("TYPE-1"))
+
+	assert.Equal(t, Type("aaaa").String(), "AAAA")
+	assert.Equal(t, Type("28").String(), "AAAA")
+	assert.Equal(t, Type("TYPE257").String(), "CAA")
+	assert.Equal(t, Type("type65534").String(), "TYPE65534")
+	assert.Equal(t, Type("NONE").String(), "NONE")
+
+	assert.Equal(t, Question{Name: "likexian.com.", Type: 28}.String(), "likexian.com. IN AAAA")
+	assert.Equal(t, Answer{Name: "likexian.com.", Type: 1, TTL: 300, Data: "1.2.3.4"}.String(),
+		"likexian.com. 300 IN A 1.2.3.4")
+	assert.Equal(t, Answer{Name: "likexian.com.", Type: 65534, TTL: 300, Data: `\# 1 00`}.String(),
+		`likexian.com. 300 IN TYPE65534 \# 1 00`)
+}
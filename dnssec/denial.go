@@ -0,0 +1,433 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package dnssec
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/likexian/doh/dns"
+)
+
+// nsec is the parsed NSEC record, see RFC 4034 section 4
+type nsec struct {
+	name  string
+	next  string
+	types map[int]bool
+}
+
+// nsec3 is the parsed NSEC3 record, see RFC 5155 section 3
+type nsec3 struct {
+	zone       string
+	hash       []byte
+	next       []byte
+	algorithm  uint8
+	flags      uint8
+	iterations uint16
+	salt       []byte
+	types      map[int]bool
+}
+
+const (
+	// maxIterations is the max NSEC3 iterations, the proof with more iterations is treated as insecure
+	maxIterations = 150
+	// nsec3SHA1 is the NSEC3 SHA1 hash algorithm
+	nsec3SHA1 = 1
+)
+
+// base32Hex is the base32 extended hex encoding without padding
+var base32Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// verifyDenial returns the validation result of NXDOMAIN or NODATA response of name and type
+func (v *Validator) verifyDenial(ctx context.Context, rsp *dns.Response, name string, qtype int) (Result, error) {
+	nsecs, nsec3s, r, err := v.denialRecords(ctx, rsp, name)
+	if r != Secure {
+		return r, err
+	}
+
+	nxdomain := rsp.Status == int(dns.RCodeNXDomain)
+	if len(nsecs) > 0 {
+		return denyNSEC(nsecs, name, qtype, nxdomain)
+	}
+
+	return denyNSEC3(nsec3s, name, qtype, nxdomain)
+}
+
+// verifyWildcard returns the validation result of the name is not exists, as the answer expanded from wildcard
+func (v *Validator) verifyWildcard(ctx context.Context, rsp *dns.Response, name, wildcard string) (Result, error) {
+	nsecs, nsec3s, r, err := v.denialRecords(ctx, rsp, name)
+	if r != Secure {
+		return r, err
+	}
+
+	for _, n := range nsecs {
+		if n.covers(name) {
+			return Secure, nil
+		}
+	}
+
+	if len(nsec3s) > 0 {
+		if r, err := checkNSEC3(nsec3s); r != Secure {
+			return r, err
+		}
+		labels := splitLabels(name)
+		nc := joinLabels(labels[len(labels)-len(splitLabels(wildcard)):])
+		if cover := coverNSEC3(nsec3s, nc); cover != nil {
+			return Secure, nil
+		}
+	}
+
+	return Bogus, bogus(fmt.Errorf("no proof of %s not exists for wildcard %s", name, wildcard))
+}
+
+// denialRecords returns the validated NSEC and NSEC3 records in authority section
+func (v *Validator) denialRecords(ctx context.Context, rsp *dns.Response, name string) ([]*nsec, []*nsec3, Result, error) {
+	nsecs := []*nsec{}
+	nsec3s := []*nsec3{}
+
+	for _, set := range rrsets(rsp.Authority) {
+		if set.typ != typeSOA && set.typ != typeNSEC && set.typ != typeNSEC3 {
+			continue
+		}
+		r, _, err := v.verify(ctx, set)
+		if r != Secure {
+			return nil, nil, r, err
+		}
+		for _, rr := range set.rrs {
+			switch set.typ {
+			case typeNSEC:
+				n, err := parseNSEC(rr)
+				if err != nil {
+					return nil, nil, Bogus, bogus(err)
+				}
+				nsecs = append(nsecs, n)
+			case typeNSEC3:
+				n, err := parseNSEC3(rr)
+				if err != nil {
+					return nil, nil, Bogus, bogus(err)
+				}
+				nsec3s = append(nsec3s, n)
+			}
+		}
+	}
+
+	if len(nsecs) == 0 && len(nsec3s) == 0 {
+		r, err := v.verifyUnsigned(ctx, name)
+		if r == Bogus {
+			err = bogus(fmt.Errorf("missing denial proof of %s", name))
+		}
+		return nil, nil, r, err
+	}
+
+	return nsecs, nsec3s, Secure, nil
+}
+
+// denyNSEC returns the validation result of NSEC denial proof, see RFC 4035 section 5.4
+func denyNSEC(nsecs []*nsec, name string, qtype int, nxdomain bool) (Result, error) {
+	if !nxdomain {
+		for _, n := range nsecs {
+			if n.name == name {
+				if n.types[qtype] || n.types[typeCNAME] || (qtype == typeDS && n.types[typeSOA]) {
+					return Bogus, bogus(fmt.Errorf("NSEC proves type %d of %s exists", qtype, name))
+				}
+				return Secure, nil
+			}
+		}
+	}
+
+	var cover *nsec
+	for _, n := range nsecs {
+		if n.covers(name) {
+			cover = n
+			break
+		}
+	}
+
+	if cover == nil {
+		return Bogus, bogus(fmt.Errorf("no NSEC covers %s", name))
+	}
+
+	// empty non-terminal name exists without any records
+	if isSubdomain(cover.next, name) {
+		if nxdomain {
+			return Bogus, bogus(fmt.Errorf("NSEC proves %s exists", name))
+		}
+		return Secure, nil
+	}
+
+	ce := commonAncestor(name, cover.name)
+	if next := commonAncestor(name, cover.next); len(next) > len(ce) {
+		ce = next
+	}
+
+	wildcard := "*." + strings.TrimPrefix(ce, ".")
+	for _, n := range nsecs {
+		if nxdomain && n.covers(wildcard) {
+			return Secure, nil
+		}
+		if !nxdomain && n.name == wildcard && !n.types[qtype] && !n.types[typeCNAME] {
+			return Secure, nil
+		}
+	}
+
+	return Bogus, bogus(fmt.Errorf("no NSEC proves wildcard %s not exists", wildcard))
+}
+
+// denyNSEC3 returns the validation result of NSEC3 denial proof, see RFC 5155 section 8
+func denyNSEC3(nsec3s []*nsec3, name string, qtype int, nxdomain bool) (Result, error) {
+	if r, err := checkNSEC3(nsec3s); r != Secure {
+		return r, err
+	}
+
+	if m := matchNSEC3(nsec3s, name); m != nil {
+		if nxdomain || m.types[qtype] || m.types[typeCNAME] {
+			return Bogus, bogus(fmt.Errorf("NSEC3 proves %s exists", name))
+		}
+		return Secure, nil
+	}
+
+	// closest encloser proof, see RFC 5155 section 8.3
+	labels := splitLabels(name)
+	ce, nc := "", ""
+	for i := 1; i <= len(labels); i++ {
+		candidate := joinLabels(labels[i:])
+		if matchNSEC3(nsec3s, candidate) != nil {
+			ce, nc = candidate, joinLabels(labels[i-1:])
+			break
+		}
+	}
+
+	if ce == "" {
+		return Bogus, bogus(fmt.Errorf("no NSEC3 proves closest encloser of %s", name))
+	}
+
+	cover := coverNSEC3(nsec3s, nc)
+	if cover == nil {
+		return Bogus, bogus(fmt.Errorf("no NSEC3 covers next closer name %s", nc))
+	}
+
+	// opt-out may be an unsigned delegation, see RFC 5155 section 9.2
+	if cover.flags&0x01 != 0 {
+		return Insecure, nil
+	}
+
+	wildcard := "*." + strings.TrimPrefix(ce, ".")
+	if nxdomain {
+		if coverNSEC3(nsec3s, wildcard) != nil {
+			return Secure, nil
+		}
+	} else if m := matchNSEC3(nsec3s, wildcard); m != nil && !m.types[qtype] && !m.types[typeCNAME] {
+		return Secure, nil
+	}
+
+	return Bogus, bogus(fmt.Errorf("no NSEC3 proves wildcard %s not exists", wildcard))
+}
+
+// checkNSEC3 returns insecure if NSEC3 records use unsupported algorithm or too many iterations
+func checkNSEC3(nsec3s []*nsec3) (Result, error) {
+	for _, n := range nsec3s {
+		if n.algorithm != nsec3SHA1 || n.iterations > maxIterations {
+			return Insecure, nil
+		}
+	}
+
+	return Secure, nil
+}
+
+// matchNSEC3 returns the NSEC3 record matches the name
+func matchNSEC3(nsec3s []*nsec3, name string) *nsec3 {
+	for _, n := range nsec3s {
+		if !isSubdomain(name, n.zone) {
+			continue
+		}
+		h, err := hashName(name, n.salt, n.iterations)
+		if err == nil && bytes.Equal(h, n.hash) {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// coverNSEC3 returns the NSEC3 record covers the name
+func coverNSEC3(nsec3s []*nsec3, name string) *nsec3 {
+	for _, n := range nsec3s {
+		if !isSubdomain(name, n.zone) {
+			continue
+		}
+		h, err := hashName(name, n.salt, n.iterations)
+		if err == nil && covers(bytes.Compare(n.hash, h), bytes.Compare(h, n.next), bytes.Compare(n.next, n.hash)) {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// parseNSEC returns the parsed NSEC record
+func parseNSEC(rr dns.Answer) (*nsec, error) {
+	b, err := rr.RData()
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(rr.Data)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("invalid NSEC record: %s", rr.Data)
+	}
+
+	next, err := dns.CanonicalName(fields[0])
+	if err != nil {
+		return nil, err
+	}
+
+	types, err := parseBitmap(b[len(next):])
+	if err != nil {
+		return nil, err
+	}
+
+	return &nsec{
+		name:  fqdn(rr.Name),
+		next:  fqdn(fields[0]),
+		types: types,
+	}, nil
+}
+
+// covers returns if the name is between the owner and next name in canonical order,
+// the next name of the last NSEC record is the zone apex
+func (n *nsec) covers(name string) bool {
+	if compareNames(n.next, n.name) <= 0 && !isSubdomain(name, n.next) {
+		return false
+	}
+
+	return covers(compareNames(n.name, name), compareNames(name, n.next), compareNames(n.next, n.name))
+}
+
+// parseNSEC3 returns the parsed NSEC3 record
+func parseNSEC3(rr dns.Answer) (*nsec3, error) {
+	b, err := rr.RData()
+	if err != nil {
+		return nil, err
+	}
+
+	labels := splitLabels(rr.Name)
+	if len(labels) == 0 || len(b) < 5 {
+		return nil, fmt.Errorf("invalid NSEC3 record: %s", rr.Data)
+	}
+
+	hash, err := base32Hex.DecodeString(strings.ToUpper(labels[0]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid NSEC3 owner name: %s", rr.Name)
+	}
+
+	n := &nsec3{
+		zone:       joinLabels(labels[1:]),
+		hash:       hash,
+		algorithm:  b[0],
+		flags:      b[1],
+		iterations: binary.BigEndian.Uint16(b[2:]),
+	}
+
+	off := 5 + int(b[4])
+	if len(b) < off+1 || len(b) < off+1+int(b[off]) {
+		return nil, fmt.Errorf("invalid NSEC3 record: %s", rr.Data)
+	}
+
+	n.salt = b[5:off]
+	n.next = b[off+1 : off+1+int(b[off])]
+	n.types, err = parseBitmap(b[off+1+int(b[off]):])
+	if err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// parseBitmap returns the types of type bitmap, see RFC 4034 section 4.1.2
+func parseBitmap(b []byte) (map[int]bool, error) {
+	types := map[int]bool{}
+	for len(b) > 0 {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return nil, fmt.Errorf("invalid type bitmap")
+		}
+		for i, v := range b[2 : 2+int(b[1])] {
+			for j := 0; j < 8; j++ {
+				if v&(0x80>>j) != 0 {
+					types[int(b[0])<<8|i*8+j] = true
+				}
+			}
+		}
+		b = b[2+int(b[1]):]
+	}
+
+	return types, nil
+}
+
+// hashName returns the NSEC3 hash of name, see RFC 5155 section 5
+func hashName(name string, salt []byte, iterations uint16) ([]byte, error) {
+	b, err := dns.CanonicalName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha1.Sum(append(b, salt...))
+	for i := 0; i < int(iterations); i++ {
+		h = sha1.Sum(append(h[:], salt...))
+	}
+
+	return h[:], nil
+}
+
+// covers returns if value is between owner and next, the last record wraps around to the first
+func covers(ownerValue, valueNext, nextOwner int) bool {
+	if nextOwner <= 0 {
+		return ownerValue < 0 || valueNext < 0
+	}
+
+	return ownerValue < 0 && valueNext < 0
+}
+
+// compareNames compares names in canonical order, see RFC 4034 section 6.1
+func compareNames(a, b string) int {
+	la, lb := splitLabels(a), splitLabels(b)
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+
+	return len(la) - len(lb)
+}
+
+// commonAncestor returns the longest common ancestor of names
+func commonAncestor(a, b string) string {
+	la, lb := splitLabels(a), splitLabels(b)
+	n := 0
+	for n < len(la) && n < len(lb) && la[len(la)-1-n] == lb[len(lb)-1-n] {
+		n++
+	}
+
+	return joinLabels(la[len(la)-n:])
+}
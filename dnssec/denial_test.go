@@ -0,0 +1,234 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package dnssec
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/gokit/assert"
+)
+
+var testSalt = []byte{0xaa, 0xbb, 0xcc, 0xdd}
+
+// testNSEC3 returns the NSEC3 chain of names in zone example., see RFC 5155 appendix A
+func testNSEC3(t *testing.T, flags uint8, iterations uint16, names map[string]string) []*nsec3 {
+	type entry struct {
+		hash  []byte
+		types string
+	}
+
+	entries := []entry{}
+	for name, types := range names {
+		h, err := hashName(name, testSalt, iterations)
+		assert.Nil(t, err)
+		entries = append(entries, entry{h, types})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].hash, entries[j].hash) < 0
+	})
+
+	nsec3s := []*nsec3{}
+	for i, e := range entries {
+		next := entries[(i+1)%len(entries)].hash
+		rr := dns.Answer{
+			Name: base32Hex.EncodeToString(e.hash) + ".example.",
+			Type: typeNSEC3,
+			Data: fmt.Sprintf("1 %d %d AABBCCDD %s %s", flags, iterations, base32Hex.EncodeToString(next), e.types),
+		}
+		n, err := parseNSEC3(rr)
+		assert.Nil(t, err)
+		nsec3s = append(nsec3s, n)
+	}
+
+	return nsec3s
+}
+
+func TestHashName(t *testing.T) {
+	tests := map[string]string{
+		"example.":     "0P9MHAVEQVM6T7VBL5LOP2U3T2RP3TOM",
+		"a.example.":   "35MTHGPGCU1QG68FAB165KLNSNK3DPVL",
+		"ns1.example.": "2T7B4G4VSA5SMI47K61MV5BV1A22BOJR",
+		"w.example.":   "K8UDEMVP1J2F7EG6JEBPS17VP3N8I58H",
+		"*.w.example.": "R53BQ7CC2UVMUBFU5OCMM6PERS9TK9EN",
+	}
+
+	for k, v := range tests {
+		h, err := hashName(k, testSalt, 12)
+		assert.Nil(t, err)
+		assert.Equal(t, base32Hex.EncodeToString(h), v, k)
+	}
+}
+
+func TestParseNSEC(t *testing.T) {
+	n, err := parseNSEC(dns.Answer{Name: "Example.", Type: typeNSEC, Data: "a.example. NS SOA RRSIG NSEC DNSKEY TYPE1234"})
+	assert.Nil(t, err)
+	assert.Equal(t, n.name, "example.")
+	assert.Equal(t, n.next, "a.example.")
+	assert.Equal(t, len(n.types), 6)
+	assert.True(t, n.types[1234])
+	assert.False(t, n.types[1])
+
+	_, err = parseNSEC(dns.Answer{Name: "example.", Type: typeNSEC, Data: ""})
+	assert.NotNil(t, err)
+
+	_, err = parseNSEC3(dns.Answer{Name: "!!.example.", Type: typeNSEC3, Data: "1 0 12 AABBCCDD 2T7B4G4VSA5SMI47K61MV5BV1A22BOJR A"})
+	assert.NotNil(t, err)
+
+	n3, err := parseNSEC3(dns.Answer{
+		Name: "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom.example.",
+		Type: typeNSEC3,
+		Data: "1 1 12 aabbccdd 2t7b4g4vsa5smi47k61mv5bv1a22bojr NS SOA MX RRSIG DNSKEY NSEC3PARAM",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, n3.zone, "example.")
+	assert.Equal(t, n3.flags, uint8(1))
+	assert.Equal(t, n3.iterations, uint16(12))
+	assert.Equal(t, n3.salt, testSalt)
+	assert.Equal(t, base32Hex.EncodeToString(n3.next), "2T7B4G4VSA5SMI47K61MV5BV1A22BOJR")
+	assert.True(t, n3.types[51])
+}
+
+func TestCompareNames(t *testing.T) {
+	names := []string{
+		"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.",
+		"zABC.a.EXAMPLE.", "z.example.", "\001.z.example.", "*.z.example.",
+	}
+
+	for i := 1; i < len(names); i++ {
+		assert.True(t, compareNames(fqdn(names[i-1]), fqdn(names[i])) < 0, names[i])
+	}
+
+	assert.Equal(t, compareNames("a.example.", "a.example."), 0)
+	assert.Equal(t, commonAncestor("a.b.example.", "c.b.example."), "b.example.")
+	assert.Equal(t, commonAncestor("a.com.", "b.net."), ".")
+}
+
+func TestDenyNSEC(t *testing.T) {
+	nsecs := []*nsec{}
+	for _, v := range [][]string{
+		{"example.", "a.example.", "NS SOA RRSIG NSEC DNSKEY"},
+		{"a.example.", "c.b.example.", "A RRSIG NSEC"},
+		{"c.b.example.", "d.example.", "NS RRSIG NSEC"},
+		{"d.example.", "example.", "A TXT RRSIG NSEC"},
+	} {
+		n, err := parseNSEC(dns.Answer{Name: v[0], Type: typeNSEC, Data: v[1] + " " + v[2]})
+		assert.Nil(t, err)
+		nsecs = append(nsecs, n)
+	}
+
+	tests := []struct {
+		name     string
+		qtype    int
+		nxdomain bool
+		result   Result
+	}{
+		{"a.example.", 16, false, Secure},
+		{"a.example.", 1, false, Bogus},
+		{"c.b.example.", typeDS, false, Secure},
+		{"example.", typeDS, false, Bogus},
+		{"b.example.", 1, false, Secure},
+		{"b.example.", 1, true, Bogus},
+		{"c.example.", 1, true, Secure},
+		{"z.example.", 1, true, Secure},
+		{"z.example.", 1, false, Bogus},
+		{"a.example.", 1, true, Bogus},
+		{"other.", 1, true, Bogus},
+	}
+
+	for _, v := range tests {
+		r, err := denyNSEC(nsecs, v.name, v.qtype, v.nxdomain)
+		assert.Equal(t, r, v.result, v.name)
+		assert.Equal(t, err != nil, v.result == Bogus, v.name)
+	}
+
+	// the wildcard *.example. is covered by example. NSEC only
+	r, _ := denyNSEC(nsecs[1:], "c.example.", 1, true)
+	assert.Equal(t, r, Bogus)
+}
+
+func TestDenyNSEC3(t *testing.T) {
+	names := map[string]string{
+		"example.":     "NS SOA MX RRSIG DNSKEY NSEC3PARAM",
+		"a.example.":   "NS DS RRSIG",
+		"ns1.example.": "A RRSIG",
+		"w.example.":   "",
+		"*.w.example.": "MX RRSIG",
+		"x.w.example.": "MX RRSIG",
+	}
+
+	nsec3s := testNSEC3(t, 0, 12, names)
+
+	tests := []struct {
+		name     string
+		qtype    int
+		nxdomain bool
+		result   Result
+	}{
+		{"ns1.example.", 15, false, Secure},
+		{"ns1.example.", 1, false, Bogus},
+		{"ns1.example.", 1, true, Bogus},
+		{"a.example.", typeDS, false, Bogus},
+		{"a.c.x.w.example.", 1, true, Secure},
+		{"b.example.", 1, true, Secure},
+		{"y.w.example.", 1, false, Secure},
+		{"y.w.example.", 15, false, Bogus},
+		{"other.", 1, true, Bogus},
+	}
+
+	for _, v := range tests {
+		r, err := denyNSEC3(nsec3s, v.name, v.qtype, v.nxdomain)
+		assert.Equal(t, r, v.result, v.name)
+		assert.Equal(t, err != nil, v.result == Bogus, v.name)
+	}
+
+	// the wildcard *.w.example. exists
+	r, _ := denyNSEC3(nsec3s, "y.w.example.", 1, true)
+	assert.Equal(t, r, Bogus)
+
+	// the next closer name is covered by opt-out NSEC3
+	r, err := denyNSEC3(testNSEC3(t, 1, 12, names), "b.example.", typeDS, false)
+	assert.Nil(t, err)
+	assert.Equal(t, r, Insecure)
+
+	// the hash before the first owner is covered by the last record
+	first := nsec3s[0].hash
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("n%d.example.", i)
+		h, err := hashName(name, testSalt, 12)
+		assert.Nil(t, err)
+		if bytes.Compare(h, first) < 0 {
+			assert.Equal(t, coverNSEC3(nsec3s, name), nsec3s[len(nsec3s)-1])
+			r, err = denyNSEC3(nsec3s, name, 1, true)
+			assert.Nil(t, err)
+			assert.Equal(t, r, Secure)
+			break
+		}
+	}
+
+	// too many iterations
+	r, err = denyNSEC3(testNSEC3(t, 0, maxIterations+1, names), "b.example.", 1, true)
+	assert.Nil(t, err)
+	assert.Equal(t, r, Insecure)
+}
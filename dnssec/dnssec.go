@@ -0,0 +1,468 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package dnssec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/likexian/doh/dns"
+)
+
+// Result is DNSSEC validation result
+type Result int
+
+// Provider is the dns provider of validator, it must returns DNSSEC records if DO bit is set
+type Provider interface {
+	QueryWithOptions(ctx context.Context, q dns.Question, o dns.Options) (*dns.Response, error)
+}
+
+// Validator is DNSSEC validating resolver, see RFC 4035
+type Validator struct {
+	sync.Mutex
+	provider Provider
+	anchors  map[string][]dns.Answer
+	zones    map[string]*zone
+	now      func() time.Time
+}
+
+// zone is the validated keys of zone
+type zone struct {
+	result Result
+	keys   []*dnskey
+	expire time.Time
+}
+
+// DNSSEC validation result
+const (
+	// Indeterminate is no validation result, for example the DNSSEC records are not available
+	Indeterminate Result = iota
+	// Secure is the response is signed and validated from a trust anchor
+	Secure
+	// Insecure is the response is proven to be not signed
+	Insecure
+	// Bogus is the response should be signed but failed to validate
+	Bogus
+)
+
+const (
+	// typeSOA is the SOA record type
+	typeSOA = 6
+	// typeCNAME is the CNAME record type
+	typeCNAME = 5
+	// typeDS is the DS record type
+	typeDS = 43
+	// typeRRSIG is the RRSIG record type
+	typeRRSIG = 46
+	// typeNSEC is the NSEC record type
+	typeNSEC = 47
+	// typeDNSKEY is the DNSKEY record type
+	typeDNSKEY = 48
+	// typeNSEC3 is the NSEC3 record type
+	typeNSEC3 = 50
+	// maxZoneTTL is the max cache ttl of validated zone keys
+	maxZoneTTL = time.Hour
+)
+
+var (
+	// RootAnchors is the DS records of root zone trust anchor, see https://data.iana.org/root-anchors/
+	RootAnchors = []string{
+		". 0 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+		". 0 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+	}
+	// ErrBogus is the error of bogus response
+	ErrBogus = errors.New("dnssec: bogus response")
+)
+
+// Version returns package version
+func Version() string {
+	return "0.1.0"
+}
+
+// Author returns package author
+func Author() string {
+	return "[Li Kexian](https://www.likexian.com/)"
+}
+
+// License returns package license
+func License() string {
+	return "Licensed under the Apache License 2.0"
+}
+
+// NewValidator returns a new validator queries by provider, trusts the root anchors by default
+func NewValidator(provider Provider) *Validator {
+	v := &Validator{
+		provider: provider,
+		zones:    map[string]*zone{},
+		now:      time.Now,
+	}
+
+	_ = v.SetTrustAnchor(RootAnchors...)
+
+	return v
+}
+
+// String returns the validation result name
+func (r Result) String() string {
+	switch r {
+	case Secure:
+		return "secure"
+	case Insecure:
+		return "insecure"
+	case Bogus:
+		return "bogus"
+	default:
+		return "indeterminate"
+	}
+}
+
+// SetTrustAnchor set the trust anchors in DS record presentation format,
+// for example: ". 0 IN DS 20326 8 2 E06D...", names outside the anchors are insecure
+func (v *Validator) SetTrustAnchor(ds ...string) error {
+	anchors := map[string][]dns.Answer{}
+	for _, s := range ds {
+		fields := strings.Fields(s)
+		if len(fields) < 8 || !strings.EqualFold(fields[3], "DS") {
+			return fmt.Errorf("dnssec: invalid trust anchor: %s", s)
+		}
+		rr := dns.Answer{
+			Name: fqdn(fields[0]),
+			Type: typeDS,
+			Data: strings.Join(fields[4:], " "),
+		}
+		if _, err := parseDS(rr); err != nil {
+			return fmt.Errorf("dnssec: invalid trust anchor: %s", s)
+		}
+		anchors[rr.Name] = append(anchors[rr.Name], rr)
+	}
+
+	if len(anchors) == 0 {
+		return fmt.Errorf("dnssec: missing trust anchor")
+	}
+
+	v.Lock()
+	v.anchors = anchors
+	v.zones = map[string]*zone{}
+	v.Unlock()
+
+	return nil
+}
+
+// Query do dns query and validates the response, the AD bit of response is set by the result,
+// the error wraps ErrBogus if the result is bogus
+func (v *Validator) Query(ctx context.Context, d dns.Domain, t dns.Type, s ...dns.ECS) (*dns.Response, Result, error) {
+	m, err := dns.NewQuery(d, t, s...)
+	if err != nil {
+		return nil, Indeterminate, err
+	}
+
+	o := dns.Options{
+		DO:  true,
+		CD:  true,
+		ECS: m.ECS(),
+	}
+
+	rsp, err := v.query(ctx, m.Question[0], o)
+	if err != nil {
+		return rsp, Indeterminate, err
+	}
+
+	result, verr := v.validate(ctx, m.Question[0], rsp)
+	rsp.AD = result == Secure
+	if verr != nil {
+		return rsp, result, verr
+	}
+
+	return rsp, result, rsp.Err()
+}
+
+// query do dns query, the NXDOMAIN response is not an error
+func (v *Validator) query(ctx context.Context, q dns.Question, o dns.Options) (*dns.Response, error) {
+	rsp, err := v.provider.QueryWithOptions(ctx, q, o)
+	if rsp != nil && (rsp.Status == 0 || rsp.Status == int(dns.RCodeNXDomain)) {
+		return rsp, nil
+	}
+
+	if err == nil {
+		err = rsp.Err()
+	}
+
+	return rsp, err
+}
+
+// validate returns the validation result of response
+func (v *Validator) validate(ctx context.Context, q dns.Question, rsp *dns.Response) (Result, error) {
+	name := fqdn(q.Name)
+
+	for _, set := range rrsets(rsp.Answer) {
+		if set.typ == typeRRSIG {
+			continue
+		}
+		r, wildcard, err := v.verify(ctx, set)
+		if r != Secure {
+			return r, err
+		}
+		if wildcard != "" {
+			r, err = v.verifyWildcard(ctx, rsp, set.name, wildcard)
+			if r != Secure {
+				return r, err
+			}
+		}
+	}
+
+	// follows the cname chain to the final name
+	for i := 0; i < len(rsp.Answer) && q.Type != typeCNAME; i++ {
+		for _, rr := range rsp.Answer {
+			if rr.Type == typeCNAME && fqdn(rr.Name) == name {
+				name = fqdn(rr.Data)
+				break
+			}
+		}
+	}
+
+	for _, rr := range rsp.Answer {
+		if fqdn(rr.Name) == name && (rr.Type == q.Type || q.Type == 255) {
+			return Secure, nil
+		}
+	}
+
+	return v.verifyDenial(ctx, rsp, name, q.Type)
+}
+
+// verify returns the validation result of rrset, and the wildcard name if it is expanded from wildcard
+func (v *Validator) verify(ctx context.Context, set *rrset) (Result, string, error) {
+	if len(set.sigs) == 0 {
+		r, err := v.verifyUnsigned(ctx, set.name)
+		return r, "", err
+	}
+
+	var lastErr error
+	for _, rr := range set.sigs {
+		sig, err := parseRRSIG(rr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if !isSubdomain(set.name, sig.signer) || (set.typ == typeDS && sig.signer == set.name) {
+			lastErr = fmt.Errorf("invalid signer name: %s", sig.signer)
+			continue
+		}
+		if !sig.valid(v.now()) {
+			lastErr = fmt.Errorf("signature of %s is expired", set.name)
+			continue
+		}
+		r, keys, err := v.zoneKeys(ctx, sig.signer)
+		if r != Secure {
+			return r, "", err
+		}
+		for _, key := range keys {
+			if err = sig.verify(key, set.name, set.rrs); err == nil {
+				return Secure, sig.wildcard(set.name), nil
+			}
+			lastErr = err
+		}
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no valid signature of %s", set.name)
+	}
+
+	return Bogus, "", bogus(lastErr)
+}
+
+// verifyUnsigned returns insecure if the name is in an insecure zone, or bogus
+func (v *Validator) verifyUnsigned(ctx context.Context, name string) (Result, error) {
+	rsp, err := v.query(ctx, dns.Question{Name: name, Type: typeSOA}, dns.Options{DO: true, CD: true})
+	if err != nil {
+		return Indeterminate, err
+	}
+
+	apex := ""
+	for _, rr := range append(rsp.Answer, rsp.Authority...) {
+		if rr.Type == typeSOA && isSubdomain(name, fqdn(rr.Name)) {
+			apex = fqdn(rr.Name)
+			break
+		}
+	}
+
+	if apex == "" {
+		return Indeterminate, fmt.Errorf("dnssec: no zone found of %s", name)
+	}
+
+	r, _, err := v.zoneKeys(ctx, apex)
+	if r == Secure {
+		return Bogus, bogus(fmt.Errorf("missing signature of %s", name))
+	}
+
+	return r, err
+}
+
+// zoneKeys returns the validated zone keys of zone
+func (v *Validator) zoneKeys(ctx context.Context, name string) (Result, []*dnskey, error) {
+	v.Lock()
+	z, ok := v.zones[name]
+	anchors := v.anchors[name]
+	v.Unlock()
+
+	if ok && v.now().Before(z.expire) {
+		return z.result, z.keys, nil
+	}
+
+	ds := anchors
+	if len(ds) == 0 {
+		if name == "." {
+			return Insecure, nil, nil
+		}
+		var r Result
+		var err error
+		ds, r, err = v.delegation(ctx, name)
+		if r != Secure {
+			if r == Insecure {
+				v.setZone(name, &zone{result: Insecure}, maxZoneTTL)
+			}
+			return r, nil, err
+		}
+	}
+
+	r, keys, ttl, err := v.verifyKeys(ctx, name, ds)
+	if r == Secure || r == Insecure {
+		v.setZone(name, &zone{result: r, keys: keys}, ttl)
+	}
+
+	return r, keys, err
+}
+
+// delegation returns the validated DS records of zone, insecure if proven not exists
+func (v *Validator) delegation(ctx context.Context, name string) ([]dns.Answer, Result, error) {
+	q := dns.Question{Name: name, Type: typeDS}
+	rsp, err := v.query(ctx, q, dns.Options{DO: true, CD: true})
+	if err != nil {
+		return nil, Indeterminate, err
+	}
+
+	for _, set := range rrsets(rsp.Answer) {
+		if set.typ != typeDS || set.name != name {
+			continue
+		}
+		r, _, err := v.verify(ctx, set)
+		return set.rrs, r, err
+	}
+
+	r, err := v.verifyDenial(ctx, rsp, name, typeDS)
+	if r == Secure {
+		return nil, Insecure, nil
+	}
+
+	return nil, r, err
+}
+
+// verifyKeys returns the zone keys of zone if the DNSKEY rrset is signed by key matches DS records
+func (v *Validator) verifyKeys(ctx context.Context, name string, ds []dns.Answer) (Result, []*dnskey, time.Duration, error) {
+	dss := []*dsRecord{}
+	for _, rr := range ds {
+		d, err := parseDS(rr)
+		if err == nil && d.supported() {
+			dss = append(dss, d)
+		}
+	}
+
+	// RFC 4035 section 5.2, no supported algorithm is treated as insecure
+	if len(dss) == 0 {
+		return Insecure, nil, maxZoneTTL, nil
+	}
+
+	rsp, err := v.query(ctx, dns.Question{Name: name, Type: typeDNSKEY}, dns.Options{DO: true, CD: true})
+	if err != nil {
+		return Indeterminate, nil, 0, err
+	}
+
+	var set *rrset
+	for _, s := range rrsets(rsp.Answer) {
+		if s.typ == typeDNSKEY && s.name == name {
+			set = s
+		}
+	}
+
+	if set == nil {
+		return Bogus, nil, 0, bogus(fmt.Errorf("missing DNSKEY of %s", name))
+	}
+
+	keys := []*dnskey{}
+	entry := []*dnskey{}
+	for _, rr := range set.rrs {
+		key, err := parseDNSKEY(rr)
+		if err != nil {
+			continue
+		}
+		// the revoked key or the key without zone key flag is not trusted, see RFC 4035 section 5.2 and RFC 5011
+		if !key.zoneKey() {
+			continue
+		}
+		keys = append(keys, key)
+		for _, d := range dss {
+			if d.match(name, key) {
+				entry = append(entry, key)
+				break
+			}
+		}
+	}
+
+	if len(entry) == 0 {
+		return Bogus, nil, 0, bogus(fmt.Errorf("no DNSKEY of %s matches DS", name))
+	}
+
+	lastErr := fmt.Errorf("no valid signature of %s DNSKEY", name)
+	for _, rr := range set.sigs {
+		sig, err := parseRRSIG(rr)
+		if err != nil || sig.signer != name || !sig.valid(v.now()) {
+			continue
+		}
+		for _, key := range entry {
+			if err = sig.verify(key, name, set.rrs); err == nil {
+				return Secure, keys, set.ttl(), nil
+			}
+			lastErr = err
+		}
+	}
+
+	return Bogus, nil, 0, bogus(lastErr)
+}
+
+// setZone set the validated zone to cache
+func (v *Validator) setZone(name string, z *zone, ttl time.Duration) {
+	if ttl > maxZoneTTL {
+		ttl = maxZoneTTL
+	}
+
+	z.expire = v.now().Add(ttl)
+
+	v.Lock()
+	v.zones[name] = z
+	v.Unlock()
+}
+
+// bogus returns the bogus error
+func bogus(err error) error {
+	return fmt.Errorf("%w: %s", ErrBogus, err)
+}
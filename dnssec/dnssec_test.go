@@ -0,0 +1,323 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package dnssec
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/gokit/assert"
+)
+
+type testZone struct {
+	name string
+	key  *ecdsa.PrivateKey
+	rr   dns.Answer
+}
+
+type testProvider struct {
+	responses map[string]*dns.Response
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	pub := append(key.X.FillBytes(make([]byte, 32)), key.Y.FillBytes(make([]byte, 32))...)
+
+	return &testZone{
+		name: name,
+		key:  key,
+		rr: dns.Answer{
+			Name: name,
+			Type: typeDNSKEY,
+			TTL:  3600,
+			Data: "257 3 13 " + base64.StdEncoding.EncodeToString(pub),
+		},
+	}
+}
+
+func (z *testZone) keyTag(t *testing.T) uint16 {
+	key, err := parseDNSKEY(z.rr)
+	assert.Nil(t, err)
+	return key.keyTag()
+}
+
+func (z *testZone) ds(t *testing.T) dns.Answer {
+	key, err := parseDNSKEY(z.rr)
+	assert.Nil(t, err)
+
+	owner, err := dns.CanonicalName(z.name)
+	assert.Nil(t, err)
+
+	sum := sha256.Sum256(append(owner, key.rdata...))
+
+	return dns.Answer{
+		Name: z.name,
+		Type: typeDS,
+		TTL:  3600,
+		Data: fmt.Sprintf("%d 13 2 %s", key.keyTag(), hex.EncodeToString(sum[:])),
+	}
+}
+
+func (z *testZone) sign(t *testing.T, rrs ...dns.Answer) []dns.Answer {
+	now := time.Now()
+	return z.signAt(t, now.Add(-time.Hour), now.Add(time.Hour), "", rrs...)
+}
+
+func (z *testZone) signAt(t *testing.T, inception, expiration time.Time, wildcard string, rrs ...dns.Answer) []dns.Answer {
+	owner := rrs[0].Name
+	if wildcard != "" {
+		owner = wildcard
+	}
+
+	labels := len(splitLabels(owner))
+	if wildcard != "" {
+		labels--
+	}
+
+	rr := dns.Answer{
+		Name: rrs[0].Name,
+		Type: typeRRSIG,
+		TTL:  rrs[0].TTL,
+		Data: fmt.Sprintf("%s 13 %d %d %d %d %d %s AA==", dns.TypeFromCode(rrs[0].Type), labels, rrs[0].TTL,
+			expiration.Unix(), inception.Unix(), z.keyTag(t), z.name),
+	}
+
+	sig, err := parseRRSIG(rr)
+	assert.Nil(t, err)
+
+	data, err := sig.signedData(owner, rrs)
+	assert.Nil(t, err)
+
+	sum := sha256.Sum256(data)
+	r, s, err := ecdsa.Sign(rand.Reader, z.key, sum[:])
+	assert.Nil(t, err)
+
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	rr.Data = strings.TrimSuffix(rr.Data, "AA==") + base64.StdEncoding.EncodeToString(signature)
+
+	return append(rrs, rr)
+}
+
+func (p *testProvider) QueryWithOptions(ctx context.Context, q dns.Question, o dns.Options) (*dns.Response, error) {
+	if !o.DO || !o.CD {
+		return nil, fmt.Errorf("missing DO or CD bit")
+	}
+
+	rsp, ok := p.responses[fmt.Sprintf("%s/%d", fqdn(q.Name), q.Type)]
+	if !ok {
+		return nil, fmt.Errorf("no response of %s/%d", q.Name, q.Type)
+	}
+
+	rsp.Question = []dns.Question{q}
+	rsp.Provider = "test"
+	if rsp.Status != 0 {
+		return rsp, fmt.Errorf("test: bad response code: %d", rsp.Status)
+	}
+
+	return rsp, nil
+}
+
+func newTestValidator(t *testing.T) *Validator {
+	root := newTestZone(t, ".")
+	example := newTestZone(t, "example.")
+	wild := newTestZone(t, "wild.example.")
+
+	// the revoked key matches DS and signs the DNSKEY set, the data is signed by the other key
+	revoked := newTestZone(t, "revoked.example.")
+	revoked.rr.Data = "385" + strings.TrimPrefix(revoked.rr.Data, "257")
+	zsk := newTestZone(t, "revoked.example.")
+	zsk.rr.Data = "256" + strings.TrimPrefix(zsk.rr.Data, "257")
+
+	soa := func(name string) dns.Answer {
+		return dns.Answer{Name: name, Type: typeSOA, TTL: 300, Data: "ns." + name + " admin." + name + " 1 2 3 4 300"}
+	}
+	nsec := func(name, next, types string) dns.Answer {
+		return dns.Answer{Name: name, Type: typeNSEC, TTL: 300, Data: next + " " + types}
+	}
+	a := func(name, ip string) dns.Answer {
+		return dns.Answer{Name: name, Type: 1, TTL: 300, Data: ip}
+	}
+
+	now := time.Now()
+	tampered := example.sign(t, a("bad.example.", "1.2.3.4"))
+	tampered[0].Data = "4.3.2.1"
+
+	p := &testProvider{
+		responses: map[string]*dns.Response{
+			"./48":                   {Answer: root.sign(t, root.rr)},
+			"example./43":            {Answer: root.sign(t, example.ds(t))},
+			"example./48":            {Answer: example.sign(t, example.rr)},
+			"wild.example./43":       {Answer: example.sign(t, wild.ds(t))},
+			"wild.example./48":       {Answer: wild.sign(t, wild.rr)},
+			"revoked.example./43":    {Answer: example.sign(t, revoked.ds(t))},
+			"revoked.example./48":    {Answer: revoked.sign(t, revoked.rr, zsk.rr)},
+			"www.revoked.example./1": {Answer: zsk.sign(t, a("www.revoked.example.", "1.2.3.4"))},
+			"www.example./1":         {Answer: example.sign(t, a("www.example.", "1.2.3.4"), a("www.example.", "5.6.7.8"))},
+			"www.example./16": {Authority: append(
+				example.sign(t, soa("example.")),
+				example.sign(t, nsec("www.example.", "example.", "A RRSIG NSEC"))...,
+			)},
+			"nx.example./1": {Status: 3, Authority: append(append(
+				example.sign(t, soa("example.")),
+				example.sign(t, nsec("example.", "insecure.example.", "NS SOA RRSIG NSEC DNSKEY"))...),
+				example.sign(t, nsec("insecure.example.", "www.example.", "NS RRSIG NSEC"))...,
+			)},
+			"nx-unsigned.example./1": {Status: 3, Authority: example.sign(t, soa("example."))},
+			"nx-unsigned.example./6": {Status: 3, Authority: example.sign(t, soa("example."))},
+			"insecure.example./43": {Authority: append(
+				example.sign(t, soa("example.")),
+				example.sign(t, nsec("insecure.example.", "www.example.", "NS RRSIG NSEC"))...,
+			)},
+			"www.insecure.example./1": {Answer: []dns.Answer{a("www.insecure.example.", "1.2.3.4")}},
+			"www.insecure.example./6": {Authority: []dns.Answer{soa("insecure.example.")}},
+			"bad.example./1":          {Answer: tampered},
+			"unsigned.example./1":     {Answer: []dns.Answer{a("unsigned.example.", "1.2.3.4")}},
+			"unsigned.example./6":     {Authority: example.sign(t, soa("example."))},
+			"expired.example./1": {Answer: example.signAt(t, now.Add(-2*time.Hour), now.Add(-time.Hour), "",
+				a("expired.example.", "1.2.3.4"))},
+			"foo.wild.example./1": {
+				Answer: wild.signAt(t, now.Add(-time.Hour), now.Add(time.Hour), "*.wild.example.",
+					a("foo.wild.example.", "1.2.3.4")),
+				Authority: wild.sign(t, nsec("*.wild.example.", "wild.example.", "A RRSIG NSEC")),
+			},
+			"nsec.wild.example./1": {
+				Answer: wild.signAt(t, now.Add(-time.Hour), now.Add(time.Hour), "*.wild.example.",
+					a("nsec.wild.example.", "1.2.3.4")),
+			},
+			"nsec.wild.example./6": {Authority: wild.sign(t, soa("wild.example."))},
+		},
+	}
+
+	v := NewValidator(p)
+	err := v.SetTrustAnchor(". 0 IN DS " + root.ds(t).Data)
+	assert.Nil(t, err)
+
+	return v
+}
+
+func TestVersion(t *testing.T) {
+	assert.Contains(t, Version(), ".")
+	assert.Contains(t, Author(), "likexian")
+	assert.Contains(t, License(), "Apache License")
+}
+
+func TestResult(t *testing.T) {
+	assert.Equal(t, Secure.String(), "secure")
+	assert.Equal(t, Insecure.String(), "insecure")
+	assert.Equal(t, Bogus.String(), "bogus")
+	assert.Equal(t, Indeterminate.String(), "indeterminate")
+}
+
+func TestSetTrustAnchor(t *testing.T) {
+	v := NewValidator(&testProvider{})
+	assert.Equal(t, len(v.anchors["."]), 2)
+
+	err := v.SetTrustAnchor()
+	assert.NotNil(t, err)
+
+	err = v.SetTrustAnchor("example. 0 IN A 1.2.3.4")
+	assert.NotNil(t, err)
+
+	err = v.SetTrustAnchor("example. 0 IN DS 1234 13 2")
+	assert.NotNil(t, err)
+
+	err = v.SetTrustAnchor("Example 0 IN DS 1234 13 2 ABCD")
+	assert.Nil(t, err)
+	assert.Equal(t, len(v.anchors["example."]), 1)
+}
+
+func TestQuery(t *testing.T) {
+	v := newTestValidator(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name   dns.Domain
+		t      dns.Type
+		result Result
+		status int
+	}{
+		{"www.example", dns.TypeA, Secure, 0},
+		{"www.example", dns.TypeTXT, Secure, 0},
+		{"nx.example", dns.TypeA, Secure, 3},
+		{"www.insecure.example", dns.TypeA, Insecure, 0},
+		{"foo.wild.example", dns.TypeA, Secure, 0},
+		{"bad.example", dns.TypeA, Bogus, 0},
+		{"unsigned.example", dns.TypeA, Bogus, 0},
+		{"expired.example", dns.TypeA, Bogus, 0},
+		{"nx-unsigned.example", dns.TypeA, Bogus, 3},
+		{"nsec.wild.example", dns.TypeA, Bogus, 0},
+		{"www.revoked.example", dns.TypeA, Bogus, 0},
+	}
+
+	for _, v2 := range tests {
+		rsp, result, err := v.Query(ctx, v2.name, v2.t)
+		assert.Equal(t, result, v2.result, v2.name)
+		assert.Equal(t, rsp.Status, v2.status, v2.name)
+		assert.Equal(t, rsp.AD, v2.result == Secure, v2.name)
+		switch {
+		case v2.result == Bogus:
+			assert.True(t, errors.Is(err, ErrBogus), v2.name)
+		case v2.status != 0:
+			assert.NotNil(t, err, v2.name)
+		default:
+			assert.Nil(t, err, v2.name)
+		}
+	}
+
+	_, result, err := v.Query(ctx, "notfound.example", dns.TypeA)
+	assert.NotNil(t, err)
+	assert.Equal(t, result, Indeterminate)
+
+	_, result, err = v.Query(ctx, "www.example", dns.Type("NONE"))
+	assert.NotNil(t, err)
+	assert.Equal(t, result, Indeterminate)
+}
+
+func TestQueryAnchor(t *testing.T) {
+	v := newTestValidator(t)
+	ctx := context.Background()
+
+	err := v.SetTrustAnchor(". 0 IN DS 1234 13 2 ABCD")
+	assert.Nil(t, err)
+
+	_, result, err := v.Query(ctx, "www.example", dns.TypeA)
+	assert.True(t, errors.Is(err, ErrBogus))
+	assert.Equal(t, result, Bogus)
+
+	err = v.SetTrustAnchor("other. 0 IN DS 1234 13 2 ABCD")
+	assert.Nil(t, err)
+
+	_, result, err = v.Query(ctx, "www.example", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, result, Insecure)
+}
@@ -0,0 +1,488 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package dnssec
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/likexian/doh/dns"
+)
+
+// rrset is the records of same name and type, with the covering signatures
+type rrset struct {
+	name string
+	typ  int
+	rrs  []dns.Answer
+	sigs []dns.Answer
+}
+
+// rrsig is the parsed RRSIG record, see RFC 4034 section 3
+type rrsig struct {
+	typeCovered int
+	algorithm   uint8
+	labels      int
+	originTTL   uint32
+	expiration  uint32
+	inception   uint32
+	keyTag      uint16
+	signer      string
+	header      []byte
+	signature   []byte
+}
+
+// dnskey is the parsed DNSKEY record, see RFC 4034 section 2
+type dnskey struct {
+	flags     uint16
+	protocol  uint8
+	algorithm uint8
+	publicKey []byte
+	rdata     []byte
+}
+
+// dsRecord is the parsed DS record, see RFC 4034 section 5
+type dsRecord struct {
+	keyTag     uint16
+	algorithm  uint8
+	digestType uint8
+	digest     []byte
+}
+
+// DNSSEC algorithms
+const (
+	algRSASHA1         = 5
+	algRSASHA1NSEC3    = 7
+	algRSASHA256       = 8
+	algRSASHA512       = 10
+	algECDSAP256SHA256 = 13
+	algECDSAP384SHA384 = 14
+	algED25519         = 15
+)
+
+// DS digest types
+const (
+	digestSHA1   = 1
+	digestSHA256 = 2
+	digestSHA384 = 4
+)
+
+// rrsets returns the records grouped by name and type, the RRSIG records are grouped by type covered
+func rrsets(rrs []dns.Answer) []*rrset {
+	sets := []*rrset{}
+	index := map[string]*rrset{}
+
+	get := func(name string, typ int) *rrset {
+		key := fmt.Sprintf("%s/%d", name, typ)
+		if set, ok := index[key]; ok {
+			return set
+		}
+		set := &rrset{name: name, typ: typ}
+		index[key] = set
+		sets = append(sets, set)
+		return set
+	}
+
+	for _, rr := range rrs {
+		name := fqdn(rr.Name)
+		if rr.Type != typeRRSIG {
+			set := get(name, rr.Type)
+			set.rrs = append(set.rrs, rr)
+		}
+	}
+
+	for _, rr := range rrs {
+		if rr.Type != typeRRSIG {
+			continue
+		}
+		b, err := rr.RData()
+		if err != nil || len(b) < 2 {
+			continue
+		}
+		set := get(fqdn(rr.Name), int(binary.BigEndian.Uint16(b)))
+		set.sigs = append(set.sigs, rr)
+	}
+
+	result := []*rrset{}
+	for _, set := range sets {
+		if len(set.rrs) > 0 {
+			result = append(result, set)
+		}
+	}
+
+	return result
+}
+
+// ttl returns the min ttl of rrset
+func (s *rrset) ttl() time.Duration {
+	ttl := -1
+	for _, rr := range append(s.rrs, s.sigs...) {
+		if ttl == -1 || rr.TTL < ttl {
+			ttl = rr.TTL
+		}
+	}
+
+	return time.Duration(ttl) * time.Second
+}
+
+// parseRRSIG returns the parsed RRSIG record
+func parseRRSIG(rr dns.Answer) (*rrsig, error) {
+	b, err := rr.CanonicalRData()
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(rr.Data)
+	if len(b) < 18 || len(fields) < 9 {
+		return nil, fmt.Errorf("invalid RRSIG record: %s", rr.Data)
+	}
+
+	signer, err := dns.CanonicalName(fields[7])
+	if err != nil {
+		return nil, err
+	}
+
+	n := 18 + len(signer)
+	if len(b) <= n {
+		return nil, fmt.Errorf("invalid RRSIG record: %s", rr.Data)
+	}
+
+	return &rrsig{
+		typeCovered: int(binary.BigEndian.Uint16(b)),
+		algorithm:   b[2],
+		labels:      int(b[3]),
+		originTTL:   binary.BigEndian.Uint32(b[4:]),
+		expiration:  binary.BigEndian.Uint32(b[8:]),
+		inception:   binary.BigEndian.Uint32(b[12:]),
+		keyTag:      binary.BigEndian.Uint16(b[16:]),
+		signer:      fqdn(fields[7]),
+		header:      b[:n],
+		signature:   b[n:],
+	}, nil
+}
+
+// valid returns if the signature is in validity period, with serial number arithmetic
+func (s *rrsig) valid(now time.Time) bool {
+	t := uint32(now.Unix())
+	return int32(t-s.inception) >= 0 && int32(s.expiration-t) >= 0
+}
+
+// wildcard returns the wildcard name if the rrset is expanded from wildcard, see RFC 4035 section 5.3.4
+func (s *rrsig) wildcard(name string) string {
+	labels := splitLabels(name)
+	n := len(labels)
+	if n > 0 && labels[0] == "*" {
+		n--
+	}
+
+	if s.labels >= n {
+		return ""
+	}
+
+	return "*." + joinLabels(labels[len(labels)-s.labels:])
+}
+
+// verify verifies the signature of records by key, see RFC 4034 section 3.1.8.1
+func (s *rrsig) verify(key *dnskey, name string, rrs []dns.Answer) error {
+	if key.algorithm != s.algorithm || key.keyTag() != s.keyTag || key.protocol != 3 {
+		return fmt.Errorf("DNSKEY %d does not match RRSIG", key.keyTag())
+	}
+
+	owner := name
+	if w := s.wildcard(name); w != "" {
+		owner = w
+	}
+
+	data, err := s.signedData(owner, rrs)
+	if err != nil {
+		return err
+	}
+
+	return verifySignature(key.algorithm, key.publicKey, data, s.signature)
+}
+
+// signedData returns the signed data of records
+func (s *rrsig) signedData(owner string, rrs []dns.Answer) ([]byte, error) {
+	name, err := dns.CanonicalName(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	rdatas := [][]byte{}
+	for _, rr := range rrs {
+		b, err := rr.CanonicalRData()
+		if err != nil {
+			return nil, err
+		}
+		rdatas = append(rdatas, b)
+	}
+
+	sort.Slice(rdatas, func(i, j int) bool {
+		return bytes.Compare(rdatas[i], rdatas[j]) < 0
+	})
+
+	data := append([]byte{}, s.header...)
+	for i, b := range rdatas {
+		if i > 0 && bytes.Equal(b, rdatas[i-1]) {
+			continue
+		}
+		data = append(data, name...)
+		data = binary.BigEndian.AppendUint16(data, uint16(s.typeCovered))
+		data = binary.BigEndian.AppendUint16(data, 1)
+		data = binary.BigEndian.AppendUint32(data, s.originTTL)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(b)))
+		data = append(data, b...)
+	}
+
+	return data, nil
+}
+
+// parseDNSKEY returns the parsed DNSKEY record
+func parseDNSKEY(rr dns.Answer) (*dnskey, error) {
+	b, err := rr.RData()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < 5 {
+		return nil, fmt.Errorf("invalid DNSKEY record: %s", rr.Data)
+	}
+
+	return &dnskey{
+		flags:     binary.BigEndian.Uint16(b),
+		protocol:  b[2],
+		algorithm: b[3],
+		publicKey: b[4:],
+		rdata:     b,
+	}, nil
+}
+
+// zoneKey returns if the key is a zone key and not revoked
+func (k *dnskey) zoneKey() bool {
+	return k.flags&0x0100 != 0 && k.flags&0x0080 == 0
+}
+
+// keyTag returns the key tag of key, see RFC 4034 appendix B
+func (k *dnskey) keyTag() uint16 {
+	ac := uint32(0)
+	for i, v := range k.rdata {
+		if i&1 == 0 {
+			ac += uint32(v) << 8
+		} else {
+			ac += uint32(v)
+		}
+	}
+
+	ac += ac >> 16 & 0xffff
+
+	return uint16(ac & 0xffff)
+}
+
+// parseDS returns the parsed DS record
+func parseDS(rr dns.Answer) (*dsRecord, error) {
+	b, err := rr.RData()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < 5 {
+		return nil, fmt.Errorf("invalid DS record: %s", rr.Data)
+	}
+
+	return &dsRecord{
+		keyTag:     binary.BigEndian.Uint16(b),
+		algorithm:  b[2],
+		digestType: b[3],
+		digest:     b[4:],
+	}, nil
+}
+
+// supported returns if the algorithm and digest type is supported
+func (d *dsRecord) supported() bool {
+	switch d.algorithm {
+	case algRSASHA1, algRSASHA1NSEC3, algRSASHA256, algRSASHA512,
+		algECDSAP256SHA256, algECDSAP384SHA384, algED25519:
+	default:
+		return false
+	}
+
+	switch d.digestType {
+	case digestSHA1, digestSHA256, digestSHA384:
+		return true
+	default:
+		return false
+	}
+}
+
+// match returns if the DS record is the digest of key, see RFC 4034 section 5.1.4
+func (d *dsRecord) match(name string, key *dnskey) bool {
+	if d.keyTag != key.keyTag() || d.algorithm != key.algorithm {
+		return false
+	}
+
+	owner, err := dns.CanonicalName(name)
+	if err != nil {
+		return false
+	}
+
+	data := append(owner, key.rdata...)
+
+	var sum []byte
+	switch d.digestType {
+	case digestSHA1:
+		v := sha1.Sum(data)
+		sum = v[:]
+	case digestSHA256:
+		v := sha256.Sum256(data)
+		sum = v[:]
+	case digestSHA384:
+		v := sha512.Sum384(data)
+		sum = v[:]
+	default:
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(sum, d.digest) == 1
+}
+
+// verifySignature verifies the signature of data by public key of algorithm
+func verifySignature(algorithm uint8, publicKey, data, signature []byte) error {
+	switch algorithm {
+	case algRSASHA1, algRSASHA1NSEC3, algRSASHA256, algRSASHA512:
+		key, err := parseRSAKey(publicKey)
+		if err != nil {
+			return err
+		}
+		hash := map[uint8]crypto.Hash{
+			algRSASHA1:      crypto.SHA1,
+			algRSASHA1NSEC3: crypto.SHA1,
+			algRSASHA256:    crypto.SHA256,
+			algRSASHA512:    crypto.SHA512,
+		}[algorithm]
+		h := hash.New()
+		h.Write(data)
+		return rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), signature)
+	case algECDSAP256SHA256, algECDSAP384SHA384:
+		curve, hash := elliptic.P256(), crypto.SHA256
+		if algorithm == algECDSAP384SHA384 {
+			curve, hash = elliptic.P384(), crypto.SHA384
+		}
+		size := curve.Params().BitSize / 8
+		if len(publicKey) != 2*size || len(signature) != 2*size {
+			return fmt.Errorf("invalid ECDSA key or signature")
+		}
+		key := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(publicKey[:size]),
+			Y:     new(big.Int).SetBytes(publicKey[size:]),
+		}
+		h := hash.New()
+		h.Write(data)
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, h.Sum(nil), r, s) {
+			return fmt.Errorf("invalid ECDSA signature")
+		}
+		return nil
+	case algED25519:
+		if len(publicKey) != ed25519.PublicKeySize {
+			return fmt.Errorf("invalid Ed25519 key")
+		}
+		if !ed25519.Verify(publicKey, data, signature) {
+			return fmt.Errorf("invalid Ed25519 signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm: %d", algorithm)
+	}
+}
+
+// parseRSAKey returns the RSA public key, see RFC 3110 section 2
+func parseRSAKey(b []byte) (*rsa.PublicKey, error) {
+	if len(b) < 3 {
+		return nil, fmt.Errorf("invalid RSA key")
+	}
+
+	n, off := int(b[0]), 1
+	if n == 0 {
+		n, off = int(binary.BigEndian.Uint16(b[1:])), 3
+	}
+
+	if n == 0 || n > 8 || len(b) <= off+n {
+		return nil, fmt.Errorf("invalid RSA key")
+	}
+
+	e := 0
+	for _, v := range b[off : off+n] {
+		e = e<<8 | int(v)
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(b[off+n:]),
+		E: e,
+	}, nil
+}
+
+// fqdn returns the lowercase fully qualified domain name
+func fqdn(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	return name
+}
+
+// splitLabels returns the labels of fqdn name, the root is not included
+func splitLabels(name string) []string {
+	name = strings.TrimSuffix(fqdn(name), ".")
+	if name == "" {
+		return nil
+	}
+
+	return strings.Split(name, ".")
+}
+
+// joinLabels returns the fqdn name of labels
+func joinLabels(labels []string) string {
+	return strings.Join(labels, ".") + "."
+}
+
+// isSubdomain returns if name is equal to or under the parent
+func isSubdomain(name, parent string) bool {
+	if parent == "." {
+		return true
+	}
+
+	return name == parent || strings.HasSuffix(name, "."+parent)
+}
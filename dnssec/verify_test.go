@@ -0,0 +1,167 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package dnssec
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/gokit/assert"
+)
+
+func TestRRSets(t *testing.T) {
+	sets := rrsets([]dns.Answer{
+		{Name: "Example.com", Type: 1, TTL: 300, Data: "1.2.3.4"},
+		{Name: "example.com.", Type: 46, TTL: 300, Data: "A 15 2 300 1440021600 1438207200 3613 example.com. AA=="},
+		{Name: "example.com.", Type: 1, TTL: 200, Data: "5.6.7.8"},
+		{Name: "example.com.", Type: 46, TTL: 300, Data: "MX 15 2 300 1440021600 1438207200 3613 example.com. AA=="},
+		{Name: "www.example.com.", Type: 5, TTL: 300, Data: "example.com."},
+	})
+
+	assert.Equal(t, len(sets), 2)
+	assert.Equal(t, sets[0].name, "example.com.")
+	assert.Equal(t, len(sets[0].rrs), 2)
+	assert.Equal(t, len(sets[0].sigs), 1)
+	assert.Equal(t, sets[0].ttl(), 200*time.Second)
+	assert.Equal(t, sets[1].typ, typeCNAME)
+	assert.Equal(t, len(sets[1].sigs), 0)
+}
+
+// RFC 8080 section 6.1, Ed25519 example
+func TestVerifyEd25519(t *testing.T) {
+	key, err := parseDNSKEY(dns.Answer{
+		Name: "example.com.",
+		Type: typeDNSKEY,
+		Data: "257 3 15 l02Woi0iS8Aa25FQkUd9RMzZHJpBoRQwAQEX1SxZJA4=",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, key.keyTag(), uint16(3613))
+	assert.True(t, key.zoneKey())
+
+	ds, err := parseDS(dns.Answer{
+		Name: "example.com.",
+		Type: typeDS,
+		Data: "3613 15 2 3aa5ab37efce57f737fc1627013fee07bdf241bd10f3b1964ab55c78e79a304b",
+	})
+	assert.Nil(t, err)
+	assert.True(t, ds.supported())
+	assert.True(t, ds.match("example.com.", key))
+	assert.False(t, ds.match("example.net.", key))
+
+	sig, err := parseRRSIG(dns.Answer{
+		Name: "example.com.",
+		Type: typeRRSIG,
+		Data: "MX 15 2 3600 1440021600 1438207200 3613 example.com. " +
+			"oL9krJun7xfBOIWcGHi7mag5/hdZrKWw15jPGrHpjQeRAvTdszaPD+QLs3fx8A4M3e23mRZ9VrbpMngwcrqNAg==",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, sig.typeCovered, 15)
+	assert.Equal(t, sig.signer, "example.com.")
+	assert.True(t, sig.valid(time.Unix(1440000000, 0)))
+	assert.False(t, sig.valid(time.Unix(1440021601, 0)))
+	assert.False(t, sig.valid(time.Unix(1438207199, 0)))
+
+	mx := []dns.Answer{{Name: "example.com.", Type: 15, TTL: 3600, Data: "10 mail.example.com."}}
+	err = sig.verify(key, "example.com.", mx)
+	assert.Nil(t, err)
+
+	// case of names are ignored in canonical form
+	err = sig.verify(key, "EXAMPLE.com.", []dns.Answer{{Name: "example.com.", Type: 15, Data: "10 Mail.Example.com."}})
+	assert.Nil(t, err)
+
+	err = sig.verify(key, "example.com.", []dns.Answer{{Name: "example.com.", Type: 15, Data: "20 mail.example.com."}})
+	assert.NotNil(t, err)
+
+	key.algorithm = algECDSAP256SHA256
+	err = sig.verify(key, "example.com.", mx)
+	assert.NotNil(t, err)
+}
+
+func TestVerifyRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+
+	pub := append([]byte{3}, big.NewInt(int64(key.E)).Bytes()...)
+	pub = append(pub, key.N.Bytes()...)
+
+	rr := dns.Answer{
+		Name: "example.",
+		Type: typeDNSKEY,
+		Data: "256 3 8 " + base64.StdEncoding.EncodeToString(pub),
+	}
+
+	k, err := parseDNSKEY(rr)
+	assert.Nil(t, err)
+
+	data := []byte("likexian")
+	sum := sha256.Sum256(data)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	assert.Nil(t, err)
+
+	err = verifySignature(algRSASHA256, k.publicKey, data, signature)
+	assert.Nil(t, err)
+
+	err = verifySignature(algRSASHA512, k.publicKey, data, signature)
+	assert.NotNil(t, err)
+
+	err = verifySignature(algRSASHA256, k.publicKey, []byte("doh"), signature)
+	assert.NotNil(t, err)
+
+	err = verifySignature(algRSASHA256, []byte{0, 0}, data, signature)
+	assert.NotNil(t, err)
+
+	err = verifySignature(algECDSAP256SHA256, k.publicKey, data, signature)
+	assert.NotNil(t, err)
+
+	err = verifySignature(algED25519, k.publicKey, data, signature)
+	assert.NotNil(t, err)
+
+	err = verifySignature(1, k.publicKey, data, signature)
+	assert.NotNil(t, err)
+
+	rsaKey, err := parseRSAKey(append([]byte{0, 0, 3}, pub[1:]...))
+	assert.Nil(t, err)
+	assert.Equal(t, rsaKey.E, key.E)
+	assert.Equal(t, rsaKey.N, key.N)
+}
+
+func TestNames(t *testing.T) {
+	assert.Equal(t, fqdn(" Example.COM "), "example.com.")
+	assert.Equal(t, fqdn("."), ".")
+	assert.Equal(t, len(splitLabels(".")), 0)
+	assert.Equal(t, splitLabels("www.example.com"), []string{"www", "example", "com"})
+	assert.True(t, isSubdomain("www.example.com.", "example.com."))
+	assert.True(t, isSubdomain("example.com.", "example.com."))
+	assert.True(t, isSubdomain("example.com.", "."))
+	assert.False(t, isSubdomain("wwwexample.com.", "example.com."))
+
+	sig := &rrsig{labels: 2}
+	assert.Equal(t, sig.wildcard("www.example.com."), "*.example.com.")
+	assert.Equal(t, sig.wildcard("a.b.example.com."), "*.example.com.")
+	assert.Equal(t, sig.wildcard("example.com."), "")
+	assert.Equal(t, sig.wildcard("*.example.com."), "")
+}
@@ -21,6 +21,7 @@ package doh
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
@@ -31,7 +32,8 @@ import (
 	"github.com/likexian/doh/provider/dnspod"
 	"github.com/likexian/doh/provider/google"
 	"github.com/likexian/doh/provider/quad9"
-	"github.com/likexian/gokit/xcache"
+	"github.com/likexian/doh/stamp"
+	"github.com/likexian/doh/trace"
 	"github.com/likexian/gokit/xhash"
 )
 
@@ -41,15 +43,37 @@ type provider uint
 // Provider is the provider interface
 type Provider interface {
 	Query(context.Context, dns.Domain, dns.Type, ...dns.ECS) (*dns.Response, error)
+	QueryWithOptions(context.Context, dns.Question, dns.Options) (*dns.Response, error)
 	String() string
 }
 
 // DoH is doh client
 type DoH struct {
-	providers []Provider
-	cache     xcache.Cachex
-	stats     map[int][]interface{}
-	stopc     chan bool
+	providers   []Provider
+	cache       Cache
+	minTTL      time.Duration
+	maxTTL      time.Duration
+	staleWindow time.Duration
+	staleAnswer time.Duration
+	staleRetry  time.Duration
+	padding     bool
+	strategy    Strategy
+	stats       *statsWindow
+	refresh     map[string]bool
+	hits        map[string]*cacheHits
+	prefetchc   chan struct{}
+	prefetchAt  float64
+	prefetchHit int
+	hmu         sync.Mutex
+	flight      flightGroup
+	nocoalesce  bool
+	latency     latencies
+	hedgeAt     float64
+	hedgeDelay  time.Duration
+	breakers    breakers
+	probec      chan struct{}
+	hook        trace.Hook
+	stopc       chan bool
 	sync.RWMutex
 }
 
@@ -104,19 +128,69 @@ func New(provider provider) Provider {
 // You can specify one or multiple provider,
 // if multiple, it will try to select the fastest
 func Use(provider ...provider) *DoH {
-	c := &DoH{
-		providers: []Provider{},
-		cache:     nil,
-		stats:     map[int][]interface{}{},
-		stopc:     make(chan bool),
-	}
-
 	if len(provider) == 0 {
 		provider = Providers
 	}
 
+	providers := []Provider{}
 	for _, v := range provider {
-		c.providers = append(c.providers, New(v))
+		providers = append(providers, New(v))
+	}
+
+	return UseProvider(providers...)
+}
+
+// UseStamp returns a new DoH client of the DoH, DoT and ODoH stamps, such as sdns://...,
+// the ODoH targets are queried through the first ODoH relay stamp, if multiple, it will try to select the fastest
+func UseStamp(stamps ...string) (*DoH, error) {
+	relay := ""
+	targets := []string{}
+	for _, v := range stamps {
+		st, err := stamp.Parse(v)
+		if err != nil {
+			return nil, err
+		}
+		if st.Proto != stamp.ProtoODoHRelay {
+			targets = append(targets, v)
+		} else if relay == "" {
+			relay = v
+		}
+	}
+
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("doh: missing provider stamp")
+	}
+
+	providers := []Provider{}
+	for _, v := range targets {
+		p, err := stamp.NewClient(v, relay)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, p)
+	}
+
+	return UseProvider(providers...), nil
+}
+
+// UseProvider returns a new DoH client of the specified provider client,
+// such as a custom upstream client, if multiple, it will try to select the fastest,
+// the selection strategy can be changed by SetStrategy
+func UseProvider(provider ...Provider) *DoH {
+	if len(provider) == 0 {
+		return Use()
+	}
+
+	c := &DoH{
+		providers:   provider,
+		cache:       nil,
+		strategy:    NewRatioStrategy(0),
+		stats:       newStatsWindow(0),
+		refresh:     map[string]bool{},
+		staleAnswer: staleAnswerTimeout,
+		staleRetry:  staleRetryTimeout,
+		hits:        map[string]*cacheHits{},
+		stopc:       make(chan bool),
 	}
 
 	go func() {
@@ -127,9 +201,7 @@ func Use(provider ...provider) *DoH {
 				t.Stop()
 				return
 			case <-t.C:
-				c.Lock()
-				c.stats = map[int][]interface{}{}
-				c.Unlock()
+				c.cleanHits()
 			}
 		}
 	}()
@@ -137,113 +209,327 @@ func Use(provider ...provider) *DoH {
 	return c
 }
 
-// EnableCache enable query cache
+// EnableCache enable query cache, the memory cache is used
 func (c *DoH) EnableCache(cache bool) *DoH {
 	if cache {
-		c.cache = xcache.New(xcache.MemoryCache)
-	} else {
-		c.cache = nil
+		return c.SetCache(NewMemoryCache())
+	}
+
+	return c.SetCache(nil)
+}
+
+// SetCache set the query cache, such as a shared cache, nil to disable cache
+func (c *DoH) SetCache(cache Cache) *DoH {
+	if v, ok := c.cache.(*memoryCache); ok && v != cache {
+		_ = v.Close()
 	}
 
+	c.cache = cache
+
 	return c
 }
 
+// SetStrategy set the provider selection strategy, nil to use the default strategy
+func (c *DoH) SetStrategy(strategy Strategy) *DoH {
+	if strategy == nil {
+		strategy = NewRatioStrategy(0)
+	}
+
+	c.Lock()
+	c.strategy = strategy
+	c.Unlock()
+
+	return c
+}
+
+// EnablePadding enable query padding of all providers, see RFC 8467
+func (c *DoH) EnablePadding(padding bool) *DoH {
+	c.Lock()
+	c.padding = padding
+	c.Unlock()
+
+	return c
+}
+
+// String returns string of DoH client
+func (c *DoH) String() string {
+	return "doh"
+}
+
 // Close close doh client
 func (c *DoH) Close() {
 	c.stopc <- true
-	if c.cache != nil {
-		c.cache.Close()
+	c.SetHealthCheck("", 0)
+	if v, ok := c.cache.(*memoryCache); ok {
+		_ = v.Close()
 	}
 }
 
 // Query do DoH query
 func (c *DoH) Query(ctx context.Context, d dns.Domain, t dns.Type, s ...dns.ECS) (*dns.Response, error) {
-	providers := c.providers
+	code, err := t.Code()
+	if err != nil {
+		return nil, err
+	}
+
+	o := dns.Options{}
+	if len(s) > 0 {
+		o.ECS = s[0]
+	}
+
+	return c.QueryWithOptions(ctx, dns.Question{Name: string(d), Type: code}, o)
+}
 
+// QueryWithOptions do DoH query of question with options
+func (c *DoH) QueryWithOptions(ctx context.Context, q dns.Question, o dns.Options) (*dns.Response, error) {
 	c.RLock()
-	if len(c.stats) > 0 {
-		min := []interface{}{0, 100.0}
-		for k, v := range c.stats {
-			r := v[2].(float64)
-			if r < min[1].(float64) {
-				min = []interface{}{k, r}
-			}
+	o.Padding = o.Padding || c.padding
+	nocoalesce := c.nocoalesce
+	c.RUnlock()
+
+	if nocoalesce {
+		return c.fastQuery(ctx, q, o)
+	}
+
+	rsp, err, _ := c.flight.do(ctx, flightKey{q, o}, func(ctx context.Context) (*dns.Response, error) {
+		return c.fastQuery(ctx, q, o)
+	})
+	// the response is copied as it may be shared and modified by the callers
+	if rsp != nil {
+		rsp = copyResponse(rsp)
+	}
+
+	return rsp, err
+}
+
+// fastQuery do query and returns the fastest result, the cache is used if enabled
+func (c *DoH) fastQuery(ctx context.Context, q dns.Question, o dns.Options) (*dns.Response, error) {
+	if c.cache == nil {
+		rsp, err := c.selectQuery(ctx, q, o)
+		if err != nil {
+			return nil, err
 		}
-		providers = []Provider{c.providers[min[0].(int)]}
+		return rsp, rsp.Err()
 	}
-	c.RUnlock()
 
-	return c.fastQuery(ctx, providers, d, t, s...)
+	// the name is case-insensitive and the trailing dot is optional
+	name := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	cacheKey := xhash.Sha1(name, string(dns.TypeFromCode(q.Type)), strings.TrimSpace(string(o.ECS)), o.DO, o.CD).Hex()
+	e, ok := c.getCache(cacheKey)
+	if ok && !e.stale {
+		c.stats.observeCache(true, false)
+		c.prefetch(cacheKey, e, q, o)
+		return e.Response, e.Response.Err()
+	}
+
+	if ok {
+		return c.staleQuery(ctx, cacheKey, e, q, o)
+	}
+
+	rsp, err := c.selectQuery(ctx, q, o)
+	c.stats.observeCache(false, false)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = c.setCache(cacheKey, rsp)
+
+	return rsp, rsp.Err()
 }
 
-// fastQuery do query and returns the fastest result
-func (c *DoH) fastQuery(ctx context.Context,
-	ps []Provider, d dns.Domain, t dns.Type, s ...dns.ECS) (*dns.Response, error) {
-	cacheKey := ""
-	if c.cache != nil {
-		var ss string
-		if len(s) > 0 && s[0] != "" {
-			ss = strings.TrimSpace(string(s[0]))
+// staleQuery refreshes the stale entry, and returns the stale answer if the refresh is failed,
+// or not done in the client response timeout, the refresh is continued in background, see RFC 8767
+func (c *DoH) staleQuery(ctx context.Context, key string, e *cacheEntry, q dns.Question, o dns.Options) (*dns.Response, error) {
+	c.RLock()
+	timeout := c.staleAnswer
+	c.RUnlock()
+
+	donec := c.refreshCache(key, q, o, false)
+	if donec != nil {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+
+		select {
+		case rsp := <-donec:
+			if rsp != nil {
+				c.stats.observeCache(false, false)
+				return rsp, rsp.Err()
+			}
+		case <-t.C:
+		case <-ctx.Done():
 		}
-		cacheKey = xhash.Sha1(string(d), string(t), ss).Hex()
-		v := c.cache.Get(cacheKey)
-		if v != nil {
-			return v.(*dns.Response), nil
+	}
+
+	c.stats.observeCache(true, true)
+
+	return e.Response, e.Response.Err()
+}
+
+// refreshCache refreshes the cache of key in background, only one refresh of key is running,
+// the prefetch is skipped if too many prefetches are running, the failed refresh is not retried
+// in the failure recheck timeout, it returns the channel of response, nil response if failed,
+// or returns nil channel if the refresh is skipped
+func (c *DoH) refreshCache(key string, q dns.Question, o dns.Options, prefetch bool) <-chan *dns.Response {
+	c.Lock()
+	if c.refresh[key] {
+		c.Unlock()
+		return nil
+	}
+
+	var prefetchc chan struct{}
+	if prefetch {
+		select {
+		case c.prefetchc <- struct{}{}:
+			prefetchc = c.prefetchc
+		default:
+			c.Unlock()
+			return nil
 		}
 	}
 
-	ctxs, cancels := context.WithCancel(ctx)
-	defer cancels()
+	c.refresh[key] = true
+	retry := c.staleRetry
+	c.Unlock()
 
-	r := make(chan interface{})
-	for k, p := range ps {
-		go func(k int, p Provider) {
-			rsp, err := p.Query(ctxs, d, t, s...)
+	donec := make(chan *dns.Response, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+		defer cancel()
+
+		rsp, err := c.selectQuery(ctx, q, o)
+		if err == nil && c.cache != nil {
+			_ = c.setCache(key, rsp)
+		}
+
+		if prefetchc != nil {
+			<-prefetchc
+		}
+
+		done := func() {
 			c.Lock()
-			if _, ok := c.stats[k]; !ok {
-				c.stats[k] = []interface{}{0, 0, 100}
-			}
-			c.stats[k][1] = c.stats[k][1].(int) + 1
-			if err != nil {
-				c.stats[k][0] = c.stats[k][0].(int) + 1
-			}
-			c.stats[k][2] = float64(c.stats[k][0].(int)) / float64(c.stats[k][1].(int))
+			delete(c.refresh, key)
 			c.Unlock()
-			if err == nil {
-				r <- rsp
-			} else {
-				r <- nil
-			}
-		}(k, p)
+		}
+
+		if err != nil {
+			rsp = nil
+			time.AfterFunc(retry, done)
+		} else {
+			done()
+		}
+
+		donec <- rsp
+	}()
+
+	return donec
+}
+
+// selectQuery do query of providers selected by strategy, the next group is queried if all failed
+func (c *DoH) selectQuery(ctx context.Context, q dns.Question, o dns.Options) (*dns.Response, error) {
+	c.RLock()
+	strategy, hedging := c.strategy, c.hedgeAt > 0
+	c.RUnlock()
+
+	// the unhealthy providers are skipped, the remaining healthy providers are raced
+	// if all providers selected by strategy are unhealthy
+	groups := c.healthy(strategy.Select(len(c.providers)))
+	if len(groups) == 0 {
+		groups = c.healthy([][]int{sequence(len(c.providers))})
 	}
 
-	total := 0
-	result := &dns.Response{
-		Status: -1,
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("doh: no healthy provider")
 	}
 
-	for v := range r {
-		total++
-		if v != nil {
-			cancels()
-			result = v.(*dns.Response)
-			if cacheKey != "" {
-				ttl := 30
-				if len(result.Answer) > 0 {
-					ttl = result.Answer[0].TTL
-				}
-				_ = c.cache.Set(cacheKey, result, int64(ttl))
+	// the healthy providers not selected by strategy are hedged at last,
+	// as the strategy may select only one, such as the default strategy
+	if hedging {
+		var idx, rest []int
+		for _, g := range groups {
+			idx = append(idx, g...)
+		}
+		for i := range c.providers {
+			if !contains(idx, i) {
+				rest = append(rest, i)
 			}
 		}
-		if total >= len(ps) {
-			close(r)
+		for _, g := range c.healthy([][]int{rest}) {
+			idx = append(idx, g...)
+		}
+		return c.hedgeQuery(ctx, strategy, idx, q, o)
+	}
+
+	var err error
+	for _, g := range groups {
+		var rsp *dns.Response
+		rsp, err = c.raceQuery(ctx, strategy, g, q, o)
+		if err == nil {
+			return rsp, nil
+		}
+		if ctx.Err() != nil {
 			break
 		}
 	}
 
-	if result.Status == -1 {
-		return nil, fmt.Errorf("doh: all query failed")
+	return nil, err
+}
+
+// raceQuery do query of providers and returns the fastest result
+func (c *DoH) raceQuery(ctx context.Context, strategy Strategy, idx []int, q dns.Question, o dns.Options) (*dns.Response, error) {
+	ctxs, cancels := context.WithCancel(ctx)
+	defer cancels()
+
+	r := make(chan interface{}, len(idx))
+	for _, k := range idx {
+		go c.providerQuery(ctxs, strategy, k, q, o, r)
 	}
 
-	return result, nil
+	var err error
+	for range idx {
+		v := <-r
+		if e, ok := v.(error); ok {
+			err = e
+		} else {
+			return v.(*dns.Response), nil
+		}
+	}
+
+	return nil, fmt.Errorf("doh: all query failed: %w", err)
+}
+
+// providerQuery do query of provider index, the response or error is sent to r
+func (c *DoH) providerQuery(ctx context.Context, strategy Strategy, k int, q dns.Question, o dns.Options, r chan<- interface{}) {
+	// the trial of recovering provider is only taken by the query actually sent
+	if !c.breakers.acquire(k) {
+		r <- fmt.Errorf("doh: no healthy provider")
+		return
+	}
+
+	ctx = c.traceContext(ctx)
+
+	start := time.Now()
+	rsp, err := c.providers[k].QueryWithOptions(ctx, q, o)
+	// the NXDOMAIN response is an authoritative negative answer, not a failure
+	if rsp != nil && errors.Is(err, dns.ErrNXDomain) {
+		err = nil
+	}
+
+	// the query cancelled by the fastest is not observed
+	if err == nil || ctx.Err() == nil {
+		rtt := time.Since(start)
+		strategy.Observe(k, rtt, err)
+		c.breakers.report(k, err)
+		c.stats.observe(k, rtt, rsp, err)
+		if err == nil {
+			c.latency.observe(k, rtt)
+		}
+	} else {
+		c.breakers.release(k)
+	}
+
+	if err == nil {
+		r <- rsp
+	} else {
+		r <- err
+	}
 }
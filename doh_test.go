@@ -21,11 +21,17 @@ package doh
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/likexian/doh/dns"
+	"github.com/likexian/doh/provider/custom"
+	"github.com/likexian/doh/stamp"
 	"github.com/likexian/gokit/assert"
 )
 
@@ -97,7 +103,7 @@ func TestEnableCache(t *testing.T) {
 	rsp, err = c.Query(ctx, "likexian.com", dns.TypeA)
 	assert.Nil(t, err)
 	assert.Gt(t, len(rsp.Answer), 0)
-	assert.Equal(t, rsp.Answer[0].TTL, ttl)
+	assert.Lt(t, rsp.Answer[0].TTL, ttl)
 
 	c.EnableCache(false)
 	rsp, err = c.Query(ctx, "likexian.com", dns.TypeA)
@@ -132,3 +138,136 @@ func TestConcurrentQuery(t *testing.T) {
 
 	wg.Wait()
 }
+
+func newServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		q := &dns.Msg{}
+		if q.Unpack(data) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		rsp := &dns.Response{Question: q.Question, AD: q.EDNS != nil && q.EDNS.DO, CD: q.CD}
+		switch q.Question[0].Name {
+		case "likexian.com.":
+			rsp.Answer = []dns.Answer{{Name: "likexian.com.", Type: 1, TTL: 600, Data: "1.2.3.4"}}
+		case "padding.likexian.com.":
+			if q.Padded() {
+				rsp.Answer = []dns.Answer{{Name: "padding.likexian.com.", Type: 1, TTL: 600, Data: "1.2.3.4"}}
+			}
+		case "ttl.likexian.com.":
+			rsp.Answer = []dns.Answer{
+				{Name: "ttl.likexian.com.", Type: 1, TTL: 600, Data: "1.2.3.4"},
+				{Name: "ttl.likexian.com.", Type: 1, TTL: 30, Data: "5.6.7.8"},
+			}
+		case "servfail.likexian.com.":
+			rsp.Status = 2
+		case "nosoa.likexian.com.":
+			rsp.Status = 3
+		default:
+			rsp.Status = 3
+			rsp.Authority = []dns.Answer{
+				{Name: "likexian.com.", Type: 6, TTL: 3600, Data: "ns.likexian.com. admin.likexian.com. 1 7200 3600 86400 60"},
+			}
+		}
+
+		b, _ := rsp.Msg().Pack()
+		_, _ = w.Write(b)
+	}))
+}
+
+func TestUseProvider(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	p, err := custom.NewClient(ts.URL+"/dns-query", dns.FormatWire)
+	assert.Nil(t, err)
+
+	c := UseProvider(p)
+	defer c.Close()
+	assert.Equal(t, c.String(), "doh")
+
+	rsp, err := c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Answer[0].Data, "1.2.3.4")
+
+	rsp, err = c.QueryWithOptions(ctx, dns.Question{Name: "likexian.com", Type: 1}, dns.Options{DO: true, CD: true})
+	assert.Nil(t, err)
+	assert.True(t, rsp.AD)
+	assert.True(t, rsp.CD)
+
+	_, err = c.Query(ctx, "likexian.com", "XX")
+	assert.NotNil(t, err)
+
+	rsp, err = c.Query(ctx, "padding.likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Len(t, rsp.Answer, 0)
+
+	rsp, err = c.EnablePadding(true).Query(ctx, "padding.likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Len(t, rsp.Answer, 1)
+	c.EnablePadding(false)
+
+	// padding is toggled while querying
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c.EnablePadding(i%2 == 0)
+			_, _ = c.Query(ctx, "padding.likexian.com", dns.TypeA)
+		}(i)
+	}
+	wg.Wait()
+	c.EnablePadding(false)
+
+	// the NXDOMAIN response is returned with error
+	rsp, err = c.Query(ctx, "nx.likexian.com", dns.TypeA)
+	assert.True(t, errors.Is(err, dns.ErrNXDomain))
+	assert.False(t, errors.Is(err, dns.ErrServFail))
+	assert.Equal(t, rsp.Status, int(dns.RCodeNXDomain))
+
+	var rerr *dns.RCodeError
+	assert.True(t, errors.As(err, &rerr))
+	assert.Equal(t, rerr.RCode, dns.RCodeNXDomain)
+	assert.Equal(t, rerr.Provider, p.String())
+
+	// the NXDOMAIN response is not a provider failure
+	s := c.strategy.(*ratioStrategy)
+	assert.Equal(t, s.stats.providerStats(1, false)[0].ErrorCount(), int64(0))
+
+	rsp, err = c.Query(ctx, "servfail.likexian.com", dns.TypeA)
+	assert.True(t, errors.Is(err, dns.ErrServFail))
+	assert.True(t, rsp == nil)
+}
+
+func TestUseStamp(t *testing.T) {
+	_, err := UseStamp()
+	assert.NotNil(t, err)
+
+	_, err = UseStamp("sdns://!!!")
+	assert.NotNil(t, err)
+
+	relay := (&stamp.Stamp{Proto: stamp.ProtoODoHRelay, Hostname: "relay.likexian.com", Path: "/proxy"}).String()
+	_, err = UseStamp(relay)
+	assert.NotNil(t, err)
+
+	_, err = UseStamp("sdns://BQcAAAAAAAAAF29kb2guY2xvdWRmbGFyZS1kbnMuY29tCi9kbnMtcXVlcnk")
+	assert.Equal(t, err.Error(), "stamp: odoh target requires relay")
+
+	c, err := UseStamp(
+		"sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5",
+		"sdns://AwcAAAAAAAAABzEuMS4xLjEAEmNsb3VkZmxhcmUtZG5zLmNvbQ",
+		"sdns://BQcAAAAAAAAAF29kb2guY2xvdWRmbGFyZS1kbnMuY29tCi9kbnMtcXVlcnk",
+		relay,
+	)
+	assert.Nil(t, err)
+	defer c.Close()
+	assert.Equal(t, len(c.providers), 3)
+	assert.Equal(t, c.providers[0].String(), "dns.cloudflare.com")
+	assert.Equal(t, c.providers[1].String(), "cloudflare-dns.com")
+	assert.Equal(t, c.providers[2].String(), "odoh.cloudflare-dns.com")
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package doh
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/likexian/doh/dns"
+)
+
+// FlightStats is the stats of query coalescing
+type FlightStats struct {
+	// Queries is the number of queries sent to the providers or cache
+	Queries int64
+	// Coalesced is the number of queries that shared an in-flight query
+	Coalesced int64
+}
+
+// flightKey is the key of identical queries
+type flightKey struct {
+	q dns.Question
+	o dns.Options
+}
+
+// flightCall is an in-flight query
+type flightCall struct {
+	done chan struct{}
+	rsp  *dns.Response
+	err  error
+}
+
+// flightGroup coalesces the identical concurrent queries into one in-flight query
+type flightGroup struct {
+	calls map[flightKey]*flightCall
+	stats FlightStats
+	sync.Mutex
+}
+
+// flightTimeout is the min timeout of in-flight query
+const flightTimeout = 10 * time.Second
+
+// do runs fn once for the identical concurrent queries of key, shared is true if the result is shared,
+// the in-flight query is not cancelled by the callers, it is run with the values of first caller,
+// and it times out after the deadline of first caller or the flight timeout, whichever is later,
+// the waiting is cancelled by ctx of each caller
+func (g *flightGroup) do(ctx context.Context, key flightKey, fn func(context.Context) (*dns.Response, error)) (rsp *dns.Response, err error, shared bool) {
+	g.Lock()
+	if g.calls == nil {
+		g.calls = map[flightKey]*flightCall{}
+	}
+
+	call, shared := g.calls[key]
+	if shared {
+		g.stats.Coalesced++
+	} else {
+		call = &flightCall{done: make(chan struct{})}
+		g.calls[key] = call
+		g.stats.Queries++
+	}
+	g.Unlock()
+
+	if !shared {
+		deadline := time.Now().Add(flightTimeout)
+		if v, ok := ctx.Deadline(); ok && v.After(deadline) {
+			deadline = v
+		}
+
+		fctx, cancel := context.WithDeadline(context.WithoutCancel(ctx), deadline)
+		go func() {
+			defer cancel()
+			call.rsp, call.err = fn(fctx)
+			g.Lock()
+			delete(g.calls, key)
+			g.Unlock()
+			close(call.done)
+		}()
+	}
+
+	select {
+	case <-call.done:
+		return call.rsp, call.err, shared
+	case <-ctx.Done():
+		return nil, ctx.Err(), shared
+	}
+}
+
+// copyResponse returns a deep copy of response, the shared response may be modified by the callers
+func copyResponse(rsp *dns.Response) *dns.Response {
+	r := *rsp
+	r.Question = append([]dns.Question(nil), rsp.Question...)
+	r.Answer = append([]dns.Answer(nil), rsp.Answer...)
+	r.Authority = append([]dns.Answer(nil), rsp.Authority...)
+	r.Additional = append([]dns.Answer(nil), rsp.Additional...)
+	r.EDE = append([]dns.ExtendedError(nil), rsp.EDE...)
+
+	return &r
+}
+
+// EnableCoalescing enable query coalescing, the identical concurrent queries share one in-flight query,
+// it is enabled by default
+func (c *DoH) EnableCoalescing(coalescing bool) *DoH {
+	c.Lock()
+	c.nocoalesce = !coalescing
+	c.Unlock()
+
+	return c
+}
+
+// FlightStats returns the stats of query coalescing
+func (c *DoH) FlightStats() FlightStats {
+	c.flight.Lock()
+	defer c.flight.Unlock()
+
+	return c.flight.stats
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package doh
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/doh/provider/custom"
+	"github.com/likexian/gokit/assert"
+)
+
+// slowProvider blocks the queries until released
+type slowProvider struct {
+	Provider
+	release chan struct{}
+}
+
+func (p *slowProvider) QueryWithOptions(ctx context.Context, q dns.Question, o dns.Options) (*dns.Response, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.release:
+	}
+
+	return p.Provider.QueryWithOptions(ctx, q, o)
+}
+
+func TestFlight(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	p, err := custom.NewClient(ts.URL+"/dns-query", dns.FormatWire)
+	assert.Nil(t, err)
+
+	cp := &countProvider{Provider: p}
+	sp := &slowProvider{Provider: cp, release: make(chan struct{})}
+	c := UseProvider(sp)
+	defer c.Close()
+
+	// waitCoalesced waits for the number of coalesced queries
+	waitCoalesced := func(n int64) {
+		for i := 0; i < 100; i++ {
+			if c.FlightStats().Coalesced >= n {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// the identical concurrent queries share one in-flight query
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rsp, err := c.Query(ctx, "likexian.com", dns.TypeA)
+			assert.Nil(t, err)
+			assert.Equal(t, rsp.Answer[0].Data, "1.2.3.4")
+		}()
+	}
+
+	waitCoalesced(49)
+	close(sp.release)
+	wg.Wait()
+
+	assert.Equal(t, cp.n.Load(), int32(1))
+	assert.Equal(t, c.FlightStats(), FlightStats{Queries: 1, Coalesced: 49})
+
+	// the queries of different options are not coalesced
+	sp.release = make(chan struct{})
+	for _, o := range []dns.Options{{}, {DO: true}, {ECS: "1.2.3.0/24"}} {
+		wg.Add(1)
+		go func(o dns.Options) {
+			defer wg.Done()
+			_, err := c.QueryWithOptions(ctx, dns.Question{Name: "likexian.com", Type: 1}, o)
+			assert.Nil(t, err)
+		}(o)
+	}
+
+	// the waiting is cancelled by context
+	for i := 0; i < 100 && c.FlightStats().Queries < 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	ctxc, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = c.Query(ctxc, "likexian.com", dns.TypeA)
+	assert.True(t, errors.Is(err, context.Canceled))
+
+	close(sp.release)
+	wg.Wait()
+
+	assert.Equal(t, cp.n.Load(), int32(4))
+	assert.Equal(t, c.FlightStats(), FlightStats{Queries: 4, Coalesced: 50})
+
+	// the in-flight query is not cancelled by the first caller
+	sp.release = make(chan struct{})
+	ctxc, cancel = context.WithCancel(ctx)
+	errc := make(chan error)
+	go func() {
+		_, err := c.Query(ctxc, "likexian.com", dns.TypeA)
+		errc <- err
+	}()
+
+	for i := 0; i < 100 && c.FlightStats().Queries < 5; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rsps := make([]*dns.Response, 2)
+	for i := range rsps {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rsp, err := c.Query(ctx, "likexian.com", dns.TypeA)
+			assert.Nil(t, err)
+			rsps[i] = rsp
+		}(i)
+	}
+
+	waitCoalesced(52)
+	cancel()
+	assert.True(t, errors.Is(<-errc, context.Canceled))
+
+	close(sp.release)
+	wg.Wait()
+
+	assert.Equal(t, cp.n.Load(), int32(5))
+	assert.Equal(t, c.FlightStats(), FlightStats{Queries: 5, Coalesced: 52})
+
+	// the shared responses are deep copied
+	rsps[0].Question[0].Name = "x"
+	rsps[0].Answer[0].Data = "x"
+	assert.Equal(t, rsps[1].Question[0].Name, "likexian.com.")
+	assert.Equal(t, rsps[1].Answer[0].Data, "1.2.3.4")
+
+	// the coalescing is disabled
+	c.EnableCoalescing(false)
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, cp.n.Load(), int32(6))
+	assert.Equal(t, c.FlightStats(), FlightStats{Queries: 5, Coalesced: 52})
+}
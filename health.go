@@ -0,0 +1,277 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package doh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/likexian/doh/dns"
+)
+
+// BreakerState is the circuit breaker state of provider
+type BreakerState int
+
+// Circuit breaker states
+const (
+	// BreakerClosed is the healthy state, queries are allowed
+	BreakerClosed BreakerState = iota
+	// BreakerOpen is the unhealthy state, queries are skipped
+	BreakerOpen
+	// BreakerHalfOpen is the recovering state, one trial query is allowed
+	BreakerHalfOpen
+)
+
+// breaker is the circuit breaker of provider
+type breaker struct {
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	trialAt  time.Time
+}
+
+// breakers is the circuit breakers of providers
+type breakers struct {
+	threshold int
+	cooldown  time.Duration
+	states    map[int]*breaker
+	sync.Mutex
+}
+
+// String returns the name of breaker state
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+// SetCircuitBreaker set the circuit breaker of providers, the provider is skipped by every strategy
+// after failures consecutive failures, and one trial query is allowed after cooldown, zero failures to disable
+func (c *DoH) SetCircuitBreaker(failures int, cooldown time.Duration) *DoH {
+	if cooldown <= 0 {
+		cooldown = 30 * time.Second
+	}
+
+	c.breakers.Lock()
+	c.breakers.threshold = failures
+	c.breakers.cooldown = cooldown
+	c.breakers.states = map[int]*breaker{}
+	c.breakers.Unlock()
+
+	return c
+}
+
+// SetHealthCheck set the active health check of providers, the canary name is queried every interval,
+// and the result is reported to the circuit breaker, zero interval to disable
+func (c *DoH) SetHealthCheck(name dns.Domain, interval time.Duration) *DoH {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.probec != nil {
+		close(c.probec)
+		c.probec = nil
+	}
+
+	if name != "" && interval > 0 {
+		c.probec = make(chan struct{})
+		go c.healthCheck(name, interval, c.probec)
+	}
+
+	return c
+}
+
+// Health returns the circuit breaker state of providers, in order of providers
+func (c *DoH) Health() []BreakerState {
+	r := make([]BreakerState, len(c.providers))
+	for i := range r {
+		r[i] = c.breakers.state(i)
+	}
+
+	return r
+}
+
+// healthCheck queries the canary name of providers every interval until stopped
+func (c *DoH) healthCheck(name dns.Domain, interval time.Duration, stopc chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stopc:
+			return
+		case <-t.C:
+			c.probe(name, interval)
+		}
+	}
+}
+
+// probe queries the canary name of all providers, and reports the result to the circuit breaker
+func (c *DoH) probe(name dns.Domain, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for k, p := range c.providers {
+		wg.Add(1)
+		go func(k int, p Provider) {
+			defer wg.Done()
+			rsp, err := p.QueryWithOptions(ctx, dns.Question{Name: string(name), Type: 1}, dns.Options{})
+			if rsp != nil && errors.Is(err, dns.ErrNXDomain) {
+				err = nil
+			}
+			c.breakers.report(k, err)
+		}(k, p)
+	}
+
+	wg.Wait()
+}
+
+// healthy returns the groups of healthy provider index, the empty group is removed
+func (c *DoH) healthy(groups [][]int) [][]int {
+	r := make([][]int, 0, len(groups))
+	for _, g := range groups {
+		var h []int
+		for _, k := range g {
+			if c.breakers.allow(k) {
+				h = append(h, k)
+			}
+		}
+		if len(h) > 0 {
+			r = append(r, h)
+		}
+	}
+
+	return r
+}
+
+// allow returns whether the provider index is allowed to query, the breaker state is not changed
+func (b *breakers) allow(k int) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	s, ok := b.states[k]
+	if b.threshold <= 0 || !ok {
+		return true
+	}
+
+	switch s.state {
+	case BreakerOpen:
+		return time.Since(s.openedAt) >= b.cooldown
+	case BreakerHalfOpen:
+		// the trial is retried if it is not reported in cooldown
+		return time.Since(s.trialAt) >= b.cooldown
+	default:
+		return true
+	}
+}
+
+// acquire claims the query of provider index, the trial is taken if the breaker is recovering
+func (b *breakers) acquire(k int) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	s, ok := b.states[k]
+	if b.threshold <= 0 || !ok {
+		return true
+	}
+
+	switch s.state {
+	case BreakerOpen:
+		if time.Since(s.openedAt) < b.cooldown {
+			return false
+		}
+		s.state = BreakerHalfOpen
+		s.trialAt = time.Now()
+		return true
+	case BreakerHalfOpen:
+		if time.Since(s.trialAt) < b.cooldown {
+			return false
+		}
+		s.trialAt = time.Now()
+		return true
+	default:
+		return true
+	}
+}
+
+// release gives back the trial of provider index if the query is not reported
+func (b *breakers) release(k int) {
+	b.Lock()
+	defer b.Unlock()
+
+	if s, ok := b.states[k]; ok && s.state == BreakerHalfOpen {
+		s.trialAt = time.Time{}
+	}
+}
+
+// report reports the query result of provider index
+func (b *breakers) report(k int, err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.threshold <= 0 {
+		return
+	}
+
+	s, ok := b.states[k]
+	if !ok {
+		s = &breaker{}
+		b.states[k] = s
+	}
+
+	if err == nil {
+		s.state = BreakerClosed
+		s.failures = 0
+		return
+	}
+
+	s.failures++
+	if s.state == BreakerHalfOpen || s.failures >= b.threshold {
+		s.state = BreakerOpen
+		s.openedAt = time.Now()
+	}
+}
+
+// state returns the breaker state of provider index
+func (b *breakers) state(k int) BreakerState {
+	b.Lock()
+	defer b.Unlock()
+
+	s, ok := b.states[k]
+	if b.threshold <= 0 || !ok {
+		return BreakerClosed
+	}
+
+	if s.state == BreakerOpen && time.Since(s.openedAt) >= b.cooldown {
+		return BreakerHalfOpen
+	}
+
+	return s.state
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package doh
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/doh/provider/custom"
+	"github.com/likexian/gokit/assert"
+)
+
+func TestBreakerState(t *testing.T) {
+	assert.Equal(t, BreakerClosed.String(), "closed")
+	assert.Equal(t, BreakerOpen.String(), "open")
+	assert.Equal(t, BreakerHalfOpen.String(), "half-open")
+	assert.Equal(t, BreakerState(9).String(), "unknown(9)")
+}
+
+func TestSetCircuitBreaker(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	p, err := custom.NewClient(ts.URL+"/dns-query", dns.FormatWire)
+	assert.Nil(t, err)
+
+	ps := []*countProvider{{Provider: p}, {Provider: p}}
+	c := UseProvider(ps[0], ps[1]).SetStrategy(NewFailoverStrategy()).SetCircuitBreaker(2, 100*time.Millisecond)
+	defer c.Close()
+
+	// the breaker is opened after consecutive failures
+	ps[0].fail.Store(2)
+	for i := 0; i < 2; i++ {
+		_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+		assert.Nil(t, err)
+		assert.Equal(t, ps[1].n.Load(), int32(i+1))
+	}
+	assert.Equal(t, c.Health(), []BreakerState{BreakerOpen, BreakerClosed})
+
+	// the unhealthy provider is skipped
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, ps[0].n.Load(), int32(2))
+	assert.Equal(t, ps[1].n.Load(), int32(3))
+
+	// the breaker is closed if the trial succeeded
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, c.Health(), []BreakerState{BreakerHalfOpen, BreakerClosed})
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, ps[0].n.Load(), int32(3))
+	assert.Equal(t, c.Health(), []BreakerState{BreakerClosed, BreakerClosed})
+
+	// the breaker is opened again if the trial failed
+	ps[0].fail.Store(3)
+	for i := 0; i < 2; i++ {
+		_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+		assert.Nil(t, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, ps[0].n.Load(), int32(6))
+	assert.Equal(t, c.Health(), []BreakerState{BreakerOpen, BreakerClosed})
+
+	// the query is failed if no healthy provider
+	ps[1].fail.Store(2)
+	for i := 0; i < 2; i++ {
+		_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+		assert.NotNil(t, err)
+	}
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Equal(t, err.Error(), "doh: no healthy provider")
+
+	// the breaker is disabled
+	c.SetCircuitBreaker(0, 0)
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, c.Health(), []BreakerState{BreakerClosed, BreakerClosed})
+}
+
+func TestCircuitBreakerRatio(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	p, err := custom.NewClient(ts.URL+"/dns-query", dns.FormatWire)
+	assert.Nil(t, err)
+
+	ps := []*countProvider{{Provider: p}, {Provider: p}}
+	c := UseProvider(ps[0], ps[1]).SetCircuitBreaker(2, time.Hour)
+	defer c.Close()
+
+	// the default strategy selects the provider of lowest failure ratio
+	ps[1].fail.Store(1)
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, c.strategy.Select(2), [][]int{{0}})
+
+	// the remaining healthy provider is used if the selected provider is unhealthy
+	c.breakers.report(0, errors.New("test: query failed"))
+	c.breakers.report(0, errors.New("test: query failed"))
+	assert.Equal(t, c.Health(), []BreakerState{BreakerOpen, BreakerClosed})
+	assert.Equal(t, c.strategy.Select(2), [][]int{{0}})
+
+	n := ps[0].n.Load()
+	rsp, err := c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Answer[0].Data, "1.2.3.4")
+	assert.Equal(t, ps[0].n.Load(), n)
+	assert.Equal(t, ps[1].n.Load(), int32(2))
+}
+
+func TestBreakerTrial(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	p, err := custom.NewClient(ts.URL+"/dns-query", dns.FormatWire)
+	assert.Nil(t, err)
+
+	ps := []*countProvider{{Provider: p}, {Provider: p}}
+	c := UseProvider(ps[0], ps[1]).SetStrategy(NewFailoverStrategy()).SetCircuitBreaker(1, 50*time.Millisecond)
+	defer c.Close()
+
+	c.breakers.report(1, errors.New("test: query failed"))
+	time.Sleep(50 * time.Millisecond)
+
+	// the selection does not take the trial of provider not queried
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, ps[1].n.Load(), int32(0))
+	assert.Equal(t, c.breakers.states[1].state, BreakerOpen)
+	assert.True(t, c.breakers.allow(1))
+
+	// only one trial is taken until it is reported or released
+	assert.True(t, c.breakers.acquire(1))
+	assert.False(t, c.breakers.allow(1))
+	assert.False(t, c.breakers.acquire(1))
+	c.breakers.release(1)
+	assert.True(t, c.breakers.acquire(1))
+	c.breakers.report(1, nil)
+	assert.Equal(t, c.Health(), []BreakerState{BreakerClosed, BreakerClosed})
+}
+
+func TestSetHealthCheck(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	p, err := custom.NewClient(ts.URL+"/dns-query", dns.FormatWire)
+	assert.Nil(t, err)
+
+	ps := []*countProvider{{Provider: p}, {Provider: p}}
+	c := UseProvider(ps[0], ps[1]).SetCircuitBreaker(1, time.Hour)
+	defer c.Close()
+
+	// waitHealth waits for the breaker state of providers
+	waitHealth := func(states ...BreakerState) {
+		for i := 0; i < 100; i++ {
+			if reflect.DeepEqual(c.Health(), states) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, c.Health(), states)
+	}
+
+	// the failed provider is opened by probe
+	ps[0].fail.Store(1000)
+	c.SetHealthCheck("nx.likexian.com", 20*time.Millisecond)
+	waitHealth(BreakerOpen, BreakerClosed)
+	for i := 0; i < 100 && ps[1].n.Load() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Gt(t, ps[1].n.Load(), int32(0))
+
+	// the provider is recovered by probe without waiting for cooldown
+	ps[0].fail.Store(0)
+	waitHealth(BreakerClosed, BreakerClosed)
+
+	// the health check is stopped
+	c.SetHealthCheck("", 0)
+	time.Sleep(50 * time.Millisecond)
+	n := ps[1].n.Load()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, ps[1].n.Load(), n)
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package doh
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/likexian/doh/dns"
+)
+
+const (
+	// latencySamples is the max number of latency samples of provider
+	latencySamples = 100
+	// latencyMinSamples is the min number of latency samples to get percentile
+	latencyMinSamples = 10
+)
+
+// latencies is the recent latency samples of providers
+type latencies struct {
+	samples map[int][]time.Duration
+	next    map[int]int
+	sync.Mutex
+}
+
+// SetHedging set the hedged query, the preferred provider is queried first, and the next provider
+// is queried if no answer within its latency percentile, such as 0.95, the slower query is cancelled,
+// the providers are in order of strategy, then the others not selected by strategy,
+// delay is used if not enough latency observed, zero percentile to disable
+func (c *DoH) SetHedging(percentile float64, delay time.Duration) *DoH {
+	if percentile <= 0 || percentile >= 1 {
+		percentile = 0
+	}
+
+	c.Lock()
+	c.hedgeAt = percentile
+	c.hedgeDelay = delay
+	c.Unlock()
+
+	return c
+}
+
+// hedgeQuery do query of providers in order, the next is queried if the previous failed or too slow
+func (c *DoH) hedgeQuery(ctx context.Context, strategy Strategy, idx []int, q dns.Question, o dns.Options) (*dns.Response, error) {
+	ctxs, cancels := context.WithCancel(ctx)
+	defer cancels()
+
+	r := make(chan interface{}, len(idx))
+	next, running := 0, 0
+
+	var hedge <-chan time.Time
+	launch := func() {
+		k := idx[next]
+		next++
+		running++
+		go c.providerQuery(ctxs, strategy, k, q, o, r)
+		hedge = nil
+		if next < len(idx) {
+			hedge = time.After(c.hedgeAfter(k))
+		}
+	}
+
+	launch()
+
+	var err error
+	for running > 0 {
+		select {
+		case <-hedge:
+			launch()
+		case v := <-r:
+			running--
+			if e, ok := v.(error); ok {
+				err = e
+				if next < len(idx) && ctx.Err() == nil {
+					launch()
+				}
+			} else {
+				return v.(*dns.Response), nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("doh: all query failed: %w", err)
+}
+
+// hedgeAfter returns the hedging delay of provider index
+func (c *DoH) hedgeAfter(k int) time.Duration {
+	c.RLock()
+	percentile, delay := c.hedgeAt, c.hedgeDelay
+	c.RUnlock()
+
+	if v, ok := c.latency.percentile(k, percentile); ok {
+		return v
+	}
+
+	return delay
+}
+
+// observe adds the latency sample of provider index
+func (l *latencies) observe(k int, rtt time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.samples == nil {
+		l.samples = map[int][]time.Duration{}
+		l.next = map[int]int{}
+	}
+
+	if len(l.samples[k]) < latencySamples {
+		l.samples[k] = append(l.samples[k], rtt)
+		return
+	}
+
+	l.samples[k][l.next[k]] = rtt
+	l.next[k] = (l.next[k] + 1) % latencySamples
+}
+
+// percentile returns the latency percentile of provider index, false if not enough samples
+func (l *latencies) percentile(k int, p float64) (time.Duration, bool) {
+	l.Lock()
+	samples := append([]time.Duration(nil), l.samples[k]...)
+	l.Unlock()
+
+	if len(samples) < latencyMinSamples {
+		return 0, false
+	}
+
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i] < samples[j]
+	})
+
+	i := int(float64(len(samples))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(samples) {
+		i = len(samples) - 1
+	}
+
+	return samples[i], true
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package doh
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/doh/provider/custom"
+	"github.com/likexian/gokit/assert"
+)
+
+// delayProvider delays the queries, and counts the cancelled queries
+type delayProvider struct {
+	Provider
+	delay     atomic.Int64
+	cancelled atomic.Int32
+}
+
+func (p *delayProvider) QueryWithOptions(ctx context.Context, q dns.Question, o dns.Options) (*dns.Response, error) {
+	select {
+	case <-time.After(time.Duration(p.delay.Load())):
+		return p.Provider.QueryWithOptions(ctx, q, o)
+	case <-ctx.Done():
+		p.cancelled.Add(1)
+		return nil, ctx.Err()
+	}
+}
+
+func TestLatencies(t *testing.T) {
+	l := latencies{}
+	_, ok := l.percentile(0, 0.9)
+	assert.False(t, ok)
+
+	for i := 1; i <= 10; i++ {
+		l.observe(0, time.Duration(i)*time.Millisecond)
+	}
+
+	v, ok := l.percentile(0, 0.9)
+	assert.True(t, ok)
+	assert.Equal(t, v, 9*time.Millisecond)
+
+	v, _ = l.percentile(0, 0.5)
+	assert.Equal(t, v, 5*time.Millisecond)
+
+	// the oldest samples are replaced
+	for i := 0; i < latencySamples; i++ {
+		l.observe(0, time.Second)
+	}
+	assert.Len(t, l.samples[0], latencySamples)
+
+	v, _ = l.percentile(0, 0.5)
+	assert.Equal(t, v, time.Second)
+}
+
+func TestSetHedging(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	p, err := custom.NewClient(ts.URL+"/dns-query", dns.FormatWire)
+	assert.Nil(t, err)
+
+	ps := []*countProvider{{Provider: p}, {Provider: p}}
+	dp := &delayProvider{Provider: ps[0]}
+	c := UseProvider(dp, ps[1]).SetStrategy(NewFailoverStrategy()).SetHedging(0.9, 50*time.Millisecond)
+	defer c.Close()
+
+	// the next provider is not queried if the preferred is fast
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, ps[0].n.Load(), int32(1))
+	assert.Equal(t, ps[1].n.Load(), int32(0))
+
+	// the next provider is queried after delay, and the slower is cancelled
+	dp.delay.Store(int64(time.Second))
+	start := time.Now()
+	rsp, err := c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Answer[0].Data, "1.2.3.4")
+	assert.Lt(t, time.Since(start), 500*time.Millisecond)
+	assert.Equal(t, ps[1].n.Load(), int32(1))
+
+	for i := 0; i < 100 && dp.cancelled.Load() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, dp.cancelled.Load(), int32(1))
+
+	// the next provider is queried at once if the preferred failed
+	dp.delay.Store(0)
+	ps[0].fail.Store(1)
+	c.SetHedging(0.9, time.Hour)
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, ps[1].n.Load(), int32(2))
+
+	ps[0].fail.Store(1)
+	ps[1].fail.Store(1)
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, dns.ErrNXDomain))
+
+	// the delay is the latency percentile of provider
+	for i := 0; i < latencyMinSamples; i++ {
+		c.latency.observe(0, 10*time.Millisecond)
+	}
+	assert.Equal(t, c.hedgeAfter(0), 10*time.Millisecond)
+	assert.Equal(t, c.hedgeAfter(1), time.Hour)
+
+	// the hedging is disabled
+	c.SetHedging(0, 0)
+	dp.delay.Store(int64(100 * time.Millisecond))
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, ps[1].n.Load(), int32(3))
+}
+
+func TestHedgingRatio(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	p, err := custom.NewClient(ts.URL+"/dns-query", dns.FormatWire)
+	assert.Nil(t, err)
+
+	ps := []*countProvider{{Provider: p}, {Provider: p}}
+	dp := &delayProvider{Provider: ps[0]}
+	c := UseProvider(dp, ps[1]).SetHedging(0.9, 50*time.Millisecond)
+	defer c.Close()
+
+	// the default strategy selects the preferred provider only
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, c.strategy.Select(2), [][]int{{0}})
+	assert.Equal(t, ps[1].n.Load(), int32(0))
+
+	// the provider not selected is hedged
+	dp.delay.Store(int64(time.Second))
+	start := time.Now()
+	rsp, err := c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Answer[0].Data, "1.2.3.4")
+	assert.Lt(t, time.Since(start), 500*time.Millisecond)
+	assert.Equal(t, ps[1].n.Load(), int32(1))
+}
@@ -0,0 +1,341 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package hpke
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// Suite is HPKE cipher suite, see RFC 9180
+type Suite struct {
+	KEM  uint16
+	KDF  uint16
+	AEAD uint16
+}
+
+// Context is HPKE encryption context
+type Context struct {
+	suite    Suite
+	aead     cipher.AEAD
+	nonce    []byte
+	exporter []byte
+	seq      uint64
+}
+
+// Supported HPKE algorithms
+const (
+	// KEMP256 is DHKEM(P-256, HKDF-SHA256)
+	KEMP256 uint16 = 0x0010
+	// KEMX25519 is DHKEM(X25519, HKDF-SHA256)
+	KEMX25519 uint16 = 0x0020
+	// KDFSHA256 is HKDF-SHA256
+	KDFSHA256 uint16 = 0x0001
+	// KDFSHA384 is HKDF-SHA384
+	KDFSHA384 uint16 = 0x0002
+	// KDFSHA512 is HKDF-SHA512
+	KDFSHA512 uint16 = 0x0003
+	// AEADAES128GCM is AES-128-GCM
+	AEADAES128GCM uint16 = 0x0001
+	// AEADAES256GCM is AES-256-GCM
+	AEADAES256GCM uint16 = 0x0002
+)
+
+// ErrOpen is returned when decryption failed
+var ErrOpen = errors.New("hpke: decryption failed")
+
+// Version returns package version
+func Version() string {
+	return "0.1.0"
+}
+
+// Author returns package author
+func Author() string {
+	return "[Li Kexian](https://www.likexian.com/)"
+}
+
+// License returns package license
+func License() string {
+	return "Licensed under the Apache License 2.0"
+}
+
+// Supported returns if the suite is supported
+func (s Suite) Supported() bool {
+	return s.curve() != nil && s.hash() != nil && s.KeySize() > 0
+}
+
+// KeySize returns the key size of AEAD, Nk
+func (s Suite) KeySize() int {
+	switch s.AEAD {
+	case AEADAES128GCM:
+		return 16
+	case AEADAES256GCM:
+		return 32
+	default:
+		return 0
+	}
+}
+
+// NonceSize returns the nonce size of AEAD, Nn
+func (s Suite) NonceSize() int {
+	return 12
+}
+
+// HashSize returns the output size of KDF, Nh
+func (s Suite) HashSize() int {
+	return s.hash()().Size()
+}
+
+// Extract is the KDF Extract function
+func (s Suite) Extract(salt, ikm []byte) []byte {
+	return extract(s.hash(), salt, ikm)
+}
+
+// Expand is the KDF Expand function
+func (s Suite) Expand(prk, info []byte, size int) []byte {
+	return expand(s.hash(), prk, info, size)
+}
+
+// NewAEAD returns the AEAD cipher of key
+func (s Suite) NewAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != s.KeySize() {
+		return nil, fmt.Errorf("hpke: invalid key size")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// GenerateKey returns a new private key of the suite KEM
+func (s Suite) GenerateKey() (*ecdh.PrivateKey, error) {
+	if !s.Supported() {
+		return nil, fmt.Errorf("hpke: unsupported suite")
+	}
+
+	return s.curve().GenerateKey(rand.Reader)
+}
+
+// SetupBaseS setups base mode sender context to public key, returns encapsulated key and context
+func (s Suite) SetupBaseS(pkR, info []byte) ([]byte, *Context, error) {
+	skE, err := s.GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return s.setupBaseS(pkR, info, skE)
+}
+
+// setupBaseS setups base mode sender context with the ephemeral key
+func (s Suite) setupBaseS(pkR, info []byte, skE *ecdh.PrivateKey) ([]byte, *Context, error) {
+	if !s.Supported() {
+		return nil, nil, fmt.Errorf("hpke: unsupported suite")
+	}
+
+	pk, err := s.curve().NewPublicKey(pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dh, err := skE.ECDH(pk)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	enc := skE.PublicKey().Bytes()
+	ctx, err := s.keySchedule(s.sharedSecret(dh, append(append([]byte{}, enc...), pkR...)), info)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return enc, ctx, nil
+}
+
+// SetupBaseR setups base mode receiver context of encapsulated key
+func (s Suite) SetupBaseR(enc []byte, skR *ecdh.PrivateKey, info []byte) (*Context, error) {
+	if !s.Supported() {
+		return nil, fmt.Errorf("hpke: unsupported suite")
+	}
+
+	pkE, err := s.curve().NewPublicKey(enc)
+	if err != nil {
+		return nil, err
+	}
+
+	dh, err := skR.ECDH(pkE)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.keySchedule(s.sharedSecret(dh, append(append([]byte{}, enc...), skR.PublicKey().Bytes()...)), info)
+}
+
+// Seal encrypts plaintext with additional data
+func (c *Context) Seal(aad, pt []byte) []byte {
+	ct := c.aead.Seal(nil, c.nextNonce(), pt, aad)
+	c.seq++
+	return ct
+}
+
+// Open decrypts ciphertext with additional data
+func (c *Context) Open(aad, ct []byte) ([]byte, error) {
+	pt, err := c.aead.Open(nil, c.nextNonce(), ct, aad)
+	if err != nil {
+		return nil, ErrOpen
+	}
+
+	c.seq++
+
+	return pt, nil
+}
+
+// Export returns secret derived from exporter secret
+func (c *Context) Export(exporterContext []byte, size int) []byte {
+	return c.suite.labeledExpand(c.suite.id(), c.exporter, "sec", exporterContext, size)
+}
+
+// nextNonce returns the nonce of current sequence
+func (c *Context) nextNonce() []byte {
+	nonce := append([]byte{}, c.nonce...)
+	seq := binary.BigEndian.AppendUint64(nil, c.seq)
+	for i := range seq {
+		nonce[len(nonce)-len(seq)+i] ^= seq[i]
+	}
+
+	return nonce
+}
+
+// keySchedule returns the base mode context of shared secret
+func (s Suite) keySchedule(secret, info []byte) (*Context, error) {
+	id := s.id()
+	pskIDHash := s.labeledExtract(id, nil, "psk_id_hash", nil)
+	infoHash := s.labeledExtract(id, nil, "info_hash", info)
+	ksContext := append(append([]byte{0}, pskIDHash...), infoHash...)
+
+	secret = s.labeledExtract(id, secret, "secret", nil)
+	aead, err := s.NewAEAD(s.labeledExpand(id, secret, "key", ksContext, s.KeySize()))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Context{
+		suite:    s,
+		aead:     aead,
+		nonce:    s.labeledExpand(id, secret, "base_nonce", ksContext, s.NonceSize()),
+		exporter: s.labeledExpand(id, secret, "exp", ksContext, s.HashSize()),
+	}, nil
+}
+
+// sharedSecret returns the KEM shared secret of dh
+func (s Suite) sharedSecret(dh, kemContext []byte) []byte {
+	id := binary.BigEndian.AppendUint16([]byte("KEM"), s.KEM)
+	kem := Suite{KEM: s.KEM, KDF: KDFSHA256}
+	prk := kem.labeledExtract(id, nil, "eae_prk", dh)
+	return kem.labeledExpand(id, prk, "shared_secret", kemContext, 32)
+}
+
+// id returns the suite id of key schedule
+func (s Suite) id() []byte {
+	id := []byte("HPKE")
+	id = binary.BigEndian.AppendUint16(id, s.KEM)
+	id = binary.BigEndian.AppendUint16(id, s.KDF)
+	return binary.BigEndian.AppendUint16(id, s.AEAD)
+}
+
+// labeledExtract is the HPKE LabeledExtract function
+func (s Suite) labeledExtract(id, salt []byte, label string, ikm []byte) []byte {
+	data := append([]byte("HPKE-v1"), id...)
+	data = append(append(data, label...), ikm...)
+	return s.Extract(salt, data)
+}
+
+// labeledExpand is the HPKE LabeledExpand function
+func (s Suite) labeledExpand(id, prk []byte, label string, info []byte, size int) []byte {
+	data := binary.BigEndian.AppendUint16(nil, uint16(size))
+	data = append(append(data, "HPKE-v1"...), id...)
+	data = append(append(data, label...), info...)
+	return s.Expand(prk, data, size)
+}
+
+// curve returns the curve of KEM
+func (s Suite) curve() ecdh.Curve {
+	switch s.KEM {
+	case KEMX25519:
+		return ecdh.X25519()
+	case KEMP256:
+		return ecdh.P256()
+	default:
+		return nil
+	}
+}
+
+// hash returns the hash of KDF
+func (s Suite) hash() func() hash.Hash {
+	switch s.KDF {
+	case KDFSHA256:
+		return sha256.New
+	case KDFSHA384:
+		return sha512.New384
+	case KDFSHA512:
+		return sha512.New
+	default:
+		return nil
+	}
+}
+
+// extract is the HKDF Extract function, see RFC 5869
+func extract(h func() hash.Hash, salt, ikm []byte) []byte {
+	if len(salt) == 0 {
+		salt = make([]byte, h().Size())
+	}
+
+	m := hmac.New(h, salt)
+	m.Write(ikm)
+
+	return m.Sum(nil)
+}
+
+// expand is the HKDF Expand function, see RFC 5869
+func expand(h func() hash.Hash, prk, info []byte, size int) []byte {
+	r := []byte{}
+	t := []byte{}
+	for i := byte(1); len(r) < size; i++ {
+		m := hmac.New(h, prk)
+		m.Write(t)
+		m.Write(info)
+		m.Write([]byte{i})
+		t = m.Sum(nil)
+		r = append(r, t...)
+	}
+
+	return r[:size]
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package hpke
+
+import (
+	"crypto/ecdh"
+	"encoding/hex"
+	"testing"
+
+	"github.com/likexian/gokit/assert"
+)
+
+func unhex(s string) []byte {
+	b, _ := hex.DecodeString(s)
+	return b
+}
+
+func TestVersion(t *testing.T) {
+	assert.Contains(t, Version(), ".")
+	assert.Contains(t, Author(), "likexian")
+	assert.Contains(t, License(), "Apache License")
+}
+
+// RFC 9180 A.1.1, DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-128-GCM, base mode
+func TestVector(t *testing.T) {
+	s := Suite{KEM: KEMX25519, KDF: KDFSHA256, AEAD: AEADAES128GCM}
+	assert.True(t, s.Supported())
+
+	info := unhex("4f6465206f6e2061204772656369616e2055726e")
+	skE, err := ecdh.X25519().NewPrivateKey(unhex("52c4a758a802cd8b936eceea314432798d5baf2d7e9235dc084ab1b9cfa2f736"))
+	assert.Nil(t, err)
+	skR, err := ecdh.X25519().NewPrivateKey(unhex("4612c550263fc8ad58375df3f557aac531d26850903e55a9f23f21d8534e8ac8"))
+	assert.Nil(t, err)
+
+	pkR := unhex("3948cfe0ad1ddb695d780e59077195da6c56506b027329794ab02bca80815c4d")
+	assert.Equal(t, skR.PublicKey().Bytes(), pkR)
+
+	enc, sender, err := s.setupBaseS(pkR, info, skE)
+	assert.Nil(t, err)
+	assert.Equal(t, enc, unhex("37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431"))
+	assert.Equal(t, sender.nonce, unhex("56d890e5accaaf011cff4b7d"))
+	assert.Equal(t, sender.exporter, unhex("45ff1c2e220db587171952c0592d5f5ebe103f1561a2614e38f2ffd47e99e3f8"))
+
+	pt := unhex("4265617574792069732074727574682c20747275746820626561757479")
+	ct := sender.Seal(unhex("436f756e742d30"), pt)
+	assert.Equal(t, ct, unhex("f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a"))
+
+	receiver, err := s.SetupBaseR(enc, skR, info)
+	assert.Nil(t, err)
+
+	v, err := receiver.Open(unhex("436f756e742d30"), ct)
+	assert.Nil(t, err)
+	assert.Equal(t, v, pt)
+
+	_, err = receiver.Open(unhex("436f756e742d30"), ct)
+	assert.Equal(t, err, ErrOpen)
+}
+
+func TestSetup(t *testing.T) {
+	for _, s := range []Suite{
+		{KEM: KEMX25519, KDF: KDFSHA256, AEAD: AEADAES128GCM},
+		{KEM: KEMP256, KDF: KDFSHA384, AEAD: AEADAES256GCM},
+		{KEM: KEMX25519, KDF: KDFSHA512, AEAD: AEADAES128GCM},
+	} {
+		skR, err := s.GenerateKey()
+		assert.Nil(t, err)
+
+		enc, sender, err := s.SetupBaseS(skR.PublicKey().Bytes(), []byte("info"))
+		assert.Nil(t, err)
+
+		receiver, err := s.SetupBaseR(enc, skR, []byte("info"))
+		assert.Nil(t, err)
+
+		for i := 0; i < 3; i++ {
+			ct := sender.Seal([]byte("aad"), []byte("likexian"))
+			pt, err := receiver.Open([]byte("aad"), ct)
+			assert.Nil(t, err)
+			assert.Equal(t, pt, []byte("likexian"))
+		}
+
+		assert.Equal(t, sender.Export([]byte("ctx"), 32), receiver.Export([]byte("ctx"), 32))
+
+		_, err = s.SetupBaseR(enc[:10], skR, nil)
+		assert.NotNil(t, err)
+	}
+
+	s := Suite{KEM: 0x0021, KDF: KDFSHA256, AEAD: AEADAES128GCM}
+	assert.False(t, s.Supported())
+
+	_, err := s.GenerateKey()
+	assert.NotNil(t, err)
+
+	_, _, err = s.SetupBaseS(nil, nil)
+	assert.NotNil(t, err)
+
+	_, err = s.SetupBaseR(nil, nil, nil)
+	assert.NotNil(t, err)
+}
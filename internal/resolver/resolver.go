@@ -0,0 +1,124 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package resolver
+
+import (
+	"context"
+
+	"github.com/likexian/doh"
+	"github.com/likexian/doh/dns"
+)
+
+// Version returns package version
+func Version() string {
+	return "0.1.0"
+}
+
+// Author returns package author
+func Author() string {
+	return "[Li Kexian](https://www.likexian.com/)"
+}
+
+// License returns package license
+func License() string {
+	return "Licensed under the Apache License 2.0"
+}
+
+// Query resolves question by provider with options, returns SERVFAIL response if failed
+func Query(ctx context.Context, p doh.Provider, q dns.Question, o dns.Options) *dns.Response {
+	rsp, _ := p.QueryWithOptions(ctx, q, o)
+	if rsp != nil {
+		r := *rsp
+		return &r
+	}
+
+	return &dns.Response{
+		Status:   int(dns.RCodeServFail),
+		Provider: p.String(),
+	}
+}
+
+// Resolve resolves wire format query by provider, returns the reply message and the response
+func Resolve(ctx context.Context, p doh.Provider, q *dns.Msg) (*dns.Msg, *dns.Response) {
+	var rsp *dns.Response
+	if q.Opcode != 0 {
+		rsp = &dns.Response{Status: int(dns.RCodeNotImp)}
+	} else {
+		o := dns.Options{
+			CD:  q.CD,
+			ECS: q.ECS(),
+		}
+		if q.EDNS != nil {
+			o.DO = q.EDNS.DO
+		}
+		rsp = Query(ctx, p, q.Question[0], o)
+	}
+
+	m := rsp.Msg()
+	m.ID = q.ID
+	m.Opcode = q.Opcode
+	m.RD = q.RD
+	m.CD = m.CD || q.CD
+	m.Question = q.Question
+	if q.EDNS != nil {
+		edns := &dns.EDNS{
+			UDPSize: q.EDNS.UDPSize,
+			DO:      q.EDNS.DO,
+		}
+		if m.EDNS != nil {
+			edns.Options = m.EDNS.Options
+		}
+		// the response is padded if the query is padded, see RFC 8467
+		if q.Padded() {
+			edns.Padding = dns.ResponsePadding
+		}
+		m.EDNS = edns
+	} else {
+		m.EDNS = nil
+	}
+
+	return m, rsp
+}
+
+// ServFail returns the SERVFAIL reply message of query
+func ServFail(q *dns.Msg) *dns.Msg {
+	return &dns.Msg{
+		ID:       q.ID,
+		QR:       true,
+		Opcode:   q.Opcode,
+		RD:       q.RD,
+		RCode:    int(dns.RCodeServFail),
+		Question: q.Question,
+	}
+}
+
+// MinTTL returns the min TTL of answer and authority records, -1 if no records
+func MinTTL(rsp *dns.Response) int {
+	ttl := -1
+	for _, rrs := range [][]dns.Answer{rsp.Answer, rsp.Authority} {
+		for _, v := range rrs {
+			if ttl < 0 || v.TTL < ttl {
+				ttl = v.TTL
+			}
+		}
+	}
+
+	return ttl
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/gokit/assert"
+)
+
+type testProvider struct{}
+
+func (p *testProvider) Query(ctx context.Context, d dns.Domain, t dns.Type, s ...dns.ECS) (*dns.Response, error) {
+	if d == "blocked.likexian.com." {
+		rsp := &dns.Response{
+			Status:   3,
+			EDE:      []dns.ExtendedError{{InfoCode: dns.EDEBlocked}},
+			Provider: "test",
+		}
+		return rsp, rsp.Err()
+	}
+
+	if d != "likexian.com." {
+		return nil, fmt.Errorf("test: query failed")
+	}
+
+	return &dns.Response{
+		Answer: []dns.Answer{
+			{Name: "likexian.com.", Type: 1, TTL: 600, Data: "1.2.3.4"},
+			{Name: "likexian.com.", Type: 1, TTL: 60, Data: "5.6.7.8"},
+		},
+	}, nil
+}
+
+func (p *testProvider) QueryWithOptions(ctx context.Context, q dns.Question, o dns.Options) (*dns.Response, error) {
+	rsp, err := p.Query(ctx, dns.Domain(q.Name), dns.TypeFromCode(q.Type), o.ECS)
+	if rsp != nil {
+		rsp.AD = o.DO
+		rsp.CD = o.CD
+	}
+
+	return rsp, err
+}
+
+func (p *testProvider) String() string {
+	return "test"
+}
+
+func TestVersion(t *testing.T) {
+	assert.Contains(t, Version(), ".")
+	assert.Contains(t, Author(), "likexian")
+	assert.Contains(t, License(), "Apache License")
+}
+
+func TestResolve(t *testing.T) {
+	ctx := context.Background()
+	p := &testProvider{}
+
+	q, err := dns.NewQuery("likexian.com.", dns.TypeA)
+	assert.Nil(t, err)
+	q.ID = 1234
+	q.CD = true
+
+	m, rsp := Resolve(ctx, p, q)
+	assert.Equal(t, m.ID, q.ID)
+	assert.True(t, m.QR)
+	assert.True(t, m.CD)
+	assert.NotNil(t, m.EDNS)
+	assert.Len(t, m.Answer, 2)
+	assert.Equal(t, MinTTL(rsp), 60)
+	assert.False(t, m.AD)
+
+	// the DO bit of query is passed to provider
+	q.EDNS.DO = true
+	m, _ = Resolve(ctx, p, q)
+	assert.True(t, m.AD)
+	assert.True(t, m.EDNS.DO)
+
+	// the response is padded if the query is padded
+	q.EDNS.Padding = dns.QueryPadding
+	m, _ = Resolve(ctx, p, q)
+	b, err := m.Pack()
+	assert.Nil(t, err)
+	assert.Equal(t, len(b), dns.ResponsePadding)
+	q.EDNS.Padding = 0
+
+	q.Question[0].Name = "fail.likexian.com."
+	m, rsp = Resolve(ctx, p, q)
+	assert.Equal(t, m.RCode, int(dns.RCodeServFail))
+	assert.Equal(t, rsp.Provider, "test")
+	assert.Equal(t, MinTTL(rsp), -1)
+
+	// the extended dns errors are kept only if the query has edns0
+	q.Question[0].Name = "blocked.likexian.com."
+	m, _ = Resolve(ctx, p, q)
+	assert.Equal(t, m.RCode, int(dns.RCodeNXDomain))
+	assert.Equal(t, m.ExtendedErrors(), []dns.ExtendedError{{InfoCode: dns.EDEBlocked}})
+
+	edns := q.EDNS
+	q.EDNS = nil
+	m, _ = Resolve(ctx, p, q)
+	assert.True(t, m.EDNS == nil)
+	q.EDNS = edns
+
+	q.Opcode = 2
+	m, _ = Resolve(ctx, p, q)
+	assert.Equal(t, m.RCode, int(dns.RCodeNotImp))
+
+	m = ServFail(q)
+	assert.Equal(t, m.ID, q.ID)
+	assert.Equal(t, m.RCode, int(dns.RCodeServFail))
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package resolver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/likexian/doh"
+	"github.com/likexian/doh/dns"
+)
+
+// Stats is the stats recorder of server
+type Stats struct {
+	stats doh.ServeStats
+	sync.Mutex
+}
+
+// Observe records the query of transport, with the resolving time and the response
+func (s *Stats) Observe(transport string, rtt time.Duration, rsp *dns.Response) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.init()
+	s.stats.Queries[transport]++
+	s.stats.RCodes[dns.RCode(rsp.Status)]++
+	s.stats.Latency.Observe(rtt)
+}
+
+// Invalid records an invalid query
+func (s *Stats) Invalid() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.init()
+	s.stats.Invalid++
+}
+
+// Stats returns a copy of the stats
+func (s *Stats) Stats() doh.ServeStats {
+	s.Lock()
+	defer s.Unlock()
+
+	s.init()
+	r := doh.ServeStats{
+		Queries: map[string]int64{},
+		Invalid: s.stats.Invalid,
+		RCodes:  map[dns.RCode]int64{},
+		Latency: s.stats.Latency,
+	}
+
+	for k, v := range s.stats.Queries {
+		r.Queries[k] = v
+	}
+
+	for k, v := range s.stats.RCodes {
+		r.RCodes[k] = v
+	}
+
+	r.Latency.Counts = append([]int64(nil), s.stats.Latency.Counts...)
+
+	return r
+}
+
+// init initializes the stats, the lock must be held
+func (s *Stats) init() {
+	if s.stats.Queries == nil {
+		s.stats = doh.ServeStats{
+			Queries: map[string]int64{},
+			RCodes:  map[dns.RCode]int64{},
+			Latency: doh.NewHistogram(),
+		}
+	}
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package resolver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/gokit/assert"
+)
+
+func TestStats(t *testing.T) {
+	s := &Stats{}
+	stats := s.Stats()
+	assert.Len(t, stats.Queries, 0)
+	assert.Equal(t, stats.Latency.Count, int64(0))
+
+	s.Observe("udp", time.Millisecond, &dns.Response{})
+	s.Observe("tcp", time.Second, &dns.Response{Status: 3})
+	s.Invalid()
+
+	stats = s.Stats()
+	assert.Equal(t, stats.Queries, map[string]int64{"udp": 1, "tcp": 1})
+	assert.Equal(t, stats.Invalid, int64(1))
+	assert.Equal(t, stats.RCodes, map[dns.RCode]int64{dns.RCodeNoError: 1, dns.RCodeNXDomain: 1})
+	assert.Equal(t, stats.Latency.Count, int64(2))
+
+	// the stats are copied
+	stats.Queries["udp"] = 100
+	stats.Latency.Counts[0] = 100
+	assert.Equal(t, s.Stats().Queries["udp"], int64(1))
+	assert.Equal(t, s.Stats().Latency.Counts[0], int64(1))
+}
@@ -0,0 +1,338 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/doh/trace"
+	"github.com/likexian/gokit/xip"
+)
+
+// Client is the shared DoH upstream client of providers
+type Client struct {
+	// Name is the provider name
+	Name string
+	// URL is the DoH upstream url
+	URL string
+	// Format is the DoH message format
+	Format dns.Format
+	// Method is the http method of wire format query, GET is default
+	Method string
+	// UserAgent is the http user agent
+	UserAgent string
+	// Header is the extra http header
+	Header http.Header
+	// SubnetAddrOnly sends the edns_client_subnet without prefix length in json format
+	SubnetAddrOnly bool
+	// Client is the http client, the shared client is used if nil
+	Client *http.Client
+	// Padding pads all queries to hide the size, see RFC 8467
+	Padding bool
+}
+
+const (
+	// jsonContentType is the content type of json format
+	jsonContentType = "application/dns-json"
+	// wireContentType is the content type of wire format
+	wireContentType = "application/dns-message"
+	// maxMessageSize is the max size of dns message
+	maxMessageSize = 65535
+	// paddingChars is the chars of random_padding
+	paddingChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+)
+
+var (
+	// httpClient is DoH http client
+	httpClient = &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout:   3 * time.Second,
+				KeepAlive: 60 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout: 3 * time.Second,
+			DisableKeepAlives:   false,
+			MaxIdleConns:        256,
+			MaxIdleConnsPerHost: 256,
+		},
+	}
+)
+
+// Version returns package version
+func Version() string {
+	return "0.1.0"
+}
+
+// Author returns package author
+func Author() string {
+	return "[Li Kexian](https://www.likexian.com/)"
+}
+
+// License returns package license
+func License() string {
+	return "Licensed under the Apache License 2.0"
+}
+
+// Query do DoH query with the edns0-client-subnet option
+func (c *Client) Query(ctx context.Context, d dns.Domain, t dns.Type, s ...dns.ECS) (*dns.Response, error) {
+	o := dns.Options{}
+	if len(s) > 0 {
+		o.ECS = s[0]
+	}
+
+	return c.query(ctx, d, t, o)
+}
+
+// QueryWithOptions do DoH query of question with options
+func (c *Client) QueryWithOptions(ctx context.Context, q dns.Question, o dns.Options) (*dns.Response, error) {
+	return c.query(ctx, dns.Domain(q.Name), dns.TypeFromCode(q.Type), o)
+}
+
+// query do DoH query in the client format
+func (c *Client) query(ctx context.Context, d dns.Domain, t dns.Type, o dns.Options) (rr *dns.Response, err error) {
+	ctx, tr := trace.Start(ctx, c.Name, string(d), t)
+	defer func() {
+		tr.Finish(rr, err)
+	}()
+
+	switch c.Format {
+	case dns.FormatJSON:
+		rr, err = c.queryJSON(ctx, d, t, o)
+	case dns.FormatWire:
+		rr, err = c.queryWire(ctx, d, t, o)
+	default:
+		return nil, fmt.Errorf("%s: invalid dns format", c.Name)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	rr.Provider = c.Name
+
+	return rr, rr.Err()
+}
+
+// queryJSON do DoH query in json format
+func (c *Client) queryJSON(ctx context.Context, d dns.Domain, t dns.Type, o dns.Options) (*dns.Response, error) {
+	if o.Method != "" && o.Method != http.MethodGet {
+		return nil, fmt.Errorf("%s: invalid http method of json format: %s", c.Name, o.Method)
+	}
+
+	name, err := d.Punycode()
+	if err != nil {
+		return nil, err
+	}
+
+	param := url.Values{}
+	param.Add("name", name)
+	// the json api accepts mnemonic or number, but not the RFC 3597 TYPEnnn
+	typ := strings.TrimSpace(string(t))
+	if strings.HasPrefix(strings.ToUpper(typ), "TYPE") {
+		if code, err := t.Code(); err == nil {
+			typ = strconv.Itoa(code)
+		}
+	}
+	param.Add("type", typ)
+
+	ss := strings.TrimSpace(string(o.ECS))
+	if ss != "" {
+		if c.SubnetAddrOnly {
+			ss = strings.Split(ss, "/")[0]
+		} else {
+			ss, err = xip.FixSubnet(ss)
+			if err != nil {
+				return nil, err
+			}
+		}
+		param.Add("edns_client_subnet", ss)
+	}
+
+	if o.DO {
+		param.Add("do", "1")
+	}
+
+	if o.CD {
+		param.Add("cd", "1")
+	}
+
+	dnsURL, err := c.buildURL(param)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.Padding || c.Padding {
+		param.Add("random_padding", randomPadding(len(dnsURL)+len("&random_padding=")))
+		dnsURL, err = c.buildURL(param)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dnsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", jsonContentType)
+
+	data, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	trace.TracerFromContext(ctx).Decode()
+	rr := &dns.Response{}
+	err = json.Unmarshal(data, rr)
+	if err != nil {
+		return nil, err
+	}
+
+	return rr, nil
+}
+
+// queryWire do DoH query in RFC 8484 wire format
+func (c *Client) queryWire(ctx context.Context, d dns.Domain, t dns.Type, o dns.Options) (*dns.Response, error) {
+	msg, err := dns.NewQuery(d, t, o.ECS)
+	if err != nil {
+		return nil, err
+	}
+
+	msg.CD = o.CD
+	msg.EDNS.DO = o.DO
+	if o.Padding || c.Padding {
+		msg.EDNS.Padding = dns.QueryPadding
+	}
+
+	data, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	method := c.Method
+	if o.Method != "" {
+		method = o.Method
+	}
+
+	var req *http.Request
+	switch method {
+	case "", http.MethodGet:
+		param := url.Values{}
+		param.Add("dns", base64.RawURLEncoding.EncodeToString(data))
+		dnsURL, err := c.buildURL(param)
+		if err != nil {
+			return nil, err
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, dnsURL, nil)
+		if err != nil {
+			return nil, err
+		}
+	case http.MethodPost:
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", wireContentType)
+	default:
+		return nil, fmt.Errorf("%s: invalid http method: %s", c.Name, method)
+	}
+
+	req.Header.Set("Accept", wireContentType)
+
+	data, err = c.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	trace.TracerFromContext(ctx).Decode()
+	rsp := &dns.Msg{}
+	err = rsp.Unpack(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return rsp.Response(), nil
+}
+
+// buildURL returns the upstream url with query param
+func (c *Client) buildURL(param url.Values) (string, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	for k, v := range param {
+		query[k] = v
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// do sends the http request and returns the response body
+func (c *Client) do(req *http.Request) ([]byte, error) {
+	// the custom header overrides the default user agent
+	req.Header.Set("User-Agent", c.UserAgent)
+	for k, v := range c.Header {
+		req.Header[k] = v
+	}
+
+	client := c.Client
+	if client == nil {
+		client = httpClient
+	}
+
+	rsp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status code: %d", rsp.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(rsp.Body, maxMessageSize))
+}
+
+// randomPadding returns the random_padding of json format, pads the url of size n to the block size
+func randomPadding(n int) string {
+	b := make([]byte, (dns.QueryPadding-n%dns.QueryPadding)%dns.QueryPadding)
+	for i := range b {
+		b[i] = paddingChars[rand.Intn(len(paddingChars))]
+	}
+
+	return string(b)
+}
@@ -0,0 +1,282 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package upstream
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/doh/trace"
+	"github.com/likexian/gokit/assert"
+)
+
+func TestVersion(t *testing.T) {
+	assert.Contains(t, Version(), ".")
+	assert.Contains(t, Author(), "likexian")
+	assert.Contains(t, License(), "Apache License")
+}
+
+func newServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		answer := []dns.Answer{{Name: "likexian.com.", Type: 1, TTL: 600, Data: "1.2.3.4"}}
+		if r.Header.Get("Accept") == jsonContentType {
+			rsp := &dns.Response{
+				AD:       r.URL.Query().Get("do") == "1",
+				CD:       r.URL.Query().Get("cd") == "1",
+				Question: []dns.Question{{Name: r.URL.Query().Get("name"), Type: 1}},
+				Answer:   answer,
+			}
+			if v, err := dns.Type(r.URL.Query().Get("type")).Code(); err == nil {
+				answer[0].Type = v
+			}
+			if r.URL.Query().Get("name") == "nx.likexian.com" {
+				rsp.Status = 3
+				rsp.Comment = "EDE(15): Blocked (ads)"
+			}
+			rsp.Answer[0].Data = r.URL.Query().Get("edns_client_subnet")
+			if r.URL.Query().Has("random_padding") {
+				rsp.Answer[0].Data = fmt.Sprintf("0.0.0.%d", len("http://"+r.Host+r.URL.RequestURI())%dns.QueryPadding)
+			}
+			_ = json.NewEncoder(w).Encode(rsp)
+			return
+		}
+
+		var data []byte
+		var err error
+		if r.Method == http.MethodPost {
+			assert.Equal(t, r.Header.Get("Content-Type"), wireContentType)
+			data, err = io.ReadAll(r.Body)
+		} else {
+			data, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		q := &dns.Msg{}
+		if q.Unpack(data) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		rsp := &dns.Response{RD: true, RA: true, AD: q.EDNS.DO, CD: q.CD, Question: q.Question, Answer: answer}
+		if r.Method == http.MethodPost {
+			rsp.Answer[0].Data = "5.6.7.8"
+		}
+		if q.Padded() {
+			rsp.Answer[0].Data = fmt.Sprintf("0.0.0.%d", len(data)%dns.QueryPadding)
+		}
+		if r.UserAgent() == "custom" {
+			rsp.Answer[0].Data = "9.9.9.9"
+		}
+		b, _ := rsp.Msg().Pack()
+		w.Header().Set("Content-Type", wireContentType)
+		_, _ = w.Write(b)
+	}))
+}
+
+func TestQuery(t *testing.T) {
+	ts := newServer(t)
+	defer ts.Close()
+
+	ctx := context.Background()
+	c := &Client{Name: "test", URL: ts.URL + "/dns-query"}
+
+	rsp, err := c.Query(ctx, "likexian.com", dns.TypeA, "1.1.1.1")
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Provider, "test")
+	assert.Equal(t, rsp.Answer[0].Data, "1.1.1.1/24")
+
+	c.SubnetAddrOnly = true
+	rsp, err = c.Query(ctx, "likexian.com", dns.TypeA, "1.1.1.1/24")
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Answer[0].Data, "1.1.1.1")
+
+	rsp, err = c.Query(ctx, "nx.likexian.com", dns.TypeA)
+	assert.True(t, errors.Is(err, dns.ErrNXDomain))
+	assert.Equal(t, err.Error(), "test: bad response code: NXDOMAIN, EDE(15): Blocked (ads)")
+	assert.Equal(t, rsp.Status, 3)
+	assert.Equal(t, rsp.EDE, []dns.ExtendedError{{InfoCode: dns.EDEBlocked, ExtraText: "ads"}})
+
+	// the RFC 3597 type is sent as number in json format
+	rsp, err = c.Query(ctx, "likexian.com", "TYPE65534")
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Answer[0].Type, 65534)
+
+	c.Format = dns.FormatWire
+	rsp, err = c.Query(ctx, "likexian.com", dns.TypeA, "1.1.1.1")
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Provider, "test")
+	assert.Equal(t, rsp.Question[0].Name, "likexian.com.")
+	assert.Equal(t, rsp.Answer[0].Data, "1.2.3.4")
+
+	c.Method = http.MethodPost
+	rsp, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Answer[0].Data, "5.6.7.8")
+
+	c.Method = http.MethodPut
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.NotNil(t, err)
+
+	c.Format = 100
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.NotNil(t, err)
+
+	c = &Client{Name: "test", URL: ts.URL + "/dns-query", Format: dns.FormatWire}
+	_, err = c.Query(ctx, "likexian.com", "XX")
+	assert.NotNil(t, err)
+
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA, "xx")
+	assert.NotNil(t, err)
+
+	// the custom user agent header is not overridden
+	c.UserAgent = "default"
+	c.Header = http.Header{"User-Agent": {"custom"}}
+	rsp, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Answer[0].Data, "9.9.9.9")
+}
+
+func TestQueryWithOptions(t *testing.T) {
+	ts := newServer(t)
+	defer ts.Close()
+
+	ctx := context.Background()
+	c := &Client{Name: "test", URL: ts.URL + "/dns-query"}
+
+	q := dns.Question{Name: "likexian.com", Type: 48}
+	rsp, err := c.QueryWithOptions(ctx, q, dns.Options{DO: true, CD: true, ECS: "1.1.1.1"})
+	assert.Nil(t, err)
+	assert.True(t, rsp.AD)
+	assert.True(t, rsp.CD)
+	assert.Equal(t, rsp.Answer[0].Type, 48)
+	assert.Equal(t, rsp.Answer[0].Data, "1.1.1.1/24")
+
+	rsp, err = c.QueryWithOptions(ctx, q, dns.Options{})
+	assert.Nil(t, err)
+	assert.False(t, rsp.AD)
+	assert.False(t, rsp.CD)
+
+	_, err = c.QueryWithOptions(ctx, q, dns.Options{Method: http.MethodPost})
+	assert.NotNil(t, err)
+
+	rsp, err = c.QueryWithOptions(ctx, dns.Question{Name: "likexian.com", Type: 65534}, dns.Options{})
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Answer[0].Type, 65534)
+
+	c.Format = dns.FormatWire
+	rsp, err = c.QueryWithOptions(ctx, q, dns.Options{DO: true, CD: true})
+	assert.Nil(t, err)
+	assert.True(t, rsp.AD)
+	assert.True(t, rsp.CD)
+	assert.Equal(t, rsp.Question[0].Type, 48)
+
+	rsp, err = c.QueryWithOptions(ctx, q, dns.Options{})
+	assert.Nil(t, err)
+	assert.False(t, rsp.AD)
+	assert.False(t, rsp.CD)
+	assert.Equal(t, rsp.Answer[0].Data, "1.2.3.4")
+
+	// the method of options overrides the client setting
+	rsp, err = c.QueryWithOptions(ctx, q, dns.Options{Method: http.MethodPost})
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Answer[0].Data, "5.6.7.8")
+
+	_, err = c.QueryWithOptions(ctx, q, dns.Options{Method: http.MethodPut})
+	assert.NotNil(t, err)
+}
+
+func TestQueryPadding(t *testing.T) {
+	ts := newServer(t)
+	defer ts.Close()
+
+	ctx := context.Background()
+	q := dns.Question{Name: "likexian.com", Type: 1}
+
+	for _, format := range []dns.Format{dns.FormatJSON, dns.FormatWire} {
+		c := &Client{Name: "test", URL: ts.URL + "/dns-query?ct=1", Format: format}
+		for _, name := range []string{"likexian.com", "www.likexian.com", "a-very-long-subdomain-name.likexian.com"} {
+			rsp, err := c.QueryWithOptions(ctx, dns.Question{Name: name, Type: 1}, dns.Options{Padding: true})
+			assert.Nil(t, err)
+			assert.Equal(t, rsp.Answer[0].Data, "0.0.0.0", name)
+		}
+
+		rsp, err := c.QueryWithOptions(ctx, q, dns.Options{})
+		assert.Nil(t, err)
+		assert.NotEqual(t, rsp.Answer[0].Data, "0.0.0.0")
+
+		c.Padding = true
+		rsp, err = c.QueryWithOptions(ctx, q, dns.Options{})
+		assert.Nil(t, err)
+		assert.Equal(t, rsp.Answer[0].Data, "0.0.0.0")
+	}
+}
+
+func TestQueryTrace(t *testing.T) {
+	ts := newServer(t)
+	defer ts.Close()
+
+	var spans []trace.Span
+	ctx := trace.WithHook(context.Background(), trace.HookFunc(func(s trace.Span) {
+		spans = append(spans, s)
+	}))
+
+	for _, format := range []dns.Format{dns.FormatJSON, dns.FormatWire} {
+		spans = nil
+		c := &Client{Name: "test", URL: ts.URL + "/dns-query", Format: format}
+
+		_, err := c.Query(ctx, "likexian.com", dns.TypeA)
+		assert.Nil(t, err)
+		_, err = c.Query(ctx, "likexian.com", dns.TypeMX)
+		assert.Nil(t, err)
+
+		assert.Len(t, spans, 2)
+		assert.Equal(t, spans[0].Provider, "test")
+		assert.Equal(t, spans[0].QName, "likexian.com")
+		assert.Equal(t, spans[0].QType, dns.TypeA)
+		assert.Equal(t, spans[0].Outcome, "ok")
+		assert.Gt(t, spans[0].TTFB, time.Duration(0))
+		assert.Gt(t, spans[0].Decode, time.Duration(0))
+		assert.Ge(t, spans[0].Total, spans[0].TTFB)
+		assert.Equal(t, spans[1].QType, dns.TypeMX)
+	}
+
+	// the span is tagged with response code
+	c := &Client{Name: "test", URL: ts.URL + "/dns-query"}
+	_, err := c.Query(ctx, "nx.likexian.com", dns.TypeA)
+	assert.NotNil(t, err)
+	assert.Equal(t, spans[len(spans)-1].Outcome, "NXDOMAIN")
+
+	c = &Client{Name: "test", URL: "http://127.0.0.1:1/dns-query"}
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.NotNil(t, err)
+	assert.Equal(t, spans[len(spans)-1].Outcome, "error")
+}
@@ -0,0 +1,311 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/likexian/doh"
+	"github.com/likexian/doh/dns"
+)
+
+// Listener is the server interface, such as DoH server handler and DNS stub resolver
+type Listener interface {
+	Stats() doh.ServeStats
+}
+
+// Handler is the http handler serves metrics in OpenMetrics text format
+type Handler struct {
+	clients   []client
+	listeners []listener
+	sync.Mutex
+}
+
+// client is the registered DoH client
+type client struct {
+	name string
+	c    *doh.DoH
+}
+
+// listener is the registered server
+type listener struct {
+	name string
+	l    Listener
+}
+
+// family is the metric family
+type family struct {
+	name    string
+	kind    string
+	help    string
+	samples []sample
+}
+
+// sample is the metric sample
+type sample struct {
+	suffix string
+	labels [][2]string
+	value  float64
+}
+
+// contentType is the content type of OpenMetrics text format
+const contentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// Version returns package version
+func Version() string {
+	return "0.1.0"
+}
+
+// Author returns package author
+func Author() string {
+	return "[Li Kexian](https://www.likexian.com/)"
+}
+
+// License returns package license
+func License() string {
+	return "Licensed under the Apache License 2.0"
+}
+
+// NewHandler returns a new metrics handler, register the DoH clients and servers to collect
+func NewHandler() *Handler {
+	return &Handler{}
+}
+
+// RegisterClient registers the DoH client by name, the name is the client label of metrics
+func (h *Handler) RegisterClient(name string, c *doh.DoH) *Handler {
+	h.Lock()
+	h.clients = append(h.clients, client{name, c})
+	h.Unlock()
+
+	return h
+}
+
+// RegisterListener registers the server by name, the name is the listener label of metrics
+func (h *Handler) RegisterListener(name string, l Listener) *Handler {
+	h.Lock()
+	h.listeners = append(h.listeners, listener{name, l})
+	h.Unlock()
+
+	return h
+}
+
+// ServeHTTP serves the metrics in OpenMetrics text format
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var b bytes.Buffer
+	_, _ = h.WriteTo(&b)
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	_, _ = w.Write(b.Bytes())
+}
+
+// WriteTo writes the metrics in OpenMetrics text format to w
+func (h *Handler) WriteTo(w io.Writer) (int64, error) {
+	var b bytes.Buffer
+	for _, f := range h.collect() {
+		f.write(&b)
+	}
+	b.WriteString("# EOF\n")
+
+	return b.WriteTo(w)
+}
+
+// collect returns the metric families of registered clients and servers
+func (h *Handler) collect() []*family {
+	h.Lock()
+	clients := append([]client(nil), h.clients...)
+	listeners := append([]listener(nil), h.listeners...)
+	h.Unlock()
+
+	queries := &family{name: "doh_provider_queries", kind: "counter", help: "Number of queries sent to provider."}
+	errors := &family{name: "doh_provider_errors", kind: "counter", help: "Number of failed queries of provider by kind."}
+	rcodes := &family{name: "doh_provider_responses", kind: "counter", help: "Number of responses of provider by response code."}
+	latency := &family{name: "doh_provider_latency_seconds", kind: "histogram", help: "Latency of queries of provider."}
+	state := &family{name: "doh_provider_breaker_state", kind: "stateset", help: "Circuit breaker state of provider."}
+	hits := &family{name: "doh_cache_hits", kind: "counter", help: "Number of fresh cache hits."}
+	misses := &family{name: "doh_cache_misses", kind: "counter", help: "Number of cache misses."}
+	stale := &family{name: "doh_cache_stale", kind: "counter", help: "Number of stale answers served from cache."}
+	flight := &family{name: "doh_flight_queries", kind: "counter", help: "Number of queries sent to providers or cache after coalescing."}
+	coalesced := &family{name: "doh_flight_coalesced", kind: "counter", help: "Number of queries coalesced into an in-flight query."}
+
+	for _, c := range clients {
+		s := c.c.TotalStats()
+		for _, p := range s.Providers {
+			labels := [][2]string{{"client", c.name}, {"provider", p.Provider}}
+			queries.add("_total", labels, float64(p.Total))
+			kinds := make([]string, 0, len(p.Errors))
+			for k := range p.Errors {
+				kinds = append(kinds, string(k))
+			}
+			sort.Strings(kinds)
+			for _, k := range kinds {
+				errors.add("_total", with(labels, "kind", k), float64(p.Errors[doh.ErrorKind(k)]))
+			}
+			rcodes.addRCodes(labels, p.RCodes)
+			latency.addHistogram(labels, p.Latency)
+			for _, v := range []doh.BreakerState{doh.BreakerClosed, doh.BreakerOpen, doh.BreakerHalfOpen} {
+				state.add("", with(labels, state.name, v.String()), boolValue(p.State == v))
+			}
+		}
+		labels := [][2]string{{"client", c.name}}
+		hits.add("_total", labels, float64(s.Cache.Hits))
+		misses.add("_total", labels, float64(s.Cache.Misses))
+		stale.add("_total", labels, float64(s.Cache.Stale))
+		flight.add("_total", labels, float64(s.Flight.Queries))
+		coalesced.add("_total", labels, float64(s.Flight.Coalesced))
+	}
+
+	lqueries := &family{name: "doh_listener_queries", kind: "counter", help: "Number of queries served by transport."}
+	linvalid := &family{name: "doh_listener_invalid", kind: "counter", help: "Number of invalid queries."}
+	lrcodes := &family{name: "doh_listener_responses", kind: "counter", help: "Number of responses served by response code."}
+	llatency := &family{name: "doh_listener_latency_seconds", kind: "histogram", help: "Latency of resolving served queries."}
+
+	for _, l := range listeners {
+		s := l.l.Stats()
+		labels := [][2]string{{"listener", l.name}}
+		transports := make([]string, 0, len(s.Queries))
+		for k := range s.Queries {
+			transports = append(transports, k)
+		}
+		sort.Strings(transports)
+		for _, k := range transports {
+			lqueries.add("_total", with(labels, "transport", k), float64(s.Queries[k]))
+		}
+		linvalid.add("_total", labels, float64(s.Invalid))
+		lrcodes.addRCodes(labels, s.RCodes)
+		llatency.addHistogram(labels, s.Latency)
+	}
+
+	return []*family{
+		queries, errors, rcodes, latency, state,
+		hits, misses, stale, flight, coalesced,
+		lqueries, linvalid, lrcodes, llatency,
+	}
+}
+
+// add adds a sample to family
+func (f *family) add(suffix string, labels [][2]string, value float64) {
+	f.samples = append(f.samples, sample{suffix, labels, value})
+}
+
+// addRCodes adds the samples of response codes to family, in order of response code
+func (f *family) addRCodes(labels [][2]string, rcodes map[dns.RCode]int64) {
+	codes := make([]dns.RCode, 0, len(rcodes))
+	for k := range rcodes {
+		codes = append(codes, k)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		return codes[i] < codes[j]
+	})
+
+	for _, k := range codes {
+		f.add("_total", with(labels, "rcode", k.String()), float64(rcodes[k]))
+	}
+}
+
+// addHistogram adds the samples of histogram to family, the buckets are cumulative
+func (f *family) addHistogram(labels [][2]string, h doh.Histogram) {
+	n := int64(0)
+	for i, v := range h.Counts {
+		n += v
+		le := "+Inf"
+		if i < len(h.Bounds) {
+			le = formatFloat(h.Bounds[i].Seconds())
+		}
+		f.add("_bucket", with(labels, "le", le), float64(n))
+	}
+
+	f.add("_count", labels, float64(h.Count))
+	f.add("_sum", labels, h.Sum.Seconds())
+}
+
+// write writes the family in OpenMetrics text format, the family without samples is skipped
+func (f *family) write(b *bytes.Buffer) {
+	if len(f.samples) == 0 {
+		return
+	}
+
+	fmt.Fprintf(b, "# TYPE %s %s\n", f.name, f.kind)
+	fmt.Fprintf(b, "# HELP %s %s\n", f.name, escape(f.help, false))
+	for _, s := range f.samples {
+		b.WriteString(f.name)
+		b.WriteString(s.suffix)
+		if len(s.labels) > 0 {
+			b.WriteByte('{')
+			for i, v := range s.labels {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				fmt.Fprintf(b, `%s="%s"`, v[0], escape(v[1], true))
+			}
+			b.WriteByte('}')
+		}
+		b.WriteByte(' ')
+		b.WriteString(formatFloat(s.value))
+		b.WriteByte('\n')
+	}
+}
+
+// with returns the labels with a new label
+func with(labels [][2]string, name, value string) [][2]string {
+	return append(append([][2]string(nil), labels...), [2]string{name, value})
+}
+
+// boolValue returns 1 if true, else 0
+func boolValue(v bool) float64 {
+	if v {
+		return 1
+	}
+
+	return 0
+}
+
+// formatFloat returns the float in text format
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// escape escapes the help text or label value
+func escape(s string, quote bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quote {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+
+	return s
+}
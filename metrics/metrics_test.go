@@ -0,0 +1,174 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/likexian/doh"
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/gokit/assert"
+)
+
+type testProvider struct{}
+
+func (p *testProvider) Query(ctx context.Context, d dns.Domain, t dns.Type, s ...dns.ECS) (*dns.Response, error) {
+	return nil, fmt.Errorf("test: not implemented")
+}
+
+func (p *testProvider) QueryWithOptions(ctx context.Context, q dns.Question, o dns.Options) (*dns.Response, error) {
+	switch q.Name {
+	case "likexian.com":
+		return &dns.Response{
+			Answer: []dns.Answer{{Name: "likexian.com.", Type: 1, TTL: 600, Data: "1.2.3.4"}},
+		}, nil
+	case "nx.likexian.com":
+		rsp := &dns.Response{Status: 3, Provider: p.String()}
+		return rsp, rsp.Err()
+	default:
+		return nil, fmt.Errorf("test: query failed")
+	}
+}
+
+func (p *testProvider) String() string {
+	return `test "provider"`
+}
+
+type testListener struct{}
+
+func (l *testListener) Stats() doh.ServeStats {
+	h := doh.NewHistogram()
+	h.Observe(time.Millisecond)
+	h.Observe(2 * time.Second)
+
+	return doh.ServeStats{
+		Queries: map[string]int64{"udp": 1, "tcp": 1},
+		Invalid: 3,
+		RCodes:  map[dns.RCode]int64{dns.RCodeServFail: 1, dns.RCodeNoError: 1},
+		Latency: h,
+	}
+}
+
+func TestVersion(t *testing.T) {
+	assert.Contains(t, Version(), ".")
+	assert.Contains(t, Author(), "likexian")
+	assert.Contains(t, License(), "Apache License")
+}
+
+func TestHandler(t *testing.T) {
+	ctx := context.Background()
+
+	c := doh.UseProvider(&testProvider{}).EnableCache(true)
+	defer c.Close()
+
+	for _, v := range []dns.Domain{"likexian.com", "likexian.com", "nx.likexian.com", "fail.likexian.com"} {
+		_, _ = c.Query(ctx, v, dns.TypeA)
+	}
+
+	h := NewHandler().RegisterClient("default", c).RegisterListener("stub", &testListener{})
+
+	var b bytes.Buffer
+	_, err := h.WriteTo(&b)
+	assert.Nil(t, err)
+
+	text := b.String()
+	labels := `client="default",provider="test \"provider\""`
+	for _, v := range []string{
+		"# TYPE doh_provider_queries counter\n",
+		"# HELP doh_provider_queries Number of queries sent to provider.\n",
+		"doh_provider_queries_total{" + labels + "} 3\n",
+		"doh_provider_errors_total{" + labels + `,kind="other"} 1` + "\n",
+		"doh_provider_responses_total{" + labels + `,rcode="NOERROR"} 1` + "\n",
+		"doh_provider_responses_total{" + labels + `,rcode="NXDOMAIN"} 1` + "\n",
+		"# TYPE doh_provider_latency_seconds histogram\n",
+		"doh_provider_latency_seconds_bucket{" + labels + `,le="0.005"} `,
+		"doh_provider_latency_seconds_bucket{" + labels + `,le="+Inf"} 3` + "\n",
+		"doh_provider_latency_seconds_count{" + labels + "} 3\n",
+		"doh_provider_latency_seconds_sum{" + labels + "} ",
+		"# TYPE doh_provider_breaker_state stateset\n",
+		"doh_provider_breaker_state{" + labels + `,doh_provider_breaker_state="closed"} 1` + "\n",
+		"doh_provider_breaker_state{" + labels + `,doh_provider_breaker_state="open"} 0` + "\n",
+		`doh_cache_hits_total{client="default"} 1` + "\n",
+		`doh_cache_misses_total{client="default"} 3` + "\n",
+		`doh_cache_stale_total{client="default"} 0` + "\n",
+		`doh_flight_queries_total{client="default"} 4` + "\n",
+		`doh_flight_coalesced_total{client="default"} 0` + "\n",
+		`doh_listener_queries_total{listener="stub",transport="tcp"} 1` + "\n",
+		`doh_listener_queries_total{listener="stub",transport="udp"} 1` + "\n",
+		`doh_listener_invalid_total{listener="stub"} 3` + "\n",
+		`doh_listener_responses_total{listener="stub",rcode="NOERROR"} 1` + "\n",
+		`doh_listener_responses_total{listener="stub",rcode="SERVFAIL"} 1` + "\n",
+		`doh_listener_latency_seconds_bucket{listener="stub",le="0.005"} 1` + "\n",
+		`doh_listener_latency_seconds_bucket{listener="stub",le="2.5"} 2` + "\n",
+		`doh_listener_latency_seconds_bucket{listener="stub",le="+Inf"} 2` + "\n",
+		`doh_listener_latency_seconds_count{listener="stub"} 2` + "\n",
+		`doh_listener_latency_seconds_sum{listener="stub"} 2.001` + "\n",
+	} {
+		assert.Contains(t, text, v)
+	}
+
+	// the families are not repeated and the text ends with EOF
+	assert.Equal(t, strings.Count(text, "# TYPE doh_provider_queries "), 1)
+	assert.True(t, strings.HasSuffix(text, "\n# EOF\n"))
+
+	// the family without samples is skipped
+	text = func() string {
+		var b bytes.Buffer
+		_, _ = NewHandler().WriteTo(&b)
+		return b.String()
+	}()
+	assert.Equal(t, text, "# EOF\n")
+}
+
+func TestServeHTTP(t *testing.T) {
+	ts := httptest.NewServer(NewHandler().RegisterListener("stub", &testListener{}))
+	defer ts.Close()
+
+	rsp, err := http.Get(ts.URL + "/metrics")
+	assert.Nil(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, rsp.StatusCode, http.StatusOK)
+	assert.Equal(t, rsp.Header.Get("Content-Type"), contentType)
+
+	body, err := io.ReadAll(rsp.Body)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), `doh_listener_invalid_total{listener="stub"} 3`)
+
+	rsp, err = http.Post(ts.URL+"/metrics", "text/plain", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.StatusCode, http.StatusMethodNotAllowed)
+
+	// the HEAD request has the headers only
+	w := httptest.NewRecorder()
+	ts.Config.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/metrics", nil))
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Header().Get("Content-Type"), contentType)
+	assert.Equal(t, w.Header().Get("Content-Length"), strconv.Itoa(len(body)))
+	assert.Equal(t, w.Body.Len(), 0)
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package doh
+
+import (
+	"time"
+
+	"github.com/likexian/doh/dns"
+)
+
+// cacheHits is the hit count of cache entry
+type cacheHits struct {
+	time   time.Time
+	expire time.Time
+	n      int
+}
+
+// SetPrefetch set the cache prefetch, the entry is refreshed in background if it is hit at least hits times
+// and its age reaches the fraction of ttl, at most concurrency prefetches are running, zero fraction to disable
+func (c *DoH) SetPrefetch(fraction float64, hits, concurrency int) *DoH {
+	if fraction <= 0 || fraction >= 1 || concurrency <= 0 {
+		fraction = 0
+		concurrency = 0
+	}
+
+	c.Lock()
+	c.prefetchc = nil
+	if concurrency > 0 {
+		c.prefetchc = make(chan struct{}, concurrency)
+	}
+	c.Unlock()
+
+	c.hmu.Lock()
+	c.prefetchAt = fraction
+	c.prefetchHit = hits
+	c.hits = map[string]*cacheHits{}
+	c.hmu.Unlock()
+
+	return c
+}
+
+// prefetch counts the hit of cache entry, and refreshes it in background if it is hot and about to expire,
+// the hits are guarded by the hits lock, so cache hits do not wait for the client lock
+func (c *DoH) prefetch(key string, e *cacheEntry, q dns.Question, o dns.Options) {
+	c.hmu.Lock()
+	if c.prefetchAt <= 0 {
+		c.hmu.Unlock()
+		return
+	}
+
+	h, ok := c.hits[key]
+	if !ok || !h.time.Equal(e.Time) {
+		h = &cacheHits{
+			time:   e.Time,
+			expire: e.Time.Add(time.Duration(e.TTL) * time.Second),
+		}
+		c.hits[key] = h
+	}
+	h.n++
+
+	ttl := time.Duration(e.TTL) * time.Second
+	hot := h.n >= c.prefetchHit && time.Since(e.Time) >= time.Duration(float64(ttl)*c.prefetchAt)
+	c.hmu.Unlock()
+
+	if hot {
+		c.refreshCache(key, q, o, true)
+	}
+}
+
+// cleanHits deletes the hit count of expired entries
+func (c *DoH) cleanHits() {
+	c.hmu.Lock()
+	defer c.hmu.Unlock()
+
+	now := time.Now()
+	for k, v := range c.hits {
+		if now.After(v.expire) {
+			delete(c.hits, k)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package doh
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/doh/provider/custom"
+	"github.com/likexian/gokit/assert"
+)
+
+func TestPrefetch(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	p, err := custom.NewClient(ts.URL+"/dns-query", dns.FormatWire)
+	assert.Nil(t, err)
+
+	store := newFakeRedis()
+	cp := &countProvider{Provider: p}
+	c := UseProvider(cp).SetCache(store).SetPrefetch(0.5, 2, 1)
+	defer c.Close()
+
+	// waitRefresh waits for the background refresh done
+	waitRefresh := func() {
+		for i := 0; i < 100; i++ {
+			c.RLock()
+			n := len(c.refresh)
+			c.RUnlock()
+			if n == 0 {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	_, err = c.Query(ctx, "ttl.likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, cp.n.Load(), int32(1))
+
+	// the entry is not prefetched before the fraction of ttl
+	for i := 0; i < 3; i++ {
+		_, err = c.Query(ctx, "ttl.likexian.com", dns.TypeA)
+		assert.Nil(t, err)
+	}
+	waitRefresh()
+	assert.Equal(t, cp.n.Load(), int32(1))
+
+	// the hot entry is prefetched at the fraction of ttl
+	e := expireCache(t, store, "ttl.likexian.com", 20*time.Second)
+	rsp, err := c.Query(ctx, "ttl.likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Answer[1].TTL, 10)
+	_, err = c.Query(ctx, "ttl.likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	waitRefresh()
+	assert.Equal(t, cp.n.Load(), int32(2))
+
+	f := expireCache(t, store, "ttl.likexian.com", 0)
+	assert.True(t, f.Time.After(e.Time))
+
+	// the entry is not prefetched if it is not hot
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	expireCache(t, store, "likexian.com", 500*time.Second)
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	waitRefresh()
+	assert.Equal(t, cp.n.Load(), int32(3))
+
+	// the prefetch is skipped if too many prefetches are running
+	c.prefetchc <- struct{}{}
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	waitRefresh()
+	assert.Equal(t, cp.n.Load(), int32(3))
+
+	<-c.prefetchc
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	waitRefresh()
+	assert.Equal(t, cp.n.Load(), int32(4))
+
+	// the cache hit does not wait for the client lock
+	c.RLock()
+	done := make(chan struct{})
+	go func() {
+		_, _ = c.Query(ctx, "likexian.com", dns.TypeA)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("cache hit is blocked by the client lock")
+	}
+	c.RUnlock()
+	<-done
+
+	// the prefetch is disabled
+	c.SetPrefetch(0, 0, 0)
+	expireCache(t, store, "ttl.likexian.com", 20*time.Second)
+	for i := 0; i < 3; i++ {
+		_, err = c.Query(ctx, "ttl.likexian.com", dns.TypeA)
+		assert.Nil(t, err)
+	}
+	waitRefresh()
+	assert.Equal(t, cp.n.Load(), int32(4))
+}
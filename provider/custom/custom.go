@@ -0,0 +1,138 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package custom
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/doh/internal/upstream"
+)
+
+// Client is DoH provider client of custom upstream
+type Client struct {
+	name    string
+	url     string
+	format  dns.Format
+	method  string
+	header  http.Header
+	client  *http.Client
+	padding bool
+}
+
+// Version returns package version
+func Version() string {
+	return "0.1.0"
+}
+
+// Author returns package author
+func Author() string {
+	return "[Li Kexian](https://www.likexian.com/)"
+}
+
+// License returns package license
+func License() string {
+	return "Licensed under the Apache License 2.0"
+}
+
+// NewClient returns a new provider client of DoH url and message format
+func NewClient(dnsURL string, f dns.Format) (*Client, error) {
+	u, err := url.Parse(dnsURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+		return nil, fmt.Errorf("custom: invalid DoH url: %s", dnsURL)
+	}
+
+	if f != dns.FormatJSON && f != dns.FormatWire {
+		return nil, fmt.Errorf("custom: invalid dns format")
+	}
+
+	return &Client{
+		name:   u.Host,
+		url:    dnsURL,
+		format: f,
+		method: http.MethodGet,
+		header: http.Header{},
+	}, nil
+}
+
+// String returns string of provider, it is the host of url by default
+func (c *Client) String() string {
+	return c.name
+}
+
+// SetName set name of provider
+func (c *Client) SetName(name string) {
+	c.name = name
+}
+
+// SetMethod set http method of wire format query, GET or POST, GET is default
+func (c *Client) SetMethod(m string) error {
+	if m != http.MethodGet && m != http.MethodPost {
+		return fmt.Errorf("custom: invalid http method: %s", m)
+	}
+	c.method = m
+	return nil
+}
+
+// SetHeader set extra http header sent with every query
+func (c *Client) SetHeader(key, value string) {
+	c.header.Set(key, value)
+}
+
+// SetHTTPClient set the http client of queries, for example with custom transport
+func (c *Client) SetHTTPClient(client *http.Client) {
+	c.client = client
+}
+
+// SetPadding set whether to pad queries to hide the size, see RFC 8467
+func (c *Client) SetPadding(padding bool) {
+	c.padding = padding
+}
+
+// Query do DoH query with the edns0-client-subnet option
+func (c *Client) Query(ctx context.Context, d dns.Domain, t dns.Type, s ...dns.ECS) (*dns.Response, error) {
+	return c.upstream().Query(ctx, d, t, s...)
+}
+
+// QueryWithOptions do DoH query of question with options
+func (c *Client) QueryWithOptions(ctx context.Context, q dns.Question, o dns.Options) (*dns.Response, error) {
+	return c.upstream().QueryWithOptions(ctx, q, o)
+}
+
+// upstream returns the upstream client of current settings
+func (c *Client) upstream() *upstream.Client {
+	return &upstream.Client{
+		Name:      c.name,
+		URL:       c.url,
+		Format:    c.format,
+		Method:    c.method,
+		UserAgent: fmt.Sprintf("DoH Client/%s", Version()),
+		Header:    c.header,
+		Client:    c.client,
+		Padding:   c.padding,
+	}
+}
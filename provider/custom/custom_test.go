@@ -0,0 +1,111 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package custom
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/gokit/assert"
+)
+
+func TestVersion(t *testing.T) {
+	assert.Contains(t, Version(), ".")
+	assert.Contains(t, Author(), "likexian")
+	assert.Contains(t, License(), "Apache License")
+}
+
+func TestNewClient(t *testing.T) {
+	_, err := NewClient("://", dns.FormatWire)
+	assert.NotNil(t, err)
+
+	_, err = NewClient("ftp://dns.likexian.com/dns-query", dns.FormatWire)
+	assert.NotNil(t, err)
+
+	_, err = NewClient("https:///dns-query", dns.FormatWire)
+	assert.NotNil(t, err)
+
+	_, err = NewClient("https://dns.likexian.com/dns-query", 100)
+	assert.NotNil(t, err)
+
+	c, err := NewClient("https://dns.likexian.com/dns-query", dns.FormatWire)
+	assert.Nil(t, err)
+	assert.Equal(t, c.String(), "dns.likexian.com")
+
+	c.SetName("likexian")
+	assert.Equal(t, c.String(), "likexian")
+
+	err = c.SetMethod(http.MethodPut)
+	assert.Equal(t, err.Error(), "custom: invalid http method: PUT")
+
+	err = c.SetMethod(http.MethodPost)
+	assert.Nil(t, err)
+}
+
+func TestQuery(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "likexian" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		answer := []dns.Answer{{Name: "likexian.com.", Type: 1, TTL: 600, Data: "1.2.3.4"}}
+		if r.URL.Query().Get("name") != "" {
+			_ = json.NewEncoder(w).Encode(&dns.Response{Answer: answer})
+			return
+		}
+
+		data, _ := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		q := &dns.Msg{}
+		if q.Unpack(data) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		b, _ := (&dns.Response{Question: q.Question, Answer: answer}).Msg().Pack()
+		_, _ = w.Write(b)
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	for _, f := range []dns.Format{dns.FormatJSON, dns.FormatWire} {
+		c, err := NewClient(ts.URL+"/profile?x=1", f)
+		assert.Nil(t, err)
+
+		_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+		assert.NotNil(t, err)
+
+		c.SetHeader("X-Token", "likexian")
+		rsp, err := c.Query(ctx, "likexian.com", dns.TypeA)
+		assert.Nil(t, err)
+		assert.Equal(t, rsp.Provider, c.String())
+		assert.Equal(t, rsp.Answer[0].Data, "1.2.3.4")
+
+		rsp, err = c.QueryWithOptions(ctx, dns.Question{Name: "likexian.com", Type: 1}, dns.Options{DO: true})
+		assert.Nil(t, err)
+		assert.Equal(t, rsp.Answer[0].Data, "1.2.3.4")
+	}
+}
@@ -0,0 +1,481 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package dot
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/doh/trace"
+)
+
+// Client is DNS over TLS provider client, see RFC 7858
+type Client struct {
+	name      string
+	addr      string
+	tlsConfig *tls.Config
+	dialer    *net.Dialer
+	conn      *conn
+	dialing   chan struct{}
+	padding   bool
+	sync.Mutex
+}
+
+// conn is a pipelined DNS over TLS connection
+type conn struct {
+	net.Conn
+	pending map[uint16]chan []byte
+	err     error
+	wmu     sync.Mutex
+	sync.Mutex
+}
+
+const (
+	// defaultPort is DNS over TLS default port
+	defaultPort = "853"
+	// idleTimeout is the idle timeout of connection
+	idleTimeout = 30 * time.Second
+)
+
+var (
+	// dialer is DNS over TLS dialer
+	dialer = &net.Dialer{
+		Timeout:   3 * time.Second,
+		KeepAlive: 60 * time.Second,
+	}
+	// errConnClosed is returned when the connection is closed
+	errConnClosed = errors.New("dot: connection closed")
+)
+
+// Version returns package version
+func Version() string {
+	return "0.1.0"
+}
+
+// Author returns package author
+func Author() string {
+	return "[Li Kexian](https://www.likexian.com/)"
+}
+
+// License returns package license
+func License() string {
+	return "Licensed under the Apache License 2.0"
+}
+
+// NewClient returns a new DNS over TLS client, for example: dns.google or 1.1.1.1:853,
+// port 853 is default, the TLS server name is the host of addr
+func NewClient(addr string) (*Client, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, defaultPort
+	}
+
+	if host == "" {
+		return nil, fmt.Errorf("dot: invalid server address: %s", addr)
+	}
+
+	return &Client{
+		name: host,
+		addr: net.JoinHostPort(host, port),
+		tlsConfig: &tls.Config{
+			ServerName:         host,
+			ClientSessionCache: tls.NewLRUClientSessionCache(8),
+			MinVersion:         tls.VersionTLS12,
+		},
+		dialer: dialer,
+	}, nil
+}
+
+// String returns string of provider, it is the host of address by default
+func (c *Client) String() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.name
+}
+
+// SetName set name of provider
+func (c *Client) SetName(name string) {
+	c.Lock()
+	defer c.Unlock()
+	c.name = name
+}
+
+// SetServerName set the TLS server name, it is required if address is IP but certificate is not
+func (c *Client) SetServerName(name string) {
+	c.Lock()
+	defer c.Unlock()
+	// the config is cloned as it may be in use of dialing
+	config := c.tlsConfig.Clone()
+	config.ServerName = name
+	c.tlsConfig = config
+}
+
+// SetTLSConfig set the TLS config
+func (c *Client) SetTLSConfig(config *tls.Config) {
+	c.Lock()
+	defer c.Unlock()
+	c.tlsConfig = config.Clone()
+}
+
+// SetDialer set the dialer of connection, for example with a custom resolver
+func (c *Client) SetDialer(d *net.Dialer) {
+	c.Lock()
+	defer c.Unlock()
+	c.dialer = d
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.conn != nil {
+		c.conn.close(errConnClosed)
+		c.conn = nil
+	}
+
+	return nil
+}
+
+// SetPadding set whether to pad queries to hide the size, see RFC 8467
+func (c *Client) SetPadding(padding bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.padding = padding
+}
+
+// Query do DoT query with the edns0-client-subnet option
+func (c *Client) Query(ctx context.Context, d dns.Domain, t dns.Type, s ...dns.ECS) (*dns.Response, error) {
+	q, err := dns.NewQuery(d, t, s...)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.query(ctx, q)
+}
+
+// QueryWithOptions do DoT query of question with options
+func (c *Client) QueryWithOptions(ctx context.Context, q dns.Question, o dns.Options) (*dns.Response, error) {
+	m, err := dns.NewQueryWithOptions(q, o)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.query(ctx, m)
+}
+
+// query sends the query message and returns the response
+func (c *Client) query(ctx context.Context, q *dns.Msg) (rr *dns.Response, err error) {
+	ctx, tr := trace.Start(ctx, c.String(), q.Question[0].Name, dns.TypeFromCode(q.Question[0].Type))
+	defer func() {
+		tr.Finish(rr, err)
+	}()
+
+	c.Lock()
+	padding := c.padding
+	c.Unlock()
+
+	if padding && q.EDNS != nil && q.EDNS.Padding == 0 {
+		q.EDNS.Padding = dns.QueryPadding
+	}
+
+	m, err := c.exchange(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	rr = m.Response()
+	rr.Provider = c.String()
+
+	return rr, rr.Err()
+}
+
+// exchange sends query and returns the response, retry once if the reused connection is broken
+func (c *Client) exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	var err error
+	for i := 0; i < 2; i++ {
+		var cn *conn
+		var reused bool
+		cn, reused, err = c.getConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		trace.TracerFromContext(ctx).SetReused(reused)
+
+		var m *dns.Msg
+		m, err = cn.exchange(ctx, q)
+		if err == nil {
+			return m, nil
+		}
+
+		c.putConn(cn)
+		if !reused || ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, err
+}
+
+// getConn returns the current connection, or dials a new one, the dial is done without the lock
+// and concurrent callers wait for it instead of dialing again
+func (c *Client) getConn(ctx context.Context) (*conn, bool, error) {
+	for {
+		c.Lock()
+		if c.conn != nil && c.conn.alive() {
+			cn := c.conn
+			c.Unlock()
+			return cn, true, nil
+		}
+
+		if c.dialing != nil {
+			dialing := c.dialing
+			c.Unlock()
+			select {
+			case <-ctx.Done():
+				return nil, false, ctx.Err()
+			case <-dialing:
+				continue
+			}
+		}
+
+		dialing := make(chan struct{})
+		c.dialing = dialing
+		d, config := c.dialer, c.tlsConfig
+		c.Unlock()
+
+		tc, err := dial(ctx, d, config, c.addr)
+
+		c.Lock()
+		c.dialing = nil
+		close(dialing)
+		if err != nil {
+			c.Unlock()
+			return nil, false, err
+		}
+
+		cn := &conn{
+			Conn:    tc,
+			pending: map[uint16]chan []byte{},
+		}
+		c.conn = cn
+		c.Unlock()
+
+		go cn.read()
+
+		return cn, false, nil
+	}
+}
+
+// dial dials a new TLS connection, the DNS lookup, connect and TLS handshake are traced separately
+func dial(ctx context.Context, d *net.Dialer, config *tls.Config, addr string) (*tls.Conn, error) {
+	if d == nil {
+		d = &net.Dialer{}
+	}
+
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	// the DNS lookup and connect are traced by the httptrace of context, which is called by dialer
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.ServerName == "" {
+		host, _, _ := net.SplitHostPort(addr)
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	tc := tls.Client(nc, config)
+	start := time.Now()
+	err = tc.HandshakeContext(ctx)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	trace.TracerFromContext(ctx).Add(trace.PhaseTLS, time.Since(start))
+
+	return tc, nil
+}
+
+// putConn drops the connection if it is broken
+func (c *Client) putConn(cn *conn) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.conn == cn && !cn.alive() {
+		c.conn = nil
+	}
+}
+
+// alive returns if connection is alive
+func (cn *conn) alive() bool {
+	cn.Lock()
+	defer cn.Unlock()
+	return cn.err == nil
+}
+
+// close closes the connection and wakes up all pending queries
+func (cn *conn) close(err error) {
+	cn.Lock()
+	defer cn.Unlock()
+
+	if cn.err != nil {
+		return
+	}
+
+	cn.err = err
+	for _, v := range cn.pending {
+		close(v)
+	}
+	cn.pending = nil
+	cn.Conn.Close()
+}
+
+// read reads responses and dispatches them to pending queries by id
+func (cn *conn) read() {
+	size := make([]byte, 2)
+	for {
+		_ = cn.SetReadDeadline(time.Now().Add(idleTimeout))
+		_, err := io.ReadFull(cn, size)
+		if err != nil {
+			cn.close(err)
+			return
+		}
+
+		data := make([]byte, binary.BigEndian.Uint16(size))
+		_, err = io.ReadFull(cn, data)
+		if err != nil {
+			cn.close(err)
+			return
+		}
+
+		if len(data) < 2 {
+			continue
+		}
+
+		cn.Lock()
+		id := binary.BigEndian.Uint16(data)
+		if ch, ok := cn.pending[id]; ok {
+			delete(cn.pending, id)
+			ch <- data
+		}
+		cn.Unlock()
+	}
+}
+
+// exchange sends the query with an unused id and waits for response
+func (cn *conn) exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	ch := make(chan []byte, 1)
+
+	cn.Lock()
+	if cn.err != nil {
+		err := cn.err
+		cn.Unlock()
+		return nil, err
+	}
+	id := randomID()
+	for cn.pending[id] != nil {
+		id = randomID()
+	}
+	cn.pending[id] = ch
+	cn.Unlock()
+
+	defer func() {
+		cn.Lock()
+		if cn.pending != nil && cn.pending[id] == ch {
+			delete(cn.pending, id)
+		}
+		cn.Unlock()
+	}()
+
+	query := *q
+	query.ID = id
+	b, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	cn.wmu.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = cn.SetWriteDeadline(deadline)
+	} else {
+		_ = cn.SetWriteDeadline(time.Now().Add(idleTimeout))
+	}
+	_, err = cn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...))
+	cn.wmu.Unlock()
+	if err != nil {
+		cn.close(err)
+		return nil, err
+	}
+
+	tr := trace.TracerFromContext(ctx)
+	tr.Wrote()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case data, ok := <-ch:
+		if !ok {
+			cn.Lock()
+			err = cn.err
+			cn.Unlock()
+			return nil, err
+		}
+		tr.FirstByte()
+		tr.Decode()
+		m := &dns.Msg{}
+		err = m.Unpack(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(m.Question) != 1 || !sameQuestion(m.Question[0], q.Question[0]) {
+			return nil, fmt.Errorf("dot: mismatched response question")
+		}
+		return m, nil
+	}
+}
+
+// sameQuestion returns if the questions are the same, the name is compared case-insensitively
+func sameQuestion(a, b dns.Question) bool {
+	return a.Type == b.Type && strings.EqualFold(strings.TrimSuffix(a.Name, "."), strings.TrimSuffix(b.Name, "."))
+}
+
+// randomID returns a random message id
+func randomID() uint16 {
+	b := make([]byte, 2)
+	_, _ = rand.Read(b)
+	return binary.BigEndian.Uint16(b)
+}
@@ -0,0 +1,367 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package dot
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/doh/trace"
+	"github.com/likexian/gokit/assert"
+)
+
+type testServer struct {
+	net.Listener
+	config *tls.Config
+	conns  atomic.Int32
+}
+
+func newServer(t *testing.T) *testServer {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(ts.Close)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: ts.TLS.Certificates})
+	assert.Nil(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	s := &testServer{
+		Listener: l,
+		config:   ts.Client().Transport.(*http.Transport).TLSClientConfig,
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.conns.Add(1)
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *testServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var wmu sync.Mutex
+	size := make([]byte, 2)
+	for {
+		_, err := io.ReadFull(conn, size)
+		if err != nil {
+			return
+		}
+
+		data := make([]byte, binary.BigEndian.Uint16(size))
+		_, err = io.ReadFull(conn, data)
+		if err != nil {
+			return
+		}
+
+		q := &dns.Msg{}
+		if q.Unpack(data) != nil {
+			return
+		}
+
+		if q.Question[0].Name == "close.likexian.com." {
+			return
+		}
+
+		go func() {
+			m := &dns.Msg{ID: q.ID, QR: true, RD: true, RA: true, AD: q.EDNS.DO, CD: q.CD, Question: q.Question}
+			switch q.Question[0].Name {
+			case "slow.likexian.com.":
+				time.Sleep(200 * time.Millisecond)
+				m.Answer = []dns.Answer{{Name: "slow.likexian.com.", Type: 1, TTL: 60, Data: "5.6.7.8"}}
+			case "mismatch.likexian.com.":
+				m.Question = []dns.Question{{Name: "likexian.com.", Type: q.Question[0].Type}}
+				m.Answer = []dns.Answer{{Name: "likexian.com.", Type: 1, TTL: 60, Data: "1.2.3.4"}}
+			case "case.likexian.com.":
+				m.Question = []dns.Question{{Name: "CASE.LikeXian.com", Type: q.Question[0].Type}}
+				m.Answer = []dns.Answer{{Name: "case.likexian.com.", Type: 1, TTL: 60, Data: "1.2.3.4"}}
+			case "likexian.com.":
+				m.Answer = []dns.Answer{{Name: "likexian.com.", Type: 1, TTL: 60, Data: "1.2.3.4"}}
+			case "padding.likexian.com.":
+				if q.Padded() && len(data)%dns.QueryPadding == 0 {
+					m.Answer = []dns.Answer{{Name: "padding.likexian.com.", Type: 1, TTL: 60, Data: "1.2.3.4"}}
+				}
+			default:
+				m.RCode = 3
+			}
+			b, _ := m.Pack()
+			wmu.Lock()
+			_, _ = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...))
+			wmu.Unlock()
+		}()
+	}
+}
+
+// slowResolver answers 127.0.0.1 of any name after 100 milliseconds
+func slowResolver(_ context.Context, _, _ string) (net.Conn, error) {
+	conn, server := net.Pipe()
+
+	go func() {
+		defer server.Close()
+		size := make([]byte, 2)
+		if _, err := io.ReadFull(server, size); err != nil {
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint16(size))
+		if _, err := io.ReadFull(server, data); err != nil {
+			return
+		}
+
+		q := &dns.Msg{}
+		if q.Unpack(data) != nil {
+			return
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		m := &dns.Msg{ID: q.ID, QR: true, RD: true, RA: true, Question: q.Question}
+		if q.Question[0].Type == 1 {
+			m.Answer = []dns.Answer{{Name: q.Question[0].Name, Type: 1, TTL: 60, Data: "127.0.0.1"}}
+		}
+		b, _ := m.Pack()
+		_, _ = server.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...))
+	}()
+
+	return conn, nil
+}
+
+func TestVersion(t *testing.T) {
+	assert.Contains(t, Version(), ".")
+	assert.Contains(t, Author(), "likexian")
+	assert.Contains(t, License(), "Apache License")
+}
+
+func TestNewClient(t *testing.T) {
+	_, err := NewClient(":853")
+	assert.NotNil(t, err)
+
+	c, err := NewClient("dns.google")
+	assert.Nil(t, err)
+	assert.Equal(t, c.String(), "dns.google")
+	assert.Equal(t, c.addr, "dns.google:853")
+
+	c, err = NewClient("1.1.1.1:8853")
+	assert.Nil(t, err)
+	assert.Equal(t, c.addr, "1.1.1.1:8853")
+
+	c.SetName("cloudflare")
+	assert.Equal(t, c.String(), "cloudflare")
+
+	c.SetServerName("cloudflare-dns.com")
+	assert.Equal(t, c.tlsConfig.ServerName, "cloudflare-dns.com")
+}
+
+func TestQuery(t *testing.T) {
+	s := newServer(t)
+
+	c, err := NewClient(s.Addr().String())
+	assert.Nil(t, err)
+	defer c.Close()
+
+	c.SetTLSConfig(s.config)
+	c.SetServerName("example.com")
+
+	ctx := context.Background()
+
+	rsp, err := c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Provider, c.String())
+	assert.Equal(t, rsp.Answer[0].Data, "1.2.3.4")
+
+	rsp, err = c.Query(ctx, "nx.likexian.com", dns.TypeA)
+	assert.NotNil(t, err)
+	assert.Equal(t, rsp.Status, 3)
+
+	_, err = c.Query(ctx, "likexian.com", "XX")
+	assert.NotNil(t, err)
+
+	_, err = c.Query(ctx, "mismatch.likexian.com", dns.TypeA)
+	assert.NotNil(t, err)
+
+	// the question name of response is compared case-insensitively
+	rsp, err = c.Query(ctx, "case.likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Answer[0].Data, "1.2.3.4")
+
+	rsp, err = c.QueryWithOptions(ctx, dns.Question{Name: "likexian.com", Type: 1}, dns.Options{DO: true, CD: true})
+	assert.Nil(t, err)
+	assert.True(t, rsp.AD)
+	assert.True(t, rsp.CD)
+
+	rsp, err = c.Query(ctx, "padding.likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Len(t, rsp.Answer, 0)
+
+	rsp, err = c.QueryWithOptions(ctx, dns.Question{Name: "padding.likexian.com", Type: 1}, dns.Options{Padding: true})
+	assert.Nil(t, err)
+	assert.Len(t, rsp.Answer, 1)
+
+	c.SetPadding(true)
+	rsp, err = c.Query(ctx, "padding.likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Len(t, rsp.Answer, 1)
+	c.SetPadding(false)
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			rsp, err := c.Query(ctx, "slow.likexian.com", dns.TypeA)
+			assert.Nil(t, err)
+			assert.Equal(t, rsp.Answer[0].Data, "5.6.7.8")
+		}()
+		go func() {
+			defer wg.Done()
+			rsp, err := c.Query(ctx, "likexian.com", dns.TypeA)
+			assert.Nil(t, err)
+			assert.Equal(t, rsp.Answer[0].Data, "1.2.3.4")
+		}()
+	}
+	wg.Wait()
+	assert.Lt(t, time.Since(start), time.Second)
+	assert.Equal(t, s.conns.Load(), int32(1))
+
+	// broken reused connection is retried once with a new connection
+	_, err = c.Query(ctx, "close.likexian.com", dns.TypeA)
+	assert.NotNil(t, err)
+	assert.Equal(t, s.conns.Load(), int32(2))
+
+	rsp, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Answer[0].Data, "1.2.3.4")
+	assert.Equal(t, s.conns.Load(), int32(3))
+
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = c.Query(tctx, "slow.likexian.com", dns.TypeA)
+	assert.NotNil(t, err)
+
+	err = c.Close()
+	assert.Nil(t, err)
+
+	rsp, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Answer[0].Data, "1.2.3.4")
+}
+
+func TestQueryDial(t *testing.T) {
+	s := newServer(t)
+
+	c, err := NewClient(s.Addr().String())
+	assert.Nil(t, err)
+	defer c.Close()
+
+	c.SetTLSConfig(s.config)
+	c.SetServerName("example.com")
+
+	// concurrent queries wait for the same dial
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rsp, err := c.Query(context.Background(), "likexian.com", dns.TypeA)
+			assert.Nil(t, err)
+			assert.Equal(t, rsp.Answer[0].Data, "1.2.3.4")
+			c.SetName("dot")
+			assert.Equal(t, c.String(), "dot")
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, s.conns.Load(), int32(1))
+}
+
+func TestQueryTrace(t *testing.T) {
+	s := newServer(t)
+
+	c, err := NewClient(s.Addr().String())
+	assert.Nil(t, err)
+	defer c.Close()
+
+	c.SetTLSConfig(s.config)
+	c.SetServerName("example.com")
+
+	var spans []trace.Span
+	ctx := trace.WithHook(context.Background(), trace.HookFunc(func(s trace.Span) {
+		spans = append(spans, s)
+	}))
+
+	_, err = c.Query(ctx, "slow.likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	_, err = c.Query(ctx, "nx.likexian.com", dns.TypeAAAA)
+	assert.NotNil(t, err)
+
+	assert.Len(t, spans, 2)
+
+	// the first query dials a new connection
+	assert.Equal(t, spans[0].Provider, c.String())
+	assert.Equal(t, spans[0].QName, "slow.likexian.com")
+	assert.Equal(t, spans[0].QType, dns.TypeA)
+	assert.Equal(t, spans[0].Outcome, "ok")
+	assert.False(t, spans[0].Reused)
+	assert.Equal(t, spans[0].DNS, time.Duration(0))
+	assert.Gt(t, spans[0].Connect, time.Duration(0))
+	assert.Gt(t, spans[0].TLS, time.Duration(0))
+	assert.Ge(t, spans[0].TTFB, 200*time.Millisecond)
+	assert.Gt(t, spans[0].Decode, time.Duration(0))
+
+	// the second query reuses the connection
+	assert.Equal(t, spans[1].QType, dns.TypeAAAA)
+	assert.Equal(t, spans[1].Outcome, "NXDOMAIN")
+	assert.True(t, spans[1].Reused)
+	assert.Equal(t, spans[1].Connect, time.Duration(0))
+	assert.Equal(t, spans[1].TLS, time.Duration(0))
+
+	// the slow DNS lookup is not counted as connect
+	_, port, _ := net.SplitHostPort(s.Addr().String())
+	c, err = NewClient(net.JoinHostPort("dot.likexian.test", port))
+	assert.Nil(t, err)
+	defer c.Close()
+
+	c.SetTLSConfig(s.config)
+	c.SetServerName("example.com")
+	c.SetDialer(&net.Dialer{Resolver: &net.Resolver{PreferGo: true, Dial: slowResolver}})
+
+	spans = nil
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Len(t, spans, 1)
+	assert.Ge(t, spans[0].DNS, 100*time.Millisecond)
+	assert.Gt(t, spans[0].Connect, time.Duration(0))
+	assert.Lt(t, spans[0].Connect, 100*time.Millisecond)
+	assert.Gt(t, spans[0].TLS, time.Duration(0))
+}
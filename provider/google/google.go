@@ -21,17 +21,11 @@ package google
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
-	"net"
 	"net/http"
-	"net/url"
-	"strings"
-	"time"
 
 	"github.com/likexian/doh/dns"
-	"github.com/likexian/gokit/xip"
+	"github.com/likexian/doh/internal/upstream"
 )
 
 // provider is provider
@@ -40,6 +34,9 @@ type provider uint
 // Client is DoH provider client
 type Client struct {
 	provider provider
+	format   dns.Format
+	method   string
+	padding  bool
 }
 
 const (
@@ -50,23 +47,13 @@ const (
 )
 
 var (
-	// upstreams is DoH upstreams
+	// upstreams is DoH upstreams of json format
 	upstreams = map[uint]string{
 		DefaultProvider: "https://dns.google/resolve",
 	}
-	// httpClient is DoH http client
-	httpClient = &http.Client{
-		Timeout: 5 * time.Second,
-		Transport: &http.Transport{
-			DialContext: (&net.Dialer{
-				Timeout:   3 * time.Second,
-				KeepAlive: 60 * time.Second,
-			}).DialContext,
-			TLSHandshakeTimeout: 3 * time.Second,
-			DisableKeepAlives:   false,
-			MaxIdleConns:        256,
-			MaxIdleConnsPerHost: 256,
-		},
+	// wireUpstreams is DoH upstreams of wire format
+	wireUpstreams = map[uint]string{
+		DefaultProvider: "https://dns.google/dns-query",
 	}
 )
 
@@ -89,6 +76,8 @@ func License() string {
 func NewClient() *Client {
 	return &Client{
 		provider: DefaultProvider,
+		format:   dns.FormatJSON,
+		method:   http.MethodGet,
 	}
 }
 
@@ -106,65 +95,52 @@ func (c *Client) SetProvider(p provider) error {
 	return nil
 }
 
-// Query do DoH query with the edns0-client-subnet option
-func (c *Client) Query(ctx context.Context, d dns.Domain, t dns.Type, s ...dns.ECS) (*dns.Response, error) {
-	name, err := d.Punycode()
-	if err != nil {
-		return nil, err
-	}
-
-	param := url.Values{}
-	param.Add("name", name)
-	param.Add("type", strings.TrimSpace(string(t)))
-
-	if len(s) > 0 {
-		ss := strings.TrimSpace(string(s[0]))
-		if ss != "" {
-			ss, err := xip.FixSubnet(ss)
-			if err != nil {
-				return nil, err
-			}
-			param.Add("edns_client_subnet", ss)
-		}
+// SetFormat set DoH message format, json format is default
+func (c *Client) SetFormat(f dns.Format) error {
+	if f != dns.FormatJSON && f != dns.FormatWire {
+		return fmt.Errorf("google: invalid dns format")
 	}
+	c.format = f
+	return nil
+}
 
-	dnsURL := fmt.Sprintf("%s?%s", upstreams[uint(c.provider)], param.Encode())
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dnsURL, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Accept", "application/dns-json")
-	req.Header.Set("User-Agent", fmt.Sprintf("DoH Client/%s", Version()))
-
-	rsp, err := httpClient.Do(req)
-	if err != nil {
-		return nil, err
+// SetMethod set http method of wire format query, GET or POST, GET is default
+func (c *Client) SetMethod(m string) error {
+	if m != http.MethodGet && m != http.MethodPost {
+		return fmt.Errorf("google: invalid http method")
 	}
+	c.method = m
+	return nil
+}
 
-	defer rsp.Body.Close()
-	if rsp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("bad status code: %d", rsp.StatusCode)
-	}
+// SetPadding set whether to pad queries to hide the size, see RFC 8467
+func (c *Client) SetPadding(padding bool) {
+	c.padding = padding
+}
 
-	data, err := io.ReadAll(rsp.Body)
-	if err != nil {
-		return nil, err
-	}
+// Query do DoH query with the edns0-client-subnet option
+func (c *Client) Query(ctx context.Context, d dns.Domain, t dns.Type, s ...dns.ECS) (*dns.Response, error) {
+	return c.upstream().Query(ctx, d, t, s...)
+}
 
-	rr := &dns.Response{
-		Provider: c.String(),
-	}
+// QueryWithOptions do DoH query of question with options
+func (c *Client) QueryWithOptions(ctx context.Context, q dns.Question, o dns.Options) (*dns.Response, error) {
+	return c.upstream().QueryWithOptions(ctx, q, o)
+}
 
-	err = json.Unmarshal(data, rr)
-	if err != nil {
-		return nil, err
+// upstream returns the upstream client of current settings
+func (c *Client) upstream() *upstream.Client {
+	dnsURL := upstreams[uint(c.provider)]
+	if c.format == dns.FormatWire {
+		dnsURL = wireUpstreams[uint(c.provider)]
 	}
 
-	if rr.Status != 0 {
-		return rr, fmt.Errorf("google: bad response code: %d", rr.Status)
+	return &upstream.Client{
+		Name:      c.String(),
+		URL:       dnsURL,
+		Format:    c.format,
+		Method:    c.method,
+		UserAgent: fmt.Sprintf("DoH Client/%s", Version()),
+		Padding:   c.padding,
 	}
-
-	return rr, nil
 }
@@ -21,6 +21,7 @@ package google
 
 import (
 	"context"
+	"net/http"
 	"testing"
 
 	"github.com/likexian/doh/dns"
@@ -71,3 +72,31 @@ func TestQuery(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Gt(t, len(rsp.Answer), 0)
 }
+
+func TestQueryWire(t *testing.T) {
+	c := NewClient()
+
+	err := c.SetFormat(100)
+	assert.NotNil(t, err)
+
+	err = c.SetMethod(http.MethodPut)
+	assert.NotNil(t, err)
+
+	err = c.SetFormat(dns.FormatWire)
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+
+	for _, m := range []string{http.MethodGet, http.MethodPost} {
+		err = c.SetMethod(m)
+		assert.Nil(t, err)
+
+		rsp, err := c.Query(ctx, "likexian.com", dns.TypeA)
+		assert.Nil(t, err)
+		assert.Gt(t, len(rsp.Answer), 0)
+
+		rsp, err = c.Query(ctx, "likexian.com", dns.TypeMX, "1.1.1.1/24")
+		assert.Nil(t, err)
+		assert.Gt(t, len(rsp.Answer), 0)
+	}
+}
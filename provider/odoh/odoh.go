@@ -0,0 +1,529 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package odoh
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/doh/internal/hpke"
+	"github.com/likexian/doh/trace"
+)
+
+// Client is Oblivious DoH provider client, see RFC 9230
+type Client struct {
+	name    string
+	target  *url.URL
+	proxy   *url.URL
+	config  *Config
+	client  *http.Client
+	fetch   *http.Client
+	padding bool
+	sync.Mutex
+}
+
+// Config is the ObliviousDoHConfig of target
+type Config struct {
+	Suite     hpke.Suite
+	PublicKey []byte
+	KeyID     []byte
+	contents  []byte
+}
+
+const (
+	// contentType is the content type of oblivious dns message
+	contentType = "application/oblivious-dns-message"
+	// configVersion is the supported ObliviousDoHConfig version
+	configVersion = 0x0001
+	// messageQuery is the query message type
+	messageQuery = 0x01
+	// messageResponse is the response message type
+	messageResponse = 0x02
+	// maxMessageSize is the max size of oblivious dns message
+	maxMessageSize = 65535
+)
+
+var (
+	// httpClient is ODoH http client
+	httpClient = &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout:   3 * time.Second,
+				KeepAlive: 60 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout: 3 * time.Second,
+			DisableKeepAlives:   false,
+			MaxIdleConns:        256,
+			MaxIdleConnsPerHost: 256,
+		},
+	}
+	// errKeyMismatch is returned when target rejects the key id
+	errKeyMismatch = errors.New("odoh: target key mismatch")
+)
+
+// Version returns package version
+func Version() string {
+	return "0.1.0"
+}
+
+// Author returns package author
+func Author() string {
+	return "[Li Kexian](https://www.likexian.com/)"
+}
+
+// License returns package license
+func License() string {
+	return "Licensed under the Apache License 2.0"
+}
+
+// NewClient returns a new ODoH client of target url, queries are sent through the proxy url,
+// for example: https://odoh.cloudflare-dns.com/dns-query and https://odoh-relay.example/proxy,
+// queries are sent to target directly if proxy is empty, which is NOT oblivious
+func NewClient(target, proxy string) (*Client, error) {
+	t, err := parseURL(target)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		name:   t.Host,
+		target: t,
+		client: httpClient,
+		fetch:  httpClient,
+	}
+
+	if proxy != "" {
+		c.proxy, err = parseURL(proxy)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// String returns string of provider, it is the host of target by default
+func (c *Client) String() string {
+	return c.name
+}
+
+// SetName set name of provider
+func (c *Client) SetName(name string) {
+	c.name = name
+}
+
+// SetHTTPClient set the http client of queries and configs fetching
+func (c *Client) SetHTTPClient(client *http.Client) {
+	c.client = client
+	c.fetch = client
+}
+
+// SetConfigHTTPClient set the http client of configs fetching, it connects to target even if proxy is set,
+// so it should verify the target instead of proxy, it must be called after SetHTTPClient
+func (c *Client) SetConfigHTTPClient(client *http.Client) {
+	c.fetch = client
+}
+
+// SetConfigs set the ObliviousDoHConfigs of target, instead of fetching from target
+func (c *Client) SetConfigs(data []byte) error {
+	config, err := ParseConfigs(data)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.config = config
+	c.Unlock()
+
+	return nil
+}
+
+// SetPadding set whether to pad queries to hide the size, see RFC 8467
+func (c *Client) SetPadding(padding bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.padding = padding
+}
+
+// Query do ODoH query with the edns0-client-subnet option
+func (c *Client) Query(ctx context.Context, d dns.Domain, t dns.Type, s ...dns.ECS) (*dns.Response, error) {
+	q, err := dns.NewQuery(d, t, s...)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.query(ctx, q)
+}
+
+// QueryWithOptions do ODoH query of question with options
+func (c *Client) QueryWithOptions(ctx context.Context, q dns.Question, o dns.Options) (*dns.Response, error) {
+	m, err := dns.NewQueryWithOptions(q, o)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.query(ctx, m)
+}
+
+// query sends the query message and returns the response
+func (c *Client) query(ctx context.Context, q *dns.Msg) (rr *dns.Response, err error) {
+	ctx, tr := trace.Start(ctx, c.String(), q.Question[0].Name, dns.TypeFromCode(q.Question[0].Type))
+	defer func() {
+		tr.Finish(rr, err)
+	}()
+
+	c.Lock()
+	padding := c.padding
+	c.Unlock()
+
+	if padding && q.EDNS != nil && q.EDNS.Padding == 0 {
+		q.EDNS.Padding = dns.QueryPadding
+	}
+
+	query, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	for i := 0; i < 2; i++ {
+		var config *Config
+		config, err = c.getConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		data, err = c.exchange(ctx, config, query)
+		if !errors.Is(err, errKeyMismatch) {
+			break
+		}
+		c.Lock()
+		if c.config == config {
+			c.config = nil
+		}
+		c.Unlock()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	tr.Decode()
+	m := &dns.Msg{}
+	err = m.Unpack(data)
+	if err != nil {
+		return nil, err
+	}
+
+	rr = m.Response()
+	rr.Provider = c.String()
+
+	return rr, rr.Err()
+}
+
+// exchange encrypts the query, sends it and decrypts the response
+func (c *Client) exchange(ctx context.Context, config *Config, query []byte) ([]byte, error) {
+	enc, sender, err := config.Suite.SetupBaseS(config.PublicKey, []byte("odoh query"))
+	if err != nil {
+		return nil, err
+	}
+
+	plain := encodePlaintext(query)
+	aad := appendOpaque([]byte{messageQuery}, config.KeyID)
+	encrypted := append(enc, sender.Seal(aad, plain)...)
+	body := appendOpaque(appendOpaque([]byte{messageQuery}, config.KeyID), encrypted)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.queryURL(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", contentType)
+	req.Header.Set("User-Agent", fmt.Sprintf("DoH Client/%s", Version()))
+
+	data, err := do(c.client, req)
+	if err != nil {
+		return nil, err
+	}
+
+	msgType, nonce, ct, err := decodeMessage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if msgType != messageResponse {
+		return nil, fmt.Errorf("odoh: invalid response message type: %d", msgType)
+	}
+
+	suite := config.Suite
+	secret := sender.Export([]byte("odoh response"), suite.KeySize())
+	key, aeadNonce := responseKey(suite, secret, plain, nonce)
+
+	aead, err := suite.NewAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aad = appendOpaque([]byte{messageResponse}, nonce)
+	pt, err := aead.Open(nil, aeadNonce, ct, aad)
+	if err != nil {
+		return nil, fmt.Errorf("odoh: decrypt response failed")
+	}
+
+	return decodePlaintext(pt)
+}
+
+// responseKey returns the key and nonce of response encryption,
+// the salt is Q_plain || len(resp_nonce) || resp_nonce, see RFC 9230 section 6.4
+func responseKey(suite hpke.Suite, secret, plain, nonce []byte) ([]byte, []byte) {
+	prk := suite.Extract(appendOpaque(append([]byte{}, plain...), nonce), secret)
+	return suite.Expand(prk, []byte("odoh key"), suite.KeySize()), suite.Expand(prk, []byte("odoh nonce"), suite.NonceSize())
+}
+
+// queryURL returns the url of query, it is the proxy url with target if proxy is set
+func (c *Client) queryURL() string {
+	if c.proxy == nil {
+		return c.target.String()
+	}
+
+	u := *c.proxy
+	param := u.Query()
+	param.Set("targethost", c.target.Host)
+	param.Set("targetpath", c.target.Path)
+	u.RawQuery = param.Encode()
+
+	return u.String()
+}
+
+// getConfig returns the config of target, fetch it if not set
+func (c *Client) getConfig(ctx context.Context) (*Config, error) {
+	c.Lock()
+	config := c.config
+	c.Unlock()
+
+	if config != nil {
+		return config, nil
+	}
+
+	u := url.URL{Scheme: c.target.Scheme, Host: c.target.Host, Path: "/.well-known/odohconfigs"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", fmt.Sprintf("DoH Client/%s", Version()))
+
+	data, err := do(c.fetch, req)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err = ParseConfigs(data)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	c.config = config
+	c.Unlock()
+
+	return config, nil
+}
+
+// ParseConfigs parses ObliviousDoHConfigs, returns the first supported config
+func ParseConfigs(data []byte) (*Config, error) {
+	configs, n, err := readOpaque(data)
+	if err != nil || n != len(data) {
+		return nil, fmt.Errorf("odoh: invalid configs")
+	}
+
+	for len(configs) > 0 {
+		if len(configs) < 2 {
+			return nil, fmt.Errorf("odoh: invalid config")
+		}
+		version := binary.BigEndian.Uint16(configs)
+		contents, n, err := readOpaque(configs[2:])
+		if err != nil {
+			return nil, fmt.Errorf("odoh: invalid config")
+		}
+		configs = configs[2+n:]
+		if version != configVersion {
+			continue
+		}
+		config, err := parseConfig(contents)
+		if err == nil {
+			return config, nil
+		}
+	}
+
+	return nil, fmt.Errorf("odoh: no supported config")
+}
+
+// parseConfig parses ObliviousDoHConfigContents
+func parseConfig(contents []byte) (*Config, error) {
+	if len(contents) < 6 {
+		return nil, fmt.Errorf("odoh: invalid config contents")
+	}
+
+	suite := hpke.Suite{
+		KEM:  binary.BigEndian.Uint16(contents),
+		KDF:  binary.BigEndian.Uint16(contents[2:]),
+		AEAD: binary.BigEndian.Uint16(contents[4:]),
+	}
+
+	if !suite.Supported() {
+		return nil, fmt.Errorf("odoh: unsupported suite")
+	}
+
+	pk, n, err := readOpaque(contents[6:])
+	if err != nil || 6+n != len(contents) || len(pk) == 0 {
+		return nil, fmt.Errorf("odoh: invalid config contents")
+	}
+
+	return &Config{
+		Suite:     suite,
+		PublicKey: pk,
+		KeyID:     suite.Expand(suite.Extract(nil, contents), []byte("odoh key id"), suite.HashSize()),
+		contents:  contents,
+	}, nil
+}
+
+// Marshal returns ObliviousDoHConfigs of the config
+func (c *Config) Marshal() []byte {
+	config := binary.BigEndian.AppendUint16(nil, configVersion)
+	return appendOpaque(nil, appendOpaque(config, c.contents))
+}
+
+// NewConfig returns a new config of suite and public key
+func NewConfig(suite hpke.Suite, pk []byte) (*Config, error) {
+	contents := binary.BigEndian.AppendUint16(nil, suite.KEM)
+	contents = binary.BigEndian.AppendUint16(contents, suite.KDF)
+	contents = binary.BigEndian.AppendUint16(contents, suite.AEAD)
+
+	return parseConfig(appendOpaque(contents, pk))
+}
+
+// encodePlaintext returns ObliviousDoHMessagePlaintext of dns message
+func encodePlaintext(msg []byte) []byte {
+	return appendOpaque(appendOpaque(nil, msg), nil)
+}
+
+// decodePlaintext returns dns message of ObliviousDoHMessagePlaintext
+func decodePlaintext(data []byte) ([]byte, error) {
+	msg, n, err := readOpaque(data)
+	if err != nil {
+		return nil, err
+	}
+
+	padding, m, err := readOpaque(data[n:])
+	if err != nil || n+m != len(data) {
+		return nil, fmt.Errorf("odoh: invalid plaintext")
+	}
+
+	for _, v := range padding {
+		if v != 0 {
+			return nil, fmt.Errorf("odoh: invalid plaintext padding")
+		}
+	}
+
+	return msg, nil
+}
+
+// decodeMessage returns type, key id and encrypted message of ObliviousDoHMessage
+func decodeMessage(data []byte) (byte, []byte, []byte, error) {
+	if len(data) < 1 {
+		return 0, nil, nil, fmt.Errorf("odoh: invalid message")
+	}
+
+	keyID, n, err := readOpaque(data[1:])
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("odoh: invalid message")
+	}
+
+	encrypted, m, err := readOpaque(data[1+n:])
+	if err != nil || 1+n+m != len(data) {
+		return 0, nil, nil, fmt.Errorf("odoh: invalid message")
+	}
+
+	return data[0], keyID, encrypted, nil
+}
+
+// appendOpaque appends 2 bytes length prefixed data to b
+func appendOpaque(b, data []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(b, uint16(len(data))), data...)
+}
+
+// readOpaque reads 2 bytes length prefixed data, returns data and read size
+func readOpaque(b []byte) ([]byte, int, error) {
+	if len(b) < 2 {
+		return nil, 0, fmt.Errorf("odoh: data too short")
+	}
+
+	n := 2 + int(binary.BigEndian.Uint16(b))
+	if n > len(b) {
+		return nil, 0, fmt.Errorf("odoh: data too short")
+	}
+
+	return b[2:n], n, nil
+}
+
+// do sends the http request by client and returns the response body
+func do(client *http.Client, req *http.Request) ([]byte, error) {
+	rsp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rsp.Body.Close()
+	if rsp.StatusCode == http.StatusUnauthorized {
+		return nil, errKeyMismatch
+	}
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status code: %d", rsp.StatusCode)
+	}
+
+	return io.ReadAll(io.LimitReader(rsp.Body, maxMessageSize))
+}
+
+// parseURL parses and checks the https url
+func parseURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+		return nil, fmt.Errorf("odoh: invalid url: %s", s)
+	}
+
+	return u, nil
+}
@@ -0,0 +1,319 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package odoh
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/doh/internal/hpke"
+	"github.com/likexian/doh/trace"
+	"github.com/likexian/gokit/assert"
+)
+
+type testTarget struct {
+	*httptest.Server
+	config  *Config
+	key     *ecdh.PrivateKey
+	fetched atomic.Int32
+}
+
+func newTarget(t *testing.T) *testTarget {
+	suite := hpke.Suite{KEM: hpke.KEMX25519, KDF: hpke.KDFSHA256, AEAD: hpke.AEADAES128GCM}
+	key, err := suite.GenerateKey()
+	assert.Nil(t, err)
+
+	config, err := NewConfig(suite, key.PublicKey().Bytes())
+	assert.Nil(t, err)
+
+	s := &testTarget{config: config, key: key}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *testTarget) rotate() {
+	key, _ := s.config.Suite.GenerateKey()
+	s.config, _ = NewConfig(s.config.Suite, key.PublicKey().Bytes())
+	s.key = key
+}
+
+func (s *testTarget) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/.well-known/odohconfigs" {
+		s.fetched.Add(1)
+		_, _ = w.Write(s.config.Marshal())
+		return
+	}
+
+	if r.Header.Get("Content-Type") != contentType {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	msgType, keyID, encrypted, err := decodeMessage(body)
+	if err != nil || msgType != messageQuery {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !bytes.Equal(keyID, s.config.KeyID) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	suite := s.config.Suite
+	enc := encrypted[:32]
+	receiver, err := suite.SetupBaseR(enc, s.key, []byte("odoh query"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	pt, err := receiver.Open(appendOpaque([]byte{messageQuery}, keyID), encrypted[32:])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	query, err := decodePlaintext(pt)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	q := &dns.Msg{}
+	if q.Unpack(query) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	m := &dns.Msg{ID: q.ID, QR: true, RD: true, RA: true, AD: q.EDNS.DO, CD: q.CD, Question: q.Question}
+	if q.Question[0].Name == "likexian.com." {
+		m.Answer = []dns.Answer{{Name: "likexian.com.", Type: 1, TTL: 600, Data: "1.2.3.4"}}
+	} else {
+		m.RCode = 3
+	}
+	answer, _ := m.Pack()
+
+	// the response key is derived independently of client, see RFC 9230 section 6.4
+	nonce := make([]byte, suite.KeySize())
+	_, _ = rand.Read(nonce)
+	secret := receiver.Export([]byte("odoh response"), suite.KeySize())
+	salt := append(append(append([]byte{}, pt...), 0, byte(len(nonce))), nonce...)
+	prk := hmacSHA256(salt, secret)
+	block, _ := aes.NewCipher(hmacSHA256(prk, []byte("odoh key\x01"))[:16])
+	aead, _ := cipher.NewGCM(block)
+	ct := aead.Seal(nil, hmacSHA256(prk, []byte("odoh nonce\x01"))[:12],
+		encodePlaintext(answer), append([]byte{messageResponse, 0, byte(len(nonce))}, nonce...))
+
+	w.Header().Set("Content-Type", contentType)
+	_, _ = w.Write(appendOpaque(appendOpaque([]byte{messageResponse}, nonce), ct))
+}
+
+// hmacSHA256 returns HMAC-SHA256 of data, it is HKDF-Extract with key as salt,
+// or a single block HKDF-Expand with data as info || 0x01
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func newProxy(t *testing.T, relayed *atomic.Int32) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.URL.Query().Get("targethost")
+		path := r.URL.Query().Get("targetpath")
+		if r.Method != http.MethodPost || host == "" || path == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		relayed.Add(1)
+		rsp, err := http.Post("http://"+host+path, r.Header.Get("Content-Type"), r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer rsp.Body.Close()
+
+		w.WriteHeader(rsp.StatusCode)
+		_, _ = io.Copy(w, rsp.Body)
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func TestVersion(t *testing.T) {
+	assert.Contains(t, Version(), ".")
+	assert.Contains(t, Author(), "likexian")
+	assert.Contains(t, License(), "Apache License")
+}
+
+func TestNewClient(t *testing.T) {
+	_, err := NewClient("odoh.likexian.com", "")
+	assert.NotNil(t, err)
+
+	_, err = NewClient("https://odoh.likexian.com/dns-query", "relay")
+	assert.NotNil(t, err)
+
+	c, err := NewClient("https://odoh.likexian.com/dns-query", "https://relay.likexian.com/proxy?x=1")
+	assert.Nil(t, err)
+	assert.Equal(t, c.String(), "odoh.likexian.com")
+	assert.Equal(t, c.queryURL(),
+		"https://relay.likexian.com/proxy?targethost=odoh.likexian.com&targetpath=%2Fdns-query&x=1")
+
+	c.SetName("likexian")
+	assert.Equal(t, c.String(), "likexian")
+}
+
+func TestParseConfigs(t *testing.T) {
+	suite := hpke.Suite{KEM: hpke.KEMX25519, KDF: hpke.KDFSHA256, AEAD: hpke.AEADAES128GCM}
+	key, err := suite.GenerateKey()
+	assert.Nil(t, err)
+
+	config, err := NewConfig(suite, key.PublicKey().Bytes())
+	assert.Nil(t, err)
+	assert.Len(t, config.KeyID, 32)
+
+	v, err := ParseConfigs(config.Marshal())
+	assert.Nil(t, err)
+	assert.Equal(t, v, config)
+
+	_, err = NewConfig(hpke.Suite{KEM: 0x0021, KDF: 1, AEAD: 1}, key.PublicKey().Bytes())
+	assert.NotNil(t, err)
+
+	// unsupported version is skipped
+	data := appendOpaque([]byte{0xff, 0x06}, config.contents)
+	data = append(data, config.Marshal()[2:]...)
+	v, err = ParseConfigs(appendOpaque(nil, data))
+	assert.Nil(t, err)
+	assert.Equal(t, v, config)
+
+	for _, v := range [][]byte{
+		nil,
+		{0, 1},
+		{0, 2, 0, 1},
+		appendOpaque(nil, appendOpaque([]byte{0xff, 0x06}, config.contents)),
+		config.Marshal()[:20],
+	} {
+		_, err = ParseConfigs(v)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	target := newTarget(t)
+
+	var relayed atomic.Int32
+	proxy := newProxy(t, &relayed)
+
+	c, err := NewClient(target.URL+"/dns-query", proxy.URL+"/proxy")
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+
+	rsp, err := c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Provider, c.String())
+	assert.Equal(t, rsp.Answer[0].Data, "1.2.3.4")
+	assert.Equal(t, relayed.Load(), int32(1))
+	assert.Equal(t, target.fetched.Load(), int32(1))
+
+	rsp, err = c.QueryWithOptions(ctx, dns.Question{Name: "likexian.com", Type: 1}, dns.Options{DO: true, CD: true})
+	assert.Nil(t, err)
+	assert.True(t, rsp.AD)
+	assert.True(t, rsp.CD)
+
+	rsp, err = c.Query(ctx, "nx.likexian.com", dns.TypeA)
+	assert.NotNil(t, err)
+	assert.Equal(t, rsp.Status, 3)
+	assert.Equal(t, relayed.Load(), int32(3))
+	assert.Equal(t, target.fetched.Load(), int32(1))
+
+	// target key rotated, config is fetched again
+	target.rotate()
+	rsp, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Answer[0].Data, "1.2.3.4")
+	assert.Equal(t, target.fetched.Load(), int32(2))
+
+	// query target directly
+	c, err = NewClient(target.URL+"/dns-query", "")
+	assert.Nil(t, err)
+
+	err = c.SetConfigs(target.config.Marshal())
+	assert.Nil(t, err)
+
+	rsp, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Answer[0].Data, "1.2.3.4")
+	assert.Equal(t, target.fetched.Load(), int32(2))
+
+	err = c.SetConfigs([]byte{0})
+	assert.NotNil(t, err)
+
+	_, err = c.Query(ctx, "likexian.com", "XX")
+	assert.NotNil(t, err)
+}
+
+func TestQueryTrace(t *testing.T) {
+	target := newTarget(t)
+
+	var relayed atomic.Int32
+	proxy := newProxy(t, &relayed)
+
+	c, err := NewClient(target.URL+"/dns-query", proxy.URL+"/proxy")
+	assert.Nil(t, err)
+
+	var spans []trace.Span
+	ctx := trace.WithHook(context.Background(), trace.HookFunc(func(s trace.Span) {
+		spans = append(spans, s)
+	}))
+
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	_, err = c.Query(ctx, "nx.likexian.com", dns.TypeA)
+	assert.NotNil(t, err)
+
+	assert.Len(t, spans, 2)
+	assert.Equal(t, spans[0].Provider, c.String())
+	assert.Equal(t, spans[0].QName, "likexian.com")
+	assert.Equal(t, spans[0].Outcome, "ok")
+	assert.Gt(t, spans[0].Connect, time.Duration(0))
+	assert.Gt(t, spans[0].TTFB, time.Duration(0))
+	assert.Gt(t, spans[0].Decode, time.Duration(0))
+	assert.Equal(t, spans[1].Outcome, "NXDOMAIN")
+	assert.True(t, spans[1].Reused)
+}
@@ -0,0 +1,227 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/likexian/doh"
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/doh/internal/resolver"
+)
+
+// Handler is DoH server http handler
+type Handler struct {
+	provider doh.Provider
+	timeout  time.Duration
+	stats    resolver.Stats
+}
+
+const (
+	// jsonContentType is the content type of json format
+	jsonContentType = "application/dns-json"
+	// wireContentType is the content type of wire format
+	wireContentType = "application/dns-message"
+	// maxMessageSize is the max size of dns message
+	maxMessageSize = 65535
+)
+
+// Version returns package version
+func Version() string {
+	return "0.1.0"
+}
+
+// Author returns package author
+func Author() string {
+	return "[Li Kexian](https://www.likexian.com/)"
+}
+
+// License returns package license
+func License() string {
+	return "Licensed under the Apache License 2.0"
+}
+
+// NewHandler returns a new DoH server handler resolves queries by provider,
+// it accepts RFC 8484 GET and POST queries, and JSON queries with ?name=&type=
+func NewHandler(provider doh.Provider) *Handler {
+	return &Handler{
+		provider: provider,
+		timeout:  10 * time.Second,
+	}
+}
+
+// SetTimeout set timeout of resolving a query, 10 seconds is default
+func (h *Handler) SetTimeout(timeout time.Duration) {
+	h.timeout = timeout
+}
+
+// Stats returns the stats of handler, since it is created
+func (h *Handler) Stats() doh.ServeStats {
+	return h.stats.Stats()
+}
+
+// ServeHTTP serves DoH query
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Has("dns") {
+			data, err := decodeBase64(r.URL.Query().Get("dns"))
+			if err != nil {
+				h.stats.Invalid()
+				http.Error(w, "invalid dns param", http.StatusBadRequest)
+				return
+			}
+			h.serveWire(w, r, data)
+		} else if r.URL.Query().Has("name") {
+			h.serveJSON(w, r)
+		} else {
+			h.stats.Invalid()
+			http.Error(w, "missing dns or name param", http.StatusBadRequest)
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != wireContentType {
+			h.stats.Invalid()
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		data, err := io.ReadAll(io.LimitReader(r.Body, maxMessageSize+1))
+		if err != nil {
+			h.stats.Invalid()
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		if len(data) > maxMessageSize {
+			h.stats.Invalid()
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		h.serveWire(w, r, data)
+	default:
+		h.stats.Invalid()
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveWire serves RFC 8484 wire format query
+func (h *Handler) serveWire(w http.ResponseWriter, r *http.Request, data []byte) {
+	q := &dns.Msg{}
+	err := q.Unpack(data)
+	if err != nil || q.QR || len(q.Question) != 1 {
+		h.stats.Invalid()
+		http.Error(w, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+
+	start := time.Now()
+	m, rsp := resolver.Resolve(ctx, h.provider, q)
+	b, err := m.Pack()
+	if err != nil {
+		rsp = &dns.Response{Status: int(dns.RCodeServFail)}
+		b, err = resolver.ServFail(q).Pack()
+		if err != nil {
+			h.stats.Invalid()
+			http.Error(w, "invalid dns message", http.StatusBadRequest)
+			return
+		}
+	}
+	h.stats.Observe("wire", time.Since(start), rsp)
+
+	setCacheControl(w, rsp)
+	w.Header().Set("Content-Type", wireContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	_, _ = w.Write(b)
+}
+
+// serveJSON serves JSON format query
+func (h *Handler) serveJSON(w http.ResponseWriter, r *http.Request) {
+	param := r.URL.Query()
+
+	t := dns.Type(strings.TrimSpace(param.Get("type")))
+	if t == "" {
+		t = dns.TypeA
+	}
+
+	name := param.Get("name")
+	q, err := dns.NewQuery(dns.Domain(name), t)
+	if err != nil {
+		h.stats.Invalid()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	o := dns.Options{
+		DO:  isTrue(param.Get("do")),
+		CD:  isTrue(param.Get("cd")),
+		ECS: dns.ECS(param.Get("edns_client_subnet")),
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+
+	start := time.Now()
+	rsp := resolver.Query(ctx, h.provider, dns.Question{Name: name, Type: q.Question[0].Type}, o)
+	h.stats.Observe("json", time.Since(start), rsp)
+	if len(rsp.Question) == 0 {
+		rsp.Question = []dns.Question{{Name: name}}
+	}
+
+	b, err := json.Marshal(rsp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	setCacheControl(w, rsp)
+	w.Header().Set("Content-Type", jsonContentType)
+	_, _ = w.Write(b)
+}
+
+// setCacheControl sets Cache-Control header by the min TTL of answers
+func setCacheControl(w http.ResponseWriter, rsp *dns.Response) {
+	ttl := resolver.MinTTL(rsp)
+	if ttl < 0 || rsp.Status == int(dns.RCodeServFail) {
+		ttl = 0
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+}
+
+// decodeBase64 decodes base64url data, with or without padding
+func decodeBase64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// isTrue returns whether the json api flag param is set, such as do=1 or cd=true
+func isTrue(s string) bool {
+	s = strings.ToLower(strings.TrimSpace(s))
+	return s == "1" || s == "true"
+}
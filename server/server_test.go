@@ -0,0 +1,290 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/doh/provider/custom"
+	"github.com/likexian/gokit/assert"
+)
+
+type testProvider struct{}
+
+func (p *testProvider) Query(ctx context.Context, d dns.Domain, t dns.Type, s ...dns.ECS) (*dns.Response, error) {
+	switch d {
+	case "likexian.com.", "likexian.com":
+		rsp := &dns.Response{
+			Question: []dns.Question{{Name: "likexian.com.", Type: 1}},
+			Answer: []dns.Answer{
+				{Name: "likexian.com.", Type: 1, TTL: 600, Data: "1.2.3.4"},
+				{Name: "likexian.com.", Type: 1, TTL: 300, Data: "5.6.7.8"},
+			},
+			Provider: p.String(),
+		}
+		if len(s) > 0 && s[0] == "1.2.3.0/24" {
+			rsp.Answer = rsp.Answer[:1]
+			rsp.Answer[0].Data = "9.9.9.9"
+		}
+		return rsp, nil
+	case "nx.likexian.com.", "nx.likexian.com":
+		return &dns.Response{
+			Status: 3,
+			Authority: []dns.Answer{
+				{Name: "likexian.com.", Type: 6, TTL: 60, Data: "ns.likexian.com. admin.likexian.com. 1 2 3 4 5"},
+			},
+			Provider: p.String(),
+		}, fmt.Errorf("test: bad response code: 3")
+	case "bad.likexian.com.":
+		return &dns.Response{
+			Answer: []dns.Answer{{Name: "bad.likexian.com.", Type: 1, TTL: 600, Data: "xx"}},
+		}, nil
+	default:
+		return nil, fmt.Errorf("test: query failed")
+	}
+}
+
+func (p *testProvider) QueryWithOptions(ctx context.Context, q dns.Question, o dns.Options) (*dns.Response, error) {
+	rsp, err := p.Query(ctx, dns.Domain(q.Name), dns.TypeFromCode(q.Type), o.ECS)
+	if rsp != nil {
+		rsp.AD = o.DO
+		rsp.CD = o.CD
+	}
+
+	return rsp, err
+}
+
+func (p *testProvider) String() string {
+	return "test"
+}
+
+func TestVersion(t *testing.T) {
+	assert.Contains(t, Version(), ".")
+	assert.Contains(t, Author(), "likexian")
+	assert.Contains(t, License(), "Apache License")
+}
+
+func query(t *testing.T, ts *httptest.Server, method string, name dns.Domain, s ...dns.ECS) (*http.Response, *dns.Msg) {
+	q, err := dns.NewQuery(name, dns.TypeA, s...)
+	assert.Nil(t, err)
+
+	q.ID = 1234
+	data, err := q.Pack()
+	assert.Nil(t, err)
+
+	var rsp *http.Response
+	if method == http.MethodGet {
+		rsp, err = http.Get(ts.URL + "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(data))
+	} else {
+		rsp, err = http.Post(ts.URL+"/dns-query", wireContentType, bytes.NewReader(data))
+	}
+	assert.Nil(t, err)
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return rsp, nil
+	}
+
+	body, err := io.ReadAll(rsp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Header.Get("Content-Type"), wireContentType)
+
+	m := &dns.Msg{}
+	err = m.Unpack(body)
+	assert.Nil(t, err)
+	assert.Equal(t, m.ID, uint16(1234))
+	assert.True(t, m.QR)
+
+	return rsp, m
+}
+
+func TestServeWire(t *testing.T) {
+	h := NewHandler(&testProvider{})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		rsp, m := query(t, ts, method, "likexian.com")
+		assert.Equal(t, rsp.Header.Get("Cache-Control"), "max-age=300")
+		assert.Equal(t, m.RCode, 0)
+		assert.Len(t, m.Answer, 2)
+		assert.NotNil(t, m.EDNS)
+
+		_, m = query(t, ts, method, "likexian.com", "1.2.3.0/24")
+		assert.Equal(t, m.Answer[0].Data, "9.9.9.9")
+
+		rsp, m = query(t, ts, method, "nx.likexian.com")
+		assert.Equal(t, rsp.Header.Get("Cache-Control"), "max-age=60")
+		assert.Equal(t, m.RCode, 3)
+		assert.Len(t, m.Authority, 1)
+
+		rsp, m = query(t, ts, method, "fail.likexian.com")
+		assert.Equal(t, rsp.Header.Get("Cache-Control"), "max-age=0")
+		assert.Equal(t, m.RCode, 2)
+
+		rsp, m = query(t, ts, method, "bad.likexian.com")
+		assert.Equal(t, rsp.Header.Get("Cache-Control"), "max-age=0")
+		assert.Equal(t, m.RCode, 2)
+	}
+
+	rsp, err := http.Get(ts.URL + "/dns-query?dns=xx!")
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.StatusCode, http.StatusBadRequest)
+
+	rsp, err = http.Get(ts.URL + "/dns-query?dns=AAAA")
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.StatusCode, http.StatusBadRequest)
+
+	rsp, err = http.Get(ts.URL + "/dns-query")
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.StatusCode, http.StatusBadRequest)
+
+	rsp, err = http.Post(ts.URL+"/dns-query", "text/plain", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.StatusCode, http.StatusUnsupportedMediaType)
+
+	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/dns-query", nil)
+	rsp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.StatusCode, http.StatusMethodNotAllowed)
+
+	stats := h.Stats()
+	assert.Equal(t, stats.Queries, map[string]int64{"wire": 10})
+	assert.Equal(t, stats.Invalid, int64(5))
+	assert.Equal(t, stats.RCodes, map[dns.RCode]int64{
+		dns.RCodeNoError:  4,
+		dns.RCodeNXDomain: 2,
+		dns.RCodeServFail: 4,
+	})
+	assert.Equal(t, stats.Latency.Count, int64(10))
+}
+
+func TestServeJSON(t *testing.T) {
+	h := NewHandler(&testProvider{})
+	h.SetTimeout(time.Second)
+
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	tests := []struct {
+		query  string
+		status int
+		answer int
+		cache  string
+	}{
+		{"name=likexian.com", 0, 2, "max-age=300"},
+		{"name=likexian.com&type=A&edns_client_subnet=1.2.3.0/24", 0, 1, "max-age=600"},
+		{"name=nx.likexian.com&type=1", 3, 0, "max-age=60"},
+		{"name=fail.likexian.com", 2, 0, "max-age=0"},
+	}
+
+	for _, v := range tests {
+		rsp, err := http.Get(ts.URL + "/resolve?" + v.query)
+		assert.Nil(t, err)
+		assert.Equal(t, rsp.StatusCode, http.StatusOK)
+		assert.Equal(t, rsp.Header.Get("Content-Type"), jsonContentType)
+		assert.Equal(t, rsp.Header.Get("Cache-Control"), v.cache)
+
+		r := &dns.Response{}
+		err = json.NewDecoder(rsp.Body).Decode(r)
+		assert.Nil(t, err)
+		assert.Equal(t, r.Status, v.status)
+		assert.Len(t, r.Answer, v.answer)
+		assert.Len(t, r.Question, 1)
+		rsp.Body.Close()
+	}
+
+	// the do and cd flags are passed to provider
+	rsp, err := http.Get(ts.URL + "/resolve?name=likexian.com&do=1&cd=true")
+	assert.Nil(t, err)
+	r := &dns.Response{}
+	err = json.NewDecoder(rsp.Body).Decode(r)
+	assert.Nil(t, err)
+	assert.True(t, r.AD)
+	assert.True(t, r.CD)
+	rsp.Body.Close()
+
+	rsp, err = http.Get(ts.URL + "/resolve?name=likexian.com&type=XX")
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.StatusCode, http.StatusBadRequest)
+
+	stats := h.Stats()
+	assert.Equal(t, stats.Queries, map[string]int64{"json": 5})
+	assert.Equal(t, stats.Invalid, int64(1))
+}
+
+func TestServeJSONUpstream(t *testing.T) {
+	// the json upstream returns record data in presentation format
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := "likexian.com."
+		rsp := &dns.Response{Question: []dns.Question{{Name: name, Type: 65}}}
+		switch r.URL.Query().Get("type") {
+		case "HTTPS":
+			rsp.Answer = []dns.Answer{{Name: name, Type: 65, TTL: 300, Data: `1 . alpn="h2,h3" ipv4hint=1.2.3.4 ech=AQID`}}
+		case "NAPTR":
+			rsp.Question[0].Type = 35
+			rsp.Answer = []dns.Answer{{Name: name, Type: 35, TTL: 300, Data: `100 10 "S" "SIP+D2U" "" _sip._udp.likexian.com.`}}
+		}
+		_ = json.NewEncoder(w).Encode(rsp)
+	}))
+	defer up.Close()
+
+	p, err := custom.NewClient(up.URL+"/resolve", dns.FormatJSON)
+	assert.Nil(t, err)
+
+	ts := httptest.NewServer(NewHandler(p))
+	defer ts.Close()
+
+	for _, v := range []struct {
+		t    dns.Type
+		data string
+	}{
+		{dns.TypeHTTPS, `1 . alpn="h2,h3" ipv4hint=1.2.3.4 ech=AQID`},
+		{dns.TypeNAPTR, `100 10 "S" "SIP+D2U" "" _sip._udp.likexian.com.`},
+	} {
+		q, err := dns.NewQuery("likexian.com", v.t)
+		assert.Nil(t, err)
+		data, err := q.Pack()
+		assert.Nil(t, err)
+
+		rsp, err := http.Post(ts.URL+"/dns-query", wireContentType, bytes.NewReader(data))
+		assert.Nil(t, err)
+		body, err := io.ReadAll(rsp.Body)
+		assert.Nil(t, err)
+		rsp.Body.Close()
+
+		m := &dns.Msg{}
+		err = m.Unpack(body)
+		assert.Nil(t, err)
+		assert.Equal(t, m.RCode, 0)
+		assert.Len(t, m.Answer, 1)
+		assert.Equal(t, m.Answer[0].Data, v.data)
+	}
+}
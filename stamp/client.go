@@ -0,0 +1,269 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package stamp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/doh/provider/custom"
+	"github.com/likexian/doh/provider/dot"
+	"github.com/likexian/doh/provider/odoh"
+)
+
+// Client is DoH provider client of stamp
+type Client struct {
+	stamp    *Stamp
+	relay    *Stamp
+	provider provider
+}
+
+// provider is the provider built from stamp
+type provider interface {
+	String() string
+	Query(ctx context.Context, d dns.Domain, t dns.Type, s ...dns.ECS) (*dns.Response, error)
+	QueryWithOptions(ctx context.Context, q dns.Question, o dns.Options) (*dns.Response, error)
+}
+
+const (
+	// httpsPort is the default port of DoH
+	httpsPort = "443"
+	// dotPort is the default port of DoT
+	dotPort = "853"
+	// dnsPort is the default port of bootstrap resolver
+	dnsPort = "53"
+)
+
+// NewClient returns a new provider client of DoH, DoT or ODoH target stamp,
+// the ODoH queries are sent through the relay stamp, which is required for ODoH target
+func NewClient(s string, relay ...string) (*Client, error) {
+	st, err := Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		stamp: st,
+	}
+
+	switch st.Proto {
+	case ProtoDoH:
+		p, err := custom.NewClient("https://"+st.Hostname+st.Path, dns.FormatWire)
+		if err != nil {
+			return nil, err
+		}
+		c.provider = p
+	case ProtoDoT:
+		addr := st.Hostname
+		if st.Addr != "" {
+			addr = joinHostPort(st.Addr, port(st.Hostname, dotPort))
+		}
+		p, err := dot.NewClient(addr)
+		if err != nil {
+			return nil, err
+		}
+		p.SetName(st.host())
+		p.SetDialer(st.dialer())
+		c.provider = p
+	case ProtoODoHTarget:
+		if len(relay) == 0 || relay[0] == "" {
+			return nil, fmt.Errorf("stamp: odoh target requires relay")
+		}
+		rt, err := Parse(relay[0])
+		if err != nil {
+			return nil, err
+		}
+		if rt.Proto != ProtoODoHRelay {
+			return nil, fmt.Errorf("stamp: invalid relay protocol: %s", rt.Proto)
+		}
+		p, err := odoh.NewClient("https://"+st.Hostname+st.Path, "https://"+rt.Hostname+rt.Path)
+		if err != nil {
+			return nil, err
+		}
+		c.relay = rt
+		c.provider = p
+	default:
+		return nil, fmt.Errorf("stamp: unsupported provider protocol: %s", st.Proto)
+	}
+
+	c.SetTLSConfig(nil)
+
+	return c, nil
+}
+
+// SetTLSConfig set the TLS config of connections, such as the root certificates,
+// the server name and certificate hashes of stamp are always verified
+func (c *Client) SetTLSConfig(config *tls.Config) {
+	switch p := c.provider.(type) {
+	case *custom.Client:
+		p.SetHTTPClient(c.stamp.httpClient(config))
+	case *dot.Client:
+		p.SetTLSConfig(c.stamp.tlsConfig(config))
+	case *odoh.Client:
+		p.SetHTTPClient(c.relay.httpClient(config))
+		// configs are fetched from target directly, not through relay
+		p.SetConfigHTTPClient(c.stamp.httpClient(config))
+	}
+}
+
+// String returns string of provider, it is the hostname of stamp
+func (c *Client) String() string {
+	return c.provider.String()
+}
+
+// Stamp returns the parsed stamp of provider
+func (c *Client) Stamp() *Stamp {
+	return c.stamp
+}
+
+// Query do DNS query with the edns0-client-subnet option
+func (c *Client) Query(ctx context.Context, d dns.Domain, t dns.Type, s ...dns.ECS) (*dns.Response, error) {
+	return c.provider.Query(ctx, d, t, s...)
+}
+
+// QueryWithOptions do DNS query of question with options
+func (c *Client) QueryWithOptions(ctx context.Context, q dns.Question, o dns.Options) (*dns.Response, error) {
+	return c.provider.QueryWithOptions(ctx, q, o)
+}
+
+// host returns the hostname without port
+func (s *Stamp) host() string {
+	host, _, err := net.SplitHostPort(s.Hostname)
+	if err != nil {
+		return strings.Trim(s.Hostname, "[]")
+	}
+
+	return host
+}
+
+// httpClient returns the http client connects to the stamp address, and verifies the certificate hashes
+func (s *Stamp) httpClient(config *tls.Config) *http.Client {
+	d := s.dialer()
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				host, port, err := net.SplitHostPort(addr)
+				if err == nil && s.Addr != "" && strings.EqualFold(host, s.host()) {
+					addr = joinHostPort(s.Addr, port)
+				}
+				return d.DialContext(ctx, network, addr)
+			},
+			TLSClientConfig:     s.tlsConfig(config),
+			TLSHandshakeTimeout: 3 * time.Second,
+			MaxIdleConns:        256,
+			MaxIdleConnsPerHost: 256,
+		},
+	}
+}
+
+// dialer returns the dialer resolves the hostname by bootstrap resolvers
+func (s *Stamp) dialer() *net.Dialer {
+	d := &net.Dialer{
+		Timeout:   3 * time.Second,
+		KeepAlive: 60 * time.Second,
+	}
+
+	if len(s.Bootstrap) == 0 {
+		return d
+	}
+
+	d.Resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var conn net.Conn
+			var err error
+			for _, v := range s.Bootstrap {
+				conn, err = (&net.Dialer{Timeout: 3 * time.Second}).DialContext(ctx, network, joinHostPort(v, dnsPort))
+				if err == nil {
+					return conn, nil
+				}
+			}
+			return nil, err
+		},
+	}
+
+	return d
+}
+
+// tlsConfig returns the TLS config based on config, which verifies the certificate hashes
+func (s *Stamp) tlsConfig(config *tls.Config) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+
+	config.ServerName = s.host()
+	config.VerifyConnection = s.verifyConnection
+	if config.ClientSessionCache == nil {
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(8)
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+
+	return config
+}
+
+// verifyConnection checks one of the certificates in chain matches the hashes, see stamps specification
+func (s *Stamp) verifyConnection(cs tls.ConnectionState) error {
+	if len(s.Hashes) == 0 || !strings.EqualFold(cs.ServerName, s.host()) {
+		return nil
+	}
+
+	for _, cert := range cs.PeerCertificates {
+		sum := sha256.Sum256(cert.RawTBSCertificate)
+		for _, v := range s.Hashes {
+			if bytes.Equal(sum[:], v) {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("stamp: certificate hash mismatch of %s", s.host())
+}
+
+// port returns the port of address, or the default port
+func port(addr, port string) string {
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return port
+	}
+
+	return p
+}
+
+// joinHostPort returns the address with port, the port of address is kept if present
+func joinHostPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
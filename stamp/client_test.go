@@ -0,0 +1,377 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package stamp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/doh/internal/hpke"
+	"github.com/likexian/doh/provider/odoh"
+	"github.com/likexian/gokit/assert"
+)
+
+func reply(data []byte) []byte {
+	q := &dns.Msg{}
+	if q.Unpack(data) != nil {
+		return nil
+	}
+
+	m := &dns.Msg{ID: q.ID, QR: true, RD: true, RA: true, Question: q.Question}
+	m.Answer = []dns.Answer{{Name: q.Question[0].Name, Type: 1, TTL: 60, Data: "1.2.3.4"}}
+	b, _ := m.Pack()
+
+	return b
+}
+
+func newServer(t *testing.T) (*httptest.Server, []byte) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		_, _ = w.Write(reply(data))
+	}))
+	t.Cleanup(ts.Close)
+
+	sum := sha256.Sum256(ts.Certificate().RawTBSCertificate)
+
+	return ts, sum[:]
+}
+
+// rootConfig returns the TLS config trusts the certificates of servers
+func rootConfig(ts ...*httptest.Server) *tls.Config {
+	pool := x509.NewCertPool()
+	for _, v := range ts {
+		pool.AddCert(v.Certificate())
+	}
+
+	return &tls.Config{RootCAs: pool}
+}
+
+func newDoTServer(t *testing.T, ts *httptest.Server) net.Listener {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: ts.TLS.Certificates})
+	assert.Nil(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				size := make([]byte, 2)
+				for {
+					if _, err := io.ReadFull(conn, size); err != nil {
+						return
+					}
+					data := make([]byte, binary.BigEndian.Uint16(size))
+					if _, err := io.ReadFull(conn, data); err != nil {
+						return
+					}
+					b := reply(data)
+					_, _ = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...))
+				}
+			}()
+		}
+	}()
+
+	return l
+}
+
+func opaque(b, data []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(b, uint16(len(data))), data...)
+}
+
+func readOpaque(b []byte) ([]byte, []byte) {
+	if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+		return nil, nil
+	}
+
+	n := 2 + int(binary.BigEndian.Uint16(b))
+	return b[2:n], b[n:]
+}
+
+// newODoHTarget returns the target server of its own certificate, which is valid for 127.0.0.1 only
+func newODoHTarget(t *testing.T) *httptest.Server {
+	suite := hpke.Suite{KEM: hpke.KEMX25519, KDF: hpke.KDFSHA256, AEAD: hpke.AEADAES128GCM}
+	key, err := suite.GenerateKey()
+	assert.Nil(t, err)
+
+	config, err := odoh.NewConfig(suite, key.PublicKey().Bytes())
+	assert.Nil(t, err)
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "odoh target"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &certKey.PublicKey, certKey)
+	assert.Nil(t, err)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/.well-known/odohconfigs" {
+			_, _ = w.Write(config.Marshal())
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		if len(body) < 1 || body[0] != 0x01 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		keyID, rest := readOpaque(body[1:])
+		encrypted, _ := readOpaque(rest)
+		if !bytes.Equal(keyID, config.KeyID) || len(encrypted) < 32 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		receiver, err := suite.SetupBaseR(encrypted[:32], key, []byte("odoh query"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		pt, err := receiver.Open(opaque([]byte{0x01}, keyID), encrypted[32:])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		query, _ := readOpaque(pt)
+		nonce := make([]byte, suite.KeySize())
+		_, _ = rand.Read(nonce)
+		prk := suite.Extract(opaque(append([]byte{}, pt...), nonce), receiver.Export([]byte("odoh response"), suite.KeySize()))
+		aead, _ := suite.NewAEAD(suite.Expand(prk, []byte("odoh key"), suite.KeySize()))
+		ct := aead.Seal(nil, suite.Expand(prk, []byte("odoh nonce"), suite.NonceSize()),
+			opaque(opaque(nil, reply(query)), nil), opaque([]byte{0x02}, nonce))
+
+		_, _ = w.Write(opaque(opaque([]byte{0x02}, nonce), ct))
+	}))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: certKey}}}
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+func newODoHRelay(t *testing.T, target *httptest.Server, relayed *atomic.Int32) *httptest.Server {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("targethost") != target.Listener.Addr().String() {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		relayed.Add(1)
+		u := target.URL + r.URL.Query().Get("targetpath")
+		rsp, err := target.Client().Post(u, r.Header.Get("Content-Type"), r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer rsp.Body.Close()
+
+		w.WriteHeader(rsp.StatusCode)
+		_, _ = io.Copy(w, rsp.Body)
+	}))
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+func TestNewClient(t *testing.T) {
+	_, err := NewClient("sdns://!!!")
+	assert.NotNil(t, err)
+
+	relay := (&Stamp{Proto: ProtoODoHRelay, Hostname: "relay.likexian.com", Path: "/proxy"}).String()
+	_, err = NewClient(relay)
+	assert.NotNil(t, err)
+
+	target := (&Stamp{Proto: ProtoODoHTarget, Hostname: "odoh.likexian.com", Path: "/dns-query"}).String()
+	c, err := NewClient(target, relay)
+	assert.Nil(t, err)
+	assert.Equal(t, c.String(), "odoh.likexian.com")
+	assert.Equal(t, c.Stamp().Proto, ProtoODoHTarget)
+
+	_, err = NewClient(target, target)
+	assert.NotNil(t, err)
+
+	_, err = NewClient(target, "sdns://!!!")
+	assert.NotNil(t, err)
+
+	// the target is not queried directly without relay
+	_, err = NewClient(target)
+	assert.Equal(t, err.Error(), "stamp: odoh target requires relay")
+
+	_, err = NewClient(target, "")
+	assert.Equal(t, err.Error(), "stamp: odoh target requires relay")
+}
+
+func TestQueryDoH(t *testing.T) {
+	ts, hash := newServer(t)
+	ctx := context.Background()
+
+	st := &Stamp{
+		Proto:    ProtoDoH,
+		Addr:     ts.Listener.Addr().String(),
+		Hashes:   [][]byte{hash},
+		Hostname: "example.com",
+		Path:     "/dns-query",
+	}
+
+	c, err := NewClient(st.String())
+	assert.Nil(t, err)
+	assert.Equal(t, c.String(), "example.com")
+
+	// the certificate is not trusted by the system pool
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.NotNil(t, err)
+
+	c.SetTLSConfig(rootConfig(ts))
+	rsp, err := c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Answer[0].Data, "1.2.3.4")
+
+	rsp, err = c.QueryWithOptions(ctx, dns.Question{Name: "likexian.com", Type: 1}, dns.Options{DO: true})
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Answer[0].Data, "1.2.3.4")
+
+	st.Hashes = [][]byte{make([]byte, 32)}
+	c, err = NewClient(st.String())
+	assert.Nil(t, err)
+	c.SetTLSConfig(rootConfig(ts))
+
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.NotNil(t, err)
+}
+
+func TestQueryDoT(t *testing.T) {
+	ts, hash := newServer(t)
+	l := newDoTServer(t, ts)
+	ctx := context.Background()
+
+	st := &Stamp{
+		Proto:    ProtoDoT,
+		Addr:     l.Addr().String(),
+		Hashes:   [][]byte{hash},
+		Hostname: "example.com",
+	}
+
+	c, err := NewClient(st.String())
+	assert.Nil(t, err)
+	assert.Equal(t, c.String(), "example.com")
+
+	// the certificate is not trusted by the system pool
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.NotNil(t, err)
+
+	c.SetTLSConfig(rootConfig(ts))
+	rsp, err := c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Answer[0].Data, "1.2.3.4")
+
+	st.Hashes = [][]byte{make([]byte, 32)}
+	c, err = NewClient(st.String())
+	assert.Nil(t, err)
+	c.SetTLSConfig(rootConfig(ts))
+
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.NotNil(t, err)
+}
+
+func TestQueryODoH(t *testing.T) {
+	_, hash := newServer(t)
+	target := newODoHTarget(t)
+	ctx := context.Background()
+
+	var relayed atomic.Int32
+	relay := newODoHRelay(t, target, &relayed)
+
+	ts := &Stamp{
+		Proto:    ProtoODoHTarget,
+		Hostname: target.Listener.Addr().String(),
+		Path:     "/dns-query",
+	}
+
+	rs := &Stamp{
+		Proto:    ProtoODoHRelay,
+		Addr:     relay.Listener.Addr().String(),
+		Hashes:   [][]byte{hash},
+		Hostname: "relay.example.com",
+		Path:     "/proxy",
+	}
+
+	// configs are fetched from target directly, and queries are sent through relay
+	c, err := NewClient(ts.String(), rs.String())
+	assert.Nil(t, err)
+	c.SetTLSConfig(rootConfig(target, relay))
+
+	rsp, err := c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Answer[0].Data, "1.2.3.4")
+	assert.Equal(t, relayed.Load(), int32(1))
+
+	rs.Hashes = [][]byte{make([]byte, 32)}
+	c, err = NewClient(ts.String(), rs.String())
+	assert.Nil(t, err)
+	c.SetTLSConfig(rootConfig(target, relay))
+
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.NotNil(t, err)
+	assert.Equal(t, relayed.Load(), int32(1))
+}
+
+func TestJoinHostPort(t *testing.T) {
+	assert.Equal(t, joinHostPort("1.2.3.4", "53"), "1.2.3.4:53")
+	assert.Equal(t, joinHostPort("1.2.3.4:5353", "53"), "1.2.3.4:5353")
+	assert.Equal(t, joinHostPort("[2001:db8::1]", "53"), "[2001:db8::1]:53")
+	assert.Equal(t, joinHostPort("2001:db8::1", "53"), "[2001:db8::1]:53")
+	assert.Equal(t, port("likexian.com:8853", "853"), "8853")
+	assert.Equal(t, port("likexian.com", "853"), "853")
+}
@@ -0,0 +1,342 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package stamp
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Protocol is the server protocol of stamp
+type Protocol uint8
+
+// Props is the informal properties of server
+type Props uint64
+
+// Stamp is the DNS server stamp, see https://dnscrypt.info/stamps-specifications
+type Stamp struct {
+	// Proto is the server protocol
+	Proto Protocol
+	// Props is the informal properties of server
+	Props Props
+	// Addr is the IP address of server, with optional port, empty to resolve the hostname
+	Addr string
+	// Hashes is the SHA256 digest of TBS certificate in the certificate chain
+	Hashes [][]byte
+	// Hostname is the server host name, with optional port
+	Hostname string
+	// Path is the http path of DoH and ODoH
+	Path string
+	// Bootstrap is the IP addresses of resolvers to resolve the hostname
+	Bootstrap []string
+}
+
+// Supported stamp protocol
+const (
+	// ProtoPlain is the plain DNS
+	ProtoPlain Protocol = 0x00
+	// ProtoDNSCrypt is the DNSCrypt
+	ProtoDNSCrypt Protocol = 0x01
+	// ProtoDoH is the DNS over HTTPS
+	ProtoDoH Protocol = 0x02
+	// ProtoDoT is the DNS over TLS
+	ProtoDoT Protocol = 0x03
+	// ProtoDoQ is the DNS over QUIC
+	ProtoDoQ Protocol = 0x04
+	// ProtoODoHTarget is the Oblivious DoH target
+	ProtoODoHTarget Protocol = 0x05
+	// ProtoDNSCryptRelay is the anonymized DNSCrypt relay
+	ProtoDNSCryptRelay Protocol = 0x81
+	// ProtoODoHRelay is the Oblivious DoH relay
+	ProtoODoHRelay Protocol = 0x85
+)
+
+// Server informal properties
+const (
+	// PropDNSSEC is the server does DNSSEC validation
+	PropDNSSEC Props = 1 << 0
+	// PropNoLog is the server does not keep logs
+	PropNoLog Props = 1 << 1
+	// PropNoFilter is the server does not intentionally block domains
+	PropNoFilter Props = 1 << 2
+)
+
+// scheme is the stamp url scheme
+const scheme = "sdns://"
+
+// Version returns package version
+func Version() string {
+	return "0.1.0"
+}
+
+// Author returns package author
+func Author() string {
+	return "[Li Kexian](https://www.likexian.com/)"
+}
+
+// License returns package license
+func License() string {
+	return "Licensed under the Apache License 2.0"
+}
+
+// Parse parses the DoH, DoT and ODoH stamp, for example: sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5
+func Parse(s string) (*Stamp, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, scheme) {
+		return nil, fmt.Errorf("stamp: invalid stamp scheme: %s", s)
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s[len(scheme):], "="))
+	if err != nil {
+		return nil, fmt.Errorf("stamp: invalid stamp encoding: %w", err)
+	}
+
+	if len(b) < 9 {
+		return nil, fmt.Errorf("stamp: stamp too short")
+	}
+
+	st := &Stamp{
+		Proto: Protocol(b[0]),
+		Props: Props(binary.LittleEndian.Uint64(b[1:])),
+	}
+
+	r := &reader{b: b[9:]}
+	switch st.Proto {
+	case ProtoDoH, ProtoODoHRelay:
+		st.Addr = r.lp()
+		st.Hashes = r.vlp()
+		st.Hostname = r.lp()
+		st.Path = r.lp()
+		st.Bootstrap = r.bootstrap()
+	case ProtoDoT:
+		st.Addr = r.lp()
+		st.Hashes = r.vlp()
+		st.Hostname = r.lp()
+		st.Bootstrap = r.bootstrap()
+	case ProtoODoHTarget:
+		st.Hostname = r.lp()
+		st.Path = r.lp()
+	default:
+		return nil, fmt.Errorf("stamp: unsupported protocol: %s", st.Proto)
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	if len(r.b) > 0 {
+		return nil, fmt.Errorf("stamp: unexpected trailing data")
+	}
+
+	err = st.check()
+	if err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// String returns the stamp in sdns:// url
+func (s *Stamp) String() string {
+	b := append([]byte{byte(s.Proto)}, binary.LittleEndian.AppendUint64(nil, uint64(s.Props))...)
+
+	switch s.Proto {
+	case ProtoDoH, ProtoODoHRelay:
+		b = appendLP(b, s.Addr)
+		b = appendVLP(b, s.Hashes)
+		b = appendLP(b, s.Hostname)
+		b = appendLP(b, s.Path)
+		b = appendBootstrap(b, s.Bootstrap)
+	case ProtoDoT:
+		b = appendLP(b, s.Addr)
+		b = appendVLP(b, s.Hashes)
+		b = appendLP(b, s.Hostname)
+		b = appendBootstrap(b, s.Bootstrap)
+	case ProtoODoHTarget:
+		b = appendLP(b, s.Hostname)
+		b = appendLP(b, s.Path)
+	}
+
+	return scheme + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// String returns the protocol name
+func (p Protocol) String() string {
+	switch p {
+	case ProtoPlain:
+		return "Plain"
+	case ProtoDNSCrypt:
+		return "DNSCrypt"
+	case ProtoDoH:
+		return "DoH"
+	case ProtoDoT:
+		return "DoT"
+	case ProtoDoQ:
+		return "DoQ"
+	case ProtoODoHTarget:
+		return "ODoH"
+	case ProtoDNSCryptRelay:
+		return "DNSCrypt relay"
+	case ProtoODoHRelay:
+		return "ODoH relay"
+	default:
+		return fmt.Sprintf("0x%02x", uint8(p))
+	}
+}
+
+// check checks the fields of stamp
+func (s *Stamp) check() error {
+	if s.Hostname == "" {
+		return fmt.Errorf("stamp: missing hostname")
+	}
+
+	if s.Proto != ProtoDoT && !strings.HasPrefix(s.Path, "/") {
+		return fmt.Errorf("stamp: invalid path: %s", s.Path)
+	}
+
+	if s.Addr != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			host = strings.Trim(s.Addr, "[]")
+		}
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("stamp: invalid address: %s", s.Addr)
+		}
+	}
+
+	for _, v := range s.Hashes {
+		if len(v) != 32 {
+			return fmt.Errorf("stamp: invalid certificate hash length: %d", len(v))
+		}
+	}
+
+	for _, v := range s.Bootstrap {
+		if net.ParseIP(strings.Trim(v, "[]")) == nil {
+			if _, _, err := net.SplitHostPort(v); err != nil {
+				return fmt.Errorf("stamp: invalid bootstrap address: %s", v)
+			}
+		}
+	}
+
+	return nil
+}
+
+// reader is the stamp data reader, the first error is kept
+type reader struct {
+	b   []byte
+	err error
+}
+
+// lp reads a length prefixed string
+func (r *reader) lp() string {
+	if r.err != nil {
+		return ""
+	}
+
+	if len(r.b) < 1 || len(r.b) < 1+int(r.b[0]) {
+		r.err = fmt.Errorf("stamp: stamp too short")
+		return ""
+	}
+
+	s := string(r.b[1 : 1+r.b[0]])
+	r.b = r.b[1+r.b[0]:]
+
+	return s
+}
+
+// vlp reads a variable length prefixed set, the high bit of length is set if more items follow
+func (r *reader) vlp() [][]byte {
+	if r.err != nil {
+		return nil
+	}
+
+	items := [][]byte{}
+	for {
+		if len(r.b) < 1 {
+			r.err = fmt.Errorf("stamp: stamp too short")
+			return nil
+		}
+		n, more := int(r.b[0]&0x7f), r.b[0]&0x80 != 0
+		if len(r.b) < 1+n {
+			r.err = fmt.Errorf("stamp: stamp too short")
+			return nil
+		}
+		if n > 0 {
+			items = append(items, r.b[1:1+n])
+		}
+		r.b = r.b[1+n:]
+		if !more {
+			return items
+		}
+	}
+}
+
+// bootstrap reads the optional bootstrap IP addresses
+func (r *reader) bootstrap() []string {
+	if len(r.b) == 0 {
+		return nil
+	}
+
+	ss := []string{}
+	for _, v := range r.vlp() {
+		ss = append(ss, string(v))
+	}
+
+	return ss
+}
+
+// appendLP appends a length prefixed string
+func appendLP(b []byte, s string) []byte {
+	return append(append(b, byte(len(s))), s...)
+}
+
+// appendVLP appends a variable length prefixed set
+func appendVLP(b []byte, items [][]byte) []byte {
+	if len(items) == 0 {
+		return append(b, 0)
+	}
+
+	for i, v := range items {
+		n := byte(len(v))
+		if i < len(items)-1 {
+			n |= 0x80
+		}
+		b = append(append(b, n), v...)
+	}
+
+	return b
+}
+
+// appendBootstrap appends the optional bootstrap IP addresses
+func appendBootstrap(b []byte, ips []string) []byte {
+	if len(ips) == 0 {
+		return b
+	}
+
+	items := [][]byte{}
+	for _, v := range ips {
+		items = append(items, []byte(v))
+	}
+
+	return appendVLP(b, items)
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package stamp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	"github.com/likexian/gokit/assert"
+)
+
+func TestVersion(t *testing.T) {
+	assert.Contains(t, Version(), ".")
+	assert.Contains(t, Author(), "likexian")
+	assert.Contains(t, License(), "Apache License")
+}
+
+func TestParse(t *testing.T) {
+	s := "sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5"
+	st, err := Parse(s)
+	assert.Nil(t, err)
+	assert.Equal(t, st.Proto, ProtoDoH)
+	assert.Equal(t, st.Props, PropDNSSEC|PropNoLog|PropNoFilter)
+	assert.Equal(t, st.Addr, "1.0.0.1")
+	assert.Equal(t, len(st.Hashes), 0)
+	assert.Equal(t, st.Hostname, "dns.cloudflare.com")
+	assert.Equal(t, st.Path, "/dns-query")
+	assert.Equal(t, st.String(), s)
+
+	s = "sdns://AwcAAAAAAAAABzEuMS4xLjEAEmNsb3VkZmxhcmUtZG5zLmNvbQ"
+	st, err = Parse(s)
+	assert.Nil(t, err)
+	assert.Equal(t, st.Proto, ProtoDoT)
+	assert.Equal(t, st.Addr, "1.1.1.1")
+	assert.Equal(t, st.Hostname, "cloudflare-dns.com")
+	assert.Equal(t, st.String(), s)
+
+	s = "sdns://BQcAAAAAAAAAF29kb2guY2xvdWRmbGFyZS1kbnMuY29tCi9kbnMtcXVlcnk"
+	st, err = Parse(s)
+	assert.Nil(t, err)
+	assert.Equal(t, st.Proto, ProtoODoHTarget)
+	assert.Equal(t, st.Hostname, "odoh.cloudflare-dns.com")
+	assert.Equal(t, st.Path, "/dns-query")
+	assert.Equal(t, st.String(), s)
+}
+
+func TestStampString(t *testing.T) {
+	hash := bytes.Repeat([]byte{0xab}, 32)
+	tests := []*Stamp{
+		{
+			Proto:     ProtoDoH,
+			Props:     PropDNSSEC,
+			Addr:      "[2001:db8::1]:8443",
+			Hashes:    [][]byte{hash, bytes.Repeat([]byte{0xcd}, 32)},
+			Hostname:  "doh.likexian.com:8443",
+			Path:      "/dns-query",
+			Bootstrap: []string{"1.1.1.1", "[2001:db8::53]:53"},
+		},
+		{
+			Proto:     ProtoDoT,
+			Props:     PropNoLog,
+			Hashes:    [][]byte{hash},
+			Hostname:  "dot.likexian.com",
+			Bootstrap: []string{"9.9.9.9"},
+		},
+		{
+			Proto:    ProtoODoHRelay,
+			Addr:     "127.0.0.1",
+			Hashes:   [][]byte{},
+			Hostname: "relay.likexian.com",
+			Path:     "/proxy",
+		},
+	}
+
+	for _, v := range tests {
+		st, err := Parse(v.String())
+		assert.Nil(t, err)
+		assert.Equal(t, st, v)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []string{
+		"https://likexian.com/",
+		"sdns://!!!",
+		"sdns://AgcAAAAA",
+		"sdns://" + base64.RawURLEncoding.EncodeToString([]byte{0x01, 0, 0, 0, 0, 0, 0, 0, 0}),
+		"sdns://" + base64.RawURLEncoding.EncodeToString([]byte{0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}),
+		(&Stamp{Proto: ProtoDoH, Hostname: "likexian.com", Path: "dns-query"}).String(),
+		(&Stamp{Proto: ProtoDoH, Path: "/dns-query"}).String(),
+		(&Stamp{Proto: ProtoDoH, Addr: "likexian.com", Hostname: "likexian.com", Path: "/"}).String(),
+		(&Stamp{Proto: ProtoDoT, Hostname: "likexian.com", Hashes: [][]byte{{1, 2, 3}}}).String(),
+		(&Stamp{Proto: ProtoDoT, Hostname: "likexian.com", Bootstrap: []string{"likexian.com"}}).String(),
+		(&Stamp{Proto: ProtoODoHTarget, Hostname: "likexian.com", Path: "/"}).String() + "AA",
+	}
+
+	for _, v := range tests {
+		_, err := Parse(v)
+		assert.NotNil(t, err, v)
+	}
+
+	assert.Equal(t, ProtoDoH.String(), "DoH")
+	assert.Equal(t, ProtoDNSCrypt.String(), "DNSCrypt")
+	assert.Equal(t, Protocol(0x99).String(), "0x99")
+}
@@ -0,0 +1,420 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package doh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/likexian/doh/dns"
+)
+
+// ErrorKind is the kind of query error
+type ErrorKind string
+
+// Query error kinds
+const (
+	// ErrorTimeout is the query timed out
+	ErrorTimeout ErrorKind = "timeout"
+	// ErrorNetwork is the network error, such as connection refused
+	ErrorNetwork ErrorKind = "network"
+	// ErrorRCode is the bad response code, such as SERVFAIL
+	ErrorRCode ErrorKind = "rcode"
+	// ErrorOther is the other error, such as bad http status or broken response
+	ErrorOther ErrorKind = "other"
+)
+
+// Stats is the query stats of DoH client in the sliding window
+type Stats struct {
+	// Window is the sliding window of stats, zero if the stats are since the client is created
+	Window time.Duration
+	// Providers is the stats of providers, in order of providers
+	Providers []ProviderStats
+	// Cache is the stats of cache
+	Cache CacheStats
+	// Flight is the stats of query coalescing, since the client is created
+	Flight FlightStats
+}
+
+// ProviderStats is the query stats of provider
+type ProviderStats struct {
+	// Provider is the name of provider
+	Provider string
+	// State is the circuit breaker state of provider
+	State BreakerState
+	// Total is the number of queries
+	Total int64
+	// Errors is the number of failed queries by kind
+	Errors map[ErrorKind]int64
+	// RCodes is the number of responses by response code
+	RCodes map[dns.RCode]int64
+	// Latency is the latency histogram of queries
+	Latency Histogram
+}
+
+// CacheStats is the stats of cache
+type CacheStats struct {
+	// Hits is the number of fresh cache hits
+	Hits int64
+	// Misses is the number of cache misses
+	Misses int64
+	// Stale is the number of stale answers served, see RFC 8767
+	Stale int64
+}
+
+// Histogram is the latency histogram
+type Histogram struct {
+	// Bounds is the upper bounds of buckets
+	Bounds []time.Duration
+	// Counts is the number of samples in buckets, the last is of +Inf
+	Counts []int64
+	// Count is the number of samples
+	Count int64
+	// Sum is the sum of samples
+	Sum time.Duration
+}
+
+// ServeStats is the stats of server or stub resolver, since it is created
+type ServeStats struct {
+	// Queries is the number of queries by transport, such as udp, tcp, wire and json
+	Queries map[string]int64
+	// Invalid is the number of invalid queries
+	Invalid int64
+	// RCodes is the number of responses by response code
+	RCodes map[dns.RCode]int64
+	// Latency is the latency histogram of resolving
+	Latency Histogram
+}
+
+// LatencyBounds is the upper bounds of latency histogram buckets
+var LatencyBounds = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+const (
+	// statsSlots is the number of slots of sliding window
+	statsSlots = 12
+	// defaultStatsWindow is the default sliding window of stats
+	defaultStatsWindow = time.Minute
+)
+
+// statsSlot is a slot of sliding window
+type statsSlot struct {
+	start     time.Time
+	providers map[int]*ProviderStats
+	cache     CacheStats
+}
+
+// statsWindow is the stats in sliding window, it is split into slots
+type statsWindow struct {
+	window time.Duration
+	slots  []statsSlot
+	total  statsSlot
+	sync.Mutex
+}
+
+// NewHistogram returns a new latency histogram of LatencyBounds
+func NewHistogram() Histogram {
+	return Histogram{
+		Bounds: LatencyBounds,
+		Counts: make([]int64, len(LatencyBounds)+1),
+	}
+}
+
+// Observe adds the latency sample to histogram
+func (h *Histogram) Observe(d time.Duration) {
+	i := 0
+	for i < len(h.Bounds) && d > h.Bounds[i] {
+		i++
+	}
+
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+// merge adds the samples of histogram of the same bounds
+func (h *Histogram) merge(v Histogram) {
+	for i, n := range v.Counts {
+		h.Counts[i] += n
+	}
+
+	h.Count += v.Count
+	h.Sum += v.Sum
+}
+
+// newProviderStats returns a new empty provider stats
+func newProviderStats() *ProviderStats {
+	return &ProviderStats{
+		Errors:  map[ErrorKind]int64{},
+		RCodes:  map[dns.RCode]int64{},
+		Latency: NewHistogram(),
+	}
+}
+
+// newStatsWindow returns a new stats in sliding window
+func newStatsWindow(window time.Duration) *statsWindow {
+	if window <= 0 {
+		window = defaultStatsWindow
+	}
+
+	return &statsWindow{
+		window: window,
+		slots:  make([]statsSlot, statsSlots),
+		total:  statsSlot{providers: map[int]*ProviderStats{}},
+	}
+}
+
+// setWindow set the sliding window, the slots are reset and the total slot is kept
+func (w *statsWindow) setWindow(window time.Duration) {
+	if window <= 0 {
+		window = defaultStatsWindow
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	w.window = window
+	w.slots = make([]statsSlot, statsSlots)
+}
+
+// size returns the sliding window
+func (w *statsWindow) size() time.Duration {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.window
+}
+
+// SetStatsWindow set the sliding window of stats, default is 1 minute,
+// the stats in window are reset, and the total stats are kept
+func (c *DoH) SetStatsWindow(window time.Duration) *DoH {
+	c.stats.setWindow(window)
+
+	return c
+}
+
+// Stats returns the query stats in the sliding window
+func (c *DoH) Stats() Stats {
+	return c.collectStats(false)
+}
+
+// TotalStats returns the query stats since the client is created
+func (c *DoH) TotalStats() Stats {
+	return c.collectStats(true)
+}
+
+// collectStats returns the query stats in the sliding window, or since the client is created
+func (c *DoH) collectStats(total bool) Stats {
+	s := Stats{
+		Providers: c.stats.providerStats(len(c.providers), total),
+		Cache:     c.stats.cacheStats(total),
+		Flight:    c.FlightStats(),
+	}
+
+	if !total {
+		s.Window = c.stats.size()
+	}
+
+	for i, p := range c.providers {
+		s.Providers[i].Provider = p.String()
+		s.Providers[i].State = c.breakers.state(i)
+	}
+
+	return s
+}
+
+// ErrorCount returns the number of failed queries
+func (s ProviderStats) ErrorCount() int64 {
+	n := int64(0)
+	for _, v := range s.Errors {
+		n += v
+	}
+
+	return n
+}
+
+// HitRatio returns the ratio of cache hits, stale answers are hits
+func (s CacheStats) HitRatio() float64 {
+	total := s.Hits + s.Stale + s.Misses
+	if total == 0 {
+		return 0
+	}
+
+	return float64(s.Hits+s.Stale) / float64(total)
+}
+
+// observe records the query result of provider index
+func (w *statsWindow) observe(k int, rtt time.Duration, rsp *dns.Response, err error) {
+	w.Lock()
+	defer w.Unlock()
+
+	for _, slot := range []*statsSlot{w.slot(time.Now()), &w.total} {
+		p, ok := slot.providers[k]
+		if !ok {
+			p = newProviderStats()
+			slot.providers[k] = p
+		}
+
+		p.Total++
+		if err != nil {
+			p.Errors[errorKind(err)]++
+		}
+
+		if rsp != nil {
+			p.RCodes[dns.RCode(rsp.Status)]++
+		}
+
+		p.Latency.Observe(rtt)
+	}
+}
+
+// observeCache records the cache result, stale is true if stale answer is served
+func (w *statsWindow) observeCache(hit, stale bool) {
+	w.Lock()
+	defer w.Unlock()
+
+	for _, slot := range []*statsSlot{w.slot(time.Now()), &w.total} {
+		switch {
+		case stale:
+			slot.cache.Stale++
+		case hit:
+			slot.cache.Hits++
+		default:
+			slot.cache.Misses++
+		}
+	}
+}
+
+// providerStats returns the stats of n providers in window, or since created if total
+func (w *statsWindow) providerStats(n int, total bool) []ProviderStats {
+	r := make([]ProviderStats, n)
+	for i := range r {
+		r[i] = *newProviderStats()
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	for _, slot := range w.collect(total) {
+		for k, p := range slot.providers {
+			if k >= n {
+				continue
+			}
+			s := &r[k]
+			s.Total += p.Total
+			for e, v := range p.Errors {
+				s.Errors[e] += v
+			}
+			for c, v := range p.RCodes {
+				s.RCodes[c] += v
+			}
+			s.Latency.merge(p.Latency)
+		}
+	}
+
+	return r
+}
+
+// cacheStats returns the stats of cache in window, or since created if total
+func (w *statsWindow) cacheStats(total bool) CacheStats {
+	w.Lock()
+	defer w.Unlock()
+
+	r := CacheStats{}
+	for _, slot := range w.collect(total) {
+		r.Hits += slot.cache.Hits
+		r.Misses += slot.cache.Misses
+		r.Stale += slot.cache.Stale
+	}
+
+	return r
+}
+
+// collect returns the slots in window, or the total slot if total, the lock must be held
+func (w *statsWindow) collect(total bool) []*statsSlot {
+	if total {
+		return []*statsSlot{&w.total}
+	}
+
+	now := time.Now()
+	r := make([]*statsSlot, 0, len(w.slots))
+	for i := range w.slots {
+		slot := &w.slots[i]
+		if !slot.start.IsZero() && now.Sub(slot.start) < w.window {
+			r = append(r, slot)
+		}
+	}
+
+	return r
+}
+
+// slot returns the slot of now, the expired slot is reset, the lock must be held
+func (w *statsWindow) slot(now time.Time) *statsSlot {
+	d := w.window / time.Duration(len(w.slots))
+	if d <= 0 {
+		d = 1
+	}
+
+	start := now.Truncate(d)
+	slot := &w.slots[int(start.UnixNano()/int64(d))%len(w.slots)]
+	if !slot.start.Equal(start) {
+		*slot = statsSlot{
+			start:     start,
+			providers: map[int]*ProviderStats{},
+		}
+	}
+
+	return slot
+}
+
+// errorKind returns the kind of query error
+func errorKind(err error) ErrorKind {
+	var rerr *dns.RCodeError
+	if errors.As(err, &rerr) {
+		return ErrorRCode
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrorTimeout
+	}
+
+	var nerr net.Error
+	if errors.As(err, &nerr) {
+		if nerr.Timeout() {
+			return ErrorTimeout
+		}
+		return ErrorNetwork
+	}
+
+	return ErrorOther
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package doh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/doh/provider/custom"
+	"github.com/likexian/gokit/assert"
+)
+
+func TestErrorKind(t *testing.T) {
+	tests := []struct {
+		err  error
+		kind ErrorKind
+	}{
+		{&dns.RCodeError{RCode: dns.RCodeServFail}, ErrorRCode},
+		{fmt.Errorf("doh: %w", context.DeadlineExceeded), ErrorTimeout},
+		{&net.DNSError{IsTimeout: true}, ErrorTimeout},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, ErrorNetwork},
+		{errors.New("bad http status"), ErrorOther},
+	}
+
+	for _, v := range tests {
+		assert.Equal(t, errorKind(v.err), v.kind, v.err)
+	}
+}
+
+func TestStatsWindow(t *testing.T) {
+	w := newStatsWindow(120 * time.Millisecond)
+	w.observe(0, 7*time.Millisecond, &dns.Response{}, nil)
+	w.observe(0, 10*time.Second, nil, context.DeadlineExceeded)
+	w.observe(1, time.Millisecond, &dns.Response{Status: 2}, &dns.RCodeError{RCode: dns.RCodeServFail})
+	w.observeCache(true, false)
+	w.observeCache(true, true)
+	w.observeCache(false, false)
+
+	ps := w.providerStats(2, false)
+	assert.Equal(t, ps[0].Total, int64(2))
+	assert.Equal(t, ps[0].Errors, map[ErrorKind]int64{ErrorTimeout: 1})
+	assert.Equal(t, ps[0].RCodes, map[dns.RCode]int64{dns.RCodeNoError: 1})
+	assert.Equal(t, ps[0].Latency.Count, int64(2))
+	assert.Equal(t, ps[0].Latency.Sum, 10*time.Second+7*time.Millisecond)
+	assert.Equal(t, ps[0].Latency.Counts[1], int64(1))
+	assert.Equal(t, ps[0].Latency.Counts[len(LatencyBounds)], int64(1))
+	assert.Equal(t, ps[1].ErrorCount(), int64(1))
+	assert.Equal(t, ps[1].RCodes, map[dns.RCode]int64{dns.RCodeServFail: 1})
+
+	cs := w.cacheStats(false)
+	assert.Equal(t, cs, CacheStats{Hits: 1, Misses: 1, Stale: 1})
+	assert.Equal(t, fmt.Sprintf("%.2f", cs.HitRatio()), "0.67")
+	assert.Equal(t, CacheStats{}.HitRatio(), 0.0)
+
+	// the stats out of window are dropped
+	time.Sleep(130 * time.Millisecond)
+	ps = w.providerStats(2, false)
+	assert.Equal(t, ps[0].Total, int64(0))
+	assert.Equal(t, w.cacheStats(false), CacheStats{})
+
+	// the total stats are kept
+	ps = w.providerStats(2, true)
+	assert.Equal(t, ps[0].Total, int64(2))
+	assert.Equal(t, ps[1].Total, int64(1))
+	assert.Equal(t, w.cacheStats(true), CacheStats{Hits: 1, Misses: 1, Stale: 1})
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram()
+	h.Observe(time.Millisecond)
+	h.Observe(5 * time.Millisecond)
+	h.Observe(6 * time.Millisecond)
+	h.Observe(time.Minute)
+
+	assert.Equal(t, h.Count, int64(4))
+	assert.Equal(t, h.Sum, time.Minute+12*time.Millisecond)
+	assert.Equal(t, h.Counts[0], int64(2))
+	assert.Equal(t, h.Counts[1], int64(1))
+	assert.Equal(t, h.Counts[len(LatencyBounds)], int64(1))
+}
+
+func TestStats(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	p, err := custom.NewClient(ts.URL+"/dns-query", dns.FormatWire)
+	assert.Nil(t, err)
+
+	c := UseProvider(p).EnableCache(true).SetStatsWindow(time.Hour)
+	defer c.Close()
+
+	for _, v := range []dns.Domain{"likexian.com", "likexian.com", "nx.likexian.com", "servfail.likexian.com"} {
+		_, _ = c.Query(ctx, v, dns.TypeA)
+	}
+
+	s := c.Stats()
+	assert.Equal(t, s.Window, time.Hour)
+	assert.Len(t, s.Providers, 1)
+	assert.Equal(t, s.Providers[0].Provider, p.String())
+	assert.Equal(t, s.Providers[0].State, BreakerClosed)
+	assert.Equal(t, s.Providers[0].Total, int64(3))
+	assert.Equal(t, s.Providers[0].Errors, map[ErrorKind]int64{ErrorRCode: 1})
+	assert.Equal(t, s.Providers[0].RCodes, map[dns.RCode]int64{
+		dns.RCodeNoError:  1,
+		dns.RCodeNXDomain: 1,
+		dns.RCodeServFail: 1,
+	})
+	assert.Equal(t, s.Providers[0].Latency.Count, int64(3))
+	assert.Equal(t, s.Cache, CacheStats{Hits: 1, Misses: 3})
+	assert.Equal(t, s.Flight, FlightStats{Queries: 4})
+
+	s = c.TotalStats()
+	assert.Equal(t, s.Window, time.Duration(0))
+	assert.Equal(t, s.Providers[0].Total, int64(3))
+	assert.Equal(t, s.Cache, CacheStats{Hits: 1, Misses: 3})
+
+	// the stats in window are reset, and the total stats are kept
+	c.SetStatsWindow(time.Minute)
+	s = c.Stats()
+	assert.Equal(t, s.Window, time.Minute)
+	assert.Equal(t, s.Providers[0].Total, int64(0))
+	assert.Equal(t, s.Cache, CacheStats{})
+
+	_, _ = c.Query(ctx, "servfail.likexian.com", dns.TypeA)
+	s = c.TotalStats()
+	assert.Equal(t, s.Providers[0].Total, int64(4))
+	assert.Equal(t, s.Cache, CacheStats{Hits: 1, Misses: 4})
+}
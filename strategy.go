@@ -0,0 +1,288 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package doh
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy is the provider selection strategy interface, it must be safe for concurrent use
+type Strategy interface {
+	// Select returns the groups of provider index to query, the providers of a group are raced,
+	// and the next group is queried if all providers of the previous group failed
+	Select(n int) [][]int
+	// Observe observes the query result of provider index, with the round-trip time
+	Observe(i int, rtt time.Duration, err error)
+}
+
+// ratioStrategy selects the provider of lowest failure ratio, all providers are raced if no stats
+type ratioStrategy struct {
+	stats *statsWindow
+}
+
+// raceStrategy races all providers
+type raceStrategy struct{}
+
+// failoverStrategy queries the providers in order
+type failoverStrategy struct{}
+
+// roundRobinStrategy queries the providers in turn
+type roundRobinStrategy struct {
+	next atomic.Uint64
+}
+
+// weightedStrategy queries the providers by weighted random
+type weightedStrategy struct {
+	weights []int
+	rand    *rand.Rand
+	sync.Mutex
+}
+
+// latencyStrategy queries the provider of lowest smoothed round-trip time
+type latencyStrategy struct {
+	alpha float64
+	rtts  map[int]float64
+	sync.Mutex
+}
+
+// latencyFailPenalty is the round-trip time of failed query
+const latencyFailPenalty = 5 * time.Second
+
+// NewRatioStrategy returns the strategy selects the provider of lowest failure ratio in the sliding window,
+// all providers are raced if no stats, it is the default strategy
+func NewRatioStrategy(window time.Duration) Strategy {
+	if window <= 0 {
+		window = 5 * time.Second
+	}
+
+	return &ratioStrategy{
+		stats: newStatsWindow(window),
+	}
+}
+
+// NewRaceStrategy returns the strategy races all providers, it is the fastest but costs most
+func NewRaceStrategy() Strategy {
+	return raceStrategy{}
+}
+
+// NewFailoverStrategy returns the strategy queries the providers in order, the next is queried if failed
+func NewFailoverStrategy() Strategy {
+	return failoverStrategy{}
+}
+
+// NewRoundRobinStrategy returns the strategy queries the providers in turn, the next is queried if failed
+func NewRoundRobinStrategy() Strategy {
+	return &roundRobinStrategy{}
+}
+
+// NewWeightedStrategy returns the strategy queries the providers by weighted random,
+// the weights are of providers in order, missing weight is 1, the others are queried if failed
+func NewWeightedStrategy(weights ...int) Strategy {
+	return &weightedStrategy{
+		weights: weights,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// NewLatencyStrategy returns the strategy queries the provider of lowest smoothed round-trip time,
+// alpha is the weight of the latest round-trip time, between 0 and 1, the others are queried if failed
+func NewLatencyStrategy(alpha float64) Strategy {
+	if alpha <= 0 || alpha > 1 {
+		alpha = 0.3
+	}
+
+	return &latencyStrategy{
+		alpha: alpha,
+		rtts:  map[int]float64{},
+	}
+}
+
+// Select returns the provider of lowest failure ratio, or all providers if no stats
+func (s *ratioStrategy) Select(n int) [][]int {
+	best, min := -1, math.MaxFloat64
+	for i, v := range s.stats.providerStats(n, false) {
+		if v.Total == 0 {
+			continue
+		}
+		if r := float64(v.ErrorCount()) / float64(v.Total); r < min {
+			best, min = i, r
+		}
+	}
+
+	if best < 0 {
+		return [][]int{sequence(n)}
+	}
+
+	return [][]int{{best}}
+}
+
+// Observe counts the errors and total of provider
+func (s *ratioStrategy) Observe(i int, rtt time.Duration, err error) {
+	s.stats.observe(i, rtt, nil, err)
+}
+
+// Select returns all providers in one group
+func (s raceStrategy) Select(n int) [][]int {
+	return [][]int{sequence(n)}
+}
+
+// Observe does nothing
+func (s raceStrategy) Observe(i int, rtt time.Duration, err error) {}
+
+// Select returns the providers in order
+func (s failoverStrategy) Select(n int) [][]int {
+	return groups(sequence(n))
+}
+
+// Observe does nothing
+func (s failoverStrategy) Observe(i int, rtt time.Duration, err error) {}
+
+// Select returns the providers in order starting from the next one
+func (s *roundRobinStrategy) Select(n int) [][]int {
+	if n == 0 {
+		return nil
+	}
+
+	start := int(s.next.Add(1)-1) % n
+	r := make([]int, n)
+	for i := range r {
+		r[i] = (start + i) % n
+	}
+
+	return groups(r)
+}
+
+// Observe does nothing
+func (s *roundRobinStrategy) Observe(i int, rtt time.Duration, err error) {}
+
+// Select returns the providers in weighted random order
+func (s *weightedStrategy) Select(n int) [][]int {
+	ws := make([]int, n)
+	total := 0
+	for i := range ws {
+		ws[i] = 1
+		if i < len(s.weights) {
+			ws[i] = s.weights[i]
+		}
+		if ws[i] < 0 {
+			ws[i] = 0
+		}
+		total += ws[i]
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	r := make([]int, 0, n)
+	for len(r) < n {
+		if total == 0 {
+			for i := range ws {
+				if ws[i] == 0 && !contains(r, i) {
+					r = append(r, i)
+				}
+			}
+			break
+		}
+		k := s.rand.Intn(total)
+		for i, w := range ws {
+			if k < w {
+				r = append(r, i)
+				total -= w
+				ws[i] = 0
+				break
+			}
+			k -= w
+		}
+	}
+
+	return groups(r)
+}
+
+// Observe does nothing
+func (s *weightedStrategy) Observe(i int, rtt time.Duration, err error) {}
+
+// Select returns the providers in order of smoothed round-trip time, the unobserved is first
+func (s *latencyStrategy) Select(n int) [][]int {
+	s.Lock()
+	rtts := make([]float64, n)
+	for i := range rtts {
+		rtts[i] = s.rtts[i]
+	}
+	s.Unlock()
+
+	r := sequence(n)
+	sort.SliceStable(r, func(i, j int) bool {
+		return rtts[r[i]] < rtts[r[j]]
+	})
+
+	return groups(r)
+}
+
+// Observe updates the smoothed round-trip time of provider, the failed query is penalized
+func (s *latencyStrategy) Observe(i int, rtt time.Duration, err error) {
+	if err != nil && rtt < latencyFailPenalty {
+		rtt = latencyFailPenalty
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if v, ok := s.rtts[i]; ok {
+		s.rtts[i] = s.alpha*float64(rtt) + (1-s.alpha)*v
+	} else {
+		s.rtts[i] = float64(rtt)
+	}
+}
+
+// sequence returns the index from 0 to n-1
+func sequence(n int) []int {
+	r := make([]int, n)
+	for i := range r {
+		r[i] = i
+	}
+
+	return r
+}
+
+// groups returns the index in groups of one
+func groups(idx []int) [][]int {
+	r := make([][]int, len(idx))
+	for i, v := range idx {
+		r[i] = []int{v}
+	}
+
+	return r
+}
+
+// contains returns whether the index is in idx
+func contains(idx []int, i int) bool {
+	for _, v := range idx {
+		if v == i {
+			return true
+		}
+	}
+
+	return false
+}
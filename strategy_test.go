@@ -0,0 +1,152 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package doh
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/doh/provider/custom"
+	"github.com/likexian/gokit/assert"
+)
+
+func TestRatioStrategy(t *testing.T) {
+	s := NewRatioStrategy(100 * time.Millisecond)
+	assert.Equal(t, s.Select(3), [][]int{{0, 1, 2}})
+
+	s.Observe(0, time.Millisecond, errors.New("failed"))
+	s.Observe(1, time.Millisecond, nil)
+	s.Observe(2, time.Millisecond, errors.New("failed"))
+	s.Observe(2, time.Millisecond, nil)
+	assert.Equal(t, s.Select(3), [][]int{{1}})
+
+	// the stats are reset out of window
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, s.Select(3), [][]int{{0, 1, 2}})
+}
+
+func TestRaceStrategy(t *testing.T) {
+	s := NewRaceStrategy()
+	s.Observe(0, time.Millisecond, nil)
+	assert.Equal(t, s.Select(3), [][]int{{0, 1, 2}})
+}
+
+func TestFailoverStrategy(t *testing.T) {
+	s := NewFailoverStrategy()
+	s.Observe(0, time.Millisecond, errors.New("failed"))
+	assert.Equal(t, s.Select(3), [][]int{{0}, {1}, {2}})
+}
+
+func TestRoundRobinStrategy(t *testing.T) {
+	s := NewRoundRobinStrategy()
+	assert.Equal(t, s.Select(3), [][]int{{0}, {1}, {2}})
+	assert.Equal(t, s.Select(3), [][]int{{1}, {2}, {0}})
+	assert.Equal(t, s.Select(3), [][]int{{2}, {0}, {1}})
+	assert.Equal(t, s.Select(3), [][]int{{0}, {1}, {2}})
+	assert.Len(t, s.Select(0), 0)
+}
+
+func TestWeightedStrategy(t *testing.T) {
+	s := NewWeightedStrategy(0, 3)
+	firsts := map[int]int{}
+	for i := 0; i < 1000; i++ {
+		r := s.Select(3)
+		assert.Len(t, r, 3)
+		assert.Equal(t, r[2], []int{0})
+		firsts[r[0][0]]++
+	}
+	assert.Equal(t, firsts[0], 0)
+	assert.Gt(t, firsts[1], firsts[2])
+
+	s = NewWeightedStrategy(0, 0)
+	assert.Equal(t, s.Select(2), [][]int{{0}, {1}})
+}
+
+func TestLatencyStrategy(t *testing.T) {
+	s := NewLatencyStrategy(0.5)
+	s.Observe(0, 100*time.Millisecond, nil)
+	s.Observe(1, 10*time.Millisecond, nil)
+	assert.Equal(t, s.Select(3), [][]int{{2}, {1}, {0}})
+
+	s.Observe(2, 50*time.Millisecond, nil)
+	assert.Equal(t, s.Select(3), [][]int{{1}, {2}, {0}})
+
+	// the smoothed rtt is moved by the latest rtt
+	s.Observe(1, 200*time.Millisecond, nil)
+	assert.Equal(t, s.Select(3), [][]int{{2}, {0}, {1}})
+
+	// the failed query is penalized
+	s.Observe(2, time.Millisecond, errors.New("failed"))
+	assert.Equal(t, s.Select(3), [][]int{{0}, {1}, {2}})
+}
+
+func TestSetStrategy(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	p, err := custom.NewClient(ts.URL+"/dns-query", dns.FormatWire)
+	assert.Nil(t, err)
+
+	ps := []*countProvider{{Provider: p}, {Provider: p}}
+	c := UseProvider(ps[0], ps[1]).SetStrategy(NewFailoverStrategy())
+	defer c.Close()
+
+	// the next provider is queried if failed
+	ps[0].fail.Store(1)
+	rsp, err := c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, rsp.Answer[0].Data, "1.2.3.4")
+	assert.Equal(t, ps[0].n.Load(), int32(1))
+	assert.Equal(t, ps[1].n.Load(), int32(1))
+
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, ps[0].n.Load(), int32(2))
+	assert.Equal(t, ps[1].n.Load(), int32(1))
+
+	// the NXDOMAIN response is not failed over
+	_, err = c.Query(ctx, "nx.likexian.com", dns.TypeA)
+	assert.True(t, errors.Is(err, dns.ErrNXDomain))
+	assert.Equal(t, ps[1].n.Load(), int32(1))
+
+	ps[0].fail.Store(1)
+	ps[1].fail.Store(1)
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.NotNil(t, err)
+
+	// the providers are queried in turn
+	c.SetStrategy(NewRoundRobinStrategy())
+	for i := 0; i < 4; i++ {
+		_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, ps[0].n.Load(), int32(6))
+	assert.Equal(t, ps[1].n.Load(), int32(4))
+
+	// the default strategy is used
+	c.SetStrategy(nil)
+	_, ok := c.strategy.(*ratioStrategy)
+	assert.True(t, ok)
+}
@@ -0,0 +1,362 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package stub
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/likexian/doh"
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/doh/internal/resolver"
+)
+
+// Server is DNS stub resolver server, it answers classic UDP and TCP queries by DoH provider
+type Server struct {
+	addr     string
+	provider doh.Provider
+	timeout  time.Duration
+	queries  int
+	udp      net.PacketConn
+	tcp      net.Listener
+	conns    map[net.Conn]bool
+	closed   bool
+	stats    resolver.Stats
+	wg       sync.WaitGroup
+	sync.Mutex
+}
+
+const (
+	// minUDPSize is the max udp message size without edns0
+	minUDPSize = 512
+	// maxMessageSize is the max size of dns message
+	maxMessageSize = 65535
+	// tcpIdleTimeout is the idle timeout of tcp connection
+	tcpIdleTimeout = 10 * time.Second
+	// maxUDPQueries is the default max number of concurrent udp queries
+	maxUDPQueries = 1000
+)
+
+// ErrServerClosed is returned by Serve after Close
+var ErrServerClosed = errors.New("stub: server closed")
+
+// Version returns package version
+func Version() string {
+	return "0.1.0"
+}
+
+// Author returns package author
+func Author() string {
+	return "[Li Kexian](https://www.likexian.com/)"
+}
+
+// License returns package license
+func License() string {
+	return "Licensed under the Apache License 2.0"
+}
+
+// NewServer returns a new stub server listens on addr, for example: 127.0.0.1:53
+func NewServer(addr string, provider doh.Provider) *Server {
+	return &Server{
+		addr:     addr,
+		provider: provider,
+		timeout:  10 * time.Second,
+		queries:  maxUDPQueries,
+		conns:    map[net.Conn]bool{},
+	}
+}
+
+// SetTimeout set timeout of resolving a query, 10 seconds is default
+func (s *Server) SetTimeout(timeout time.Duration) {
+	s.timeout = timeout
+}
+
+// SetMaxQueries set the max number of concurrent udp queries, 1000 is default,
+// the udp packets are not read until a running query is done, it must be called before Serve
+func (s *Server) SetMaxQueries(n int) {
+	if n <= 0 {
+		n = maxUDPQueries
+	}
+	s.queries = n
+}
+
+// Listen listens on both udp and tcp of the same address
+func (s *Server) Listen() error {
+	tcp, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	// listen udp on the same port if the port is chosen by system
+	udp, err := net.ListenPacket("udp", tcp.Addr().String())
+	if err != nil {
+		tcp.Close()
+		return err
+	}
+
+	s.Lock()
+	s.tcp, s.udp = tcp, udp
+	s.Unlock()
+
+	return nil
+}
+
+// Stats returns the stats of server, since it is created
+func (s *Server) Stats() doh.ServeStats {
+	return s.stats.Stats()
+}
+
+// Addr returns the listening address, it is available after Listen
+func (s *Server) Addr() string {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.tcp == nil {
+		return s.addr
+	}
+
+	return s.tcp.Addr().String()
+}
+
+// ListenAndServe listens and serves queries until Close
+func (s *Server) ListenAndServe() error {
+	err := s.Listen()
+	if err != nil {
+		return err
+	}
+
+	return s.Serve()
+}
+
+// Serve serves queries until Close, Listen must be called first
+func (s *Server) Serve() error {
+	s.Lock()
+	tcp, udp := s.tcp, s.udp
+	s.Unlock()
+
+	if tcp == nil || udp == nil {
+		return fmt.Errorf("stub: server is not listening")
+	}
+
+	errc := make(chan error, 2)
+	go func() {
+		errc <- s.serveUDP(udp)
+	}()
+	go func() {
+		errc <- s.serveTCP(tcp)
+	}()
+
+	err := <-errc
+	s.Close()
+	<-errc
+	s.wg.Wait()
+
+	return err
+}
+
+// Close closes the server and all connections
+func (s *Server) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+	for c := range s.conns {
+		c.Close()
+	}
+
+	if s.tcp != nil {
+		s.tcp.Close()
+	}
+
+	if s.udp != nil {
+		s.udp.Close()
+	}
+
+	return nil
+}
+
+// isClosed returns if server is closed
+func (s *Server) isClosed() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.closed
+}
+
+// serveUDP serves udp queries
+func (s *Server) serveUDP(conn net.PacketConn) error {
+	sem := make(chan struct{}, s.queries)
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		data := append([]byte{}, buf[:n]...)
+		sem <- struct{}{}
+		s.wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				s.wg.Done()
+			}()
+			b := s.handle(data, true)
+			if b != nil {
+				_, _ = conn.WriteTo(b, addr)
+			}
+		}()
+	}
+}
+
+// serveTCP serves tcp queries
+func (s *Server) serveTCP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		s.Lock()
+		if s.closed {
+			s.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = true
+		s.wg.Add(1)
+		s.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+			s.Lock()
+			delete(s.conns, conn)
+			s.Unlock()
+		}()
+	}
+}
+
+// serveConn serves queries of a tcp connection, queries are length prefixed, see RFC 7766
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	size := make([]byte, 2)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		_, err := io.ReadFull(conn, size)
+		if err != nil {
+			return
+		}
+
+		data := make([]byte, binary.BigEndian.Uint16(size))
+		_, err = io.ReadFull(conn, data)
+		if err != nil {
+			return
+		}
+
+		b := s.handle(data, false)
+		if b == nil {
+			return
+		}
+
+		_, err = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(b))), b...))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handle resolves the query, and returns the wire format reply, returns nil if query is invalid
+func (s *Server) handle(data []byte, udp bool) []byte {
+	q := &dns.Msg{}
+	err := q.Unpack(data)
+	if err != nil || q.QR || len(q.Question) != 1 {
+		s.stats.Invalid()
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	start := time.Now()
+	m, rsp := resolver.Resolve(ctx, s.provider, q)
+	b, err := m.Pack()
+	if err != nil {
+		rsp = &dns.Response{Status: int(dns.RCodeServFail)}
+		m = resolver.ServFail(q)
+		b, err = m.Pack()
+		if err != nil {
+			s.stats.Invalid()
+			return nil
+		}
+	}
+
+	transport := "tcp"
+	if udp {
+		transport = "udp"
+	}
+	s.stats.Observe(transport, time.Since(start), rsp)
+
+	if udp && len(b) > udpSize(q) {
+		m.TC = true
+		m.Answer = nil
+		m.Authority = nil
+		m.Additional = nil
+		b, err = m.Pack()
+		if err != nil {
+			return nil
+		}
+	}
+
+	return b
+}
+
+// udpSize returns the max udp message size of query
+func udpSize(q *dns.Msg) int {
+	if q.EDNS == nil || q.EDNS.UDPSize < minUDPSize {
+		return minUDPSize
+	}
+
+	return q.EDNS.UDPSize
+}
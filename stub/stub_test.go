@@ -0,0 +1,225 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package stub
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/gokit/assert"
+)
+
+type testProvider struct {
+	running atomic.Int32
+	peak    atomic.Int32
+}
+
+func (p *testProvider) Query(ctx context.Context, d dns.Domain, t dns.Type, s ...dns.ECS) (*dns.Response, error) {
+	rsp := &dns.Response{
+		Question: []dns.Question{{Name: string(d), Type: 1}},
+		Provider: p.String(),
+	}
+
+	switch d {
+	case "likexian.com.":
+		rsp.Answer = []dns.Answer{{Name: "likexian.com.", Type: 1, TTL: 600, Data: "1.2.3.4"}}
+	case "https.likexian.com.":
+		rsp.Answer = []dns.Answer{{Name: "https.likexian.com.", Type: 65, TTL: 600, Data: `1 . alpn="h2,h3" port=443`}}
+	case "slow.likexian.com.":
+		n := p.running.Add(1)
+		defer p.running.Add(-1)
+		for {
+			v := p.peak.Load()
+			if n <= v || p.peak.CompareAndSwap(v, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		rsp.Answer = []dns.Answer{{Name: "slow.likexian.com.", Type: 1, TTL: 600, Data: "1.2.3.4"}}
+	case "big.likexian.com.":
+		for i := 0; i < 100; i++ {
+			rsp.Answer = append(rsp.Answer, dns.Answer{
+				Name: "big.likexian.com.",
+				Type: 1,
+				TTL:  600,
+				Data: fmt.Sprintf("10.0.0.%d", i),
+			})
+		}
+	default:
+		return nil, fmt.Errorf("test: query failed")
+	}
+
+	return rsp, nil
+}
+
+func (p *testProvider) QueryWithOptions(ctx context.Context, q dns.Question, o dns.Options) (*dns.Response, error) {
+	rsp, err := p.Query(ctx, dns.Domain(q.Name), dns.TypeFromCode(q.Type), o.ECS)
+	if rsp != nil {
+		rsp.AD = o.DO
+		rsp.CD = o.CD
+	}
+
+	return rsp, err
+}
+
+func (p *testProvider) String() string {
+	return "test"
+}
+
+func TestVersion(t *testing.T) {
+	assert.Contains(t, Version(), ".")
+	assert.Contains(t, Author(), "likexian")
+	assert.Contains(t, License(), "Apache License")
+}
+
+func exchange(t *testing.T, network, addr string, name dns.Domain, edns bool) *dns.Msg {
+	q, err := dns.NewQuery(name, dns.TypeA)
+	assert.Nil(t, err)
+
+	q.ID = 1234
+	if !edns {
+		q.EDNS = nil
+	}
+
+	data, err := q.Pack()
+	assert.Nil(t, err)
+
+	conn, err := net.Dial(network, addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	buf := make([]byte, 65535)
+	n := 0
+	if network == "udp" {
+		_, err = conn.Write(data)
+		assert.Nil(t, err)
+		n, err = conn.Read(buf)
+		assert.Nil(t, err)
+	} else {
+		_, err = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(data))), data...))
+		assert.Nil(t, err)
+		_, err = io.ReadFull(conn, buf[:2])
+		assert.Nil(t, err)
+		n = int(binary.BigEndian.Uint16(buf))
+		_, err = io.ReadFull(conn, buf[:n])
+		assert.Nil(t, err)
+	}
+
+	m := &dns.Msg{}
+	err = m.Unpack(buf[:n])
+	assert.Nil(t, err)
+	assert.Equal(t, m.ID, uint16(1234))
+
+	return m
+}
+
+func TestServer(t *testing.T) {
+	s := NewServer("127.0.0.1:0", &testProvider{})
+	s.SetTimeout(time.Second)
+
+	err := s.Serve()
+	assert.NotNil(t, err)
+
+	err = s.Listen()
+	assert.Nil(t, err)
+
+	errc := make(chan error)
+	go func() {
+		errc <- s.Serve()
+	}()
+
+	addr := s.Addr()
+
+	for _, network := range []string{"udp", "tcp"} {
+		m := exchange(t, network, addr, "likexian.com", true)
+		assert.False(t, m.TC)
+		assert.Equal(t, m.RCode, 0)
+		assert.Equal(t, m.Answer[0].Data, "1.2.3.4")
+
+		m = exchange(t, network, addr, "fail.likexian.com", true)
+		assert.Equal(t, m.RCode, 2)
+	}
+
+	m := exchange(t, "udp", addr, "big.likexian.com", false)
+	assert.True(t, m.TC)
+	assert.Len(t, m.Answer, 0)
+
+	m = exchange(t, "udp", addr, "big.likexian.com", true)
+	assert.False(t, m.TC)
+	assert.Len(t, m.Answer, 100)
+
+	m = exchange(t, "tcp", addr, "big.likexian.com", false)
+	assert.False(t, m.TC)
+	assert.Len(t, m.Answer, 100)
+
+	stats := s.Stats()
+	assert.Equal(t, stats.Queries, map[string]int64{"udp": 4, "tcp": 3})
+	assert.Equal(t, stats.RCodes, map[dns.RCode]int64{dns.RCodeNoError: 5, dns.RCodeServFail: 2})
+	assert.Equal(t, stats.Latency.Count, int64(7))
+
+	err = s.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, <-errc, ErrServerClosed)
+
+	err = s.Close()
+	assert.Nil(t, err)
+}
+
+func TestServerQueries(t *testing.T) {
+	p := &testProvider{}
+	s := NewServer("127.0.0.1:0", p)
+	s.SetMaxQueries(2)
+
+	err := s.Listen()
+	assert.Nil(t, err)
+	defer s.Close()
+
+	go func() {
+		_ = s.Serve()
+	}()
+
+	// the service binding answer of json upstream is packed
+	m := exchange(t, "udp", s.Addr(), "https.likexian.com", true)
+	assert.Equal(t, m.RCode, 0)
+	assert.Equal(t, m.Answer[0].Data, `1 . alpn="h2,h3" port=443`)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m := exchange(t, "udp", s.Addr(), "slow.likexian.com", true)
+			assert.Equal(t, m.Answer[0].Data, "1.2.3.4")
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, p.peak.Load(), int32(2))
+}
@@ -0,0 +1,49 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package doh
+
+import (
+	"context"
+
+	"github.com/likexian/doh/trace"
+)
+
+// SetTraceHook set the trace hook of upstream queries, the timing of each query attempt is sent to hook,
+// the hook of query context set by trace.WithHook is preferred, nil to disable
+func (c *DoH) SetTraceHook(hook trace.Hook) *DoH {
+	c.Lock()
+	c.hook = hook
+	c.Unlock()
+
+	return c
+}
+
+// traceContext returns the context with client trace hook if the context has no hook
+func (c *DoH) traceContext(ctx context.Context) context.Context {
+	c.RLock()
+	hook := c.hook
+	c.RUnlock()
+
+	if hook == nil || trace.HookFromContext(ctx) != nil {
+		return ctx
+	}
+
+	return trace.WithHook(ctx, hook)
+}
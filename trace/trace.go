@@ -0,0 +1,362 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package trace
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/likexian/doh/dns"
+)
+
+// Span is the timing of one upstream query attempt
+type Span struct {
+	// Provider is the provider name
+	Provider string
+	// QName is the query name
+	QName string
+	// QType is the query type
+	QType dns.Type
+	// Outcome is ok, the response code such as NXDOMAIN, canceled, timeout or error
+	Outcome string
+	// Err is the query error
+	Err error
+	// Start is the start time of query
+	Start time.Time
+	// DNS is the duration of resolving the provider address
+	DNS time.Duration
+	// Connect is the duration of connecting to the provider
+	Connect time.Duration
+	// TLS is the duration of TLS handshake
+	TLS time.Duration
+	// TTFB is the duration from request written to the first response byte
+	TTFB time.Duration
+	// Decode is the duration of decoding the response
+	Decode time.Duration
+	// Total is the duration of whole query
+	Total time.Duration
+	// Reused is true if an idle connection is reused
+	Reused bool
+}
+
+// Hook is the trace hook, it is called when the query attempt is finished
+type Hook interface {
+	Trace(s Span)
+}
+
+// HookFunc is the function adapter of hook
+type HookFunc func(s Span)
+
+// Phase is the timing phase of query
+type Phase int
+
+// Tracer records the span of one query attempt, nil tracer does nothing
+type Tracer struct {
+	hook   Hook
+	span   Span
+	dns    time.Time
+	dials  map[string]time.Time
+	tls    time.Time
+	wrote  time.Time
+	decode time.Time
+	sync.Mutex
+}
+
+// hookKey is the context key of hook
+type hookKey struct{}
+
+// tracerKey is the context key of tracer
+type tracerKey struct{}
+
+// Supported timing phase
+const (
+	PhaseDNS Phase = iota
+	PhaseConnect
+	PhaseTLS
+	PhaseTTFB
+	PhaseDecode
+)
+
+// Version returns package version
+func Version() string {
+	return "0.1.0"
+}
+
+// Author returns package author
+func Author() string {
+	return "[Li Kexian](https://www.likexian.com/)"
+}
+
+// License returns package license
+func License() string {
+	return "Licensed under the Apache License 2.0"
+}
+
+// Trace calls the hook function
+func (f HookFunc) Trace(s Span) {
+	f(s)
+}
+
+// String returns string of phase
+func (p Phase) String() string {
+	switch p {
+	case PhaseDNS:
+		return "dns"
+	case PhaseConnect:
+		return "connect"
+	case PhaseTLS:
+		return "tls"
+	case PhaseTTFB:
+		return "ttfb"
+	case PhaseDecode:
+		return "decode"
+	default:
+		return "phase" + strconv.Itoa(int(p))
+	}
+}
+
+// WithHook returns a copy of context with the trace hook, queries of the context are traced
+func WithHook(ctx context.Context, hook Hook) context.Context {
+	return context.WithValue(ctx, hookKey{}, hook)
+}
+
+// HookFromContext returns the trace hook of context, nil if not set
+func HookFromContext(ctx context.Context) Hook {
+	hook, _ := ctx.Value(hookKey{}).(Hook)
+	return hook
+}
+
+// TracerFromContext returns the tracer started by Start, nil if not traced
+func TracerFromContext(ctx context.Context) *Tracer {
+	t, _ := ctx.Value(tracerKey{}).(*Tracer)
+	return t
+}
+
+// Start starts tracing the query if the context has hook, the returned context carries the tracer and httptrace,
+// the returned tracer is nil if not traced
+func Start(ctx context.Context, provider, name string, qtype dns.Type) (context.Context, *Tracer) {
+	hook := HookFromContext(ctx)
+	if hook == nil {
+		return ctx, nil
+	}
+
+	t := &Tracer{
+		hook: hook,
+		span: Span{
+			Provider: provider,
+			QName:    name,
+			QType:    qtype,
+			Start:    time.Now(),
+		},
+		dials: map[string]time.Time{},
+	}
+
+	ctx = context.WithValue(ctx, tracerKey{}, t)
+
+	return httptrace.WithClientTrace(ctx, t.clientTrace()), t
+}
+
+// clientTrace returns the httptrace of tracer
+func (t *Tracer) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.Lock()
+			t.dns = time.Now()
+			t.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.Lock()
+			t.span.DNS += since(t.dns)
+			t.Unlock()
+		},
+		ConnectStart: func(network, addr string) {
+			t.Lock()
+			t.dials[network+addr] = time.Now()
+			t.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.Lock()
+			// only the successful dial is counted, the others are raced by happy eyeballs
+			if err == nil {
+				t.span.Connect += since(t.dials[network+addr])
+			}
+			delete(t.dials, network+addr)
+			t.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			t.Lock()
+			t.tls = time.Now()
+			t.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.Lock()
+			t.span.TLS += since(t.tls)
+			t.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.SetReused(info.Reused)
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.Wrote()
+		},
+		GotFirstResponseByte: func() {
+			t.FirstByte()
+		},
+	}
+}
+
+// Add adds the duration to phase, it is used by the transport without httptrace
+func (t *Tracer) Add(p Phase, d time.Duration) {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	switch p {
+	case PhaseDNS:
+		t.span.DNS += d
+	case PhaseConnect:
+		t.span.Connect += d
+	case PhaseTLS:
+		t.span.TLS += d
+	case PhaseTTFB:
+		t.span.TTFB += d
+	case PhaseDecode:
+		t.span.Decode += d
+	}
+}
+
+// SetReused sets if the connection is reused
+func (t *Tracer) SetReused(reused bool) {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	t.span.Reused = reused
+	t.Unlock()
+}
+
+// Wrote marks the request is written
+func (t *Tracer) Wrote() {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	t.wrote = time.Now()
+	t.Unlock()
+}
+
+// FirstByte marks the first response byte is received, the ttfb is of the last request
+func (t *Tracer) FirstByte() {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	if t.wrote.IsZero() {
+		t.wrote = t.span.Start
+	}
+	t.span.TTFB = since(t.wrote)
+	t.Unlock()
+}
+
+// Decode marks the response decoding is started
+func (t *Tracer) Decode() {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	t.decode = time.Now()
+	t.Unlock()
+}
+
+// Finish finishes the span with query result and calls the hook
+func (t *Tracer) Finish(rsp *dns.Response, err error) {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	if !t.decode.IsZero() {
+		t.span.Decode += since(t.decode)
+	}
+	t.span.Total = since(t.span.Start)
+	t.span.Outcome = outcome(rsp, err)
+	t.span.Err = err
+	s := t.span
+	t.Unlock()
+
+	t.hook.Trace(s)
+}
+
+// Attributes returns the span attributes in OpenTelemetry style
+func (s Span) Attributes() map[string]string {
+	return map[string]string{
+		"dns.provider":      s.Provider,
+		"dns.question.name": s.QName,
+		"dns.question.type": string(s.QType),
+		"dns.outcome":       s.Outcome,
+		"dns.conn.reused":   strconv.FormatBool(s.Reused),
+	}
+}
+
+// outcome returns the outcome of query result
+func outcome(rsp *dns.Response, err error) string {
+	var rerr *dns.RCodeError
+	switch {
+	case errors.As(err, &rerr):
+		return rerr.RCode.String()
+	case err == nil && rsp != nil && rsp.Status != 0:
+		return dns.RCode(rsp.Status).String()
+	case err == nil:
+		return "ok"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	}
+
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return "timeout"
+	}
+
+	return "error"
+}
+
+// since returns the duration since t, zero if t is not set
+func since(t time.Time) time.Duration {
+	if t.IsZero() {
+		return 0
+	}
+
+	return time.Since(t)
+}
@@ -0,0 +1,201 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package trace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/gokit/assert"
+)
+
+type testHook struct {
+	spans []Span
+	sync.Mutex
+}
+
+func (h *testHook) Trace(s Span) {
+	h.Lock()
+	h.spans = append(h.spans, s)
+	h.Unlock()
+}
+
+func TestVersion(t *testing.T) {
+	assert.Contains(t, Version(), ".")
+	assert.Contains(t, Author(), "likexian")
+	assert.Contains(t, License(), "Apache License")
+}
+
+func TestStart(t *testing.T) {
+	ctx := context.Background()
+
+	// the query is not traced without hook
+	tctx, tr := Start(ctx, "test", "likexian.com.", dns.TypeA)
+	assert.Equal(t, tctx, ctx)
+	assert.True(t, tr == nil)
+	assert.True(t, TracerFromContext(tctx) == nil)
+
+	// the nil tracer does nothing
+	tr.Add(PhaseDNS, time.Second)
+	tr.SetReused(true)
+	tr.Wrote()
+	tr.FirstByte()
+	tr.Decode()
+	tr.Finish(nil, nil)
+
+	h := &testHook{}
+	ctx = WithHook(ctx, h)
+	assert.Equal(t, HookFromContext(ctx), Hook(h))
+
+	tctx, tr = Start(ctx, "test", "likexian.com.", dns.TypeA)
+	assert.NotNil(t, tr)
+	assert.Equal(t, TracerFromContext(tctx), tr)
+
+	tr.Add(PhaseDNS, time.Millisecond)
+	tr.Add(PhaseConnect, 2*time.Millisecond)
+	tr.Add(PhaseTLS, 3*time.Millisecond)
+	tr.Add(PhaseTTFB, 4*time.Millisecond)
+	tr.Add(PhaseDecode, 5*time.Millisecond)
+	tr.SetReused(true)
+	tr.Finish(&dns.Response{}, nil)
+
+	assert.Len(t, h.spans, 1)
+	s := h.spans[0]
+	assert.Equal(t, s.Provider, "test")
+	assert.Equal(t, s.QName, "likexian.com.")
+	assert.Equal(t, s.QType, dns.TypeA)
+	assert.Equal(t, s.Outcome, "ok")
+	assert.Equal(t, s.DNS, time.Millisecond)
+	assert.Equal(t, s.Connect, 2*time.Millisecond)
+	assert.Equal(t, s.TLS, 3*time.Millisecond)
+	assert.Equal(t, s.TTFB, 4*time.Millisecond)
+	assert.Equal(t, s.Decode, 5*time.Millisecond)
+	assert.True(t, s.Reused)
+	assert.False(t, s.Start.IsZero())
+	assert.Gt(t, s.Total, time.Duration(0))
+
+	assert.Equal(t, s.Attributes(), map[string]string{
+		"dns.provider":      "test",
+		"dns.question.name": "likexian.com.",
+		"dns.question.type": "A",
+		"dns.outcome":       "ok",
+		"dns.conn.reused":   "true",
+	})
+
+	// the first byte and decode are timed by marks
+	_, tr = Start(ctx, "test", "likexian.com.", dns.TypeA)
+	tr.Wrote()
+	time.Sleep(10 * time.Millisecond)
+	tr.FirstByte()
+	tr.Decode()
+	time.Sleep(10 * time.Millisecond)
+	tr.Finish(nil, fmt.Errorf("test: query failed"))
+
+	assert.Len(t, h.spans, 2)
+	s = h.spans[1]
+	assert.Equal(t, s.Outcome, "error")
+	assert.NotNil(t, s.Err)
+	assert.Ge(t, s.TTFB, 10*time.Millisecond)
+	assert.Ge(t, s.Decode, 10*time.Millisecond)
+	assert.Ge(t, s.Total, s.TTFB+s.Decode)
+}
+
+func TestHTTPTrace(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	h := &testHook{}
+	client := ts.Client()
+
+	for i := 0; i < 2; i++ {
+		ctx, tr := Start(WithHook(context.Background(), h), "test", "likexian.com.", dns.TypeA)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+		assert.Nil(t, err)
+		rsp, err := client.Do(req)
+		assert.Nil(t, err)
+		_, _ = io.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		tr.Decode()
+		tr.Finish(&dns.Response{}, nil)
+	}
+
+	assert.Len(t, h.spans, 2)
+
+	// the first request dials a new connection
+	s := h.spans[0]
+	assert.False(t, s.Reused)
+	assert.Gt(t, s.Connect, time.Duration(0))
+	assert.Gt(t, s.TLS, time.Duration(0))
+	assert.Ge(t, s.TTFB, 10*time.Millisecond)
+	assert.Gt(t, s.Decode, time.Duration(0))
+
+	// the second request reuses the connection
+	s = h.spans[1]
+	assert.True(t, s.Reused)
+	assert.Equal(t, s.Connect, time.Duration(0))
+	assert.Equal(t, s.TLS, time.Duration(0))
+	assert.Ge(t, s.TTFB, 10*time.Millisecond)
+}
+
+func TestOutcome(t *testing.T) {
+	tests := []struct {
+		rsp *dns.Response
+		err error
+		out string
+	}{
+		{&dns.Response{}, nil, "ok"},
+		{&dns.Response{Status: 3}, nil, "NXDOMAIN"},
+		{nil, &dns.RCodeError{RCode: dns.RCodeServFail}, "SERVFAIL"},
+		{nil, fmt.Errorf("test: %w", context.Canceled), "canceled"},
+		{nil, context.DeadlineExceeded, "timeout"},
+		{nil, errors.New("test: query failed"), "error"},
+	}
+
+	for _, v := range tests {
+		assert.Equal(t, outcome(v.rsp, v.err), v.out)
+	}
+}
+
+func TestHookFunc(t *testing.T) {
+	var n int
+	h := HookFunc(func(s Span) {
+		n++
+	})
+
+	h.Trace(Span{})
+	assert.Equal(t, n, 1)
+
+	for _, v := range []Phase{PhaseDNS, PhaseConnect, PhaseTLS, PhaseTTFB, PhaseDecode, 100} {
+		assert.NotEqual(t, v.String(), "")
+	}
+	assert.Equal(t, PhaseTTFB.String(), "ttfb")
+	assert.Equal(t, Phase(100).String(), "phase100")
+}
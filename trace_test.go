@@ -0,0 +1,93 @@
+/*
+ * Copyright 2019-2024 Li Kexian
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * DNS over HTTPS (DoH) Golang implementation
+ * https://www.likexian.com/
+ */
+
+package doh
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/likexian/doh/dns"
+	"github.com/likexian/doh/provider/custom"
+	"github.com/likexian/doh/trace"
+	"github.com/likexian/gokit/assert"
+)
+
+type testHook struct {
+	spans []trace.Span
+	sync.Mutex
+}
+
+func (h *testHook) Trace(s trace.Span) {
+	h.Lock()
+	h.spans = append(h.spans, s)
+	h.Unlock()
+}
+
+func (h *testHook) len() int {
+	h.Lock()
+	defer h.Unlock()
+	return len(h.spans)
+}
+
+func TestSetTraceHook(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	p, err := custom.NewClient(ts.URL+"/dns-query", dns.FormatWire)
+	assert.Nil(t, err)
+
+	c := UseProvider(p)
+	defer c.Close()
+
+	// the query is not traced without hook
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+
+	h := &testHook{}
+	c.SetTraceHook(h)
+
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	_, err = c.Query(ctx, "nx.likexian.com", dns.TypeAAAA)
+	assert.NotNil(t, err)
+
+	assert.Equal(t, h.len(), 2)
+	assert.Equal(t, h.spans[0].Provider, p.String())
+	assert.Equal(t, h.spans[0].QName, "likexian.com")
+	assert.Equal(t, h.spans[0].QType, dns.TypeA)
+	assert.Equal(t, h.spans[0].Outcome, "ok")
+	assert.Equal(t, h.spans[1].QType, dns.TypeAAAA)
+	assert.Equal(t, h.spans[1].Outcome, "NXDOMAIN")
+
+	// the hook of query context is preferred
+	q := &testHook{}
+	_, err = c.Query(trace.WithHook(ctx, q), "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, q.len(), 1)
+	assert.Equal(t, h.len(), 2)
+
+	c.SetTraceHook(nil)
+	_, err = c.Query(ctx, "likexian.com", dns.TypeA)
+	assert.Nil(t, err)
+	assert.Equal(t, h.len(), 2)
+}